@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/agent"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+)
+
+// Build-time variables (set via ldflags)
+var (
+	BuildDate = "unknown"
+	GitCommit = "unknown"
+)
+
+func main() {
+	server := flag.String("server", "", "proxy address: ws(s)://host:8080/ws/register or host:2217")
+	token := flag.String("token", "", "registration token: DEVICE_ID or AUTH_TOKEN+DEVICE_ID")
+	portName := flag.String("port", "", "local serial port, e.g. /dev/ttyUSB0 or a PTY")
+	target := flag.String("target", "", "local serial server TCP address (e.g. ser2net), host:port, instead of -port")
+	dialect := flag.String("dialect", device.DialectRFC2217, "serial control dialect of the device in the proxy: rfc2217, usrvcom or none")
+	baud := flag.Uint("baud", 9600, "initial baud rate of -port")
+	mode := flag.String("mode", "8N1", "initial data bits, parity and stop bits of -port")
+	retryMin := flag.Duration("retry-min", time.Second, "first delay before reconnect, doubled after every failure")
+	retryMax := flag.Duration("retry-max", time.Minute, "maximum delay before reconnect")
+	flag.Parse()
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if *server == "" || *token == "" || (*portName == "") == (*target == "") || !device.ValidDialect(*dialect) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	profile, err := serial.ParseMode(*mode, uint32(*baud))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("RFC-2217 device agent starting... (build: %s, commit: %s)", BuildDate, GitCommit)
+
+	// The serial port outlives proxy connections and keeps settings applied by the proxy
+	var port *serial.Port
+	if *portName != "" {
+		port, err = serial.Open(*portName, profile)
+		if err != nil {
+			log.Fatalf("serial port: %v", err)
+		}
+		defer port.Close()
+		log.Printf("[agent] serial port %s %d %s", *portName, profile.BaudRate, profile.ModeString())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	backoff := agent.Backoff{Min: *retryMin, Max: *retryMax}
+	for {
+		start := time.Now()
+		if port != nil {
+			profile, err = run(ctx, *server, *token, port, *dialect, profile)
+		} else {
+			err = runTarget(ctx, *server, *token, *target, *dialect, profile)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[agent] %v", err)
+		}
+		// A session that was up longer than the maximum delay is not a failing attempt
+		if time.Since(start) > *retryMax {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+		select {
+		case <-ctx.Done():
+			log.Println("RFC-2217 device agent stopped")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// run registers at the proxy and bridges data to the serial port until either side closes
+// Returns port settings left by the proxy, kept for the next connection
+func run(ctx context.Context, server, token string, port *serial.Port, dialect string, profile device.SerialProfile) (device.SerialProfile, error) {
+	conn, err := register(ctx, server, token)
+	if err != nil {
+		return profile, err
+	}
+	defer conn.Close()
+
+	b := agent.NewBridge(conn, port, dialect, profile)
+	err = bridge(ctx, conn, nil, b)
+	return b.Profile(), err
+}
+
+// runTarget registers at the proxy and bridges data to a TCP serial server until either side closes
+func runTarget(ctx context.Context, server, token, target, dialect string, profile device.SerialProfile) error {
+	conn, err := register(ctx, server, token)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var d net.Dialer
+	port, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	log.Printf("[agent] connected to %s", target)
+
+	return bridge(ctx, conn, port, agent.NewBridge(conn, port, dialect, profile))
+}
+
+func register(ctx context.Context, server, token string) (net.Conn, error) {
+	conn, err := agent.Dial(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := agent.Register(conn, token, 10*time.Second); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Printf("[agent] registered at %s", server)
+	return conn, nil
+}
+
+// bridge runs b, closing the connection (and TCP port) on shutdown to unblock it
+func bridge(ctx context.Context, conn net.Conn, port io.Closer, b *agent.Bridge) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		if port != nil {
+			port.Close()
+		}
+	})
+	defer stop()
+	return b.Run()
+}
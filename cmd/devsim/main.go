@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/devsim"
+)
+
+// Build-time variables (set via ldflags)
+var (
+	BuildDate = "unknown"
+	GitCommit = "unknown"
+)
+
+func main() {
+	server := flag.String("server", "", "proxy address host:2217 for clients (and devices, unless -register is set)")
+	register := flag.String("register", "", "device registration address: host:2217 or ws(s)://host:8080/ws/register")
+	auth := flag.String("auth", "", "AUTH_TOKEN of the proxy")
+	prefix := flag.String("prefix", "sim-", "device ID prefix, IDs are <prefix>00001, <prefix>00002, ...")
+	devices := flag.Int("devices", 100, "number of simulated devices")
+	clients := flag.Int("clients", 100, "number of simulated clients, client N opens sessions with device N")
+	dialect := flag.String("dialect", device.DialectRFC2217, "dialect of simulated devices in the proxy: rfc2217, usrvcom or none")
+	peripheral := flag.String("peripheral", devsim.PeripheralEcho, "device peripheral: echo, script, modbus or iec")
+	script := flag.String("script", "", "script file for -peripheral script: \"request\" \"response\" per line")
+	payload := flag.Int("payload", 64, "echo request size")
+	unit := flag.Uint("unit", 1, "Modbus unit id")
+	registers := flag.Int("registers", 100, "Modbus register count")
+	ramp := flag.Int("ramp", 200, "device registrations per second, 0 - all at once")
+	duration := flag.Duration("duration", 30*time.Second, "test duration")
+	requests := flag.Int("requests", 0, "transactions per client, 0 - until the end of the test")
+	interval := flag.Duration("interval", 0, "pause between transactions of a client")
+	timeout := flag.Duration("timeout", 5*time.Second, "registration, connect and transaction timeout")
+	retry := flag.Duration("retry", time.Second, "delay before reconnect")
+	report := flag.Duration("report", 10*time.Second, "interval of intermediate reports, 0 - final only")
+	flag.Parse()
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if *server == "" || *devices < 1 || !device.ValidDialect(*dialect) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *register == "" {
+		*register = *server
+	}
+	*clients = min(*clients, *devices)
+
+	scenario := devsim.Scenario{Kind: *peripheral, Unit: byte(*unit), Registers: *registers, Payload: *payload}
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scenario.Rules, err = devsim.ParseScript(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", *script, err)
+		}
+	}
+	if err := scenario.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("RFC-2217 device simulator starting... (build: %s, commit: %s)", BuildDate, GitCommit)
+	log.Printf("[devsim] %d %s devices, %d clients, %s", *devices, *peripheral, *clients, *duration)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ctx, cancelTest := context.WithTimeout(ctx, *duration)
+	defer cancelTest()
+
+	token := func(id string) string {
+		if *auth != "" {
+			return *auth + "+" + id
+		}
+		return id
+	}
+	stats := devsim.NewStats()
+
+	var devWG, clientWG sync.WaitGroup
+	var pause time.Duration
+	if *ramp > 0 {
+		pause = time.Second / time.Duration(*ramp)
+	}
+	rampDone := make(chan struct{})
+	go func() {
+		defer close(rampDone)
+		for i := 1; i <= *devices && ctx.Err() == nil; i++ {
+			id := fmt.Sprintf("%s%05d", *prefix, i)
+			dev := devsim.NewDevice(devsim.DeviceConfig{
+				Server:  *register,
+				Token:   token(id),
+				Dialect: *dialect,
+				Timeout: *timeout,
+				Retry:   *retry,
+			}, scenario.Peripheral(id), stats)
+			devWG.Add(1)
+			go func() {
+				defer devWG.Done()
+				dev.Run(ctx)
+			}()
+
+			if i <= *clients {
+				client := devsim.NewClient(devsim.ClientConfig{
+					Server:   *server,
+					Token:    token(id),
+					Requests: *requests,
+					Interval: *interval,
+					Timeout:  *timeout,
+					Retry:    *retry,
+				}, scenario, stats)
+				clientWG.Add(1)
+				go func() {
+					defer clientWG.Done()
+					select {
+					case <-dev.Registered():
+						client.Run(ctx)
+					case <-ctx.Done():
+					}
+				}()
+			}
+			if pause > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(pause):
+				}
+			}
+		}
+		// With -requests the test ends when all clients are done
+		if *requests > 0 {
+			clientWG.Wait()
+			cancelTest()
+		}
+	}()
+
+	if *report > 0 {
+		go func() {
+			ticker := time.NewTicker(*report)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					stats.Report(os.Stderr)
+				}
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	<-rampDone
+	clientWG.Wait()
+	devWG.Wait()
+	stats.Report(os.Stdout)
+	log.Println("RFC-2217 device simulator stopped")
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/api"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/drain"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
 )
 
@@ -24,7 +29,13 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	log.Printf("RFC-2217 NAT Proxy starting... (build: %s, commit: %s)", BuildDate, GitCommit)
 
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	if cfg.Path() != "" {
+		log.Printf("Config file: %s", cfg.Path())
+	}
 	log.Printf("Config: port=%s api_port=%s keepalive=%v debug=%v",
 		cfg.Port, cfg.APIPort, cfg.KeepAlive, cfg.Debug)
 
@@ -38,39 +49,172 @@ func main() {
 			log.Printf("[session] started: id=%s device=%s", s.ID, s.DeviceID)
 		},
 		func(s *session.Session) {
-			log.Printf("[session] ended: id=%s device=%s bytes_in=%d bytes_out=%d",
-				s.ID, s.DeviceID, s.BytesIn, s.BytesOut)
+			reason := s.EndReason()
+			if reason == "" {
+				reason = "closed"
+			}
+			log.Printf("[session] ended: id=%s device=%s bytes_in=%d bytes_out=%d reason=%s",
+				s.ID, s.DeviceID, s.BytesIn, s.BytesOut, reason)
 		},
 	)
 
 	// Create servers
 	connServer := connection.NewServer(cfg, registry, sessions)
-	apiServer := api.NewServer(cfg, registry, sessions)
+	apiServer := api.NewServer(cfg, registry, sessions, connServer.Handler())
+
+	var modbusGateway *modbus.Gateway
+	if cfg.ModbusPort != "" {
+		var err error
+		modbusGateway, err = modbus.NewGateway(cfg, registry, sessions)
+		if err != nil {
+			log.Fatalf("Modbus gateway: %v", err)
+		}
+	}
+
+	var modbusPoller *modbus.Poller
+	if len(cfg.ModbusPoll) > 0 {
+		var items []modbus.PollItem
+		for _, s := range cfg.ModbusPoll {
+			item, err := modbus.ParsePollItem(s)
+			if err != nil {
+				log.Fatalf("Modbus polling: %v", err)
+			}
+			items = append(items, item)
+		}
+		// Share RTU client with the gateway so polls and gateway requests are serialized
+		client := modbus.NewClient(registry, sessions, cfg.ModbusTimeout)
+		if modbusGateway != nil {
+			client = modbusGateway.Client()
+		}
+		modbusPoller = modbus.NewPoller(client, registry, items, cfg.ModbusPollInterval)
+		apiServer.SetPoller(modbusPoller)
+	}
+
+	var clusterNode *cluster.Node
+	if cfg.ClusterEnabled() {
+		clusterNode = cluster.NewNode(cluster.Config{
+			NodeID:    cfg.ClusterNodeID,
+			Listen:    ":" + cfg.ClusterPort,
+			Advertise: cfg.ClusterAdvertise,
+			Peers:     cfg.ClusterPeers,
+			DNS:       cfg.ClusterDNS,
+			Secret:    cfg.ClusterSecret,
+			Interval:  cfg.ClusterInterval,
+		}, registry)
+		connServer.SetCluster(clusterNode)
+		apiServer.SetCluster(clusterNode)
+	}
+
+	// Listening sockets may be inherited from the previous process on upgrade
+	drainCtl := drain.New()
+	connServer.SetDrain(drainCtl)
+	apiServer.SetDrain(drainCtl)
+	apiServer.SetReload(func() ([]string, []string, error) { return reloadConfig(cfg, sessions) })
+	// Wedged proxy listener also fails liveness, so the pod is restarted
+	apiServer.Health().Add("listener", true, connServer.CheckAccept)
+
+	proxyConfigs := cfg.ProxyListeners()
+	proxyListeners := make([]net.Listener, len(proxyConfigs))
+	for i, lc := range proxyConfigs {
+		// Inherited sockets are matched by name, keep "proxy" for the default listener
+		name := "proxy"
+		if lc.Name != name {
+			name += "-" + lc.Name
+		}
+		if proxyListeners[i], err = drainCtl.Listen(name, lc.Address); err != nil {
+			log.Fatalf("Listen %s: %v", lc.Name, err)
+		}
+	}
+	apiListener, err := drainCtl.Listen("api", ":"+cfg.APIPort)
+	if err != nil {
+		log.Fatalf("API listen: %v", err)
+	}
+	var modbusListener, clusterListener net.Listener
+	if modbusGateway != nil {
+		if modbusListener, err = drainCtl.Listen("modbus", ":"+cfg.ModbusPort); err != nil {
+			log.Fatalf("Modbus gateway listen: %v", err)
+		}
+	}
+	if clusterNode != nil {
+		if clusterListener, err = drainCtl.Listen("cluster", ":"+cfg.ClusterPort); err != nil {
+			log.Fatalf("Cluster listen: %v", err)
+		}
+	}
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, upgradeSignal, reloadSignal)
 
 	go func() {
-		sig := <-sigCh
-		log.Printf("Received signal %v, shutting down...", sig)
-		cancel()
+		for sig := range sigCh {
+			if sig == reloadSignal {
+				reloadConfig(cfg, sessions)
+				continue
+			}
+			if sig == upgradeSignal {
+				// New process takes over listening sockets, this one drains
+				proc, err := drainCtl.Spawn()
+				if err != nil {
+					log.Printf("Upgrade failed: %v", err)
+					continue
+				}
+				log.Printf("Started new process %d, listening sockets handed over", proc.Pid)
+				proc.Release()
+			}
+			log.Printf("Received signal %v, draining (delay %v, timeout %v)...", sig, cfg.Current().DrainDelay, cfg.Current().DrainTimeout)
+			go func() {
+				// Second SIGINT/SIGTERM stops without waiting for sessions
+				for sig := range sigCh {
+					switch sig {
+					case reloadSignal:
+						reloadConfig(cfg, sessions)
+					case upgradeSignal:
+						log.Printf("Received signal %v while draining, ignored", sig)
+					default:
+						log.Printf("Received signal %v, shutting down...", sig)
+						cancel()
+						return
+					}
+				}
+			}()
+			drainServers(drainCtl, cfg, registry, sessions)
+			cancel()
+			return
+		}
 	}()
 
 	// Start servers
-	errCh := make(chan error, 2)
+	errCh := make(chan error, 3+len(proxyListeners))
 
-	go func() {
-		errCh <- connServer.Start(ctx)
-	}()
+	for i, l := range proxyListeners {
+		go func(l net.Listener, lc config.Listener) {
+			errCh <- connServer.ServeListener(ctx, l, lc)
+		}(l, proxyConfigs[i])
+	}
 
 	go func() {
-		errCh <- apiServer.Start(ctx)
+		errCh <- apiServer.Serve(ctx, apiListener)
 	}()
 
+	if modbusGateway != nil {
+		go func() {
+			errCh <- modbusGateway.Serve(ctx, modbusListener)
+		}()
+	}
+
+	if clusterNode != nil {
+		go func() {
+			errCh <- clusterNode.Serve(ctx, clusterListener)
+		}()
+	}
+
+	if modbusPoller != nil {
+		go modbusPoller.Start(ctx)
+	}
+
 	// Wait for shutdown or error
 	select {
 	case err := <-errCh:
@@ -83,3 +227,42 @@ func main() {
 
 	log.Println("RFC-2217 NAT Proxy stopped")
 }
+
+// drainServers withdraws readiness, stops accepting connections after DRAIN_DELAY and waits
+// until sessions end and devices are released, at most DRAIN_TIMEOUT
+func drainServers(ctl *drain.Controller, cfg *config.Config, registry *device.Registry, sessions *session.Manager) {
+	cfg = cfg.Current()
+	ctl.Start(cfg.DrainDelay)
+	timeout := time.After(cfg.DrainDelay + cfg.DrainTimeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if ctl.Stopped() && sessions.Count() == 0 && registry.Count() == 0 {
+			log.Printf("Drain complete")
+			return
+		}
+		select {
+		case <-timeout:
+			log.Printf("Drain timeout: %d sessions, %d devices left", sessions.Count(), registry.Count())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reloadConfig re-reads configuration file and environment and applies changes that don't need restart
+func reloadConfig(cfg *config.Config, sessions *session.Manager) (applied, restart []string, err error) {
+	applied, restart, err = cfg.Reload()
+	if err != nil {
+		log.Printf("[config] reload failed, configuration unchanged: %v", err)
+		return nil, nil, err
+	}
+	cur := cfg.Current()
+	sessions.SetOptions(cur.Debug, cur.IdleTimeout)
+	log.Printf("[config] reloaded, changed: %v", applied)
+	if len(restart) > 0 {
+		log.Printf("[config] changes need restart and were not applied: %v", restart)
+	}
+	return applied, restart, nil
+}
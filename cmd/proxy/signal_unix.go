@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal starts a new process with listening sockets handed over and drains this one
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// reloadSignal re-reads configuration and applies changes that don't need restart
+var reloadSignal os.Signal = syscall.SIGHUP
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// upgradeSignal is not supported: sockets can't be handed over to a new process
+var upgradeSignal os.Signal
+
+// reloadSignal is not supported, configuration is reloaded through the API
+var reloadSignal os.Signal
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/ctl"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+)
+
+// Build-time variables (set via ldflags)
+var (
+	BuildDate = "unknown"
+	GitCommit = "unknown"
+)
+
+// options are global flags shared by commands
+type options struct {
+	api     *ctl.API
+	server  string
+	auth    string
+	json    bool
+	timeout time.Duration
+}
+
+// token returns AT+CONNECT token for device
+func (o *options) token(deviceID string) string {
+	if o.auth != "" {
+		return o.auth + "+" + deviceID
+	}
+	return deviceID
+}
+
+const usage = `Usage: rfc2217ctl [flags] <command> [args]
+
+Commands:
+  devices                      list registered devices
+  sessions                     list active sessions
+  kill <session-id>...         terminate sessions
+  connect [flags] <device>     interactive session (-view raw, hex or line)
+  send [flags] <device> <file> send file ("-" for stdin) and print the response
+  script [flags] <device> <file>
+                               run hex script with expectations
+  version                      print version
+
+Run "rfc2217ctl <command> -h" for command flags.
+
+Flags:
+`
+
+func main() {
+	apiURL := flag.String("api", getEnv("RFC2217_API", "http://localhost:8080"), "proxy HTTP API URL (RFC2217_API)")
+	user := flag.String("user", os.Getenv("WEB_USER"), "API user for IP addresses and kill (WEB_USER)")
+	pass := flag.String("pass", os.Getenv("WEB_PASS"), "API password (WEB_PASS)")
+	server := flag.String("server", getEnv("RFC2217_SERVER", "localhost:2217"), "proxy address for sessions (RFC2217_SERVER)")
+	auth := flag.String("auth", os.Getenv("AUTH_TOKEN"), "AUTH_TOKEN of the proxy (AUTH_TOKEN)")
+	jsonOut := flag.Bool("json", false, "JSON output")
+	timeout := flag.Duration("timeout", 10*time.Second, "API and connect timeout")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	o := &options{
+		api:     &ctl.API{BaseURL: *apiURL, User: *user, Pass: *pass},
+		server:  *server,
+		auth:    *auth,
+		json:    *jsonOut,
+		timeout: *timeout,
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	commands := map[string]func(context.Context, *options, []string) error{
+		"devices":  cmdDevices,
+		"sessions": cmdSessions,
+		"kill":     cmdKill,
+		"connect":  cmdConnect,
+		"send":     cmdSend,
+		"script":   cmdScript,
+		"version": func(context.Context, *options, []string) error {
+			fmt.Printf("rfc2217ctl (build: %s, commit: %s)\n", BuildDate, GitCommit)
+			return nil
+		},
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rfc2217ctl: unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := cmd(ctx, o, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "rfc2217ctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultValue
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cmdDevices(ctx context.Context, o *options, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	resp, err := o.api.Devices(ctx)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDIALECT\tSERIAL\tSESSION\tREGISTERED\tADDRESS")
+	for _, d := range resp.Devices {
+		serialMode, sess := "-", "-"
+		if d.Serial != nil {
+			serialMode = fmt.Sprintf("%d %s", d.Serial.BaudRate, d.Serial.ModeString())
+		}
+		if d.InSession {
+			sess = d.SessionID
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Dialect, serialMode, sess,
+			d.RegisteredAt.Local().Format(time.DateTime), d.RemoteAddr)
+	}
+	return w.Flush()
+}
+
+func cmdSessions(ctx context.Context, o *options, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	resp, err := o.api.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDEVICE\tKIND\tCLIENT\tDURATION\tIN\tOUT")
+	for _, s := range resp.Sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", s.ID, s.DeviceID, s.Kind, s.ClientAddr,
+			(time.Duration(s.DurationSecs) * time.Second).String(), s.BytesIn, s.BytesOut)
+	}
+	return w.Flush()
+}
+
+func cmdKill(ctx context.Context, o *options, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: kill <session-id>...")
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	result := make(map[string]string)
+	failed := 0
+	for _, id := range args {
+		if err := o.api.Terminate(ctx, id); err != nil {
+			result[id] = err.Error()
+			failed++
+			if !o.json {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			}
+			continue
+		}
+		result[id] = "terminated"
+		if !o.json {
+			fmt.Printf("%s: terminated\n", id)
+		}
+	}
+	if o.json {
+		printJSON(result)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sessions not terminated", failed, len(args))
+	}
+	return nil
+}
+
+// sessionFlags adds serial settings flags of connect, send and script
+func sessionFlags(fs *flag.FlagSet) (baud *uint, mode *string) {
+	baud = fs.Uint("baud", 0, "baud rate to set after connect, 0 - keep device settings")
+	mode = fs.String("mode", "8N1", "data bits, parity and stop bits with -baud")
+	return baud, mode
+}
+
+// open connects to the device and applies -baud/-mode
+// RFC2217 replies are printed to stderr unless JSON output is requested
+func open(ctx context.Context, o *options, deviceID string, baud uint, mode string) (*ctl.Session, error) {
+	onReply := func(cmd connection.RFC2217Command) {
+		if !o.json {
+			fmt.Fprintf(os.Stderr, "[confirmed %s]\n", cmd.String())
+		}
+	}
+	sess, err := ctl.Connect(ctx, o.server, o.token(deviceID), o.timeout, onReply)
+	if err != nil {
+		return nil, err
+	}
+	if baud != 0 {
+		profile, err := serial.ParseMode(mode, uint32(baud))
+		if err == nil {
+			err = sess.SetSerial(profile)
+		}
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+	}
+	return sess, nil
+}
+
+func cmdConnect(ctx context.Context, o *options, args []string) error {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	baud, mode := sessionFlags(fs)
+	view := fs.String("view", "raw", "raw (bytes as is), hex (input and output in hex) or line (input lines with -eol)")
+	eol := fs.String("eol", "crlf", "line ending in line view: cr, lf or crlf")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: connect [flags] <device>")
+	}
+	lineEnd, ok := map[string]string{"cr": "\r", "lf": "\n", "crlf": "\r\n"}[*eol]
+	if !ok {
+		return fmt.Errorf("invalid -eol %q", *eol)
+	}
+	if *view != "raw" && *view != "hex" && *view != "line" {
+		return fmt.Errorf("invalid -view %q", *view)
+	}
+
+	sess, err := open(ctx, o, fs.Arg(0), *baud, *mode)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	fmt.Fprintf(os.Stderr, "[connected to %s, Ctrl-D to exit]\n", fs.Arg(0))
+
+	// Device output
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := sess.Read(buf)
+			if n > 0 {
+				if *view == "hex" {
+					fmt.Printf("% x\n", buf[:n])
+				} else {
+					os.Stdout.Write(buf[:n])
+				}
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	// User input until EOF
+	go func() {
+		if *view == "raw" {
+			io.Copy(sess, os.Stdin)
+		} else {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				data := []byte(scanner.Text() + lineEnd)
+				if *view == "hex" {
+					if data, err = ctl.ParseData(scanner.Text()); err != nil {
+						fmt.Fprintf(os.Stderr, "[%v]\n", err)
+						continue
+					}
+				}
+				if _, err := sess.Write(data); err != nil {
+					break
+				}
+			}
+		}
+		// Give the device time to answer the last input
+		time.Sleep(500 * time.Millisecond)
+		sess.Close()
+	}()
+
+	err = <-done
+	if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func cmdSend(ctx context.Context, o *options, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	baud, mode := sessionFlags(fs)
+	wait := fs.Duration("wait", time.Second, "end of response: no data for this interval")
+	hexOut := fs.Bool("hex", false, "print response in hex")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: send [flags] <device> <file>")
+	}
+	data, err := readInput(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	sess, err := open(ctx, o, fs.Arg(0), *baud, *mode)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if _, err := sess.Write(data); err != nil {
+		return err
+	}
+
+	// Collect response until the device is silent for -wait
+	var resp []byte
+	buf := make([]byte, 4096)
+	for ctx.Err() == nil {
+		sess.SetReadDeadline(time.Now().Add(*wait))
+		n, err := sess.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return err
+			}
+			break
+		}
+	}
+
+	switch {
+	case o.json:
+		return printJSON(map[string]any{"sent": len(data), "received": hex.EncodeToString(resp)})
+	case *hexOut:
+		fmt.Println(hex.Dump(resp))
+	default:
+		os.Stdout.Write(resp)
+	}
+	return nil
+}
+
+func cmdScript(ctx context.Context, o *options, args []string) error {
+	fs := flag.NewFlagSet("script", flag.ExitOnError)
+	baud, mode := sessionFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: script [flags] <device> <file>")
+	}
+	text, err := readInput(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	steps, err := ctl.ParseScript(strings.NewReader(string(text)))
+	if err != nil {
+		return err
+	}
+
+	sess, err := open(ctx, o, fs.Arg(0), *baud, *mode)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+
+	res := ctl.RunScript(sess, steps)
+	if o.json {
+		printJSON(res)
+	} else {
+		for _, s := range res.Steps {
+			status := "ok"
+			if s.Error != "" {
+				status = "FAIL: " + s.Error
+			}
+			fmt.Printf("%4d %-7s %8.1fms %s %s\n", s.Line, s.Op, s.Elapsed, s.Data, status)
+			if s.Op == ctl.OpExpect && s.Received != "" {
+				fmt.Printf("     received %s\n", s.Received)
+			}
+		}
+	}
+	if !res.OK {
+		return errors.New("script failed")
+	}
+	return nil
+}
+
+// readInput reads file, "-" is stdin
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/vcom"
+)
+
+// Build-time variables (set via ldflags)
+var (
+	BuildDate = "unknown"
+	GitCommit = "unknown"
+)
+
+func main() {
+	server := flag.String("server", "", "proxy address, host:2217")
+	token := flag.String("token", "", "client token: DEVICE_ID or AUTH_TOKEN+DEVICE_ID")
+	link := flag.String("link", "", "stable symlink to the pseudo-terminal, e.g. /tmp/ttyMETER")
+	baud := flag.Uint("baud", 9600, "initial baud rate")
+	mode := flag.String("mode", "8N1", "data bits, parity and stop bits (PTY does not report data bits and even parity)")
+	poll := flag.Duration("poll", 100*time.Millisecond, "interval of checking port settings")
+	retry := flag.Duration("retry", 5*time.Second, "delay before reconnect")
+	flag.Parse()
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if *server == "" || *token == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	defaults, err := serial.ParseMode(*mode, uint32(*baud))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("RFC-2217 virtual serial port starting... (build: %s, commit: %s)", BuildDate, GitCommit)
+
+	// The PTY outlives proxy connections so the path stays valid for applications
+	pty, err := vcom.OpenPTY(*link, defaults.BaudRate)
+	if err != nil {
+		log.Fatalf("PTY: %v", err)
+	}
+	defer pty.Close()
+	if *link != "" {
+		log.Printf("[vcom] serial port %s -> %s", *link, pty.Name())
+	} else {
+		log.Printf("[vcom] serial port %s", pty.Name())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	for {
+		if err := run(ctx, *server, *token, pty, defaults, *poll); err != nil && ctx.Err() == nil {
+			log.Printf("[vcom] %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("RFC-2217 virtual serial port stopped")
+			return
+		case <-time.After(*retry):
+		}
+	}
+}
+
+// run connects to the device and serves the PTY until the session ends
+func run(ctx context.Context, server, token string, pty *vcom.PTY, defaults device.SerialProfile, poll time.Duration) error {
+	conn, err := vcom.Connect(ctx, server, token, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("[vcom] connected to %s", server)
+
+	return vcom.NewSession(conn, pty, defaults).Run(ctx, poll)
+}
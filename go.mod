@@ -2,4 +2,9 @@ module git2.jad.ru/MeterRS485/proxy-rfc2217
 
 go 1.24
 
-require github.com/pires/go-proxyproto v0.9.2 // indirect
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/pires/go-proxyproto v0.9.2
+	gopkg.in/yaml.v3 v3.0.1
+)
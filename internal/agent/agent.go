@@ -0,0 +1,73 @@
+// Package agent implements the device side of the proxy protocol:
+// registration with AT+REG and data exchange with a local serial port
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/wsconn"
+)
+
+// maxResponseLen limits AT response line length
+const maxResponseLen = 256
+
+// Dial connects to the proxy
+// ws:// and wss:// URLs open WebSocket (/ws/register of API server), otherwise addr is TCP host:port
+func Dial(ctx context.Context, addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		ws, _, err := websocket.DefaultDialer.DialContext(ctx, addr, nil)
+		if err != nil {
+			return nil, err
+		}
+		return wsconn.New(ws), nil
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Register registers the device with AT+REG=<token> ([AUTH_TOKEN+]DEVICE_ID)
+// ATDT is sent afterwards so the proxy does not wait for it before sessions
+func Register(conn net.Conn, token string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	for _, cmd := range []string{"AT+REG=" + token, "ATDT"} {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			return err
+		}
+		resp, err := readLine(conn)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cmd, err)
+		}
+		if resp != "OK" {
+			return fmt.Errorf("%s: proxy replied %q", cmd, resp)
+		}
+	}
+	return nil
+}
+
+// readLine reads response line byte by byte so no data after it is consumed
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxResponseLen {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		switch b[0] {
+		case '\n':
+			return string(line), nil
+		case '\r':
+		default:
+			line = append(line, b[0])
+		}
+	}
+	return "", errors.New("response too long")
+}
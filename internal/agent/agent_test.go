@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	conn, proxy := net.Pipe()
+	defer conn.Close()
+	defer proxy.Close()
+
+	got := make(chan []string, 1)
+	go func() {
+		reader := bufio.NewReader(proxy)
+		var lines []string
+		for _, resp := range []string{"OK\r\n", "OK\r\n"} {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			lines = append(lines, line)
+			proxy.Write([]byte(resp))
+		}
+		got <- lines
+	}()
+
+	if err := Register(conn, "secret+meter1", time.Second); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if lines := <-got; len(lines) != 2 || lines[0] != "AT+REG=secret+meter1\r\n" || lines[1] != "ATDT\r\n" {
+		t.Errorf("proxy got %q", lines)
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	conn, proxy := net.Pipe()
+	defer conn.Close()
+	defer proxy.Close()
+
+	go func() {
+		bufio.NewReader(proxy).ReadString('\n')
+		proxy.Write([]byte("ERROR\r\n"))
+	}()
+	if err := Register(conn, "meter1", time.Second); err == nil {
+		t.Error("Register should fail on ERROR")
+	}
+}
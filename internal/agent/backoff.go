@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes reconnect delays: doubled after every failed attempt
+// from Min up to Max, with ±20% jitter so gateways don't reconnect in lockstep
+type Backoff struct {
+	Min, Max time.Duration
+
+	attempt int
+}
+
+// Next returns delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := b.Min << b.attempt
+	if d > b.Max || d <= 0 {
+		d = b.Max
+	} else {
+		b.attempt++
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+// Reset starts over from Min, called after a session that was up long enough
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,20 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second}
+	for i, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		want *= time.Second
+		if d := b.Next(); d < want*4/5 || d > want*6/5 {
+			t.Errorf("attempt %d: delay %v, want %v±20%%", i, d, want)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d > 1200*time.Millisecond {
+		t.Errorf("delay after reset %v, want 1s±20%%", d)
+	}
+}
@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+)
+
+// Telnet options accepted from the proxy in RFC2217 dialect
+var acceptedTelnetOptions = map[byte]bool{
+	0:                        true, // BINARY
+	3:                        true, // SUPPRESS-GO-AHEAD
+	connection.ComPortOption: true,
+}
+
+// telnetNOP is the proxy keepalive, sent in every dialect
+var telnetNOP = []byte{rfc2217.IAC, rfc2217.NOP}
+
+// Configurable is a local port accepting serial settings, e.g. *serial.Port
+// Ports without it (TCP serial servers) get data only
+type Configurable interface {
+	SetProfile(profile device.SerialProfile) error
+	SetControl(value byte) error
+}
+
+// Bridge exchanges data between registered proxy connection and local port
+// and applies port settings sent by the proxy in the device dialect:
+//   - rfc2217: COM-PORT-OPTION subnegotiations are applied and answered, Telnet
+//     options are negotiated, port data is IAC escaped
+//   - usrvcom: Baud Rate Sync packets (55 AA 55) are applied and removed from data
+//   - none: data is passed as is
+//
+// NOP keepalives of the proxy are dropped in every dialect
+type Bridge struct {
+	conn    net.Conn
+	port    io.ReadWriter
+	dialect string
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu         sync.Mutex
+	profile    device.SerialProfile // current port settings
+	negotiated map[[2]byte]bool     // answered Telnet negotiations
+}
+
+// NewBridge creates bridge on connection returned by Register
+// profile is the current port settings, used to answer RFC2217 queries
+func NewBridge(conn net.Conn, port io.ReadWriter, dialect string, profile device.SerialProfile) *Bridge {
+	return &Bridge{
+		conn:       conn,
+		port:       port,
+		dialect:    dialect,
+		profile:    profile,
+		negotiated: make(map[[2]byte]bool),
+	}
+}
+
+// Profile returns port settings after changes made by the proxy
+func (b *Bridge) Profile() device.SerialProfile {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.profile
+}
+
+// Run exchanges data until either side fails
+// A port with SetReadDeadline (serial port, PTY) is released for the next bridge;
+// the caller closes the connection afterwards
+func (b *Bridge) Run() error {
+	errc := make(chan error, 2)
+	go b.fromProxy(errc)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.toProxy(errc)
+	}()
+
+	err := <-errc
+	if d, ok := b.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		d.SetReadDeadline(time.Now())
+		wg.Wait()
+		d.SetReadDeadline(time.Time{})
+	}
+	return err
+}
+
+// fromProxy writes device data to the port and handles control frames of the dialect
+func (b *Bridge) fromProxy(errc chan<- error) {
+	var dec rfc2217.Decoder
+	buf := make([]byte, 4096)
+	for {
+		n, err := b.conn.Read(buf)
+		if n > 0 {
+			var data []byte
+			switch b.dialect {
+			case device.DialectRFC2217:
+				data = b.decodeRFC2217(&dec, buf[:n])
+			case device.DialectUSRVCOM:
+				data = b.decodeUSRVCOM(stripNOP(buf[:n]))
+			default:
+				data = stripNOP(buf[:n])
+			}
+			if len(data) > 0 {
+				if _, werr := b.port.Write(data); werr != nil {
+					errc <- fmt.Errorf("port write: %w", werr)
+					return
+				}
+			}
+		}
+		if err != nil {
+			errc <- fmt.Errorf("proxy read: %w", err)
+			return
+		}
+	}
+}
+
+// toProxy sends port data, IAC escaped in RFC2217 dialect
+func (b *Bridge) toProxy(errc chan<- error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := b.port.Read(buf)
+		if n > 0 {
+			data := buf[:n]
+			if b.dialect == device.DialectRFC2217 {
+				data = rfc2217.Escape(data)
+			}
+			if werr := b.write(data); werr != nil {
+				errc <- fmt.Errorf("proxy write: %w", werr)
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				errc <- fmt.Errorf("port read: %w", err)
+			}
+			return
+		}
+	}
+}
+
+// decodeRFC2217 returns data of Telnet stream, answering negotiation and COM-PORT-OPTION commands
+func (b *Bridge) decodeRFC2217(dec *rfc2217.Decoder, p []byte) []byte {
+	var data, reply []byte
+	for _, ev := range dec.Feed(p) {
+		switch ev.Type {
+		case rfc2217.EventData:
+			data = append(data, ev.Data...)
+		case rfc2217.EventCommand:
+			reply = append(reply, b.negotiate(ev)...)
+		case rfc2217.EventSubneg:
+			if ev.Option == connection.ComPortOption && len(ev.Data) > 0 {
+				reply = append(reply, b.comPort(connection.RFC2217Command{Command: ev.Data[0], Data: ev.Data[1:]})...)
+			}
+		}
+	}
+	if len(reply) > 0 {
+		if err := b.write(reply); err != nil {
+			log.Printf("[agent] reply failed: %v", err)
+		}
+	}
+	return data
+}
+
+// negotiate accepts BINARY, SUPPRESS-GO-AHEAD and COM-PORT-OPTION, refuses others
+func (b *Bridge) negotiate(ev rfc2217.Event) []byte {
+	var answer byte
+	switch ev.Command {
+	case rfc2217.WILL:
+		answer = rfc2217.DONT
+		if acceptedTelnetOptions[ev.Option] {
+			answer = rfc2217.DO
+		}
+	case rfc2217.DO:
+		answer = rfc2217.WONT
+		if acceptedTelnetOptions[ev.Option] {
+			answer = rfc2217.WILL
+		}
+	default:
+		return nil // NOP, WONT, DONT etc.
+	}
+
+	// Answer once per option to avoid negotiation loops
+	key := [2]byte{ev.Command, ev.Option}
+	if b.negotiated[key] {
+		return nil
+	}
+	b.negotiated[key] = true
+	return []byte{rfc2217.IAC, answer, ev.Option}
+}
+
+// comPort applies COM-PORT-OPTION command and returns the server reply
+// Settings the port rejects are answered with the current value
+func (b *Bridge) comPort(cmd connection.RFC2217Command) []byte {
+	cmds := []connection.RFC2217Command{cmd}
+	if cmd.Command == connection.SetControl && !cmd.IsQuery() && len(cmd.Data) > 0 {
+		if port, ok := b.port.(Configurable); ok {
+			if err := port.SetControl(cmd.Data[0]); err != nil {
+				log.Printf("[agent] %s: %v", cmd.String(), err)
+			}
+		}
+	}
+	if !b.apply(cmds) {
+		cmds = []connection.RFC2217Command{{Command: cmd.Command, Data: make([]byte, len(cmd.Data))}} // query
+	}
+	return connection.BuildRFC2217Replies(cmds, b.Profile())
+}
+
+// decodeUSRVCOM applies Baud Rate Sync packets and returns data without them
+func (b *Bridge) decodeUSRVCOM(p []byte) []byte {
+	idx := connection.FindUSRVCOMPacket(p)
+	if idx < 0 {
+		return p
+	}
+	data := append([]byte(nil), p[:idx]...)
+	for idx >= 0 {
+		cfg := connection.ParseUSRVCOM(p[idx : idx+connection.USRVCOMPacketLen])
+		b.apply(cfg.ToRFC2217Commands())
+
+		p = p[idx+connection.USRVCOMPacketLen:]
+		idx = connection.FindUSRVCOMPacket(p)
+		if idx < 0 {
+			data = append(data, p...)
+		} else {
+			data = append(data, p[:idx]...)
+		}
+	}
+	return data
+}
+
+// apply merges port settings into the profile and configures the port
+// Returns false if the port rejected them, the profile is unchanged then
+func (b *Bridge) apply(cmds []connection.RFC2217Command) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	profile, changed := connection.ApplyRFC2217Commands(b.profile, cmds)
+	if !changed || profile == b.profile {
+		return true
+	}
+	if port, ok := b.port.(Configurable); ok {
+		if err := port.SetProfile(profile); err != nil {
+			log.Printf("[agent] port settings %d %s: %v", profile.BaudRate, profile.ModeString(), err)
+			return false
+		}
+	}
+	log.Printf("[agent] port settings: %d %s", profile.BaudRate, profile.ModeString())
+	b.profile = profile
+	return true
+}
+
+func (b *Bridge) write(p []byte) error {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	_, err := b.conn.Write(p)
+	return err
+}
+
+// stripNOP removes leading NOP keepalives from raw data of non-Telnet dialects
+// The proxy sends NOP only to an idle device, so it starts a read
+func stripNOP(p []byte) []byte {
+	for bytes.HasPrefix(p, telnetNOP) {
+		p = p[len(telnetNOP):]
+	}
+	return p
+}
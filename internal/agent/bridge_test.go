@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// fakePort is a configurable port on net.Pipe
+type fakePort struct {
+	net.Conn
+
+	mu       sync.Mutex
+	profiles []device.SerialProfile
+	controls []byte
+}
+
+func (p *fakePort) SetProfile(profile device.SerialProfile) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if profile.BaudRate == 12345 {
+		return net.UnknownNetworkError("unsupported")
+	}
+	p.profiles = append(p.profiles, profile)
+	return nil
+}
+
+func (p *fakePort) SetControl(value byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.controls = append(p.controls, value)
+	return nil
+}
+
+var profile8N1 = device.SerialProfile{BaudRate: 9600, DataBits: 8, Parity: 1, StopBits: 1}
+
+// startBridge runs bridge between pipes, returns proxy and serial sides
+func startBridge(t *testing.T, dialect string) (proxy, serial net.Conn, port *fakePort, b *Bridge) {
+	t.Helper()
+	conn, proxy := net.Pipe()
+	portConn, serial := net.Pipe()
+	port = &fakePort{Conn: portConn}
+	t.Cleanup(func() {
+		conn.Close()
+		proxy.Close()
+		portConn.Close()
+		serial.Close()
+	})
+	b = NewBridge(conn, port, dialect, profile8N1)
+	go b.Run()
+	return proxy, serial, port, b
+}
+
+// readExpect reads from conn and compares with want
+func readExpect(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	buf := make([]byte, 256)
+	var got []byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < len(want) {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	proxy, serial, _, _ := startBridge(t, device.DialectRFC2217)
+
+	// NOP keepalive is dropped, escaped IAC is passed as data
+	go proxy.Write([]byte{0xFF, 0xF1, 0x01, 0xFF, 0xFF, 0x02})
+	readExpect(t, serial, []byte{0x01, 0xFF, 0x02})
+
+	// Port data is IAC escaped
+	go serial.Write([]byte{0xFF, 0x03})
+	readExpect(t, proxy, []byte{0xFF, 0xFF, 0x03})
+}
+
+func TestBridgeRFC2217Settings(t *testing.T) {
+	proxy, _, port, b := startBridge(t, device.DialectRFC2217)
+
+	// Telnet negotiation: COM-PORT-OPTION accepted, unknown option refused
+	go proxy.Write([]byte{0xFF, 0xFB, connection.ComPortOption, 0xFF, 0xFD, 0x18})
+	readExpect(t, proxy, []byte{0xFF, 0xFD, connection.ComPortOption, 0xFF, 0xFC, 0x18})
+
+	// SET-BAUDRATE 2400 and SET-PARITY even are applied and confirmed
+	go proxy.Write(connection.BuildRFC2217Packet([]connection.RFC2217Command{
+		{Command: connection.SetBaudrate, Data: []byte{0, 0, 0x09, 0x60}},
+		{Command: connection.SetParity, Data: []byte{3}},
+	}))
+	readExpect(t, proxy, []byte{
+		0xFF, 0xFA, 0x2C, 101, 0, 0, 0x09, 0x60, 0xFF, 0xF0,
+		0xFF, 0xFA, 0x2C, 103, 3, 0xFF, 0xF0,
+	})
+	if got := b.Profile(); got.BaudRate != 2400 || got.ModeString() != "8E1" {
+		t.Errorf("profile = %d %s, want 2400 8E1", got.BaudRate, got.ModeString())
+	}
+
+	// Rejected baud rate is answered with the current one, query with the current value
+	go proxy.Write(connection.BuildRFC2217Packet([]connection.RFC2217Command{
+		{Command: connection.SetBaudrate, Data: []byte{0, 0, 0x30, 0x39}},
+		{Command: connection.SetDatasize, Data: []byte{0}},
+	}))
+	readExpect(t, proxy, []byte{
+		0xFF, 0xFA, 0x2C, 101, 0, 0, 0x09, 0x60, 0xFF, 0xF0,
+		0xFF, 0xFA, 0x2C, 102, 8, 0xFF, 0xF0,
+	})
+
+	// SET-CONTROL DTR ON is passed to the port and confirmed
+	go proxy.Write(connection.BuildRFC2217Packet([]connection.RFC2217Command{{Command: connection.SetControl, Data: []byte{8}}}))
+	readExpect(t, proxy, []byte{0xFF, 0xFA, 0x2C, 105, 8, 0xFF, 0xF0})
+
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	if len(port.profiles) != 2 || !bytes.Equal(port.controls, []byte{8}) {
+		t.Errorf("port got profiles %v, controls %v", port.profiles, port.controls)
+	}
+}
+
+func TestBridgeUSRVCOM(t *testing.T) {
+	proxy, serial, port, b := startBridge(t, device.DialectUSRVCOM)
+
+	// Baud Rate Sync packet (19200 8N1) is applied and removed, NOP keepalive is dropped
+	packet := connection.BuildUSRVCOMPacket(device.SerialProfile{BaudRate: 19200, DataBits: 8, Parity: 1, StopBits: 1})
+	data := append([]byte{0xFF, 0xF1, 0x01}, packet...)
+	go proxy.Write(append(data, 0x02))
+	readExpect(t, serial, []byte{0x01, 0x02})
+
+	if got := b.Profile(); got.BaudRate != 19200 {
+		t.Errorf("baud rate = %d, want 19200", got.BaudRate)
+	}
+	port.mu.Lock()
+	if len(port.profiles) != 1 {
+		t.Errorf("port got profiles %v", port.profiles)
+	}
+	port.mu.Unlock()
+
+	// Port data is not escaped
+	go serial.Write([]byte{0xFF, 0x03})
+	readExpect(t, proxy, []byte{0xFF, 0x03})
+}
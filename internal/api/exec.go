@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// maxExecPayload limits request payload of one transaction
+const maxExecPayload = 4096
+
+// execWriteMargin is time to write the response after the transaction
+const execWriteMargin = 5 * time.Second
+
+// ExecRequest is the request for POST /api/v1/devices/{id}/exec
+// Payload is given either as hex (spaces allowed) or as base64
+type ExecRequest struct {
+	Hex       string                `json:"hex"`
+	Base64    string                `json:"base64"`
+	Serial    *device.SerialProfile `json:"serial"`     // zero fields keep current settings
+	Until     string                `json:"until"`      // timeout, length, delimiter, modbus, iec62056
+	TimeoutMs int                   `json:"timeout_ms"` // response timeout, default 2000
+	IdleMs    int                   `json:"idle_ms"`    // end response after silence, 0 disables
+	Length    int                   `json:"length"`     // for "length"
+	Delimiter string                `json:"delimiter"`  // hex, for "delimiter"
+}
+
+// ExecResponse is the response for POST /api/v1/devices/{id}/exec
+type ExecResponse struct {
+	DeviceID  string `json:"device_id"`
+	Hex       string `json:"hex"`
+	Base64    string `json:"base64"`
+	Length    int    `json:"length"`
+	Reason    string `json:"reason"` // matched rule, "idle", "timeout" or "full"
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// Exec handles POST /api/v1/devices/{id}/exec
+// Writes payload to the device in a short internal session and returns the response
+func (h *Handlers) Exec(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payload, err := req.payload()
+	if err != nil {
+		http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload) == 0 || len(payload) > maxExecPayload {
+		http.Error(w, "payload must be 1..4096 bytes", http.StatusBadRequest)
+		return
+	}
+
+	opts := connection.ExecOptions{
+		Serial:      req.Serial,
+		Until:       req.Until,
+		Timeout:     time.Duration(req.TimeoutMs) * time.Millisecond,
+		IdleTimeout: time.Duration(req.IdleMs) * time.Millisecond,
+		Length:      req.Length,
+	}
+	if opts.Delimiter, err = decodeHex(req.Delimiter); err != nil {
+		http.Error(w, "invalid delimiter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := opts.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dev, ok := h.registry.Get(deviceID)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	// Hold the device in an internal session so clients see it as busy
+	id := h.sessions.NewInternalID()
+	if !dev.TrySetSession(id) {
+		http.Error(w, "device is busy", http.StatusConflict)
+		return
+	}
+	defer dev.ClearSession()
+	sess := h.sessions.CreateInternal(id, deviceID, connection.ExecSessionKind, dev.SessionConn())
+	defer h.sessions.End(sess.ID)
+
+	// Transaction may last longer than the server write timeout: device write and read wait up to Timeout each
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(2*opts.Timeout + execWriteMargin)); err != nil {
+		log.Printf("[api] exec %s: set write deadline: %v", deviceID, err)
+	}
+
+	result, err := connection.Exec(sess, dev, payload, opts)
+	if err != nil {
+		log.Printf("[api] exec %s: %v", deviceID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("[api] exec %s: sent %d bytes, received %d bytes in %v (%s)",
+		deviceID, len(payload), len(result.Data), result.Elapsed.Round(time.Millisecond), result.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExecResponse{
+		DeviceID:  deviceID,
+		Hex:       hex.EncodeToString(result.Data),
+		Base64:    base64.StdEncoding.EncodeToString(result.Data),
+		Length:    len(result.Data),
+		Reason:    result.Reason,
+		ElapsedMs: result.Elapsed.Milliseconds(),
+	})
+}
+
+// payload decodes request payload from hex or base64
+func (req *ExecRequest) payload() ([]byte, error) {
+	if req.Base64 != "" {
+		return base64.StdEncoding.DecodeString(req.Base64)
+	}
+	return decodeHex(req.Hex)
+}
+
+// decodeHex decodes hex string ignoring spaces
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+}
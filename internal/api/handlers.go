@@ -3,13 +3,21 @@ package api
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/health"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
 )
 
@@ -20,14 +28,32 @@ type Handlers struct {
 	cfg      *config.Config
 	registry *device.Registry
 	sessions *session.Manager
+	poller   *modbus.Poller      // nil if register polling is disabled
+	conn     *connection.Handler // client sessions over WebSocket
+	cluster  *cluster.Node       // nil if cluster mode is disabled
+	health   *health.Checker     // liveness and readiness checks
+	reload   ReloadFunc          // nil if configuration reload is not available
 }
 
+// ReloadFunc reloads configuration, returns applied changes and changes that need restart
+type ReloadFunc func() (applied, restart []string, err error)
+
 // NewHandlers creates new API handlers
-func NewHandlers(cfg *config.Config, registry *device.Registry, sessions *session.Manager) *Handlers {
+// conn is the connection server handler: WebSocket clients share its keepalive, drain and cluster state
+func NewHandlers(cfg *config.Config, registry *device.Registry, sessions *session.Manager, conn *connection.Handler) *Handlers {
+	checker := health.NewChecker()
+	checker.Add("goroutines", false, health.Goroutines(cfg.ReadyMaxGoroutines))
+	checker.Add("fds", false, health.FileDescriptors(cfg.ReadyFDHeadroom))
+	if cfg.ReadyMinDevices > 0 {
+		checker.Add("devices", false, health.MinCount("devices", cfg.ReadyMinDevices, registry.Count))
+	}
+
 	return &Handlers{
 		cfg:      cfg,
 		registry: registry,
 		sessions: sessions,
+		conn:     conn,
+		health:   checker,
 	}
 }
 
@@ -43,7 +69,7 @@ func (h *Handlers) isLoggedIn(r *http.Request) bool {
 		decoded, err := base64.StdEncoding.DecodeString(cookie.Value)
 		if err == nil {
 			parts := strings.SplitN(string(decoded), ":", 2)
-			if len(parts) == 2 && parts[0] == h.cfg.WebUser && parts[1] == h.cfg.WebPass {
+			if len(parts) == 2 && parts[0] == h.cfg.Current().WebUser && parts[1] == h.cfg.Current().WebPass {
 				return true
 			}
 		}
@@ -61,7 +87,7 @@ func (h *Handlers) isAuthorized(r *http.Request) bool {
 	}
 
 	// Fall back to Basic Auth for API access
-	return checkAuth(r, h.cfg.WebUser, h.cfg.WebPass)
+	return checkAuth(r, h.cfg.Current().WebUser, h.cfg.Current().WebPass)
 }
 
 // Login handles POST /login
@@ -82,7 +108,7 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	if username == h.cfg.WebUser && password == h.cfg.WebPass {
+	if username == h.cfg.Current().WebUser && password == h.cfg.Current().WebPass {
 		// Set auth cookie
 		cookieValue := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
 		http.SetCookie(w, &http.Cookie{
@@ -115,18 +141,96 @@ func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// HealthResponse is the response for /healthz and /readyz
+type HealthResponse struct {
+	Status string          `json:"status"`
+	Failed []string        `json:"failed,omitempty"`
+	Checks []health.Result `json:"checks,omitempty"` // with ?verbose only
+}
+
 // Healthz handles liveness probe
+// Only checks that can be fixed by restart are included
 func (h *Handlers) Healthz(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	ok, results := h.health.Live()
+	writeHealth(w, r, ok, "ok", "fail", results)
 }
 
 // Readyz handles readiness probe
+// Draining or overloaded instance is not ready, so load balancers stop sending new connections
 func (h *Handlers) Readyz(w http.ResponseWriter, r *http.Request) {
+	ok, results := h.health.Ready()
+	writeHealth(w, r, ok, "ready", "not ready", results)
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, ok bool, okStatus, failStatus string, results []health.Result) {
+	resp := HealthResponse{Status: okStatus, Failed: health.Failed(results)}
+	if !ok {
+		resp.Status = failStatus
+	}
+	if r.URL.Query().Has("verbose") {
+		resp.Checks = results
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ReloadResponse is the response for POST /api/v1/config/reload
+type ReloadResponse struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// ReloadConfig handles POST /api/v1/config/reload
+// Re-reads configuration file and environment, invalid configuration is rejected and nothing changes
+func (h *Handlers) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.reload == nil {
+		http.Error(w, "reload not available", http.StatusNotImplemented)
+		return
+	}
+
+	applied, restart, err := h.reload()
+	if err != nil {
+		http.Error(w, "reload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if applied == nil {
+		applied = []string{}
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+	json.NewEncoder(w).Encode(ReloadResponse{Applied: applied, RestartRequired: restart})
+}
+
+// clusterCheck fails when cluster link is not listening or too few peers are known
+func clusterCheck(node *cluster.Node, minPeers int) health.CheckFunc {
+	return func() (string, error) {
+		if node.Addr() == nil {
+			return "", errors.New("cluster link not listening")
+		}
+		peers := len(node.Nodes()) - 1
+		detail := fmt.Sprintf("%d peers", peers)
+		if peers < minPeers {
+			return detail, fmt.Errorf("%d peers, need at least %d", peers, minPeers)
+		}
+		return detail, nil
+	}
 }
 
 // DevicesResponse is the response for GET /api/v1/devices
@@ -163,6 +267,72 @@ func (h *Handlers) ListDevices(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// DeviceSubresource handles /api/v1/devices/{id}/{resource}
+func (h *Handlers) DeviceSubresource(w http.ResponseWriter, r *http.Request) {
+	// Extract device ID and resource from path: /api/v1/devices/{id}/{resource}
+	parts := strings.SplitN(r.URL.Path[len("/api/v1/devices/"):], "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	deviceID, resource := parts[0], parts[1]
+
+	switch resource {
+	case "usr-config":
+		h.USRConfig(w, r, deviceID)
+	case "dialect":
+		h.DeviceDialect(w, r, deviceID)
+	case "registers":
+		h.Registers(w, r, deviceID)
+	case "exec":
+		h.Exec(w, r, deviceID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// DialectRequest is the request/response for /api/v1/devices/{id}/dialect
+type DialectRequest struct {
+	Dialect string `json:"dialect"`
+}
+
+// DeviceDialect handles GET/PUT /api/v1/devices/{id}/dialect
+// Changes serial control dialect of the connected device (rfc2217, usrvcom, none)
+func (h *Handlers) DeviceDialect(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodPut && !h.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	dev, ok := h.registry.Get(deviceID)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req DialectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !device.ValidDialect(req.Dialect) {
+			http.Error(w, "invalid dialect", http.StatusBadRequest)
+			return
+		}
+		dev.SetDialect(req.Dialect)
+		log.Printf("[api] device %s: serial dialect set to %s", deviceID, req.Dialect)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DialectRequest{Dialect: dev.Dialect()})
+}
+
 // SessionsResponse is the response for GET /api/v1/sessions
 type SessionsResponse struct {
 	Count    int                   `json:"count"`
@@ -248,6 +418,38 @@ func (h *Handlers) Stats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// ClusterResponse is the response for GET /api/v1/cluster
+type ClusterResponse struct {
+	Enabled bool               `json:"enabled"`
+	Node    string             `json:"node,omitempty"`
+	Nodes   []cluster.NodeInfo `json:"nodes"`
+}
+
+// Cluster handles GET /api/v1/cluster
+// Lists cluster nodes with devices registered on them
+func (h *Handlers) Cluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := ClusterResponse{Nodes: []cluster.NodeInfo{}}
+	if h.cluster != nil {
+		resp.Enabled = true
+		resp.Node = h.cluster.ID()
+		resp.Nodes = h.cluster.Nodes()
+		// Hide node addresses if not authorized (supports Basic Auth for API)
+		if !h.isAuthorized(r) {
+			for i := range resp.Nodes {
+				resp.Nodes[i].Addr = maskIP(resp.Nodes[i].Addr)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // Dashboard handles GET / - web dashboard
 func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
@@ -276,6 +478,10 @@ func maskIP(addr string) string {
 	if addr == "" {
 		return ""
 	}
+	// Internal sessions have no client address
+	if strings.HasPrefix(addr, "internal:") {
+		return addr
+	}
 	// Handle IPv4: "192.168.1.100:12345" -> "192.x.x.x:xxxxx"
 	if idx := strings.Index(addr, "."); idx > 0 {
 		firstOctet := addr[:idx]
@@ -356,6 +562,8 @@ func dashboardHTML(devCount, sessCount int, devices []device.DeviceInfo, session
         .refresh { color: #666; font-size: 0.8em; }
         .btn-terminate { background: #a00; color: #fff; border: none; padding: 5px 10px; border-radius: 4px; cursor: pointer; font-size: 0.85em; }
         .btn-terminate:hover { background: #c00; }
+        .btn-terminal { background: #0f3460; color: #0cf; padding: 5px 10px; border-radius: 4px; text-decoration: none; font-size: 0.85em; }
+        .btn-terminal:hover { background: #16498a; }
         .btn-login { background: #0a3; color: #fff; padding: 8px 16px; border-radius: 6px; text-decoration: none; font-size: 0.9em; }
         .btn-login:hover { background: #0b4; }
         .btn-logout { color: #f66; text-decoration: none; font-size: 0.9em; margin-left: 10px; }
@@ -392,11 +600,20 @@ func dashboardHTML(devCount, sessCount int, devices []device.DeviceInfo, session
             <th>ID</th>
             <th>Remote Address</th>
             <th>Registered</th>
-            <th>Status</th>
-        </tr>`
+            <th>Status</th>`
+
+	if isLoggedIn {
+		html += `<th>Actions</th>`
+	}
+
+	html += `</tr>`
 
 	if len(devices) == 0 {
-		html += `<tr><td colspan="4" class="empty">No devices connected</td></tr>`
+		cols := "4"
+		if isLoggedIn {
+			cols = "5"
+		}
+		html += `<tr><td colspan="` + cols + `" class="empty">No devices connected</td></tr>`
 	} else {
 		for _, d := range devices {
 			status := `<span class="badge badge-green">idle</span>`
@@ -411,8 +628,12 @@ func dashboardHTML(devCount, sessCount int, devices []device.DeviceInfo, session
                 <td>` + d.ID + `</td>
                 <td>` + remoteAddr + `</td>
                 <td>` + d.RegisteredAt.Format("2006-01-02 15:04:05") + `</td>
-                <td>` + status + `</td>
-            </tr>`
+                <td>` + status + `</td>`
+
+			if isLoggedIn {
+				html += `<td><a class="btn-terminal" href="/terminal/` + url.PathEscape(d.ID) + `">Terminal</a></td>`
+			}
+			html += `</tr>`
 		}
 	}
 
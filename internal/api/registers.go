@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
+)
+
+// RegistersResponse is the response for GET /api/v1/devices/{id}/registers
+type RegistersResponse struct {
+	DeviceID  string                 `json:"device_id"`
+	Online    bool                   `json:"online"`
+	Registers []modbus.RegisterValue `json:"registers"`
+	Polls     []modbus.PollStatus    `json:"polls"`
+}
+
+// Registers handles GET /api/v1/devices/{id}/registers
+// Returns cached values of polled Modbus registers (also when device is offline)
+func (h *Handlers) Registers(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.poller == nil {
+		http.Error(w, "register polling disabled", http.StatusNotFound)
+		return
+	}
+	values, polls, ok := h.poller.Registers(deviceID)
+	if !ok {
+		http.Error(w, "no registers polled on device", http.StatusNotFound)
+		return
+	}
+	_, online := h.registry.Get(deviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RegistersResponse{
+		DeviceID:  deviceID,
+		Online:    online,
+		Registers: values,
+		Polls:     polls,
+	})
+}
+
+// Metrics handles GET /metrics - Prometheus text exposition
+func (h *Handlers) Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP rfc2217_devices_connected Number of connected devices.\n")
+	b.WriteString("# TYPE rfc2217_devices_connected gauge\n")
+	fmt.Fprintf(&b, "rfc2217_devices_connected %d\n", h.registry.Count())
+	b.WriteString("# HELP rfc2217_sessions_active Number of active sessions.\n")
+	b.WriteString("# TYPE rfc2217_sessions_active gauge\n")
+	fmt.Fprintf(&b, "rfc2217_sessions_active %d\n", h.sessions.Count())
+
+	if h.poller != nil {
+		all := h.poller.AllRegisters()
+		deviceIDs := make([]string, 0, len(all))
+		for id := range all {
+			deviceIDs = append(deviceIDs, id)
+		}
+		sort.Strings(deviceIDs)
+
+		b.WriteString("# HELP rfc2217_modbus_register Last polled value of a Modbus register.\n")
+		b.WriteString("# TYPE rfc2217_modbus_register gauge\n")
+		for _, id := range deviceIDs {
+			for _, v := range all[id] {
+				fmt.Fprintf(&b, "rfc2217_modbus_register{%s} %d\n", registerLabels(id, v), v.Value)
+			}
+		}
+		b.WriteString("# HELP rfc2217_modbus_register_updated_seconds Unix time of the last successful poll of a Modbus register.\n")
+		b.WriteString("# TYPE rfc2217_modbus_register_updated_seconds gauge\n")
+		for _, id := range deviceIDs {
+			for _, v := range all[id] {
+				fmt.Fprintf(&b, "rfc2217_modbus_register_updated_seconds{%s} %d\n", registerLabels(id, v), v.UpdatedAt.Unix())
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// registerLabels formats Prometheus labels of a register
+func registerLabels(deviceID string, v modbus.RegisterValue) string {
+	return fmt.Sprintf(`device=%q,unit="%d",type=%q,address="%d"`, deviceID, v.UnitID, v.Type, v.Address)
+}
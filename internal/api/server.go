@@ -3,12 +3,19 @@ package api
 import (
 	"context"
 	"crypto/subtle"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/drain"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/health"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
 )
 
@@ -20,8 +27,8 @@ type Server struct {
 }
 
 // NewServer creates a new API server
-func NewServer(cfg *config.Config, registry *device.Registry, sessions *session.Manager) *Server {
-	handlers := NewHandlers(cfg, registry, sessions)
+func NewServer(cfg *config.Config, registry *device.Registry, sessions *session.Manager, conn *connection.Handler) *Server {
+	handlers := NewHandlers(cfg, registry, sessions, conn)
 
 	mux := http.NewServeMux()
 
@@ -31,9 +38,24 @@ func NewServer(cfg *config.Config, registry *device.Registry, sessions *session.
 
 	// API endpoints (no auth for read, auth for write)
 	mux.HandleFunc("/api/v1/devices", handlers.ListDevices)
+	mux.HandleFunc("/api/v1/devices/", handlers.DeviceSubresource) // requires auth
 	mux.HandleFunc("/api/v1/sessions", handlers.ListSessions)
 	mux.HandleFunc("/api/v1/sessions/", handlers.TerminateSession) // requires auth
 	mux.HandleFunc("/api/v1/stats", handlers.Stats)
+	mux.HandleFunc("/api/v1/cluster", handlers.Cluster)
+	mux.HandleFunc("/api/v1/config/reload", handlers.ReloadConfig) // requires auth
+
+	// WebSocket client sessions (token or login auth)
+	mux.HandleFunc("/ws/devices/", handlers.DeviceWebSocket)
+
+	// WebSocket device registration (AT+REG token auth)
+	mux.HandleFunc("/ws/register", handlers.DeviceRegisterWebSocket)
+
+	// Prometheus metrics (no auth)
+	mux.HandleFunc("/metrics", handlers.Metrics)
+
+	// Web serial terminal (login required)
+	mux.HandleFunc("/terminal/", handlers.Terminal)
 
 	// Login endpoint
 	mux.HandleFunc("/login", handlers.Login)
@@ -44,7 +66,7 @@ func NewServer(cfg *config.Config, registry *device.Registry, sessions *session.
 
 	server := &http.Server{
 		Addr:         ":" + cfg.APIPort,
-		Handler:      logMiddleware(mux, cfg.DebugHTTP),
+		Handler:      logMiddleware(mux, cfg),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
@@ -56,9 +78,50 @@ func NewServer(cfg *config.Config, registry *device.Registry, sessions *session.
 	}
 }
 
+// SetPoller sets Modbus register poller for registers API and metrics
+func (s *Server) SetPoller(p *modbus.Poller) {
+	s.handlers.poller = p
+}
+
+// SetCluster sets cluster node for cluster API and readiness
+func (s *Server) SetCluster(node *cluster.Node) {
+	s.handlers.cluster = node
+	s.handlers.health.Add("cluster", false, clusterCheck(node, s.cfg.ReadyMinPeers))
+}
+
+// SetDrain sets drain controller: readiness is withdrawn on drain
+// WebSocket sessions are rejected by the shared connection handler
+func (s *Server) SetDrain(ctl *drain.Controller) {
+	s.handlers.health.Add("drain", false, func() (string, error) {
+		if ctl.Draining() {
+			return "", errors.New("draining")
+		}
+		return "", nil
+	})
+}
+
+// SetReload sets configuration reload function for the reload API
+func (s *Server) SetReload(fn ReloadFunc) {
+	s.handlers.reload = fn
+}
+
+// Health returns checker of /healthz and /readyz for registering more checks
+func (s *Server) Health() *health.Checker {
+	return s.handlers.health
+}
+
 // Start starts the API server
 func (s *Server) Start(ctx context.Context) error {
-	log.Printf("[api] server listening on %s", s.server.Addr)
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves API requests on listener
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	log.Printf("[api] server listening on %s", listener.Addr())
 
 	go func() {
 		<-ctx.Done()
@@ -67,7 +130,7 @@ func (s *Server) Start(ctx context.Context) error {
 		s.server.Shutdown(shutdownCtx)
 	}()
 
-	err := s.server.ListenAndServe()
+	err := s.server.Serve(listener)
 	if err == http.ErrServerClosed {
 		return nil
 	}
@@ -75,11 +138,11 @@ func (s *Server) Start(ctx context.Context) error {
 }
 
 // logMiddleware logs HTTP requests when debug is enabled
-func logMiddleware(next http.Handler, debug bool) http.Handler {
+func logMiddleware(next http.Handler, cfg *config.Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		next.ServeHTTP(w, r)
-		if debug {
+		if cfg.Current().DebugHTTP {
 			log.Printf("[api] %s %s %v", r.Method, r.URL.Path, time.Since(start))
 		}
 	})
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// Terminal handles GET /terminal/{id} - web serial terminal (login required)
+// The page opens a client session over /ws/devices/{id}
+func (h *Handlers) Terminal(w http.ResponseWriter, r *http.Request) {
+	deviceID := strings.TrimPrefix(r.URL.Path, "/terminal/")
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.isLoggedIn(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(terminalHTML(deviceID)))
+}
+
+func terminalHTML(deviceID string) string {
+	// JSON escapes < and > so the ID is safe inside <script>
+	idJSON, _ := json.Marshal(deviceID)
+
+	return `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>Terminal ` + html.EscapeString(deviceID) + ` - RFC-2217 Proxy</title>
+    <style>
+        * { box-sizing: border-box; }
+        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, monospace; margin: 0; padding: 20px; background: #1a1a2e; color: #eee; display: flex; flex-direction: column; height: 100vh; }
+        .header { display: flex; justify-content: space-between; align-items: center; margin-bottom: 15px; }
+        h1 { color: #0f0; margin: 0; font-size: 1.5em; }
+        a { color: #0cf; text-decoration: none; }
+        .bar { display: flex; flex-wrap: wrap; gap: 8px; align-items: center; background: #16213e; padding: 10px; border-radius: 8px; margin-bottom: 10px; }
+        .bar label { color: #888; font-size: 0.85em; }
+        select, input[type="text"] { background: #0f3460; border: 1px solid #333; border-radius: 4px; color: #fff; padding: 5px 8px; font-family: monospace; }
+        button { background: #0f3460; color: #fff; border: 1px solid #333; padding: 5px 12px; border-radius: 4px; cursor: pointer; font-size: 0.9em; }
+        button:hover { border-color: #0cf; }
+        button:disabled { color: #666; cursor: default; border-color: #333; }
+        .btn-connect { background: #0a3; }
+        .btn-disconnect { background: #a00; }
+        .status { font-size: 0.9em; margin-left: auto; }
+        .status.on { color: #0f0; }
+        .status.off { color: #f66; }
+        #output { flex: 1; overflow-y: auto; background: #0d0d1a; border-radius: 8px; padding: 10px; margin: 0; white-space: pre-wrap; word-break: break-all; font-family: monospace; font-size: 0.95em; }
+        .rx { color: #0f0; }
+        .tx { color: #0cf; }
+        .info { color: #888; font-style: italic; }
+        .err { color: #f66; }
+        #input { flex: 1; min-width: 200px; }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <h1>Terminal: ` + html.EscapeString(deviceID) + `</h1>
+        <a href="/">← Back to Dashboard</a>
+    </div>
+
+    <div class="bar">
+        <button id="connect" class="btn-connect" onclick="toggleConnection()">Connect</button>
+        <label>Baud</label>
+        <select id="baud">
+            <option>300</option><option>600</option><option>1200</option><option>2400</option>
+            <option>4800</option><option selected>9600</option><option>19200</option>
+            <option>38400</option><option>57600</option><option>115200</option>
+        </select>
+        <label>Data</label>
+        <select id="databits"><option>5</option><option>6</option><option>7</option><option selected>8</option></select>
+        <label>Parity</label>
+        <select id="parity">
+            <option value="1" selected>None</option><option value="2">Odd</option><option value="3">Even</option>
+            <option value="4">Mark</option><option value="5">Space</option>
+        </select>
+        <label>Stop</label>
+        <select id="stopbits"><option value="1" selected>1</option><option value="2">2</option><option value="3">1.5</option></select>
+        <button id="apply" onclick="applySerial()" disabled>Apply</button>
+        <span id="status" class="status off">Disconnected</span>
+    </div>
+
+    <pre id="output"></pre>
+
+    <div class="bar">
+        <label>View</label>
+        <select id="view" onchange="setView()"><option value="text">Text</option><option value="hex">Hex</option></select>
+        <label>Send as</label>
+        <select id="mode"><option value="text">Text</option><option value="hex">Hex</option></select>
+        <label>EOL</label>
+        <select id="eol">
+            <option value="">None</option><option value="cr">CR</option><option value="lf">LF</option><option value="crlf" selected>CR LF</option>
+        </select>
+        <input type="text" id="input" placeholder="Data to send (hex: 2F 3F 21)" onkeydown="if (event.key === 'Enter') sendInput()">
+        <button id="send" onclick="sendInput()" disabled>Send</button>
+        <input type="file" id="file" style="display: none" onchange="sendFile(this)">
+        <button id="sendfile" onclick="document.getElementById('file').click()" disabled>Send file</button>
+        <button onclick="clearOutput()">Clear</button>
+        <button onclick="downloadLog()">Download log</button>
+    </div>
+
+    <script>
+    const deviceID = ` + string(idJSON) + `;
+    const maxLines = 5000;
+    const fileChunk = 1024;
+    const eols = {'': '', cr: '\r', lf: '\n', crlf: '\r\n'};
+    let ws = null;
+    let log = []; // {time, dir, data} - full session log for download
+    let textLine = null; // last text span to append to
+    let lastPort = '';
+
+    const $ = (id) => document.getElementById(id);
+
+    function toggleConnection() {
+        if (ws) { ws.close(); return; }
+        const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+        ws = new WebSocket(proto + '//' + location.host + '/ws/devices/' + encodeURIComponent(deviceID));
+        ws.binaryType = 'arraybuffer';
+        setStatus('Connecting...', false);
+        ws.onmessage = (e) => {
+            if (typeof e.data === 'string') { control(JSON.parse(e.data)); return; }
+            record('rx', new Uint8Array(e.data));
+        };
+        ws.onclose = (e) => {
+            ws = null;
+            lastPort = '';
+            info('disconnected' + (e.reason ? ': ' + e.reason : ''));
+            setStatus('Disconnected', false);
+        };
+        ws.onerror = () => info('connection error', 'err');
+    }
+
+    function control(msg) {
+        switch (msg.type) {
+        case 'connected':
+            setStatus('Connected: ' + msg.session_id, true);
+            info('session ' + msg.session_id + ' started');
+            applySerial();
+            break;
+        case 'serial':
+            if (msg.baud_rate) {
+                if (![...$('baud').options].some(o => o.value == msg.baud_rate)) $('baud').add(new Option(msg.baud_rate));
+                $('baud').value = msg.baud_rate;
+            }
+            if (msg.data_bits) $('databits').value = msg.data_bits;
+            if (msg.parity) $('parity').value = msg.parity;
+            if (msg.stop_bits) $('stopbits').value = msg.stop_bits;
+            // Device may confirm settings one by one - report the resulting port mode once
+            const port = $('baud').value + ' ' + $('databits').value +
+                'NOEMS'[$('parity').value - 1] + $('stopbits').selectedOptions[0].text;
+            if (port !== lastPort) info('port: ' + port);
+            lastPort = port;
+            break;
+        case 'error':
+            info('error: ' + msg.error, 'err');
+            break;
+        }
+    }
+
+    function applySerial() {
+        if (!ws || ws.readyState !== WebSocket.OPEN) return;
+        ws.send(JSON.stringify({
+            type: 'serial',
+            baud_rate: +$('baud').value,
+            data_bits: +$('databits').value,
+            parity: +$('parity').value,
+            stop_bits: +$('stopbits').value,
+        }));
+    }
+
+    function setStatus(text, connected) {
+        $('status').textContent = text;
+        $('status').className = 'status ' + (connected ? 'on' : 'off');
+        $('connect').textContent = ws ? 'Disconnect' : 'Connect';
+        $('connect').className = ws ? 'btn-disconnect' : 'btn-connect';
+        for (const id of ['apply', 'send', 'sendfile']) $(id).disabled = !connected;
+    }
+
+    function parseHex(s) {
+        const hex = s.replace(/[\s,]|0x/gi, '');
+        if (hex.length % 2 || /[^0-9a-f]/i.test(hex)) throw new Error('invalid hex');
+        const bytes = new Uint8Array(hex.length / 2);
+        for (let i = 0; i < bytes.length; i++) bytes[i] = parseInt(hex.substr(i * 2, 2), 16);
+        return bytes;
+    }
+
+    function sendInput() {
+        if (!ws || ws.readyState !== WebSocket.OPEN) return;
+        let bytes;
+        try {
+            bytes = $('mode').value === 'hex'
+                ? parseHex($('input').value)
+                : new TextEncoder().encode($('input').value + eols[$('eol').value]);
+        } catch (e) {
+            info(e.message, 'err');
+            return;
+        }
+        if (!bytes.length) return;
+        send(bytes);
+        $('input').value = '';
+    }
+
+    function send(bytes) {
+        ws.send(bytes);
+        record('tx', bytes);
+    }
+
+    async function sendFile(input) {
+        const file = input.files[0];
+        input.value = '';
+        if (!file || !ws) return;
+        const data = new Uint8Array(await file.arrayBuffer());
+        info('sending ' + file.name + ' (' + data.length + ' bytes)');
+        for (let i = 0; i < data.length && ws; i += fileChunk) {
+            send(data.subarray(i, i + fileChunk));
+            while (ws && ws.bufferedAmount > 16 * fileChunk) await new Promise(r => setTimeout(r, 10));
+        }
+    }
+
+    function toHex(bytes) {
+        return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join(' ');
+    }
+
+    function toText(bytes) {
+        // Bytes as Latin-1, control characters except CR/LF/TAB shown as hex
+        let s = '';
+        for (const b of bytes) {
+            if (b === 10 || b === 9 || (b >= 32 && b < 127) || b >= 160) s += String.fromCharCode(b);
+            else if (b !== 13) s += '[' + b.toString(16).padStart(2, '0') + ']';
+        }
+        return s;
+    }
+
+    function record(dir, bytes) {
+        log.push({time: new Date(), dir: dir, data: bytes.slice()});
+        render(dir, bytes);
+    }
+
+    function render(dir, bytes) {
+        const out = $('output');
+        const atBottom = out.scrollTop + out.clientHeight >= out.scrollHeight - 5;
+        if ($('view').value === 'hex') {
+            append(dir, (dir === 'rx' ? 'RX: ' : 'TX: ') + toHex(bytes) + '\n');
+            textLine = null;
+        } else if (textLine && textLine.className === dir) {
+            textLine.textContent += toText(bytes);
+        } else {
+            textLine = append(dir, toText(bytes));
+        }
+        while (out.childNodes.length > maxLines) out.removeChild(out.firstChild);
+        if (atBottom) out.scrollTop = out.scrollHeight;
+    }
+
+    function append(cls, text) {
+        const span = document.createElement('span');
+        span.className = cls;
+        span.textContent = text;
+        $('output').appendChild(span);
+        return span;
+    }
+
+    function info(text, cls) {
+        log.push({time: new Date(), dir: 'info', text: text});
+        if ($('output').lastChild && !$('output').textContent.endsWith('\n')) append('info', '\n');
+        append(cls || 'info', '-- ' + text + ' --\n');
+        textLine = null;
+        $('output').scrollTop = $('output').scrollHeight;
+    }
+
+    function setView() {
+        $('output').textContent = '';
+        textLine = null;
+        for (const e of log.slice(-maxLines)) {
+            if (e.dir === 'info') append('info', '-- ' + e.text + ' --\n');
+            else render(e.dir, e.data);
+        }
+    }
+
+    function clearOutput() {
+        $('output').textContent = '';
+        textLine = null;
+    }
+
+    function downloadLog() {
+        const lines = log.map(e => e.time.toISOString() + ' ' + e.dir.toUpperCase().padEnd(4) + ' ' +
+            (e.dir === 'info' ? e.text : toHex(e.data) + '  |' + toText(e.data).replace(/\n/g, '\\n') + '|'));
+        const blob = new Blob([lines.join('\n') + '\n'], {type: 'text/plain'});
+        const a = document.createElement('a');
+        a.href = URL.createObjectURL(blob);
+        a.download = deviceID + '-' + new Date().toISOString().replace(/[:.]/g, '-') + '.log';
+        a.click();
+        URL.revokeObjectURL(a.href);
+    }
+    </script>
+</body>
+</html>`
+}
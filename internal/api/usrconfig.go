@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// defaultUSRPassword is the factory password of USR modules
+const defaultUSRPassword = "admin"
+
+// usrPasswordHeader carries the module password of GET requests,
+// the query string would leave it in access logs and browser history
+const usrPasswordHeader = "X-USR-Password"
+
+// USRConfigResponse is the response for GET/PUT /api/v1/devices/{id}/usr-config
+type USRConfigResponse struct {
+	DeviceID string                    `json:"device_id"`
+	Params   *connection.M0BasicParams `json:"params"`
+	Mode     string                    `json:"mode"`
+	WorkMode string                    `json:"work_mode"`
+	Serial   *device.SerialProfile     `json:"serial"`
+}
+
+// USRConfigRequest is the request for PUT /api/v1/devices/{id}/usr-config
+// Only fields present in the request are changed
+type USRConfigRequest struct {
+	Password   string  `json:"password"`
+	BaudRate   *uint32 `json:"baud_rate"`
+	DataBits   *uint8  `json:"data_bits"`
+	Parity     *uint8  `json:"parity"` // 0=None, 1=Odd, 2=Even, 3=Mark, 4=Space
+	StopBits   *uint8  `json:"stop_bits"`
+	WorkMode   *uint8  `json:"work_mode"`
+	DeviceName *string `json:"device_name"`
+	Reset      bool    `json:"reset"` // restart module to apply settings
+}
+
+// apply overlays request fields on current parameters
+func (req *USRConfigRequest) apply(p *connection.M0BasicParams) {
+	if req.BaudRate != nil {
+		p.BaudRate = *req.BaudRate
+	}
+	if req.DataBits != nil {
+		p.DataBits = *req.DataBits
+	}
+	if req.Parity != nil {
+		p.Parity = *req.Parity
+	}
+	if req.StopBits != nil {
+		p.StopBits = *req.StopBits
+	}
+	if req.WorkMode != nil {
+		p.WorkMode = *req.WorkMode
+	}
+	if req.DeviceName != nil {
+		p.DeviceName = *req.DeviceName
+	}
+}
+
+// USRConfig handles GET/PUT /api/v1/devices/{id}/usr-config
+// Reads or writes USR M0/T24 basic parameters over the device connection
+func (h *Handlers) USRConfig(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Configuration access requires authentication (supports Basic Auth for API)
+	if !h.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req USRConfigRequest
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Parity != nil && *req.Parity > 4 {
+			http.Error(w, "invalid parity", http.StatusBadRequest)
+			return
+		}
+		if req.DataBits != nil && (*req.DataBits < 5 || *req.DataBits > 8) {
+			http.Error(w, "invalid data_bits", http.StatusBadRequest)
+			return
+		}
+		if req.StopBits != nil && *req.StopBits != 1 && *req.StopBits != 2 {
+			http.Error(w, "invalid stop_bits", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if r.URL.Query().Has("password") {
+			http.Error(w, "password must be sent in "+usrPasswordHeader+" header", http.StatusBadRequest)
+			return
+		}
+		req.Password = r.Header.Get(usrPasswordHeader)
+	}
+	if req.Password == "" {
+		req.Password = defaultUSRPassword
+	}
+
+	dev, ok := h.registry.Get(deviceID)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	// Hold the device in an internal session so clients see it as busy
+	id := h.sessions.NewInternalID()
+	if !dev.TrySetSession(id) {
+		http.Error(w, "device is busy", http.StatusConflict)
+		return
+	}
+	defer dev.ClearSession()
+	sess := h.sessions.CreateInternal(id, deviceID, "usr-config", dev.SessionConn())
+	defer h.sessions.End(sess.ID)
+
+	client := &connection.M0Client{Conn: sess.DeviceConn, Password: req.Password}
+
+	params, err := client.ReadBasic()
+	if err == nil && r.Method == http.MethodPut {
+		req.apply(params)
+		if err = client.WriteBasic(params); err == nil && req.Reset {
+			err = client.Reset()
+		}
+	}
+	if err != nil {
+		log.Printf("[api] usr-config %s: %v", deviceID, err)
+		status := http.StatusBadGateway
+		if errors.Is(err, connection.ErrM0WrongPassword) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	dev.SetSerialProfile(params.SerialProfile())
+
+	resp := USRConfigResponse{
+		DeviceID: deviceID,
+		Params:   params,
+		Mode:     params.ModeString(),
+		WorkMode: params.WorkModeString(),
+		Serial:   dev.SerialProfile(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
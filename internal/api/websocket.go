@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// DeviceWebSocket handles GET /ws/devices/{id} - client session over WebSocket
+// Authentication: ?token=AUTH_TOKEN (like AT+CONNECT) or web/API login
+func (h *Handlers) DeviceWebSocket(w http.ResponseWriter, r *http.Request) {
+	deviceID := strings.TrimPrefix(r.URL.Path, "/ws/devices/")
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	tokenAuth := h.checkClientToken(r.URL.Query().Get("token"))
+	if !tokenAuth && !h.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Device on another cluster node is checked by that node after upgrade
+	if dev, ok := h.registry.Get(deviceID); ok {
+		if dev.IsInSession() {
+			http.Error(w, "device is busy", http.StatusConflict)
+			return
+		}
+	} else if !h.remoteDevice(deviceID) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin: func(r *http.Request) bool {
+			// Cookie/Basic auth is sent by browsers from any page - allow only same origin
+			return tokenAuth || sameOrigin(r)
+		},
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[ws] %s: upgrade error: %v", r.RemoteAddr, err)
+		return
+	}
+
+	h.conn.ServeWebSocket(r.Context(), ws, deviceID)
+}
+
+// remoteDevice reports whether the device is registered on another cluster node
+func (h *Handlers) remoteDevice(deviceID string) bool {
+	if h.cluster == nil {
+		return false
+	}
+	_, _, ok := h.cluster.Locate(deviceID)
+	return ok
+}
+
+// DeviceRegisterWebSocket handles GET /ws/register - device connection over WebSocket
+// For sites allowing only outbound HTTPS; the device authenticates with AT+REG like over TCP
+func (h *Handlers) DeviceRegisterWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     sameOrigin, // devices send no Origin, refuse foreign web pages
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[ws] %s: upgrade error: %v", r.RemoteAddr, err)
+		return
+	}
+
+	h.conn.ServeDeviceWebSocket(r.Context(), ws)
+}
+
+// checkClientToken checks client token like AT+CONNECT (any token if AUTH_TOKEN is not set)
+func (h *Handlers) checkClientToken(token string) bool {
+	if h.cfg.Current().AuthToken == "" {
+		return true
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Current().AuthToken)) == 1
+}
+
+// sameOrigin checks that Origin header (if any) matches request host
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,435 @@
+// Package cluster shares device location between proxy nodes and forwards
+// client connections to the node holding the device
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// Config describes cluster node settings
+type Config struct {
+	NodeID    string        // unique node name, hostname if empty
+	Listen    string        // inter-node listen address (":7946")
+	Advertise string        // address announced to peers, empty host is replaced with source IP
+	Peers     []string      // static peer addresses host:port
+	DNS       string        // DNS SRV name for peer discovery
+	Secret    string        // shared secret for inter-node authentication
+	Interval  time.Duration // state sync interval
+}
+
+// DeviceState is a device announced by a node
+type DeviceState struct {
+	ID           string    `json:"id"`
+	RegisteredAt time.Time `json:"registered_at"`
+	InSession    bool      `json:"in_session"`
+}
+
+// State is the node state exchanged on sync
+type State struct {
+	Node    string        `json:"node"`
+	Addr    string        `json:"addr"`
+	Peers   []string      `json:"peers,omitempty"` // addresses of known alive nodes
+	Devices []DeviceState `json:"devices"`
+}
+
+// NodeInfo is used for API responses
+type NodeInfo struct {
+	ID       string        `json:"id"`
+	Addr     string        `json:"addr"`
+	Self     bool          `json:"self"`
+	LastSeen time.Time     `json:"last_seen"`
+	Devices  []DeviceState `json:"devices"`
+}
+
+// member is a peer node with its last received state
+type member struct {
+	state  State
+	seenAt time.Time
+}
+
+// Node is a cluster member: announces local devices and tracks devices of peers
+type Node struct {
+	cfg      Config
+	registry *device.Registry
+	onDial   func(ctx context.Context, conn *Conn)
+
+	mu       sync.Mutex
+	members  map[string]*member // node ID -> state
+	self     map[string]bool    // peer addresses that resolve to this node
+	failing  map[string]bool    // peer addresses with failed last sync
+	listener net.Listener
+}
+
+// NewNode creates a cluster node announcing devices of the registry
+func NewNode(cfg Config, registry *device.Registry) *Node {
+	if cfg.NodeID == "" {
+		cfg.NodeID, _ = os.Hostname()
+	}
+	// Node ID is a single handshake field
+	cfg.NodeID = strings.Join(strings.Fields(cfg.NodeID), "_")
+	if cfg.Listen == "" {
+		cfg.Listen = ":7946"
+	}
+	if cfg.Advertise == "" {
+		cfg.Advertise = cfg.Listen
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 2 * time.Second
+	}
+	return &Node{
+		cfg:      cfg,
+		registry: registry,
+		members:  make(map[string]*member),
+		self:     make(map[string]bool),
+		failing:  make(map[string]bool),
+	}
+}
+
+// ID returns node ID
+func (n *Node) ID() string {
+	return n.cfg.NodeID
+}
+
+// SetDialHandler sets handler of client connections forwarded by other nodes
+// The connection is closed when the handler returns
+func (n *Node) SetDialHandler(fn func(ctx context.Context, conn *Conn)) {
+	n.onDial = fn
+}
+
+// Start listens for inter-node links and syncs state with peers until context is cancelled
+func (n *Node) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", n.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	return n.Serve(ctx, listener)
+}
+
+// Serve accepts inter-node links on listener and syncs state with peers until context is cancelled
+func (n *Node) Serve(ctx context.Context, listener net.Listener) error {
+	n.mu.Lock()
+	n.listener = listener
+	// Announce the actual port when listening on a random one
+	if host, port, err := net.SplitHostPort(n.cfg.Advertise); err == nil && port == "0" {
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+		n.cfg.Advertise = net.JoinHostPort(host, port)
+	}
+	n.mu.Unlock()
+
+	log.Printf("[cluster] node %s listening on %s", n.cfg.NodeID, listener.Addr())
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go n.gossip(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				log.Printf("[cluster] accept error: %v", err)
+				continue
+			}
+		}
+		go n.serve(ctx, conn)
+	}
+}
+
+// Addr returns inter-node listen address
+func (n *Node) Addr() net.Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Addr()
+}
+
+// Locate returns node ID and link address of the peer holding the device
+// When several nodes announce the device, the latest registration wins
+func (n *Node) Locate(deviceID string) (node, addr string, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var latest time.Time
+	for id, m := range n.members {
+		for _, d := range m.state.Devices {
+			if d.ID == deviceID && (!ok || d.RegisteredAt.After(latest)) {
+				node, addr, ok, latest = id, m.state.Addr, true, d.RegisteredAt
+			}
+		}
+	}
+	return node, addr, ok
+}
+
+// Dial opens authenticated link to the node and forwards a client connection
+// Returned connection carries the client byte stream to and from the device node
+func (n *Node) Dial(ctx context.Context, addr string, req *DialRequest) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: linkTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(linkTimeout))
+	r := bufio.NewReader(conn)
+	_, key, err := clientHandshake(conn, r, n.cfg.Secret, n.cfg.NodeID, opDial)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := writeJSON(conn, key, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: r}, nil
+}
+
+// Nodes returns this node and alive peers with their devices
+func (n *Node) Nodes() []NodeInfo {
+	local := n.localState()
+	nodes := []NodeInfo{{
+		ID:       local.Node,
+		Addr:     local.Addr,
+		Self:     true,
+		LastSeen: time.Now(),
+		Devices:  local.Devices,
+	}}
+
+	n.mu.Lock()
+	for id, m := range n.members {
+		nodes = append(nodes, NodeInfo{
+			ID:       id,
+			Addr:     m.state.Addr,
+			LastSeen: m.seenAt,
+			Devices:  m.state.Devices,
+		})
+	}
+	n.mu.Unlock()
+
+	sort.Slice(nodes[1:], func(i, j int) bool { return nodes[i+1].ID < nodes[j+1].ID })
+	return nodes
+}
+
+// localState returns state announced to peers
+func (n *Node) localState() State {
+	state := State{
+		Node:    n.cfg.NodeID,
+		Devices: []DeviceState{},
+	}
+	for _, d := range n.registry.ListInfo() {
+		state.Devices = append(state.Devices, DeviceState{
+			ID:           d.ID,
+			RegisteredAt: d.RegisteredAt,
+			InSession:    d.InSession,
+		})
+	}
+	n.mu.Lock()
+	state.Addr = n.cfg.Advertise
+	for _, m := range n.members {
+		state.Peers = append(state.Peers, m.state.Addr)
+	}
+	n.mu.Unlock()
+	return state
+}
+
+// update stores peer state received over the link
+// Empty or unspecified host of the advertised address is replaced with the host the peer was reached at
+func (n *Node) update(state State, host string) {
+	if state.Node == "" || state.Node == n.cfg.NodeID {
+		return
+	}
+	if h, port, err := net.SplitHostPort(state.Addr); err == nil && (h == "" || net.ParseIP(h).IsUnspecified()) {
+		state.Addr = net.JoinHostPort(host, port)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.members[state.Node]; !ok {
+		log.Printf("[cluster] node %s joined (%s, %d devices)", state.Node, state.Addr, len(state.Devices))
+	}
+	n.members[state.Node] = &member{state: state, seenAt: time.Now()}
+}
+
+// expire removes peers not seen for three sync intervals
+func (n *Node) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, m := range n.members {
+		if time.Since(m.seenAt) > 3*n.cfg.Interval {
+			log.Printf("[cluster] node %s left (%d devices)", id, len(m.state.Devices))
+			delete(n.members, id)
+		}
+	}
+}
+
+// gossip syncs state with all known peers every interval
+func (n *Node) gossip(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, addr := range n.peerAddrs(ctx) {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				n.syncPeer(ctx, addr)
+			}(addr)
+		}
+		wg.Wait()
+		n.expire()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// peerAddrs returns addresses to sync with: static peers, DNS SRV records
+// and peers announced by known nodes, except addresses of this node
+func (n *Node) peerAddrs(ctx context.Context) []string {
+	addrs := append([]string(nil), n.cfg.Peers...)
+	if n.cfg.DNS != "" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", n.cfg.DNS)
+		if err != nil {
+			log.Printf("[cluster] SRV lookup %s: %v", n.cfg.DNS, err)
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, m := range n.members {
+		addrs = append(addrs, m.state.Addr)
+		addrs = append(addrs, m.state.Peers...)
+	}
+
+	seen := make(map[string]bool)
+	var result []string
+	for _, addr := range addrs {
+		if addr == "" || seen[addr] || n.self[addr] {
+			continue
+		}
+		seen[addr] = true
+		result = append(result, addr)
+	}
+	return result
+}
+
+// syncPeer exchanges state with a peer, sync errors are logged once until the peer recovers
+func (n *Node) syncPeer(ctx context.Context, addr string) {
+	err := n.sync(ctx, addr)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil && !n.failing[addr] {
+		log.Printf("[cluster] sync with %s: %v", addr, err)
+	}
+	n.failing[addr] = err != nil
+}
+
+// sync sends local state to a peer and stores the state it replies with
+func (n *Node) sync(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: linkTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(linkTimeout))
+
+	r := bufio.NewReader(conn)
+	peer, key, err := clientHandshake(conn, r, n.cfg.Secret, n.cfg.NodeID, opSync)
+	if err != nil {
+		return err
+	}
+	if peer == n.cfg.NodeID {
+		n.mu.Lock()
+		n.self[addr] = true
+		n.mu.Unlock()
+		return nil
+	}
+
+	if err := writeJSON(conn, key, n.localState()); err != nil {
+		return err
+	}
+	var state State
+	if err := readJSON(r, key, &state); err != nil {
+		return err
+	}
+	if state.Node != peer {
+		return fmt.Errorf("cluster: node %s sent state of %s", peer, state.Node)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	n.update(state, host)
+	return nil
+}
+
+// serve handles incoming inter-node link
+func (n *Node) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(linkTimeout))
+
+	r := bufio.NewReader(conn)
+	op, peer, key, err := serverHandshake(conn, r, n.cfg.Secret, n.cfg.NodeID)
+	if err != nil {
+		log.Printf("[cluster] %s: handshake: %v", remoteAddr, err)
+		return
+	}
+	if peer == n.cfg.NodeID {
+		// Own address found in peer list, the other side closes the link
+		return
+	}
+
+	switch op {
+	case opSync:
+		var state State
+		if err := readJSON(r, key, &state); err != nil {
+			log.Printf("[cluster] %s: read state of %s: %v", remoteAddr, peer, err)
+			return
+		}
+		if state.Node != peer {
+			log.Printf("[cluster] %s: node %s sent state of %s", remoteAddr, peer, state.Node)
+			return
+		}
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		n.update(state, host)
+		writeJSON(conn, key, n.localState())
+	case opDial:
+		var req DialRequest
+		if err := readJSON(r, key, &req); err != nil {
+			log.Printf("[cluster] %s: read dial request of %s: %v", remoteAddr, peer, err)
+			return
+		}
+		if n.onDial == nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		n.onDial(ctx, &Conn{bufferedConn: &bufferedConn{Conn: conn, reader: r}, Request: req, Node: peer})
+	default:
+		log.Printf("[cluster] %s: unknown operation %q from %s", remoteAddr, op, peer)
+	}
+}
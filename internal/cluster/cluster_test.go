@@ -0,0 +1,190 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// startNode starts a node on a random localhost port and waits until it listens
+func startNode(t *testing.T, ctx context.Context, cfg Config, registry *device.Registry) *Node {
+	t.Helper()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.Interval = 50 * time.Millisecond
+	node := NewNode(cfg, registry)
+	go node.Start(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for node.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("node did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return node
+}
+
+// waitFor polls condition until it holds or fails the test
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func registerDevice(t *testing.T, registry *device.Registry, id string) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	registry.Register(&device.Device{ID: id, Conn: a, RegisteredAt: time.Now()})
+}
+
+func TestClusterSyncAndDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	regA := device.NewRegistry()
+	registerDevice(t, regA, "meter1")
+	a := startNode(t, ctx, Config{NodeID: "a", Secret: "s3cret"}, regA)
+
+	forwarded := make(chan *Conn, 1)
+	a.SetDialHandler(func(_ context.Context, conn *Conn) {
+		forwarded <- conn
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("echo " + line))
+	})
+
+	b := startNode(t, ctx, Config{NodeID: "b", Secret: "s3cret", Peers: []string{a.Addr().String()}}, device.NewRegistry())
+
+	waitFor(t, "device location", func() bool {
+		_, _, ok := b.Locate("meter1")
+		return ok
+	})
+	node, addr, _ := b.Locate("meter1")
+	if node != "a" || addr != a.Addr().String() {
+		t.Fatalf("Locate = %s %s, want a %s", node, addr, a.Addr())
+	}
+	if _, _, ok := b.Locate("meter2"); ok {
+		t.Fatal("unknown device located")
+	}
+
+	// Node a learns b from incoming sync and detects its own address announced by b
+	waitFor(t, "membership", func() bool { return len(a.Nodes()) == 2 && len(b.Nodes()) == 2 })
+	waitFor(t, "self detection", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.self) > 0
+	})
+	if nodes := a.Nodes(); !nodes[0].Self || nodes[0].ID != "a" || nodes[1].ID != "b" || len(nodes[0].Devices) != 1 {
+		t.Fatalf("Nodes = %+v", nodes)
+	}
+
+	link, err := b.Dial(ctx, addr, &DialRequest{DeviceID: "meter1", ClientAddr: "192.0.2.1:5000", Skipped: []byte{0xFF, 0xFA}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer link.Close()
+	link.Write([]byte("ping\n"))
+	link.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := bufio.NewReader(link).ReadString('\n')
+	if err != nil || reply != "echo ping\n" {
+		t.Fatalf("reply = %q, %v", reply, err)
+	}
+
+	conn := <-forwarded
+	if conn.Node != "b" || conn.Request.DeviceID != "meter1" || string(conn.Request.Skipped) != "\xff\xfa" {
+		t.Errorf("forwarded = %s %+v", conn.Node, conn.Request)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:5000" {
+		t.Errorf("RemoteAddr = %s", conn.RemoteAddr())
+	}
+
+	// Link is closed when the dial handler returns
+	if _, err := link.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after handler return: %v", err)
+	}
+}
+
+func TestClusterAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	regA := device.NewRegistry()
+	registerDevice(t, regA, "meter1")
+	a := startNode(t, ctx, Config{NodeID: "a", Secret: "s3cret"}, regA)
+
+	intruder := NewNode(Config{NodeID: "x", Secret: "guess"}, device.NewRegistry())
+	if err := intruder.sync(ctx, a.Addr().String()); !errors.Is(err, ErrAuth) {
+		t.Fatalf("sync with wrong secret: %v", err)
+	}
+	if _, err := intruder.Dial(ctx, a.Addr().String(), &DialRequest{DeviceID: "meter1"}); !errors.Is(err, ErrAuth) {
+		t.Fatalf("dial with wrong secret: %v", err)
+	}
+	if len(a.Nodes()) != 1 {
+		t.Fatalf("intruder joined: %+v", a.Nodes())
+	}
+}
+
+func TestClusterSignedJSON(t *testing.T) {
+	var buf bytes.Buffer
+	conn := &writerConn{Writer: &buf}
+	if err := writeJSON(conn, "key", &DialRequest{DeviceID: "meter1"}); err != nil {
+		t.Fatalf("writeJSON: %v", err)
+	}
+	line := buf.String()
+
+	var req DialRequest
+	if err := readJSON(bufio.NewReader(strings.NewReader(line)), "key", &req); err != nil || req.DeviceID != "meter1" {
+		t.Fatalf("readJSON = %+v, %v", req, err)
+	}
+	// Key of another link
+	if err := readJSON(bufio.NewReader(strings.NewReader(line)), "other", &req); !errors.Is(err, ErrAuth) {
+		t.Errorf("readJSON with wrong key: %v", err)
+	}
+	// Request changed on the way
+	tampered := strings.Replace(line, "meter1", "meter2", 1)
+	if err := readJSON(bufio.NewReader(strings.NewReader(tampered)), "key", &req); !errors.Is(err, ErrAuth) {
+		t.Errorf("readJSON of tampered request: %v", err)
+	}
+}
+
+// writerConn is net.Conn writing to a buffer
+type writerConn struct {
+	net.Conn
+	io.Writer
+}
+
+func (c *writerConn) Write(p []byte) (int, error) { return c.Writer.Write(p) }
+
+func TestClusterLocateLatest(t *testing.T) {
+	n := NewNode(Config{NodeID: "self"}, device.NewRegistry())
+	now := time.Now()
+	n.update(State{Node: "a", Addr: ":7946", Devices: []DeviceState{{ID: "meter1", RegisteredAt: now.Add(-time.Minute)}}}, "10.0.0.1")
+	n.update(State{Node: "b", Addr: "0.0.0.0:7946", Devices: []DeviceState{{ID: "meter1", RegisteredAt: now}}}, "10.0.0.2")
+	n.update(State{Node: "self", Addr: ":7946", Devices: []DeviceState{{ID: "meter1", RegisteredAt: now.Add(time.Minute)}}}, "10.0.0.3")
+
+	node, addr, ok := n.Locate("meter1")
+	if !ok || node != "b" || addr != "10.0.0.2:7946" {
+		t.Fatalf("Locate = %s %s %v", node, addr, ok)
+	}
+
+	n.mu.Lock()
+	n.members["b"].seenAt = now.Add(-time.Hour)
+	n.mu.Unlock()
+	n.expire()
+	node, addr, ok = n.Locate("meter1")
+	if !ok || node != "a" || addr != "10.0.0.1:7946" {
+		t.Fatalf("Locate after expire = %s %s %v", node, addr, ok)
+	}
+}
@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Inter-node link protocol
+//
+//	server: RFC2217-CLUSTER/1 <server-nonce>
+//	client: <op> <client-node> <client-nonce> <hmac("client", op, client-node, server-nonce, client-nonce)>
+//	server: OK <server-node> <hmac("server", server-node, client-nonce, server-nonce)>
+//
+// followed by one JSON line of the operation: State for SYNC (answered with server State),
+// DialRequest for DIAL (followed by the client byte stream in both directions)
+// JSON lines are signed with the link key hmac("link", server-nonce, client-nonce): <hmac> <json>
+const (
+	linkGreeting = "RFC2217-CLUSTER/1"
+	linkTimeout  = 5 * time.Second
+
+	opSync = "SYNC" // exchange node states
+	opDial = "DIAL" // forward client connection
+)
+
+// ErrAuth is returned when the peer fails inter-node authentication
+var ErrAuth = errors.New("cluster: authentication failed")
+
+// DialRequest describes a client connection forwarded to the node holding the device
+// The client is authenticated by the forwarding node, the request carries no client token
+// Presets are the raw bytes the client sent before AT command
+type DialRequest struct {
+	DeviceID     string `json:"device_id"`
+	ClientAddr   string `json:"client_addr"` // original client address
+	Skipped      []byte `json:"skipped,omitempty"`
+	USRVCOM      []byte `json:"usrvcom,omitempty"`
+	USRSetting   []byte `json:"usr_setting,omitempty"`
+	Modem        bool   `json:"modem,omitempty"` // client dialed with ATD<number>
+	ModemVerbose bool   `json:"modem_verbose,omitempty"`
+	RFC2217      bool   `json:"rfc2217,omitempty"` // client speaks RFC2217 (WebSocket client)
+}
+
+// bufferedConn reads through the reader used for the handshake
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Conn is a client connection forwarded by another node
+// RemoteAddr returns the original client address
+type Conn struct {
+	*bufferedConn
+	Request DialRequest
+	Node    string // node that forwarded the connection
+}
+
+// RemoteAddr returns the address of the client connected to the forwarding node
+func (c *Conn) RemoteAddr() net.Addr {
+	return clientAddr(c.Request.ClientAddr)
+}
+
+// clientAddr is net.Addr of a client connected to another node
+type clientAddr string
+
+func (a clientAddr) Network() string { return "tcp" }
+func (a clientAddr) String() string  { return string(a) }
+
+// sign computes hex HMAC-SHA256 of handshake fields
+func sign(secret string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks handshake signature in constant time
+func verify(secret, signature string, fields ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(sign(secret, fields...)))
+}
+
+// newNonce returns random hex nonce
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// readLine reads a newline terminated line without the line ending
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writeJSON writes a value as one JSON line signed with the link key
+func writeJSON(conn net.Conn, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(conn, "%s %s\n", sign(key, string(data)), data)
+	return err
+}
+
+// readJSON reads one signed JSON line into a value
+// Returns ErrAuth if the signature doesn't match the link key
+func readJSON(r *bufio.Reader, key string, v any) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	mac, data, ok := strings.Cut(line, " ")
+	if !ok || !verify(key, mac, data) {
+		return ErrAuth
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+// clientHandshake authenticates an outgoing link and returns the peer node ID and the link key
+func clientHandshake(conn net.Conn, r *bufio.Reader, secret, node, op string) (peer, key string, err error) {
+	greeting, err := readLine(r)
+	if err != nil {
+		return "", "", err
+	}
+	proto, serverNonce, ok := strings.Cut(greeting, " ")
+	if !ok || proto != linkGreeting {
+		return "", "", fmt.Errorf("cluster: unexpected greeting %q", greeting)
+	}
+
+	clientNonce := newNonce()
+	mac := sign(secret, "client", op, node, serverNonce, clientNonce)
+	if _, err := fmt.Fprintf(conn, "%s %s %s %s\n", op, node, clientNonce, mac); err != nil {
+		return "", "", err
+	}
+
+	reply, err := readLine(r)
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(reply)
+	if len(fields) != 3 || fields[0] != "OK" {
+		return "", "", ErrAuth
+	}
+	peer = fields[1]
+	if !verify(secret, fields[2], "server", peer, clientNonce, serverNonce) {
+		return "", "", ErrAuth
+	}
+	return peer, sign(secret, "link", serverNonce, clientNonce), nil
+}
+
+// serverHandshake authenticates an incoming link and returns operation, peer node ID and the link key
+func serverHandshake(conn net.Conn, r *bufio.Reader, secret, node string) (op, peer, key string, err error) {
+	serverNonce := newNonce()
+	if _, err := fmt.Fprintf(conn, "%s %s\n", linkGreeting, serverNonce); err != nil {
+		return "", "", "", err
+	}
+
+	line, err := readLine(r)
+	if err != nil {
+		return "", "", "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		conn.Write([]byte("ERROR\n"))
+		return "", "", "", fmt.Errorf("cluster: malformed handshake %q", line)
+	}
+	op, peer, clientNonce := fields[0], fields[1], fields[2]
+	if !verify(secret, fields[3], "client", op, peer, serverNonce, clientNonce) {
+		conn.Write([]byte("ERROR\n"))
+		return "", "", "", ErrAuth
+	}
+
+	mac := sign(secret, "server", node, clientNonce, serverNonce)
+	if _, err := fmt.Fprintf(conn, "OK %s %s\n", node, mac); err != nil {
+		return "", "", "", err
+	}
+	return op, peer, sign(secret, "link", serverNonce, clientNonce), nil
+}
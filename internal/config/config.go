@@ -1,9 +1,17 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
 )
 
 type Config struct {
@@ -19,44 +27,441 @@ type Config struct {
 	Debug              bool
 	DebugHTTP          bool
 	ProxyProtocol      bool
+	SerialDialect      string            // Default serial control dialect for devices (rfc2217, usrvcom, none)
+	DeviceDialects     map[string]string // Per-device serial control dialect: DEVICE_ID -> dialect
+	IECAssist          bool              // IEC 62056-21 mode C speed switching for all devices
+	IECAssistDevices   []string          // Devices with IEC 62056-21 speed switching
+	Passthrough        bool              // Bridge all devices as is, without serial control translation
+	PassthroughDevices []string          // Devices bridged as is
+	ModbusPort         string            // Modbus TCP gateway port, empty disables gateway
+	ModbusUnits        map[string]string // Unit ID -> DEVICE_ID[:RTU_UNIT]
+	ModbusClients      map[string]string // Client IP -> DEVICE_ID[:RTU_UNIT]
+	ModbusTimeout      time.Duration     // RTU response timeout
+	ModbusPoll         []string          // Polled registers: DEVICE_ID:UNIT:TYPE:ADDRESS:COUNT
+	ModbusPollInterval time.Duration     // Register polling interval
+	ClusterNodeID      string            // Cluster node name, hostname if empty
+	ClusterPort        string            // Inter-node link port
+	ClusterAdvertise   string            // Inter-node address announced to peers, host defaults to source IP
+	ClusterPeers       []string          // Static peer addresses host:port
+	ClusterDNS         string            // DNS SRV name for peer discovery
+	ClusterSecret      string            // Shared secret for inter-node authentication
+	ClusterInterval    time.Duration     // Cluster state sync interval
+	DrainTimeout       time.Duration     // Max wait for active sessions on shutdown
+	DrainDelay         time.Duration     // Readiness withdrawal before listeners close
+	DrainNotice        string            // Line sent to devices before closing on drain, empty closes silently
+	DrainSpread        time.Duration     // Idle devices are released at random times within this window
+	ReadyMinDevices    int               // Not ready until this many devices are registered
+	ReadyMinPeers      int               // Not ready until this many cluster peers are known
+	ReadyMaxGoroutines int               // Not ready when goroutine count reaches this limit, 0 disables
+	ReadyFDHeadroom    int               // Not ready when less than this percent of open files limit is free
+	Listeners          []Listener        // Device and client listeners, one on Port if empty
+	// Session limits, per-device and per-client entries replace the defaults
+	DeviceLimits     SessionLimits            // every device
+	DeviceLimitsByID map[string]SessionLimits // DEVICE_ID -> limits
+	ClientLimits     SessionLimits            // every client IP
+	ClientLimitsByIP map[string]SessionLimits // client IP -> limits
+
+	path string                  // configuration file, empty if not used
+	live *atomic.Pointer[Config] // latest reloaded configuration, shared by all versions
+}
+
+// Listener describes a device and client listener
+type Listener struct {
+	Name          string   // unique name, also used for socket hand-over on upgrade
+	Address       string   // host:port, empty host listens on all interfaces
+	Roles         []string // allowed connections: device, client, modem or any
+	ProxyProtocol bool     // expect PROXY protocol header
+	TLS           bool     // TLS with TLSCert and TLSKey
+	TLSCert       string
+	TLSKey        string
+	MaxConns      int // open connections limit, 0 is unlimited
+}
+
+// SessionLimits restrict bridged traffic and duration of sessions, zero is unlimited
+// Traffic is counted in both directions
+type SessionLimits struct {
+	Rate         int64 // bytes per second
+	Burst        int64 // bytes passed at once above the rate, Rate if zero
+	SessionQuota int64 // bytes per session
+	DailyQuota   int64 // bytes per day, shared by sessions
+
+	// Session time
+	MaxDuration time.Duration // session length
+	DataTimeout time.Duration // time without payload data in both directions
+	WarnBefore  time.Duration // warning before MaxDuration or DataTimeout ends the session
+	Banner      string        // warning text to non-modem clients
+}
+
+// Listener roles
+const (
+	RoleDevice = "device" // device registration AT+REG
+	RoleClient = "client" // client connection AT+CONNECT
+	RoleModem  = "modem"  // client with modem emulation: AT commands and ATD<number>
+	RoleAny    = "any"
+)
+
+// ProxyListeners returns configured listeners or the default one on Port for all roles
+func (c *Config) ProxyListeners() []Listener {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []Listener{{
+		Name:          "proxy",
+		Address:       ":" + c.Port,
+		Roles:         []string{RoleAny},
+		ProxyProtocol: c.ProxyProtocol,
+	}}
+}
+
+// ClusterEnabled checks if cluster mode is configured
+func (c *Config) ClusterEnabled() bool {
+	return len(c.ClusterPeers) > 0 || c.ClusterDNS != ""
 }
 
-func Load() *Config {
+// DeviceDialect returns serial control dialect for a device
+func (c *Config) DeviceDialect(deviceID string) string {
+	if dialect, ok := c.DeviceDialects[deviceID]; ok {
+		return dialect
+	}
+	if c.SerialDialect != "" {
+		return c.SerialDialect
+	}
+	return "rfc2217"
+}
+
+// IECAssistEnabled checks if IEC 62056-21 speed switching is enabled for a device
+func (c *Config) IECAssistEnabled(deviceID string) bool {
+	if c.IECAssist {
+		return true
+	}
+	for _, id := range c.IECAssistDevices {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// PassthroughEnabled checks if device sessions are bridged as is
+// Serial control frames are not translated and the bridge may copy data in the kernel
+func (c *Config) PassthroughEnabled(deviceID string) bool {
+	if c.Passthrough {
+		return true
+	}
+	for _, id := range c.PassthroughDevices {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitsForDevice returns session limits of a device
+func (c *Config) LimitsForDevice(deviceID string) SessionLimits {
+	if l, ok := c.DeviceLimitsByID[deviceID]; ok {
+		return l
+	}
+	return c.DeviceLimits
+}
+
+// LimitsForClient returns session limits of a client IP
+func (c *Config) LimitsForClient(ip string) SessionLimits {
+	if l, ok := c.ClientLimitsByIP[ip]; ok {
+		return l
+	}
+	return c.ClientLimits
+}
+
+// Load reads configuration: defaults, then CONFIG_FILE (YAML or TOML), then environment variables
+func Load() (*Config, error) {
+	return load(os.Getenv("CONFIG_FILE"))
+}
+
+func load(path string) (*Config, error) {
+	c := defaults()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.path = path
+	c.live = new(atomic.Pointer[Config])
+	return c, nil
+}
+
+func defaults() *Config {
 	return &Config{
-		Port:        getEnv("PORT", "2217"),
-		APIPort:     getEnv("API_PORT", "8080"),
-		AuthToken:   getEnv("AUTH_TOKEN", ""),
-		WebUser:     getEnv("WEB_USER", "admin"),
-		WebPass:     getEnv("WEB_PASS", "admin"),
-		KeepAlive:   getDurationEnv("KEEPALIVE", 30*time.Second),
-		InitTimeout:        getDurationEnv("INIT_TIMEOUT", 5*time.Second),
-		PostConnectTimeout: getDurationEnv("POST_CONNECT_TIMEOUT", 60*time.Second),
-		IdleTimeout:        getDurationEnv("IDLE_TIMEOUT", 30*time.Second),
-		Debug:              getBoolEnv("DEBUG", false),
-		DebugHTTP:     getBoolEnv("DEBUG_HTTP", false),
-		ProxyProtocol: getBoolEnv("PROXY_PROTOCOL", false),
-	}
-}
-
-func getBoolEnv(key string, defaultVal bool) bool {
+		Port:               "2217",
+		APIPort:            "8080",
+		WebUser:            "admin",
+		WebPass:            "admin",
+		KeepAlive:          30 * time.Second,
+		InitTimeout:        5 * time.Second,
+		PostConnectTimeout: 60 * time.Second,
+		IdleTimeout:        30 * time.Second,
+		SerialDialect:      "rfc2217",
+		DeviceDialects:     map[string]string{},
+		ModbusUnits:        map[string]string{},
+		ModbusClients:      map[string]string{},
+		ModbusTimeout:      2 * time.Second,
+		ModbusPollInterval: 60 * time.Second,
+		ClusterPort:        "7946",
+		ClusterInterval:    2 * time.Second,
+		DrainTimeout:       30 * time.Second,
+		ReadyMaxGoroutines: 100000,
+		ReadyFDHeadroom:    10,
+	}
+}
+
+// loadEnv overrides values with environment variables that are set
+func (c *Config) loadEnv() error {
+	var e envReader
+	e.string(&c.Port, "PORT")
+	e.string(&c.APIPort, "API_PORT")
+	e.string(&c.AuthToken, "AUTH_TOKEN")
+	e.string(&c.WebUser, "WEB_USER")
+	e.string(&c.WebPass, "WEB_PASS")
+	e.duration(&c.KeepAlive, "KEEPALIVE")
+	e.duration(&c.InitTimeout, "INIT_TIMEOUT")
+	e.duration(&c.PostConnectTimeout, "POST_CONNECT_TIMEOUT")
+	e.duration(&c.IdleTimeout, "IDLE_TIMEOUT")
+	e.bool(&c.Debug, "DEBUG")
+	e.bool(&c.DebugHTTP, "DEBUG_HTTP")
+	e.bool(&c.ProxyProtocol, "PROXY_PROTOCOL")
+	e.string(&c.SerialDialect, "SERIAL_DIALECT")
+	e.stringMap(&c.DeviceDialects, "DEVICE_DIALECTS")
+	e.bool(&c.IECAssist, "IEC_ASSIST")
+	e.list(&c.IECAssistDevices, "IEC_ASSIST_DEVICES")
+	e.bool(&c.Passthrough, "PASSTHROUGH")
+	e.list(&c.PassthroughDevices, "PASSTHROUGH_DEVICES")
+	e.string(&c.ModbusPort, "MODBUS_PORT")
+	e.stringMap(&c.ModbusUnits, "MODBUS_UNITS")
+	e.stringMap(&c.ModbusClients, "MODBUS_CLIENTS")
+	e.duration(&c.ModbusTimeout, "MODBUS_TIMEOUT")
+	e.list(&c.ModbusPoll, "MODBUS_POLL")
+	e.duration(&c.ModbusPollInterval, "MODBUS_POLL_INTERVAL")
+	e.string(&c.ClusterNodeID, "CLUSTER_NODE_ID")
+	e.string(&c.ClusterPort, "CLUSTER_PORT")
+	e.string(&c.ClusterAdvertise, "CLUSTER_ADVERTISE")
+	e.list(&c.ClusterPeers, "CLUSTER_PEERS")
+	e.string(&c.ClusterDNS, "CLUSTER_DNS")
+	e.string(&c.ClusterSecret, "CLUSTER_SECRET")
+	e.duration(&c.ClusterInterval, "CLUSTER_INTERVAL")
+	e.duration(&c.DrainTimeout, "DRAIN_TIMEOUT")
+	e.duration(&c.DrainDelay, "DRAIN_DELAY")
+	e.string(&c.DrainNotice, "DRAIN_NOTICE")
+	e.duration(&c.DrainSpread, "DRAIN_SPREAD")
+	e.int(&c.ReadyMinDevices, "READY_MIN_DEVICES")
+	e.int(&c.ReadyMinPeers, "READY_MIN_PEERS")
+	e.int(&c.ReadyMaxGoroutines, "READY_MAX_GOROUTINES")
+	e.int(&c.ReadyFDHeadroom, "READY_FD_HEADROOM")
+	return errors.Join(e.errs...)
+}
+
+// Validate checks values and returns all problems found
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(validPort(c.Port), "PORT (listeners.port)", "invalid port %q", c.Port)
+	check(validPort(c.APIPort), "API_PORT (listeners.api_port)", "invalid port %q", c.APIPort)
+	check(c.ModbusPort == "" || validPort(c.ModbusPort), "MODBUS_PORT (listeners.modbus_port)", "invalid port %q", c.ModbusPort)
+	check(validPort(c.ClusterPort), "CLUSTER_PORT (listeners.cluster_port)", "invalid port %q", c.ClusterPort)
+
+	check(c.KeepAlive >= 0, "KEEPALIVE (timeouts.keepalive)", "negative duration %v", c.KeepAlive)
+	check(c.InitTimeout > 0, "INIT_TIMEOUT (timeouts.init)", "must be positive, got %v", c.InitTimeout)
+	check(c.PostConnectTimeout > 0, "POST_CONNECT_TIMEOUT (timeouts.post_connect)", "must be positive, got %v", c.PostConnectTimeout)
+	check(c.IdleTimeout >= 0, "IDLE_TIMEOUT (timeouts.idle)", "negative duration %v", c.IdleTimeout)
+	check(c.ModbusTimeout > 0, "MODBUS_TIMEOUT (modbus.timeout)", "must be positive, got %v", c.ModbusTimeout)
+	check(c.ModbusPollInterval > 0, "MODBUS_POLL_INTERVAL (modbus.poll_interval)", "must be positive, got %v", c.ModbusPollInterval)
+	check(c.ClusterInterval > 0, "CLUSTER_INTERVAL (cluster.interval)", "must be positive, got %v", c.ClusterInterval)
+	check(c.DrainTimeout >= 0, "DRAIN_TIMEOUT (drain.timeout)", "negative duration %v", c.DrainTimeout)
+	check(c.DrainDelay >= 0, "DRAIN_DELAY (drain.delay)", "negative duration %v", c.DrainDelay)
+	check(c.DrainSpread >= 0, "DRAIN_SPREAD (drain.spread)", "negative duration %v", c.DrainSpread)
+
+	check(device.ValidDialect(c.SerialDialect), "SERIAL_DIALECT (serial.dialect)", "unknown dialect %q (rfc2217, usrvcom, none)", c.SerialDialect)
+	for id, dialect := range c.DeviceDialects {
+		check(device.ValidDialect(dialect), "DEVICE_DIALECTS (devices)", "%s: unknown dialect %q (rfc2217, usrvcom, none)", id, dialect)
+	}
+
+	check(!c.ClusterEnabled() || c.ClusterSecret != "", "CLUSTER_SECRET (cluster.secret)", "required in cluster mode")
+
+	check(c.ReadyMinDevices >= 0, "READY_MIN_DEVICES (limits.ready_min_devices)", "negative value %d", c.ReadyMinDevices)
+	check(c.ReadyMinPeers >= 0, "READY_MIN_PEERS (limits.ready_min_peers)", "negative value %d", c.ReadyMinPeers)
+	check(c.ReadyMaxGoroutines >= 0, "READY_MAX_GOROUTINES (limits.ready_max_goroutines)", "negative value %d", c.ReadyMaxGoroutines)
+	check(c.ReadyFDHeadroom >= 0 && c.ReadyFDHeadroom <= 100, "READY_FD_HEADROOM (limits.ready_fd_headroom)", "must be 0..100, got %d", c.ReadyFDHeadroom)
+
+	names := make(map[string]bool)
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("listeners.proxy[%d]", i)
+		check(validName(l.Name), key, "invalid name %q, use letters, digits, - and _", l.Name)
+		check(!names[l.Name], key, "duplicate name %q", l.Name)
+		names[l.Name] = true
+		_, port, err := net.SplitHostPort(l.Address)
+		check(err == nil && validPort(port), key, "invalid address %q, use host:port or :port", l.Address)
+		for _, role := range l.Roles {
+			check(role == RoleDevice || role == RoleClient || role == RoleModem || role == RoleAny,
+				key, "unknown role %q (device, client, modem, any)", role)
+		}
+		check(!l.TLS || (l.TLSCert != "" && l.TLSKey != ""), key, "tls requires tls_cert and tls_key")
+		check(l.MaxConns >= 0, key, "negative max_conns %d", l.MaxConns)
+	}
+
+	checkLimits := func(key string, l SessionLimits) {
+		check(l.Rate >= 0 && l.Burst >= 0 && l.SessionQuota >= 0 && l.DailyQuota >= 0, key, "negative value")
+		check(l.MaxDuration >= 0 && l.DataTimeout >= 0 && l.WarnBefore >= 0, key, "negative duration")
+		check(l.Burst == 0 || l.Rate > 0, key, "burst requires rate")
+		check(l.WarnBefore == 0 || l.MaxDuration > 0 || l.DataTimeout > 0, key, "warn_before requires max_duration or data_timeout")
+	}
+	checkLimits("sessions.device", c.DeviceLimits)
+	checkLimits("sessions.client", c.ClientLimits)
+	for id, l := range c.DeviceLimitsByID {
+		checkLimits("sessions.devices."+id, l)
+	}
+	for ip, l := range c.ClientLimitsByIP {
+		check(net.ParseIP(ip) != nil, "sessions.clients", "invalid IP %q", ip)
+		checkLimits("sessions.clients."+ip, l)
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// validName checks listener name: it is passed in LISTEN_FDNAMES, so no colons
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// envReader overrides config values with environment variables that are set
+// and collects parse errors
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) string(dst *string, key string) {
 	if val := os.Getenv(key); val != "" {
-		return val == "1" || val == "true" || val == "yes"
+		*dst = val
 	}
-	return defaultVal
 }
 
-func getEnv(key, defaultVal string) string {
+// bool keeps the lenient env parsing: any value other than 1, true, yes, on is false
+func (e *envReader) bool(dst *bool, key string) {
 	if val := os.Getenv(key); val != "" {
-		return val
+		*dst = val == "1" || val == "true" || val == "yes" || val == "on"
 	}
-	return defaultVal
 }
 
-func getDurationEnv(key string, defaultVal time.Duration) time.Duration {
+func (e *envReader) int(dst *int, key string) {
 	if val := os.Getenv(key); val != "" {
-		if secs, err := strconv.Atoi(val); err == nil {
-			return time.Duration(secs) * time.Second
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid number %q", key, val))
+			return
+		}
+		*dst = n
+	}
+}
+
+// duration accepts integer seconds or Go duration: 30, 1m30s, 500ms
+func (e *envReader) duration(dst *time.Duration, key string) {
+	if val := os.Getenv(key); val != "" {
+		d, err := parseDuration(val)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", key, err))
+			return
+		}
+		*dst = d
+	}
+}
+
+func (e *envReader) stringMap(dst *map[string]string, key string) {
+	if os.Getenv(key) != "" {
+		*dst = getMapEnv(key)
+	}
+}
+
+func (e *envReader) list(dst *[]string, key string) {
+	if os.Getenv(key) != "" {
+		*dst = getListEnv(key)
+	}
+}
+
+// parseDuration parses integer seconds or Go duration
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, use seconds or 1m30s", s)
+	}
+	return d, nil
+}
+
+// parseSize parses byte count with optional k, M or G suffix (1024 based)
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := s
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, use bytes or 64k, 10M, 1G", s)
+	}
+	return n * mult, nil
+}
+
+// getMapEnv parses "key1=value1,key2=value2" list
+func getMapEnv(key string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if ok && k != "" {
+			result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return result
+}
+
+// getListEnv parses "value1,value2" list
+func getListEnv(key string) []string {
+	var result []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
 		}
 	}
-	return defaultVal
+	return result
 }
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes configuration file into a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Port != "2217" || cfg.APIPort != "8080" || cfg.InitTimeout != 5*time.Second || cfg.SerialDialect != "rfc2217" {
+		t.Errorf("defaults = %+v", cfg)
+	}
+	if cfg.Current() != cfg {
+		t.Error("Current of fresh config is another config")
+	}
+}
+
+func TestLoadEnvBool(t *testing.T) {
+	// Unknown values are false like before the config file, not a load error
+	t.Setenv("CONFIG_FILE", writeFile(t, "c.yaml", "listeners:\n  proxy_protocol: true\nlog:\n  debug: true\n"))
+	t.Setenv("DEBUG", "TRUE")
+	t.Setenv("PROXY_PROTOCOL", "maybe")
+	t.Setenv("PASSTHROUGH", "yes")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Debug || cfg.ProxyProtocol || !cfg.Passthrough {
+		t.Errorf("debug %v, proxy protocol %v, passthrough %v, want false, false, true", cfg.Debug, cfg.ProxyProtocol, cfg.Passthrough)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", `
+listeners:
+  port: 2300
+  modbus_port: 502
+auth:
+  token: secret
+timeouts:
+  init: 10
+  idle: 1m30s
+devices:
+  meter1:
+    dialect: usrvcom
+    iec_assist: true
+  "42":
+    iec_assist: true
+  logger:
+    passthrough: true
+modbus:
+  units:
+    1: meter1
+drain:
+  notice: AT+RECONNECT
+sessions:
+  device:
+    rate: 64k
+    daily_quota: 1G
+    max_duration: 1h
+    warn_before: 60
+    banner: SESSION ENDS
+  clients:
+    10.0.0.5:
+      session_quota: 10M
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("AUTH_TOKEN", "from-env")
+	t.Setenv("POST_CONNECT_TIMEOUT", "500ms")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Port != "2300" || cfg.ModbusPort != "502" || cfg.APIPort != "8080" {
+		t.Errorf("ports = %s %s %s", cfg.Port, cfg.ModbusPort, cfg.APIPort)
+	}
+	if cfg.AuthToken != "from-env" {
+		t.Errorf("AuthToken = %q, env must override file", cfg.AuthToken)
+	}
+	if cfg.InitTimeout != 10*time.Second || cfg.IdleTimeout != 90*time.Second || cfg.PostConnectTimeout != 500*time.Millisecond {
+		t.Errorf("timeouts = %v %v %v", cfg.InitTimeout, cfg.IdleTimeout, cfg.PostConnectTimeout)
+	}
+	if cfg.DeviceDialect("meter1") != "usrvcom" || cfg.DeviceDialect("42") != "rfc2217" {
+		t.Errorf("DeviceDialects = %v", cfg.DeviceDialects)
+	}
+	if !reflect.DeepEqual(cfg.IECAssistDevices, []string{"42", "meter1"}) {
+		t.Errorf("IECAssistDevices = %v", cfg.IECAssistDevices)
+	}
+	if !cfg.PassthroughEnabled("logger") || cfg.PassthroughEnabled("meter1") {
+		t.Errorf("PassthroughDevices = %v", cfg.PassthroughDevices)
+	}
+	if cfg.ModbusUnits["1"] != "meter1" || cfg.DrainNotice != "AT+RECONNECT" {
+		t.Errorf("ModbusUnits = %v, DrainNotice = %q", cfg.ModbusUnits, cfg.DrainNotice)
+	}
+	if l := cfg.LimitsForDevice("meter1"); l != (SessionLimits{Rate: 64 << 10, DailyQuota: 1 << 30,
+		MaxDuration: time.Hour, WarnBefore: time.Minute, Banner: "SESSION ENDS"}) {
+		t.Errorf("LimitsForDevice = %+v", l)
+	}
+	if cfg.LimitsForClient("10.0.0.5").SessionQuota != 10<<20 || cfg.LimitsForClient("10.0.0.6") != (SessionLimits{}) {
+		t.Errorf("ClientLimitsByIP = %+v", cfg.ClientLimitsByIP)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "proxy.toml", `
+[listeners]
+api_port = 9090
+
+[timeouts]
+init = "2s"
+keepalive = 15
+
+[devices.meter1]
+dialect = "none"
+
+[cluster]
+peers = ["10.0.0.2:7946"]
+secret = "s3cret"
+`)
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.APIPort != "9090" || cfg.InitTimeout != 2*time.Second || cfg.KeepAlive != 15*time.Second {
+		t.Errorf("cfg = %+v", cfg)
+	}
+	if cfg.DeviceDialect("meter1") != "none" || !cfg.ClusterEnabled() {
+		t.Errorf("DeviceDialects = %v, ClusterPeers = %v", cfg.DeviceDialects, cfg.ClusterPeers)
+	}
+}
+
+func TestProxyListeners(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", `
+listeners:
+  port: 2300
+  proxy:
+    - name: public
+      address: ":2217"
+      roles: [device]
+      proxy_protocol: true
+      max_conns: 5000
+    - name: internal
+      address: 10.0.0.1:2218
+      roles: [client, modem]
+    - name: any
+      address: ":2219"
+`)
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := []Listener{
+		{Name: "public", Address: ":2217", Roles: []string{RoleDevice}, ProxyProtocol: true, MaxConns: 5000},
+		{Name: "internal", Address: "10.0.0.1:2218", Roles: []string{RoleClient, RoleModem}},
+		{Name: "any", Address: ":2219", Roles: []string{RoleAny}},
+	}
+	if got := cfg.ProxyListeners(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProxyListeners = %+v", got)
+	}
+
+	// Without listeners the single port accepts any role
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("PROXY_PROTOCOL", "true")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want = []Listener{{Name: "proxy", Address: ":2217", Roles: []string{RoleAny}, ProxyProtocol: true}}
+	if got := cfg.ProxyListeners(); !reflect.DeepEqual(got, want) {
+		t.Errorf("default ProxyListeners = %+v", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{"unknown yaml key", "c.yaml", "listeners:\n  prot: 1\n", nil, []string{"field prot not found"}},
+		{"unknown toml key", "c.toml", "[auth]\ntokn = \"x\"\n", nil, []string{"unknown keys: auth.tokn"}},
+		{"bad duration", "c.yaml", "timeouts:\n  init: 5x\n", nil, []string{"line 2", `invalid duration "5x"`}},
+		{"unknown format", "c.json", "{}", nil, []string{`unknown format ".json"`}},
+		{"validation", "c.yaml", "serial:\n  dialect: foo\ndevices:\n  m1:\n    dialect: bar\n", map[string]string{"PORT": "0"},
+			[]string{`SERIAL_DIALECT (serial.dialect): unknown dialect "foo"`, `DEVICE_DIALECTS (devices): m1: unknown dialect "bar"`, `PORT (listeners.port): invalid port "0"`}},
+		{"cluster secret", "c.yaml", "cluster:\n  dns: _c._tcp.example\n", nil, []string{"CLUSTER_SECRET (cluster.secret): required"}},
+		{"listeners", "c.yaml", "listeners:\n  proxy:\n    - {name: a, address: \":2217\", roles: [device, printer]}\n    - {name: a, address: 2218, tls: true}\n    - {name: \"b:c\", address: \":2219\", max_conns: -1}\n", nil,
+			[]string{`listeners.proxy[0]: unknown role "printer"`, `listeners.proxy[1]: duplicate name "a"`, `listeners.proxy[1]: invalid address "2218"`,
+				"listeners.proxy[1]: tls requires tls_cert and tls_key", `listeners.proxy[2]: invalid name "b:c"`, "listeners.proxy[2]: negative max_conns -1"}},
+		{"sessions", "c.yaml", "sessions:\n  client:\n    burst: 1k\n  device:\n    warn_before: 30s\n  clients:\n    host1:\n      rate: 1k\n", nil,
+			[]string{"sessions.client: burst requires rate", "sessions.device: warn_before requires max_duration or data_timeout", `sessions.clients: invalid IP "host1"`}},
+		{"bad size", "c.toml", "[sessions.device]\nrate = \"10x\"\n", nil, []string{`invalid size "10x"`}},
+		{"bad env", "c.yaml", "", map[string]string{"IDLE_TIMEOUT": "soon"}, []string{`IDLE_TIMEOUT: invalid duration "soon"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", writeFile(t, tt.file, tt.content))
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := Load()
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", "auth:\n  token: old\nlisteners:\n  port: 2217\n")
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	os.WriteFile(path, []byte("auth:\n  token: new\nlisteners:\n  port: 2300\ntimeouts:\n  idle: 10\n"), 0o600)
+	applied, restart, err := cfg.Reload()
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []string{"AuthToken", "IdleTimeout"}) || !reflect.DeepEqual(restart, []string{"Port"}) {
+		t.Errorf("applied = %v, restart = %v", applied, restart)
+	}
+	cur := cfg.Current()
+	if cur.AuthToken != "new" || cur.IdleTimeout != 10*time.Second || cur.Port != "2217" {
+		t.Errorf("Current = %+v", cur)
+	}
+	if cfg.AuthToken != "old" {
+		t.Error("loaded config changed in place")
+	}
+	if cur.Current() != cur {
+		t.Error("reloaded config does not share current version")
+	}
+
+	// Invalid file keeps current configuration
+	os.WriteFile(path, []byte("auth:\n  token: [\n"), 0o600)
+	if _, _, err := cfg.Reload(); err == nil {
+		t.Fatal("Reload of invalid file succeeded")
+	}
+	if cfg.Current() != cur {
+		t.Error("failed reload replaced configuration")
+	}
+}
@@ -0,0 +1,429 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the layout of the configuration file, all sections are optional
+type fileConfig struct {
+	Listeners fileListeners         `yaml:"listeners" toml:"listeners"`
+	Auth      fileAuth              `yaml:"auth" toml:"auth"`
+	Timeouts  fileTimeouts          `yaml:"timeouts" toml:"timeouts"`
+	Log       fileLog               `yaml:"log" toml:"log"`
+	Serial    fileSerial            `yaml:"serial" toml:"serial"`
+	Devices   map[string]fileDevice `yaml:"devices" toml:"devices"`
+	Modbus    fileModbus            `yaml:"modbus" toml:"modbus"`
+	Cluster   fileCluster           `yaml:"cluster" toml:"cluster"`
+	Drain     fileDrain             `yaml:"drain" toml:"drain"`
+	Limits    fileLimits            `yaml:"limits" toml:"limits"`
+	Sessions  fileSessions          `yaml:"sessions" toml:"sessions"`
+}
+
+type fileListeners struct {
+	Port          int            `yaml:"port" toml:"port"`
+	APIPort       int            `yaml:"api_port" toml:"api_port"`
+	ModbusPort    int            `yaml:"modbus_port" toml:"modbus_port"` // 0 disables the gateway
+	ClusterPort   int            `yaml:"cluster_port" toml:"cluster_port"`
+	ProxyProtocol bool           `yaml:"proxy_protocol" toml:"proxy_protocol"`
+	Proxy         []fileListener `yaml:"proxy" toml:"proxy"` // replaces port and proxy_protocol
+}
+
+// fileListener is a device and client listener
+type fileListener struct {
+	Name          string   `yaml:"name" toml:"name"`
+	Address       string   `yaml:"address" toml:"address"`
+	Roles         []string `yaml:"roles" toml:"roles"`
+	ProxyProtocol bool     `yaml:"proxy_protocol" toml:"proxy_protocol"`
+	TLS           bool     `yaml:"tls" toml:"tls"`
+	TLSCert       string   `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey        string   `yaml:"tls_key" toml:"tls_key"`
+	MaxConns      int      `yaml:"max_conns" toml:"max_conns"`
+}
+
+type fileAuth struct {
+	Token   string `yaml:"token" toml:"token"`
+	WebUser string `yaml:"web_user" toml:"web_user"`
+	WebPass string `yaml:"web_pass" toml:"web_pass"`
+}
+
+type fileTimeouts struct {
+	KeepAlive   Duration `yaml:"keepalive" toml:"keepalive"`
+	Init        Duration `yaml:"init" toml:"init"`
+	PostConnect Duration `yaml:"post_connect" toml:"post_connect"`
+	Idle        Duration `yaml:"idle" toml:"idle"`
+}
+
+type fileLog struct {
+	Debug     bool `yaml:"debug" toml:"debug"`
+	DebugHTTP bool `yaml:"debug_http" toml:"debug_http"`
+}
+
+type fileSerial struct {
+	Dialect     string `yaml:"dialect" toml:"dialect"`
+	IECAssist   bool   `yaml:"iec_assist" toml:"iec_assist"`
+	Passthrough bool   `yaml:"passthrough" toml:"passthrough"`
+}
+
+// fileDevice is a per-device profile
+type fileDevice struct {
+	Dialect     string `yaml:"dialect" toml:"dialect"`
+	IECAssist   bool   `yaml:"iec_assist" toml:"iec_assist"`
+	Passthrough bool   `yaml:"passthrough" toml:"passthrough"`
+}
+
+type fileModbus struct {
+	Units        map[string]string `yaml:"units" toml:"units"`
+	Clients      map[string]string `yaml:"clients" toml:"clients"`
+	Timeout      Duration          `yaml:"timeout" toml:"timeout"`
+	Poll         []string          `yaml:"poll" toml:"poll"`
+	PollInterval Duration          `yaml:"poll_interval" toml:"poll_interval"`
+}
+
+type fileCluster struct {
+	NodeID    string   `yaml:"node_id" toml:"node_id"`
+	Advertise string   `yaml:"advertise" toml:"advertise"`
+	Peers     []string `yaml:"peers" toml:"peers"`
+	DNS       string   `yaml:"dns" toml:"dns"`
+	Secret    string   `yaml:"secret" toml:"secret"`
+	Interval  Duration `yaml:"interval" toml:"interval"`
+}
+
+type fileDrain struct {
+	Delay   Duration `yaml:"delay" toml:"delay"`
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+	Notice  string   `yaml:"notice" toml:"notice"`
+	Spread  Duration `yaml:"spread" toml:"spread"`
+}
+
+type fileLimits struct {
+	ReadyMinDevices    int `yaml:"ready_min_devices" toml:"ready_min_devices"`
+	ReadyMinPeers      int `yaml:"ready_min_peers" toml:"ready_min_peers"`
+	ReadyMaxGoroutines int `yaml:"ready_max_goroutines" toml:"ready_max_goroutines"`
+	ReadyFDHeadroom    int `yaml:"ready_fd_headroom" toml:"ready_fd_headroom"`
+}
+
+// fileSessions are session limits of devices and clients
+type fileSessions struct {
+	Device  fileSessionLimits            `yaml:"device" toml:"device"`
+	Client  fileSessionLimits            `yaml:"client" toml:"client"`
+	Devices map[string]fileSessionLimits `yaml:"devices" toml:"devices"`
+	Clients map[string]fileSessionLimits `yaml:"clients" toml:"clients"` // by client IP
+}
+
+type fileSessionLimits struct {
+	Rate         Size `yaml:"rate" toml:"rate"`
+	Burst        Size `yaml:"burst" toml:"burst"`
+	SessionQuota Size `yaml:"session_quota" toml:"session_quota"`
+	DailyQuota   Size `yaml:"daily_quota" toml:"daily_quota"`
+
+	MaxDuration Duration `yaml:"max_duration" toml:"max_duration"`
+	DataTimeout Duration `yaml:"data_timeout" toml:"data_timeout"`
+	WarnBefore  Duration `yaml:"warn_before" toml:"warn_before"`
+	Banner      string   `yaml:"banner" toml:"banner"`
+}
+
+func toFileLimits(l SessionLimits) fileSessionLimits {
+	return fileSessionLimits{Rate: Size(l.Rate), Burst: Size(l.Burst), SessionQuota: Size(l.SessionQuota), DailyQuota: Size(l.DailyQuota),
+		MaxDuration: Duration(l.MaxDuration), DataTimeout: Duration(l.DataTimeout), WarnBefore: Duration(l.WarnBefore), Banner: l.Banner}
+}
+
+func (l fileSessionLimits) limits() SessionLimits {
+	return SessionLimits{Rate: int64(l.Rate), Burst: int64(l.Burst), SessionQuota: int64(l.SessionQuota), DailyQuota: int64(l.DailyQuota),
+		MaxDuration: time.Duration(l.MaxDuration), DataTimeout: time.Duration(l.DataTimeout), WarnBefore: time.Duration(l.WarnBefore), Banner: l.Banner}
+}
+
+// Size is a byte count in the configuration file: integer or string with k, M or G suffix
+type Size int64
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *Size) UnmarshalYAML(node *yaml.Node) error {
+	v, err := parseSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*s = Size(v)
+	return nil
+}
+
+// UnmarshalTOML implements toml.Unmarshaler
+func (s *Size) UnmarshalTOML(value any) error {
+	switch v := value.(type) {
+	case int64:
+		if v >= 0 {
+			*s = Size(v)
+			return nil
+		}
+	case string:
+		parsed, err := parseSize(v)
+		if err != nil {
+			return err
+		}
+		*s = Size(parsed)
+		return nil
+	}
+	return fmt.Errorf("invalid size %v, use bytes or \"64k\", \"10M\", \"1G\"", value)
+}
+
+// Duration is a duration in the configuration file: integer seconds or Go duration string
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	v, err := parseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalTOML implements toml.Unmarshaler
+func (d *Duration) UnmarshalTOML(value any) error {
+	switch v := value.(type) {
+	case int64:
+		*d = Duration(time.Duration(v) * time.Second)
+		return nil
+	case string:
+		parsed, err := parseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	return fmt.Errorf("invalid duration %v, use seconds or \"1m30s\"", value)
+}
+
+// loadFile overrides values with the YAML or TOML file, format is chosen by extension
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	// Values absent in the file keep current ones
+	f := toFile(c)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), &f)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("config file %s: unknown format %q, use .yaml, .yml or .toml", path, ext)
+	}
+	f.apply(c)
+	return nil
+}
+
+// toFile returns file layout filled with current values
+func toFile(c *Config) fileConfig {
+	f := fileConfig{
+		Listeners: fileListeners{
+			Port:          atoi(c.Port),
+			APIPort:       atoi(c.APIPort),
+			ModbusPort:    atoi(c.ModbusPort),
+			ClusterPort:   atoi(c.ClusterPort),
+			ProxyProtocol: c.ProxyProtocol,
+			Proxy:         make([]fileListener, len(c.Listeners)),
+		},
+		Auth: fileAuth{Token: c.AuthToken, WebUser: c.WebUser, WebPass: c.WebPass},
+		Timeouts: fileTimeouts{
+			KeepAlive:   Duration(c.KeepAlive),
+			Init:        Duration(c.InitTimeout),
+			PostConnect: Duration(c.PostConnectTimeout),
+			Idle:        Duration(c.IdleTimeout),
+		},
+		Log:     fileLog{Debug: c.Debug, DebugHTTP: c.DebugHTTP},
+		Serial:  fileSerial{Dialect: c.SerialDialect, IECAssist: c.IECAssist, Passthrough: c.Passthrough},
+		Devices: map[string]fileDevice{},
+		Modbus: fileModbus{
+			Units:        c.ModbusUnits,
+			Clients:      c.ModbusClients,
+			Timeout:      Duration(c.ModbusTimeout),
+			Poll:         c.ModbusPoll,
+			PollInterval: Duration(c.ModbusPollInterval),
+		},
+		Cluster: fileCluster{
+			NodeID:    c.ClusterNodeID,
+			Advertise: c.ClusterAdvertise,
+			Peers:     c.ClusterPeers,
+			DNS:       c.ClusterDNS,
+			Secret:    c.ClusterSecret,
+			Interval:  Duration(c.ClusterInterval),
+		},
+		Drain: fileDrain{
+			Delay:   Duration(c.DrainDelay),
+			Timeout: Duration(c.DrainTimeout),
+			Notice:  c.DrainNotice,
+			Spread:  Duration(c.DrainSpread),
+		},
+		Limits: fileLimits{
+			ReadyMinDevices:    c.ReadyMinDevices,
+			ReadyMinPeers:      c.ReadyMinPeers,
+			ReadyMaxGoroutines: c.ReadyMaxGoroutines,
+			ReadyFDHeadroom:    c.ReadyFDHeadroom,
+		},
+	}
+	for i, l := range c.Listeners {
+		f.Listeners.Proxy[i] = fileListener(l)
+	}
+	f.Sessions = fileSessions{
+		Device:  toFileLimits(c.DeviceLimits),
+		Client:  toFileLimits(c.ClientLimits),
+		Devices: map[string]fileSessionLimits{},
+		Clients: map[string]fileSessionLimits{},
+	}
+	for id, l := range c.DeviceLimitsByID {
+		f.Sessions.Devices[id] = toFileLimits(l)
+	}
+	for ip, l := range c.ClientLimitsByIP {
+		f.Sessions.Clients[ip] = toFileLimits(l)
+	}
+	for id, dialect := range c.DeviceDialects {
+		f.Devices[id] = fileDevice{Dialect: dialect}
+	}
+	for _, id := range c.IECAssistDevices {
+		dev := f.Devices[id]
+		dev.IECAssist = true
+		f.Devices[id] = dev
+	}
+	for _, id := range c.PassthroughDevices {
+		dev := f.Devices[id]
+		dev.Passthrough = true
+		f.Devices[id] = dev
+	}
+	return f
+}
+
+// apply copies file values to the config
+func (f *fileConfig) apply(c *Config) {
+	c.Port = itoa(f.Listeners.Port)
+	c.APIPort = itoa(f.Listeners.APIPort)
+	c.ModbusPort = itoa(f.Listeners.ModbusPort)
+	c.ClusterPort = itoa(f.Listeners.ClusterPort)
+	c.ProxyProtocol = f.Listeners.ProxyProtocol
+	c.Listeners = nil
+	for _, l := range f.Listeners.Proxy {
+		if len(l.Roles) == 0 {
+			l.Roles = []string{RoleAny}
+		}
+		c.Listeners = append(c.Listeners, Listener(l))
+	}
+
+	c.AuthToken = f.Auth.Token
+	c.WebUser = f.Auth.WebUser
+	c.WebPass = f.Auth.WebPass
+
+	c.KeepAlive = time.Duration(f.Timeouts.KeepAlive)
+	c.InitTimeout = time.Duration(f.Timeouts.Init)
+	c.PostConnectTimeout = time.Duration(f.Timeouts.PostConnect)
+	c.IdleTimeout = time.Duration(f.Timeouts.Idle)
+
+	c.Debug = f.Log.Debug
+	c.DebugHTTP = f.Log.DebugHTTP
+
+	c.SerialDialect = f.Serial.Dialect
+	c.IECAssist = f.Serial.IECAssist
+	c.Passthrough = f.Serial.Passthrough
+	c.DeviceDialects = map[string]string{}
+	c.IECAssistDevices = nil
+	c.PassthroughDevices = nil
+	ids := make([]string, 0, len(f.Devices))
+	for id := range f.Devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		dev := f.Devices[id]
+		if dev.Dialect != "" {
+			c.DeviceDialects[id] = dev.Dialect
+		}
+		if dev.IECAssist {
+			c.IECAssistDevices = append(c.IECAssistDevices, id)
+		}
+		if dev.Passthrough {
+			c.PassthroughDevices = append(c.PassthroughDevices, id)
+		}
+	}
+
+	c.ModbusUnits = orEmpty(f.Modbus.Units)
+	c.ModbusClients = orEmpty(f.Modbus.Clients)
+	c.ModbusTimeout = time.Duration(f.Modbus.Timeout)
+	c.ModbusPoll = f.Modbus.Poll
+	c.ModbusPollInterval = time.Duration(f.Modbus.PollInterval)
+
+	c.ClusterNodeID = f.Cluster.NodeID
+	c.ClusterAdvertise = f.Cluster.Advertise
+	c.ClusterPeers = f.Cluster.Peers
+	c.ClusterDNS = f.Cluster.DNS
+	c.ClusterSecret = f.Cluster.Secret
+	c.ClusterInterval = time.Duration(f.Cluster.Interval)
+
+	c.DrainDelay = time.Duration(f.Drain.Delay)
+	c.DrainTimeout = time.Duration(f.Drain.Timeout)
+	c.DrainNotice = f.Drain.Notice
+	c.DrainSpread = time.Duration(f.Drain.Spread)
+
+	c.ReadyMinDevices = f.Limits.ReadyMinDevices
+	c.ReadyMinPeers = f.Limits.ReadyMinPeers
+	c.ReadyMaxGoroutines = f.Limits.ReadyMaxGoroutines
+	c.ReadyFDHeadroom = f.Limits.ReadyFDHeadroom
+
+	c.DeviceLimits = f.Sessions.Device.limits()
+	c.ClientLimits = f.Sessions.Client.limits()
+	c.DeviceLimitsByID = map[string]SessionLimits{}
+	for id, l := range f.Sessions.Devices {
+		c.DeviceLimitsByID[id] = l.limits()
+	}
+	c.ClientLimitsByIP = map[string]SessionLimits{}
+	for ip, l := range f.Sessions.Clients {
+		c.ClientLimitsByIP[ip] = l.limits()
+	}
+}
+
+// atoi converts port to file value, empty port is 0
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// itoa converts file port value, 0 is empty port
+func itoa(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func orEmpty(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// reloadMu serializes reloads from signal and API
+var reloadMu sync.Mutex
+
+// restartFields can't change at runtime: listeners are bound and components are built once at startup
+var restartFields = map[string]bool{
+	"Port":               true,
+	"APIPort":            true,
+	"ProxyProtocol":      true,
+	"Listeners":          true,
+	"KeepAlive":          true,
+	"ModbusPort":         true,
+	"ModbusUnits":        true,
+	"ModbusClients":      true,
+	"ModbusTimeout":      true,
+	"ModbusPoll":         true,
+	"ModbusPollInterval": true,
+	"ClusterNodeID":      true,
+	"ClusterPort":        true,
+	"ClusterAdvertise":   true,
+	"ClusterPeers":       true,
+	"ClusterDNS":         true,
+	"ClusterSecret":      true,
+	"ClusterInterval":    true,
+	"ReadyMinDevices":    true,
+	"ReadyMinPeers":      true,
+	"ReadyMaxGoroutines": true,
+	"ReadyFDHeadroom":    true,
+}
+
+// Current returns the latest reloaded configuration
+// Values that may change on reload must be read through it
+func (c *Config) Current() *Config {
+	if c.live != nil {
+		if cur := c.live.Load(); cur != nil {
+			return cur
+		}
+	}
+	return c
+}
+
+// Path returns configuration file path, empty if the file is not used
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Reload reads configuration file and environment again and applies changed values
+// Returns names of applied fields and of changed fields that need restart and were kept
+func (c *Config) Reload() (applied, restart []string, err error) {
+	if c.live == nil {
+		return nil, nil, errors.New("configuration was not loaded with Load")
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := load(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cur := c.Current()
+
+	nv := reflect.ValueOf(next).Elem()
+	cv := reflect.ValueOf(cur).Elem()
+	t := nv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || reflect.DeepEqual(nv.Field(i).Interface(), cv.Field(i).Interface()) {
+			continue
+		}
+		if restartFields[field.Name] {
+			nv.Field(i).Set(cv.Field(i))
+			restart = append(restart, field.Name)
+			continue
+		}
+		applied = append(applied, field.Name)
+	}
+
+	next.live = c.live
+	c.live.Store(next)
+	return applied, restart, nil
+}
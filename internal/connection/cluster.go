@@ -0,0 +1,150 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
+)
+
+// SetCluster enables forwarding of clients to devices registered on other cluster nodes
+// and serves clients forwarded to this node
+func (h *Handler) SetCluster(node *cluster.Node) {
+	h.cluster = node
+	node.SetDialHandler(h.serveForwarded)
+}
+
+// forwardClient passes client connection to the cluster node holding the device
+// Returns false if the device is not known in the cluster or the node is unreachable
+func (h *Handler) forwardClient(ctx context.Context, conn net.Conn, reader *bufio.Reader, atCmd *ATCommand, deviceID, remoteAddr string, modem *ModemState) bool {
+	if h.cluster == nil {
+		return false
+	}
+	// Connection forwarded by another node is served locally only
+	if _, forwarded := conn.(*cluster.Conn); forwarded {
+		return false
+	}
+	node, addr, ok := h.cluster.Locate(deviceID)
+	if !ok {
+		return false
+	}
+
+	req := &cluster.DialRequest{
+		DeviceID:   deviceID,
+		ClientAddr: remoteAddr,
+		Skipped:    atCmd.Skipped,
+	}
+	if atCmd.USRVCOMCfg != nil {
+		req.USRVCOM = atCmd.USRVCOMCfg.RawData
+	}
+	if atCmd.USRSettingCfg != nil {
+		req.USRSetting = atCmd.USRSettingCfg.RawData
+	}
+	if modem != nil {
+		req.Modem = true
+		req.ModemVerbose = modem.Verbose
+	}
+
+	link, err := h.cluster.Dial(ctx, addr, req)
+	if err != nil {
+		log.Printf("[cluster] %s: forward to node %s (%s): %v", remoteAddr, node, addr, err)
+		return false
+	}
+	defer link.Close()
+	log.Printf("[client] %s: device %s is on node %s, forwarding", remoteAddr, deviceID, node)
+
+	// Node replies OK/ERROR and runs the session, bytes are passed unchanged both ways
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		io.Copy(link, reader)
+		link.Close()
+		close(done)
+	}()
+	io.Copy(conn, link)
+	conn.Close()
+	<-done
+
+	log.Printf("[client] %s: forwarded connection to device %s ended", remoteAddr, deviceID)
+	return true
+}
+
+// forwardWebSocket passes WebSocket client to the cluster node holding the device
+// The remote node sees an RFC2217 client, already authenticated by this node
+// Returns false if the device is not known in the cluster or the node is unreachable
+func (h *Handler) forwardWebSocket(ctx context.Context, conn *WSClientConn, deviceID, remoteAddr string) bool {
+	if h.cluster == nil {
+		return false
+	}
+	node, addr, ok := h.cluster.Locate(deviceID)
+	if !ok {
+		return false
+	}
+
+	link, err := h.cluster.Dial(ctx, addr, &cluster.DialRequest{
+		DeviceID:   deviceID,
+		ClientAddr: remoteAddr,
+		RFC2217:    true,
+	})
+	if err != nil {
+		log.Printf("[cluster] %s: forward to node %s (%s): %v", remoteAddr, node, addr, err)
+		return false
+	}
+	defer link.Close()
+
+	// Node replies OK/ERROR in place of the connected control message
+	reader := bufio.NewReader(link)
+	link.SetReadDeadline(time.Now().Add(h.cfg.Current().InitTimeout))
+	resp, err := reader.ReadString('\n')
+	link.SetReadDeadline(time.Time{})
+	if err != nil || strings.TrimSpace(resp) != "OK" {
+		log.Printf("[ws] %s: device %s on node %s rejected session", remoteAddr, deviceID, node)
+		conn.WriteControl(WSControl{Type: WSControlError, Error: "device is not available"})
+		return true
+	}
+	if err := conn.WriteControl(WSControl{Type: WSControlConnected, DeviceID: deviceID}); err != nil {
+		log.Printf("[ws] %s: write connected error: %v", remoteAddr, err)
+		return true
+	}
+	log.Printf("[ws] %s: device %s is on node %s, forwarding", remoteAddr, deviceID, node)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(link, conn)
+		link.Close()
+		close(done)
+	}()
+	io.Copy(conn, reader)
+	conn.Close()
+	<-done
+
+	log.Printf("[ws] %s: forwarded connection to device %s ended", remoteAddr, deviceID)
+	return true
+}
+
+// serveForwarded runs client connection forwarded by another node as if the client connected here
+// The client token was checked by the forwarding node, handleClient takes the device ID from the request
+func (h *Handler) serveForwarded(ctx context.Context, conn *cluster.Conn) {
+	req := conn.Request
+	log.Printf("[cluster] %s: client forwarded by node %s", req.ClientAddr, conn.Node)
+
+	atCmd := &ATCommand{Cmd: CmdConnect, Param: req.DeviceID, Skipped: req.Skipped, RFC2217: req.RFC2217}
+	if len(req.USRVCOM) > 0 {
+		atCmd.USRVCOMCfg = ParseUSRVCOM(req.USRVCOM)
+	}
+	if len(req.USRSetting) > 0 {
+		atCmd.USRSettingCfg = ParseUSRSetting(req.USRSetting)
+	}
+	var modem *ModemState
+	if req.Modem {
+		modem = NewModemState()
+		modem.Verbose = req.ModemVerbose
+	}
+
+	h.handleClient(ctx, conn, bufio.NewReader(conn), atCmd, req.ClientAddr, modem)
+}
@@ -0,0 +1,220 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// startClusterNode starts cluster node for the test environment
+func (e *testEnv) startClusterNode(t *testing.T, ctx context.Context, id string, peers ...string) *cluster.Node {
+	t.Helper()
+	node := cluster.NewNode(cluster.Config{
+		NodeID:   id,
+		Listen:   "127.0.0.1:0",
+		Peers:    peers,
+		Secret:   "s3cret",
+		Interval: 50 * time.Millisecond,
+	}, e.registry)
+	e.handler.SetCluster(node)
+	go node.Start(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for node.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("cluster node did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return node
+}
+
+func TestClusterForwardClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	envA := newTestEnv()
+	envB := newTestEnv()
+	devConn := envA.registerDevice(t, "device123")
+	nodeA := envA.startClusterNode(t, ctx, "a")
+	nodeB := envB.startClusterNode(t, ctx, "b", nodeA.Addr().String())
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, _, ok := nodeB.Locate("device123"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("device not announced to node b")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Client connects to node b, session runs on node a
+	client, server := createTCPPair(t)
+	done := runHandler(ctx, envB.handler, server)
+
+	sendCmd(t, client, "AT+CONNECT=device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+
+	sessions := envA.sessions.ListInfo()
+	if len(sessions) != 1 || sessions[0].ClientAddr != client.LocalAddr().String() {
+		t.Fatalf("sessions on node a: %+v", sessions)
+	}
+	if envB.sessions.Count() != 0 {
+		t.Fatal("session created on forwarding node")
+	}
+
+	client.Write([]byte("hello"))
+	if got := readUntilContains(t, devConn, "hello", 2*time.Second); got != "hello" {
+		t.Fatalf("device received %q", got)
+	}
+	devConn.Write([]byte("world"))
+	if got := readUntilContains(t, client, "world", 2*time.Second); got != "world" {
+		t.Fatalf("client received %q", got)
+	}
+
+	// Close both sides to end bridge on node a and forwarding on node b
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+	deadline = time.Now().Add(3 * time.Second)
+	for envA.sessions.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session on node a did not end")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClusterForwardAuthToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nodes have different AUTH_TOKEN, the client is checked by the node it connects to
+	envA := newTestEnvWithAuth("tokenA")
+	envB := newTestEnvWithAuth("tokenB")
+	devConn := envA.registerDevice(t, "device123")
+	nodeA := envA.startClusterNode(t, ctx, "a")
+	nodeB := envB.startClusterNode(t, ctx, "b", nodeA.Addr().String())
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, _, ok := nodeB.Locate("device123"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("device not announced to node b")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Token of the device node is not accepted by the forwarding node
+	client, server := createTCPPair(t)
+	done := runHandler(ctx, envB.handler, server)
+	sendCmd(t, client, "AT+CONNECT=tokenA+device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "ERROR\r\n" {
+		t.Fatalf("token of node a: expected ERROR, got %q", resp)
+	}
+	waitDone(t, done, 5*time.Second)
+	if envA.sessions.Count() != 0 {
+		t.Fatal("session created with token of another node")
+	}
+
+	client, server = createTCPPair(t)
+	done = runHandler(ctx, envB.handler, server)
+	sendCmd(t, client, "AT+CONNECT=tokenB+device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("token of node b: expected OK, got %q", resp)
+	}
+	if envA.sessions.Count() != 1 {
+		t.Fatalf("sessions on node a: %d, want 1", envA.sessions.Count())
+	}
+	client.Write([]byte("hello"))
+	if got := readUntilContains(t, devConn, "hello", 2*time.Second); got != "hello" {
+		t.Fatalf("device received %q", got)
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestClusterForwardUnknownDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	envA := newTestEnv()
+	envB := newTestEnv()
+	nodeA := envA.startClusterNode(t, ctx, "a")
+	envB.startClusterNode(t, ctx, "b", nodeA.Addr().String())
+
+	client, server := createTCPPair(t)
+	done := runHandler(ctx, envB.handler, server)
+
+	sendCmd(t, client, "AT+CONNECT=nodevice")
+	if resp := readResponse(t, client, 2*time.Second); resp != "ERROR\r\n" {
+		t.Fatalf("expected ERROR, got %q", resp)
+	}
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestClusterForwardWebSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Device node requires AUTH_TOKEN the forwarding node doesn't know
+	envA := newTestEnvWithAuth("tokenA")
+	envB := newTestEnv()
+	devConn := envA.registerDevice(t, "device123")
+	dev, _ := envA.registry.Get("device123")
+	dev.SetDialect(device.DialectUSRVCOM)
+	nodeA := envA.startClusterNode(t, ctx, "a")
+	nodeB := envB.startClusterNode(t, ctx, "b", nodeA.Addr().String())
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, _, ok := nodeB.Locate("device123"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("device not announced to node b")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// WebSocket client connects to node b, session runs on node a
+	ws := dialWebSocket(t, envB, "device123")
+	if ctl := readWSControl(t, ws); ctl.Type != WSControlConnected || ctl.DeviceID != "device123" {
+		t.Fatalf("first message = %+v, want connected", ctl)
+	}
+	if envA.sessions.Count() != 1 || envB.sessions.Count() != 0 {
+		t.Fatalf("sessions: node a %d, node b %d, want 1 and 0", envA.sessions.Count(), envB.sessions.Count())
+	}
+
+	// Node a knows the client speaks RFC2217: binary data passes unchanged to USR-VCOM device
+	ws.WriteMessage(websocket.BinaryMessage, []byte{0xFF, 0x01})
+	if got := readDevice(t, devConn); !bytes.Equal(got, []byte{0xFF, 0x01}) {
+		t.Errorf("device got %x, want ff01", got)
+	}
+	devConn.Write([]byte{0xFF, 0x02})
+	if got := readWSBinary(t, ws); !bytes.Equal(got, []byte{0xFF, 0x02}) {
+		t.Errorf("client got %x, want ff02", got)
+	}
+
+	ws.Close()
+	deadline = time.Now().Add(3 * time.Second)
+	for envA.sessions.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session on node a did not end")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
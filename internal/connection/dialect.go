@@ -0,0 +1,179 @@
+package connection
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// Default serial settings when nothing is known about the device port
+var defaultSerialProfile = device.SerialProfile{
+	BaudRate: 9600,
+	DataBits: 8,
+	Parity:   1, // NONE
+	StopBits: 1,
+}
+
+// PortSettings is a set of client port settings translated for the device dialect
+type PortSettings struct {
+	Profile     device.SerialProfile // resulting port settings
+	Changed     bool                 // true if any setting (not query) was received
+	ToDevice    []byte               // control data for the device in its dialect
+	ToClient    []byte               // RFC2217 replies generated by the proxy
+	Unsupported []RFC2217Command     // commands that can't be expressed in the device dialect
+}
+
+// PortSettingsCommands returns RFC2217 commands setting all port parameters of profile
+func PortSettingsCommands(profile device.SerialProfile) []RFC2217Command {
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, profile.BaudRate)
+	return []RFC2217Command{
+		{Command: SetBaudrate, Data: baud},
+		{Command: SetDatasize, Data: []byte{profile.DataBits}},
+		{Command: SetParity, Data: []byte{profile.Parity}},
+		{Command: SetStopsize, Data: []byte{profile.StopBits}},
+	}
+}
+
+// ApplyRFC2217Commands merges RFC2217 settings into profile
+// Queries (value 0) and non-setting commands leave profile unchanged
+func ApplyRFC2217Commands(profile device.SerialProfile, commands []RFC2217Command) (device.SerialProfile, bool) {
+	changed := false
+	for _, cmd := range commands {
+		if cmd.IsQuery() {
+			continue
+		}
+		switch cmd.Command {
+		case SetBaudrate:
+			if len(cmd.Data) >= 4 {
+				profile.BaudRate = binary.BigEndian.Uint32(cmd.Data[:4])
+				changed = true
+			}
+		case SetDatasize:
+			if len(cmd.Data) >= 1 && cmd.Data[0] >= 5 && cmd.Data[0] <= 8 {
+				profile.DataBits = cmd.Data[0]
+				changed = true
+			}
+		case SetParity:
+			if len(cmd.Data) >= 1 && cmd.Data[0] >= 1 && cmd.Data[0] <= 5 {
+				profile.Parity = cmd.Data[0]
+				changed = true
+			}
+		case SetStopsize:
+			if len(cmd.Data) >= 1 && cmd.Data[0] >= 1 && cmd.Data[0] <= 3 {
+				profile.StopBits = cmd.Data[0]
+				changed = true
+			}
+		}
+	}
+	return profile, changed
+}
+
+// isPortSetting checks if command is one of SET-BAUDRATE/DATASIZE/PARITY/STOPSIZE
+func isPortSetting(cmd RFC2217Command) bool {
+	switch cmd.Command {
+	case SetBaudrate, SetDatasize, SetParity, SetStopsize:
+		return true
+	}
+	return false
+}
+
+// BuildUSRVCOMPacket builds 8-byte USR-VCOM Baud Rate Sync packet from serial profile
+func BuildUSRVCOMPacket(profile device.SerialProfile) []byte {
+	parity := uint8(0)
+	if profile.Parity >= 1 {
+		parity = profile.Parity - 1 // RFC2217 1=NONE -> USR-VCOM 0=None
+	}
+	stopBits := uint8(1)
+	if profile.StopBits == 2 {
+		stopBits = 2
+	}
+	packet := make([]byte, USRVCOMPacketLen)
+	copy(packet, USRVCOMHeader)
+	packet[3] = byte(profile.BaudRate >> 16)
+	packet[4] = byte(profile.BaudRate >> 8)
+	packet[5] = byte(profile.BaudRate)
+	packet[6] = buildUSRSerialParam(profile.DataBits, parity, stopBits)
+	packet[7] = packet[3] + packet[4] + packet[5] + packet[6]
+	return packet
+}
+
+// BuildRFC2217Replies builds server replies (command + 100) for client commands
+// Queries are answered with the current value from profile
+func BuildRFC2217Replies(commands []RFC2217Command, profile device.SerialProfile) []byte {
+	var replies []byte
+	for _, cmd := range commands {
+		reply := RFC2217Command{Command: cmd.Command, Data: cmd.Data}
+		if cmd.IsQuery() {
+			switch cmd.Command {
+			case SetBaudrate:
+				reply.Data = make([]byte, 4)
+				binary.BigEndian.PutUint32(reply.Data, profile.BaudRate)
+			case SetDatasize:
+				reply.Data = []byte{profile.DataBits}
+			case SetParity:
+				reply.Data = []byte{profile.Parity}
+			case SetStopsize:
+				reply.Data = []byte{profile.StopBits}
+			}
+		}
+		replies = append(replies, reply.BuildResponse()...)
+	}
+	return replies
+}
+
+// TranslatePortSettings converts client port settings into the device dialect
+// current is the last known device profile (nil if unknown)
+// replyToClient requests proxy-generated RFC2217 replies when the device won't answer
+func TranslatePortSettings(dialect string, commands []RFC2217Command, rawRFC2217 []byte, current *device.SerialProfile, replyToClient bool) *PortSettings {
+	base := defaultSerialProfile
+	if current != nil {
+		base = *current
+	}
+
+	result := &PortSettings{}
+	result.Profile, result.Changed = ApplyRFC2217Commands(base, commands)
+
+	switch dialect {
+	case device.DialectUSRVCOM:
+		// Baud Rate Sync carries complete port settings in one packet
+		if result.Changed {
+			result.ToDevice = BuildUSRVCOMPacket(result.Profile)
+		}
+		for _, cmd := range commands {
+			if !isPortSetting(cmd) {
+				result.Unsupported = append(result.Unsupported, cmd)
+			}
+		}
+	case device.DialectNone:
+		result.Unsupported = commands
+	default:
+		// RFC2217 device answers itself
+		result.ToDevice = rawRFC2217
+		if len(result.ToDevice) == 0 {
+			result.ToDevice = BuildRFC2217Packet(commands)
+		}
+		replyToClient = false
+	}
+
+	if replyToClient && len(commands) > 0 {
+		result.ToClient = BuildRFC2217Replies(commands, result.Profile)
+	}
+	return result
+}
+
+// LogTranslation logs translated port settings
+func (p *PortSettings) LogTranslation(prefix, dialect string) {
+	if p.Changed {
+		log.Printf("%s: port settings %d %s -> %s device", prefix,
+			p.Profile.BaudRate, p.Profile.ModeString(), dialect)
+	}
+	if len(p.ToDevice) > 0 {
+		log.Printf("%s: %s control data for device: %s", prefix, dialect, hex.EncodeToString(p.ToDevice))
+	}
+	for _, cmd := range p.Unsupported {
+		log.Printf("%s: %s not supported by %s device, dropped", prefix, cmd.String(), dialect)
+	}
+}
@@ -0,0 +1,70 @@
+package connection
+
+import (
+	"bytes"
+	"testing"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+func TestBuildUSRVCOMPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile device.SerialProfile
+		want    string
+	}{
+		{"9600 8N1", device.SerialProfile{BaudRate: 9600, DataBits: 8, Parity: 1, StopBits: 1}, "8N1"},
+		{"2400 7E1", device.SerialProfile{BaudRate: 2400, DataBits: 7, Parity: 3, StopBits: 1}, "7E1"},
+		{"115200 8O2", device.SerialProfile{BaudRate: 115200, DataBits: 8, Parity: 2, StopBits: 2}, "8O2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ParseUSRVCOM(BuildUSRVCOMPacket(tt.profile))
+			if cfg == nil || !cfg.Valid {
+				t.Fatal("expected valid USR-VCOM packet")
+			}
+			if cfg.BaudRate != tt.profile.BaudRate || cfg.ModeString() != tt.want {
+				t.Errorf("got %d %s, want %d %s", cfg.BaudRate, cfg.ModeString(), tt.profile.BaudRate, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslatePortSettings(t *testing.T) {
+	commands := []RFC2217Command{
+		{Command: SetBaudrate, Data: []byte{0x00, 0x00, 0x4B, 0x00}},
+		{Command: SetControl, Data: []byte{8}},
+		{Command: SetParity, Data: []byte{0}}, // query
+	}
+	raw := BuildRFC2217Packet(commands)
+
+	rfc := TranslatePortSettings(device.DialectRFC2217, commands, raw, nil, true)
+	if !bytes.Equal(rfc.ToDevice, raw) || rfc.ToClient != nil {
+		t.Errorf("rfc2217: device %x client %x, want raw forward only", rfc.ToDevice, rfc.ToClient)
+	}
+
+	usr := TranslatePortSettings(device.DialectUSRVCOM, commands, raw, nil, true)
+	if usr.Profile.BaudRate != 19200 || usr.Profile.ModeString() != "8N1" {
+		t.Errorf("usrvcom profile = %d %s, want 19200 8N1", usr.Profile.BaudRate, usr.Profile.ModeString())
+	}
+	if cfg := ParseUSRVCOM(usr.ToDevice); cfg == nil || cfg.BaudRate != 19200 {
+		t.Errorf("usrvcom device data = %x", usr.ToDevice)
+	}
+	if len(usr.Unsupported) != 1 || usr.Unsupported[0].Command != SetControl {
+		t.Errorf("usrvcom unsupported = %+v, want SET-CONTROL", usr.Unsupported)
+	}
+	wantReplies := BuildRFC2217Packet([]RFC2217Command{
+		{Command: SetBaudrate + 100, Data: []byte{0x00, 0x00, 0x4B, 0x00}},
+		{Command: SetControl + 100, Data: []byte{8}},
+		{Command: SetParity + 100, Data: []byte{1}}, // answered from profile
+	})
+	if !bytes.Equal(usr.ToClient, wantReplies) {
+		t.Errorf("usrvcom replies =\n%x\nwant\n%x", usr.ToClient, wantReplies)
+	}
+
+	none := TranslatePortSettings(device.DialectNone, commands, raw, nil, false)
+	if none.ToDevice != nil || none.ToClient != nil || len(none.Unsupported) != len(commands) {
+		t.Errorf("none: %+v, want everything dropped", none)
+	}
+}
@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/drain"
+)
+
+// drainSessionID marks device taken by drain, so no session can start before it is closed
+const drainSessionID = "drain"
+
+// SetDrain sets drain controller: new clients and devices are rejected and
+// registered devices are released when servers stop accepting connections
+func (h *Handler) SetDrain(ctl *drain.Controller) {
+	h.drain = ctl
+}
+
+// releaseDevice waits until the device is idle, sends drain notice and closes it
+// Idle devices are released at random times within DRAIN_SPREAD to avoid a reconnect storm
+func (h *Handler) releaseDevice(ctx context.Context, dev *device.Device) {
+	if h.cfg.Current().DrainSpread > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(rand.Int63n(int64(h.cfg.Current().DrainSpread)))):
+		}
+	}
+
+	if dev.IsInSession() {
+		log.Printf("[device] %s: draining, waiting for session end", dev.ID)
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for !dev.TrySetSession(drainSessionID) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	if h.cfg.Current().DrainNotice != "" {
+		dev.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		// Connection of a device that was in session is already closed by the bridge
+		if _, err := dev.Conn.Write([]byte(h.cfg.Current().DrainNotice + "\r\n")); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("[device] %s: drain notice: %v", dev.ID, err)
+		}
+	}
+	log.Printf("[device] %s: released on drain", dev.ID)
+	dev.Close()
+}
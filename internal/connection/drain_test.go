@@ -0,0 +1,101 @@
+package connection
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/drain"
+)
+
+func TestDrainReleasesIdleDevice(t *testing.T) {
+	env := newTestEnv()
+	env.cfg.DrainNotice = "AT+RECONNECT"
+	ctl := drain.New()
+	env.handler.SetDrain(ctl)
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(context.Background(), env.handler, server)
+
+	expectExact(t, client, "AT+REG=device123", "OK\r\n")
+	expectExact(t, client, "ATDT", "OK\r\n")
+
+	ctl.Start(0)
+	resp := readUntilContains(t, client, "AT+RECONNECT\r\n", 3*time.Second)
+	if resp != "AT+RECONNECT\r\n" {
+		t.Fatalf("expected drain notice, got %q", resp)
+	}
+	waitDone(t, done, 3*time.Second)
+	if _, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("device connection not closed: %v", err)
+	}
+	if env.registry.Count() != 0 {
+		t.Error("device still registered")
+	}
+}
+
+func TestDrainWaitsForSession(t *testing.T) {
+	env := newTestEnv()
+	ctl := drain.New()
+	env.handler.SetDrain(ctl)
+
+	devClient, devServer := createTCPPair(t)
+	defer devClient.Close()
+	devDone := runHandler(context.Background(), env.handler, devServer)
+	expectExact(t, devClient, "AT+REG=device123", "OK\r\n")
+	expectExact(t, devClient, "ATDT", "OK\r\n")
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(context.Background(), env.handler, server)
+	expectExact(t, client, "AT+CONNECT=device123", "OK\r\n")
+
+	ctl.Start(0)
+	<-ctl.Done()
+
+	// Session keeps working while draining
+	client.Write([]byte("ping"))
+	if got := readUntilContains(t, devClient, "ping", 2*time.Second); got != "ping" {
+		t.Fatalf("device received %q", got)
+	}
+	select {
+	case <-devDone:
+		t.Fatal("device released during session")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// New sessions and registrations are rejected
+	other, otherServer := createTCPPair(t)
+	defer other.Close()
+	otherDone := runHandler(context.Background(), env.handler, otherServer)
+	expectExact(t, other, "AT+REG=device456", "ERROR\r\n")
+	waitDone(t, otherDone, 3*time.Second)
+
+	sess, ok := env.sessions.GetByDevice("device123")
+	if !ok {
+		t.Fatal("session not found")
+	}
+	env.sessions.Terminate(sess.ID)
+	waitDone(t, done, 3*time.Second)
+	waitDone(t, devDone, 3*time.Second)
+	if env.registry.Count() != 0 {
+		t.Error("device still registered")
+	}
+}
+
+func TestDrainRejectsClient(t *testing.T) {
+	env := newTestEnv()
+	env.registerDevice(t, "device123")
+	ctl := drain.New()
+	env.handler.SetDrain(ctl)
+	ctl.Start(0)
+	<-ctl.Done()
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(context.Background(), env.handler, server)
+	expectExact(t, client, "AT+CONNECT=device123", "ERROR\r\n")
+	waitDone(t, done, 3*time.Second)
+}
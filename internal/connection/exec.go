@@ -0,0 +1,248 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/iec62056"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+// Response termination rules of one-shot transactions
+const (
+	ExecUntilTimeout   = "timeout"   // collect everything until timeout
+	ExecUntilLength    = "length"    // fixed number of bytes
+	ExecUntilDelimiter = "delimiter" // up to and including delimiter
+	ExecUntilModbus    = "modbus"    // Modbus RTU response to the request frame
+	ExecUntilIEC62056  = "iec62056"  // IEC 62056-21 message (ACK/NAK, "/...CRLF", STX...ETX BCC)
+)
+
+// Exec result reasons (besides termination rules)
+const (
+	ExecReasonIdle    = "idle"    // silence after the last received byte
+	ExecReasonTimeout = "timeout" // response timeout
+	ExecReasonFull    = "full"    // response size limit reached
+)
+
+const (
+	// ExecDefaultTimeout is the default response timeout
+	ExecDefaultTimeout = 2 * time.Second
+	// ExecMaxTimeout limits response timeout of one transaction
+	ExecMaxTimeout = 30 * time.Second
+	// ExecMaxResponse limits collected response size
+	ExecMaxResponse = 64 * 1024
+)
+
+// ExecSessionKind is the internal session kind of one-shot transactions
+const ExecSessionKind = "exec"
+
+// ExecOptions defines port settings and response termination of a transaction
+type ExecOptions struct {
+	Serial      *device.SerialProfile // port settings before the request, nil keeps current
+	Until       string                // termination rule, empty means timeout
+	Timeout     time.Duration         // response timeout
+	IdleTimeout time.Duration         // silence ending the response once data is received, 0 disables
+	Length      int                   // response length for "length"
+	Delimiter   []byte                // response end for "delimiter"
+}
+
+// ExecResult is the response of a transaction
+type ExecResult struct {
+	Data    []byte
+	Reason  string // termination rule that matched, "idle", "timeout" or "full"
+	Elapsed time.Duration
+}
+
+// Validate checks options and fills defaults
+func (o *ExecOptions) Validate() error {
+	if o.Until == "" {
+		o.Until = ExecUntilTimeout
+	}
+	switch o.Until {
+	case ExecUntilTimeout, ExecUntilModbus, ExecUntilIEC62056:
+	case ExecUntilLength:
+		if o.Length <= 0 || o.Length > ExecMaxResponse {
+			return fmt.Errorf("length must be 1..%d", ExecMaxResponse)
+		}
+	case ExecUntilDelimiter:
+		if len(o.Delimiter) == 0 {
+			return errors.New("delimiter required")
+		}
+	default:
+		return fmt.Errorf("unknown termination rule %q", o.Until)
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = ExecDefaultTimeout
+	}
+	if o.Timeout > ExecMaxTimeout {
+		return fmt.Errorf("timeout exceeds %v", ExecMaxTimeout)
+	}
+	if o.IdleTimeout < 0 {
+		return errors.New("negative idle timeout")
+	}
+	if p := o.Serial; p != nil {
+		if p.DataBits != 0 && (p.DataBits < 5 || p.DataBits > 8) {
+			return errors.New("invalid data_bits")
+		}
+		if p.Parity > 5 {
+			return errors.New("invalid parity")
+		}
+		if p.StopBits > 3 {
+			return errors.New("invalid stop_bits")
+		}
+	}
+	return nil
+}
+
+// Exec writes payload to the device and collects the response
+// The caller must hold the device in the session and read it through the session connection
+func Exec(sess *session.Session, dev *device.Device, payload []byte, opts ExecOptions) (*ExecResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	dialect := dev.Dialect()
+
+	var request []byte
+	if opts.Serial != nil {
+		request = append(request, execPortSettings(sess, dev, *opts.Serial)...)
+	}
+	if dialect == device.DialectRFC2217 {
+		request = append(request, rfc2217.Escape(payload)...)
+	} else {
+		request = append(request, payload...)
+	}
+
+	conn := sess.DeviceConn
+	conn.SetWriteDeadline(time.Now().Add(opts.Timeout))
+	_, err := conn.Write(request)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("exec: write: %w", err)
+	}
+	atomic.AddInt64(&sess.BytesIn, int64(len(request)))
+
+	data, reason, err := execRead(conn, dialect, payload, opts)
+	atomic.AddInt64(&sess.BytesOut, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	return &ExecResult{Data: data, Reason: reason, Elapsed: time.Since(start)}, nil
+}
+
+// execPortSettings returns control data applying port settings in the device dialect
+// Zero fields keep current device settings
+func execPortSettings(sess *session.Session, dev *device.Device, serial device.SerialProfile) []byte {
+	profile := defaultSerialProfile
+	if current := dev.SerialProfile(); current != nil {
+		profile = *current
+	}
+	if serial.BaudRate != 0 {
+		profile.BaudRate = serial.BaudRate
+	}
+	if serial.DataBits != 0 {
+		profile.DataBits = serial.DataBits
+	}
+	if serial.Parity != 0 {
+		profile.Parity = serial.Parity
+	}
+	if serial.StopBits != 0 {
+		profile.StopBits = serial.StopBits
+	}
+
+	dialect := dev.Dialect()
+	result := TranslatePortSettings(dialect, PortSettingsCommands(profile), nil, dev.SerialProfile(), false)
+	result.LogTranslation("[exec] "+sess.ID, dialect)
+	recordPortSettings(sess, dev, result.Profile, ExecSessionKind)
+	return result.ToDevice
+}
+
+// execRead collects device response until termination rule matches
+// Telnet framing of RFC2217 devices (replies, NOP keepalives, escaped IAC) is removed
+func execRead(conn net.Conn, dialect string, request []byte, opts ExecOptions) ([]byte, string, error) {
+	deadline := time.Now().Add(opts.Timeout)
+	defer conn.SetReadDeadline(time.Time{})
+
+	var dec *rfc2217.Decoder
+	if dialect == device.DialectRFC2217 {
+		dec = &rfc2217.Decoder{}
+	}
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for {
+		readDeadline := deadline
+		idle := false
+		if opts.IdleTimeout > 0 && len(data) > 0 {
+			if t := time.Now().Add(opts.IdleTimeout); t.Before(deadline) {
+				readDeadline, idle = t, true
+			}
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if dec != nil {
+				for _, ev := range dec.Feed(buf[:n]) {
+					if ev.Type == rfc2217.EventData {
+						data = append(data, ev.Data...)
+					}
+				}
+			} else {
+				data = append(data, buf[:n]...)
+			}
+			if end := execResponseEnd(data, request, opts); end > 0 {
+				return data[:end], opts.Until, nil
+			}
+			if len(data) >= ExecMaxResponse {
+				return data[:ExecMaxResponse], ExecReasonFull, nil
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return data, "", fmt.Errorf("exec: read: %w", err)
+			}
+			if !time.Now().Before(deadline) {
+				return data, ExecReasonTimeout, nil
+			}
+			if idle {
+				return data, ExecReasonIdle, nil
+			}
+		}
+	}
+}
+
+// execResponseEnd returns response length if termination rule matched, 0 otherwise
+func execResponseEnd(data, request []byte, opts ExecOptions) int {
+	switch opts.Until {
+	case ExecUntilLength:
+		if len(data) >= opts.Length {
+			return opts.Length
+		}
+	case ExecUntilDelimiter:
+		if i := bytes.Index(data, opts.Delimiter); i >= 0 {
+			return i + len(opts.Delimiter)
+		}
+	case ExecUntilModbus:
+		// Request is an RTU frame: unit, PDU, CRC
+		if len(request) < modbus.MinRTULen {
+			return 0
+		}
+		if n := modbus.ResponseLen(request[1:len(request)-2], data); n > 0 && len(data) >= n {
+			return n
+		}
+	case ExecUntilIEC62056:
+		if n := iec62056.MessageLen(data); n > 0 {
+			return n
+		}
+	}
+	return 0
+}
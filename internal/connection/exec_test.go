@@ -0,0 +1,128 @@
+package connection
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+// execDevice creates device on a pipe and a handler answering each request with reply(request)
+func execDevice(t *testing.T, dialect string, reply func([]byte) []byte) (*session.Session, *device.Device, chan []byte) {
+	t.Helper()
+	proxySide, deviceSide := net.Pipe()
+	t.Cleanup(func() {
+		proxySide.Close()
+		deviceSide.Close()
+	})
+	dev := &device.Device{ID: "meter1", Conn: proxySide}
+	dev.SetDialect(dialect)
+	sess := &session.Session{ID: "sess_exec", DeviceID: dev.ID, DeviceConn: proxySide}
+
+	received := make(chan []byte, 4)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := deviceSide.Read(buf)
+			if err != nil {
+				return
+			}
+			req := append([]byte(nil), buf[:n]...)
+			received <- req
+			if resp := reply(req); resp != nil {
+				deviceSide.Write(resp)
+			}
+		}
+	}()
+	return sess, dev, received
+}
+
+func TestExecTerminationRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   ExecOptions
+		reply  []byte
+		want   []byte
+		reason string
+	}{
+		{"length", ExecOptions{Until: ExecUntilLength, Length: 3}, []byte("abcdef"), []byte("abc"), ExecUntilLength},
+		{"delimiter", ExecOptions{Until: ExecUntilDelimiter, Delimiter: []byte("\r\n")}, []byte("OK\r\nmore"), []byte("OK\r\n"), ExecUntilDelimiter},
+		{"iec62056", ExecOptions{Until: ExecUntilIEC62056}, []byte("/ISK5ME382\r\n"), []byte("/ISK5ME382\r\n"), ExecUntilIEC62056},
+		{"idle", ExecOptions{IdleTimeout: 50 * time.Millisecond}, []byte("xyz"), []byte("xyz"), ExecReasonIdle},
+		{"timeout", ExecOptions{Until: ExecUntilLength, Length: 10, Timeout: 100 * time.Millisecond}, []byte("xyz"), []byte("xyz"), ExecReasonTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, dev, _ := execDevice(t, device.DialectNone, func([]byte) []byte { return tt.reply })
+			result, err := Exec(sess, dev, []byte("req"), tt.opts)
+			if err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			if !bytes.Equal(result.Data, tt.want) || result.Reason != tt.reason {
+				t.Errorf("result = %q (%s), want %q (%s)", result.Data, result.Reason, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestExecModbus(t *testing.T) {
+	request := modbus.BuildRTUFrame(1, []byte{modbus.FuncReadHoldingRegisters, 0, 0, 0, 1})
+	response := modbus.BuildRTUFrame(1, []byte{modbus.FuncReadHoldingRegisters, 2, 0x12, 0x34})
+
+	sess, dev, _ := execDevice(t, device.DialectNone, func([]byte) []byte {
+		return append(append([]byte(nil), response...), 0xAA) // trailing garbage is not collected
+	})
+	result, err := Exec(sess, dev, request, ExecOptions{Until: ExecUntilModbus})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if !bytes.Equal(result.Data, response) || result.Reason != ExecUntilModbus {
+		t.Errorf("result = %x (%s), want %x", result.Data, result.Reason, response)
+	}
+	if sess.BytesIn != int64(len(request)) {
+		t.Errorf("bytes in = %d, want %d", sess.BytesIn, len(request))
+	}
+}
+
+func TestExecRFC2217Device(t *testing.T) {
+	// Device escapes 0xFF, sends NOP keepalive and answers port settings
+	sess, dev, received := execDevice(t, device.DialectRFC2217, func([]byte) []byte {
+		return []byte{IAC, 0xF1, 0x01, IAC, IAC, 0x02, IAC, SB, ComPortOption, SetBaudrate + ServerResponseOffset, 0, 0, 0x4B, 0, IAC, SE}
+	})
+
+	serial := &device.SerialProfile{BaudRate: 19200}
+	result, err := Exec(sess, dev, []byte{0xFF, 0x10}, ExecOptions{Serial: serial, IdleTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	// Port settings and escaped payload are written together
+	req := <-received
+	if buf := ParseRFC2217Commands(req); len(buf.Commands) != 4 || !bytes.HasSuffix(req, []byte{IAC, SE, 0xFF, 0xFF, 0x10}) {
+		t.Errorf("device got %x, want 4 RFC2217 settings and escaped payload", req)
+	}
+	if !bytes.Equal(result.Data, []byte{0x01, 0xFF, 0x02}) {
+		t.Errorf("result = %x, want 01ff02", result.Data)
+	}
+	if profile := dev.SerialProfile(); profile == nil || profile.BaudRate != 19200 || profile.ModeString() != "8N1" {
+		t.Errorf("profile = %+v", profile)
+	}
+}
+
+func TestExecOptionsValidate(t *testing.T) {
+	for _, opts := range []ExecOptions{
+		{Until: "unknown"},
+		{Until: ExecUntilLength},
+		{Until: ExecUntilDelimiter},
+		{Timeout: time.Minute},
+		{Serial: &device.SerialProfile{DataBits: 9}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", opts)
+		}
+	}
+}
@@ -2,15 +2,20 @@ package connection
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"io"
 	"log"
 	"net"
 	"strings"
 	"time"
 
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/drain"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/wheel"
 )
 
 // Handler handles all connections (devices and clients)
@@ -18,6 +23,9 @@ type Handler struct {
 	cfg      *config.Config
 	registry *device.Registry
 	sessions *session.Manager
+	cluster  *cluster.Node     // nil if cluster mode is disabled
+	drain    *drain.Controller // nil if drain is not used
+	wheel    *wheel.Wheel      // keepalives of idle devices
 }
 
 // NewHandler creates a new connection handler
@@ -26,13 +34,19 @@ func NewHandler(cfg *config.Config, registry *device.Registry, sessions *session
 		cfg:      cfg,
 		registry: registry,
 		sessions: sessions,
+		wheel:    wheel.New(keepaliveTick, keepaliveSlots),
 	}
 }
 
-// Handle processes an incoming connection
-// Determines if it's a device or client based on AT command
-// Supports USR-VCOM and RFC2217 data before AT command
+// Handle processes an incoming connection of any role
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
+	h.HandleRoles(ctx, conn, RoleAny)
+}
+
+// HandleRoles processes an incoming connection
+// Determines if it's a device or client based on AT command, roles not allowed are rejected
+// Supports USR-VCOM and RFC2217 data before AT command
+func (h *Handler) HandleRoles(ctx context.Context, conn net.Conn, roles Role) {
 	defer conn.Close()
 
 	remoteAddr := conn.RemoteAddr().String()
@@ -40,11 +54,12 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 
 	reader := bufio.NewReader(conn)
 
-	// Track USR-VCOM config, RFC2217 presets and modem state across command loop
+	// Track USR-VCOM config, USR Setting Agreement config, RFC2217 presets and modem state across command loop
 	var usrvcomCfg *USRVCOMConfig
+	var usrSettingCfg *USRSettingPacket
 	var rfc2217Presets []byte // RFC2217 data collected from modem AT commands
 	var modem *ModemState
-	timeout := h.cfg.InitTimeout // Start with init timeout
+	timeout := h.cfg.Current().InitTimeout // Start with init timeout
 
 	for {
 		// Read AT command with support for USR-VCOM/RFC2217 presets
@@ -57,7 +72,7 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 					peek, _ := reader.Peek(reader.Buffered())
 					log.Printf("[conn] %s: init timeout, partial data: %x", remoteAddr, peek)
 				} else {
-					log.Printf("[conn] %s: init timeout (no data received in %v)", remoteAddr, h.cfg.InitTimeout)
+					log.Printf("[conn] %s: init timeout (no data received in %v)", remoteAddr, h.cfg.Current().InitTimeout)
 				}
 			} else {
 				log.Printf("[conn] %s: read command: %v", remoteAddr, err)
@@ -66,10 +81,13 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 			return
 		}
 
-		// Save USR-VCOM config if received
+		// Save USR-VCOM / Setting Agreement config if received
 		if cmd.USRVCOMCfg != nil {
 			usrvcomCfg = cmd.USRVCOMCfg
 		}
+		if cmd.USRSettingCfg != nil {
+			usrSettingCfg = cmd.USRSettingCfg
+		}
 
 		// Log received command with USR-VCOM info if present
 		if cmd.USRVCOMCfg != nil {
@@ -88,6 +106,9 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 				if usrvcomCfg != nil && cmd.USRVCOMCfg == nil {
 					cmd.USRVCOMCfg = usrvcomCfg
 				}
+				if usrSettingCfg != nil && cmd.USRSettingCfg == nil {
+					cmd.USRSettingCfg = usrSettingCfg
+				}
 				if len(rfc2217Presets) > 0 && len(cmd.Skipped) == 0 {
 					cmd.Skipped = rfc2217Presets
 				}
@@ -103,20 +124,38 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 					return
 				}
 			}
-			timeout = h.cfg.PostConnectTimeout
+			timeout = h.cfg.Current().PostConnectTimeout
 			continue
 		case CmdReg:
-			h.handleDevice(ctx, conn, cmd.Param, remoteAddr)
+			if roles&RoleDevice == 0 {
+				log.Printf("[conn] %s: device registration not allowed on this listener", remoteAddr)
+				WriteError(conn)
+				return
+			}
+			h.handleDevice(ctx, conn, buffered(reader), cmd.Param, remoteAddr)
 			return
 		case CmdConnect:
-			// Preserve USR-VCOM config for client handler
+			if roles&RoleClient == 0 {
+				log.Printf("[conn] %s: client connection not allowed on this listener", remoteAddr)
+				WriteError(conn)
+				return
+			}
+			// Preserve USR-VCOM / Setting Agreement config for client handler
 			if usrvcomCfg != nil && cmd.USRVCOMCfg == nil {
 				cmd.USRVCOMCfg = usrvcomCfg
 			}
+			if usrSettingCfg != nil && cmd.USRSettingCfg == nil {
+				cmd.USRSettingCfg = usrSettingCfg
+			}
 			h.handleClient(ctx, conn, reader, cmd, remoteAddr, nil)
 			return
 		case CmdModem:
 			// Generic modem AT command — activate modem emulation
+			if roles&RoleModem == 0 {
+				log.Printf("[conn] %s: modem emulation not allowed on this listener", remoteAddr)
+				WriteError(conn)
+				return
+			}
 			if modem == nil {
 				modem = NewModemState()
 				log.Printf("[conn] %s: modem emulation activated", remoteAddr)
@@ -127,7 +166,7 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 			}
 			log.Printf("[modem] %s: %s", remoteAddr, cmd.Param)
 			modem.HandleCommand(conn, cmd.Param)
-			timeout = h.cfg.PostConnectTimeout
+			timeout = h.cfg.Current().PostConnectTimeout
 			continue
 		default:
 			log.Printf("[conn] %s: unexpected command: %s", remoteAddr, cmd.Cmd)
@@ -137,8 +176,15 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	}
 }
 
+// buffered returns data read ahead by reader after the last command
+func buffered(reader *bufio.Reader) []byte {
+	data, _ := reader.Peek(reader.Buffered())
+	return data
+}
+
 // handleDevice handles device registration
-func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string, remoteAddr string) {
+// pending is data received after AT+REG, such as ATDT sent in the same packet
+func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, pending []byte, token string, remoteAddr string) {
 	if token == "" {
 		log.Printf("[device] %s: empty token", remoteAddr)
 		WriteError(conn)
@@ -148,7 +194,7 @@ func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string,
 	var deviceID string
 
 	// Parse token: AUTH_TOKEN+DEVICE_ID or just DEVICE_ID
-	if h.cfg.AuthToken != "" {
+	if h.cfg.Current().AuthToken != "" {
 		// Expect format: AUTH_TOKEN+DEVICE_ID
 		parts := strings.SplitN(token, "+", 2)
 		if len(parts) != 2 {
@@ -156,7 +202,7 @@ func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string,
 			WriteError(conn)
 			return
 		}
-		if parts[0] != h.cfg.AuthToken {
+		if parts[0] != h.cfg.Current().AuthToken {
 			log.Printf("[device] %s: invalid auth token", remoteAddr)
 			WriteError(conn)
 			return
@@ -173,15 +219,18 @@ func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string,
 		return
 	}
 
+	// Draining server doesn't take new devices, they reconnect to another instance
+	if h.drain.Stopped() {
+		log.Printf("[device] %s: draining, registration of %s rejected", remoteAddr, deviceID)
+		WriteError(conn)
+		return
+	}
+
 	// Check if device already registered
 	if existing, ok := h.registry.Get(deviceID); ok {
 		log.Printf("[device] %s: device %s already registered, closing old connection", remoteAddr, deviceID)
-		// Stop old keepalive goroutine first
-		if existing.StopKeepalive != nil {
-			close(existing.StopKeepalive)
-		}
-		existing.Conn.Close()
-		h.registry.Unregister(deviceID)
+		h.registry.UnregisterDevice(existing)
+		existing.Close()
 	}
 
 	// Enable aggressive TCP keepalive for fast dead connection detection
@@ -192,15 +241,20 @@ func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string,
 
 	// Register device
 	dev := &device.Device{
-		ID:            deviceID,
-		Conn:          conn,
-		RegisteredAt:  time.Now(),
-		StopKeepalive: make(chan struct{}),
+		ID:           deviceID,
+		Conn:         conn,
+		RegisteredAt: time.Now(),
+	}
+	dialect := h.cfg.Current().DeviceDialect(deviceID)
+	if !device.ValidDialect(dialect) {
+		log.Printf("[device] %s: unknown serial dialect %q, using %s", remoteAddr, dialect, device.DialectRFC2217)
+		dialect = device.DialectRFC2217
 	}
+	dev.SetDialect(dialect)
 	h.registry.Register(dev)
-	defer h.registry.Unregister(deviceID)
+	defer h.registry.UnregisterDevice(dev)
 
-	log.Printf("[device] %s: registered device %s", remoteAddr, deviceID)
+	log.Printf("[device] %s: registered device %s (dialect %s)", remoteAddr, deviceID, dialect)
 
 	// Send OK
 	if err := WriteOK(conn); err != nil {
@@ -209,8 +263,10 @@ func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string,
 	}
 
 	// Wait for optional ATDT/ATDP command
-	reader := bufio.NewReader(conn)
-	conn.SetReadDeadline(time.Now().Add(h.cfg.PostConnectTimeout))
+	// Device is already registered, so it is read through IdleRead: a client
+	// connecting meanwhile takes over the connection without losing device data
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(pending), dev.IdleReader()))
+	dev.SetIdleReadDeadline(time.Now().Add(h.cfg.Current().PostConnectTimeout))
 	cmd, err := ReadATCommand(reader, conn)
 	if err == nil && (cmd.Cmd == CmdDT || cmd.Cmd == CmdDP) {
 		if cmd.Param != "" {
@@ -222,86 +278,15 @@ func (h *Handler) handleDevice(ctx context.Context, conn net.Conn, token string,
 	}
 
 	// Clear deadline
-	conn.SetReadDeadline(time.Time{})
+	dev.SetIdleReadDeadline(time.Time{})
 
-	// Start keepalive - send NOP periodically to detect dead connections
-	connClosed := make(chan struct{})
-	if h.cfg.IdleTimeout > 0 {
-		go h.deviceKeepalive(conn, deviceID, dev.StopKeepalive, connClosed)
-	}
-
-	// Start reader goroutine to detect connection close immediately
-	readClosed := make(chan struct{})
-	go h.deviceReader(conn, deviceID, dev.StopKeepalive, readClosed)
-
-	// Wait for context cancellation or connection close
-	select {
-	case <-ctx.Done():
-		log.Printf("[device] %s: context cancelled", deviceID)
-	case <-connClosed:
-		log.Printf("[device] %s: connection closed by keepalive", deviceID)
-	case <-readClosed:
-		log.Printf("[device] %s: connection closed by device", deviceID)
-	}
-}
-
-// deviceReader reads from device connection to detect close immediately
-func (h *Handler) deviceReader(conn net.Conn, deviceID string, stop <-chan struct{}, closed chan<- struct{}) {
-	buf := make([]byte, 256)
-	for {
-		select {
-		case <-stop:
-			return
-		default:
-			// Set read deadline to allow checking stop channel periodically
-			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			_, err := conn.Read(buf)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					// Timeout is expected, continue loop
-					continue
-				}
-				// Real error or EOF - connection closed
-				log.Printf("[device] %s: read error: %v", deviceID, err)
-				close(closed)
-				return
-			}
-			// Got data from device while waiting - just discard
-			// (device shouldn't send data outside of session)
-		}
-	}
-}
-
-// deviceKeepalive sends Telnet NOP to device periodically
-func (h *Handler) deviceKeepalive(conn net.Conn, deviceID string, stop <-chan struct{}, closed chan<- struct{}) {
-	ticker := time.NewTicker(h.cfg.IdleTimeout)
-	defer ticker.Stop()
-
-	nop := []byte{0xFF, 0xF1} // Telnet NOP
-
-	for {
-		select {
-		case <-stop:
-			// Stopped due to device re-registration, exit silently
-			return
-		case <-ticker.C:
-			// Set write deadline to detect dead connections faster
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if _, err := conn.Write(nop); err != nil {
-				log.Printf("[device] %s: keepalive failed: %v", deviceID, err)
-				conn.Close()
-				close(closed)
-				return
-			}
-			conn.SetWriteDeadline(time.Time{}) // Clear deadline
-		}
-	}
+	h.idleDevice(ctx, dev)
 }
 
 // handleClient handles client connection request
 // Supports both USR-VCOM and RFC2217 presets before AT command
 // modem is non-nil when connection comes from GSM modem emulation (ATD<number>)
-func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.Reader, atCmd *ATCommand, remoteAddr string, modem *ModemState) {
+func (h *Handler) handleClient(ctx context.Context, conn net.Conn, reader *bufio.Reader, atCmd *ATCommand, remoteAddr string, modem *ModemState) {
 	// Enable TCP keepalive for fast dead connection detection
 	// idle=30s, interval=10s, count=3 => dead connection detected in ~60s
 	if err := SetTCPKeepalive(conn, 30*time.Second, 10*time.Second, 3); err != nil {
@@ -327,7 +312,10 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 	var deviceID string
 
 	// Parse token: AUTH_TOKEN+DEVICE_ID or just DEVICE_ID
-	if h.cfg.AuthToken != "" {
+	if _, forwarded := conn.(*cluster.Conn); forwarded {
+		// Client authenticated by the node that forwarded it over the cluster link
+		deviceID = token
+	} else if h.cfg.Current().AuthToken != "" {
 		// Expect format: AUTH_TOKEN+DEVICE_ID
 		parts := strings.SplitN(token, "+", 2)
 		if len(parts) != 2 {
@@ -335,7 +323,7 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 			writeError()
 			return
 		}
-		if parts[0] != h.cfg.AuthToken {
+		if parts[0] != h.cfg.Current().AuthToken {
 			log.Printf("[client] %s: invalid auth token", remoteAddr)
 			writeError()
 			return
@@ -352,8 +340,15 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 		return
 	}
 
+	if h.drain.Stopped() {
+		log.Printf("[client] %s: draining, session with device %s rejected", remoteAddr, deviceID)
+		writeError()
+		return
+	}
+
 	// Build RFC2217 buffer from presets (USR-VCOM or RFC2217 data)
 	var rfc2217Buf *RFC2217Buffer
+	clientRFC2217 := atCmd.RFC2217 // presets came as RFC2217 and expect server replies
 
 	// Priority 1: USR-VCOM config (parsed before AT command)
 	if atCmd.USRVCOMCfg != nil && atCmd.USRVCOMCfg.Valid {
@@ -367,7 +362,18 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 		log.Printf("[client] %s: converted USR-VCOM to %d RFC2217 commands", remoteAddr, len(rfc2217Buf.Commands))
 	}
 
-	// Priority 2: RFC2217 data in Skipped bytes
+	// Priority 2: USR Setting Agreement serial port settings (parsed before AT command)
+	if rfc2217Buf == nil && atCmd.USRSettingCfg != nil && atCmd.USRSettingCfg.Serial != nil {
+		log.Printf("[client] %s: USR Setting presets: %d baud, %s",
+			remoteAddr, atCmd.USRSettingCfg.Serial.BaudRate, atCmd.USRSettingCfg.Serial.ModeString())
+		rfc2217Buf = &RFC2217Buffer{
+			Commands: atCmd.USRSettingCfg.ToRFC2217Commands(),
+			RawData:  atCmd.USRSettingCfg.BuildRFC2217Packet(),
+		}
+		log.Printf("[client] %s: converted USR Setting to %d RFC2217 commands", remoteAddr, len(rfc2217Buf.Commands))
+	}
+
+	// Priority 3: RFC2217 data in Skipped bytes
 	if rfc2217Buf == nil && len(atCmd.Skipped) > 0 {
 		log.Printf("[client] %s: skipped data before AT (%d bytes): %x", remoteAddr, len(atCmd.Skipped), atCmd.Skipped)
 
@@ -384,6 +390,7 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 		} else {
 			// Parse as RFC2217
 			rfc2217Buf = ParseRFC2217Commands(atCmd.Skipped)
+			clientRFC2217 = true
 			if rfc2217Buf != nil && len(rfc2217Buf.Commands) > 0 {
 				log.Printf("[client] %s: parsed RFC2217: %d commands", remoteAddr, len(rfc2217Buf.Commands))
 			}
@@ -415,6 +422,10 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 	// Find the device
 	dev, ok := h.registry.Get(deviceID)
 	if !ok {
+		// Device may be registered on another cluster node
+		if h.forwardClient(ctx, conn, reader, atCmd, deviceID, remoteAddr, modem) {
+			return
+		}
 		log.Printf("[client] %s: device %s not found", remoteAddr, deviceID)
 		if modem != nil {
 			modem.WriteModemNoCarrier(conn)
@@ -424,8 +435,10 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 		return
 	}
 
-	// Check if device is already in a session
-	if dev.IsInSession() {
+	// Claim the device before creating the session: exec, Modbus and WebSocket
+	// sessions may take it at the same moment
+	id := h.sessions.NewID()
+	if !dev.TrySetSession(id) {
 		log.Printf("[client] %s: device %s is busy", remoteAddr, deviceID)
 		if modem != nil {
 			modem.WriteModemNoCarrier(conn)
@@ -434,10 +447,7 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 		}
 		return
 	}
-
-	// Create session
-	sess := h.sessions.Create(deviceID, conn, dev.Conn)
-	dev.SetSession(sess.ID)
+	sess := h.sessions.CreateKind(id, deviceID, session.KindClient, conn, dev.SessionConn())
 
 	log.Printf("[client] %s: created session %s with device %s", remoteAddr, sess.ID, deviceID)
 
@@ -458,13 +468,22 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 
 	// Forward RFC2217 data to device after session is established
 	if rfc2217Buf != nil && len(rfc2217Buf.RawData) > 0 {
-		if err := ForwardRFC2217ToDevice(dev.Conn, rfc2217Buf); err != nil {
+		if err := h.applyPortSettings(conn, dev, rfc2217Buf, clientRFC2217, remoteAddr); err != nil {
 			log.Printf("[client] %s: RFC2217 forward error: %v", remoteAddr, err)
 		}
 	}
 
+	// Client control protocol for in-session translation
+	clientControl := ClientControlUnknown
+	if clientRFC2217 {
+		clientControl = ClientControlRFC2217
+	} else if atCmd.USRVCOMCfg != nil && atCmd.USRVCOMCfg.Valid {
+		clientControl = ClientControlUSRVCOM
+	}
+
 	// Check if there's buffered data from client (after AT command)
 	// This may contain RFC2217 commands sent after the AT+CONNECT
+	var pending []byte // client data after a USR Setting packet, passed to the session
 	if reader.Buffered() > 0 {
 		buffered := make([]byte, reader.Buffered())
 		reader.Read(buffered)
@@ -474,7 +493,9 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 
 		// Try to parse as RFC2217 or USR-VCOM
 		var bufferedRFC2217 *RFC2217Buffer
+		bufferedClientRFC2217 := false
 		if IsUSRVCOM(buffered) {
+			clientControl = ClientControlUSRVCOM
 			cfg := ParseUSRVCOM(buffered)
 			if cfg != nil && cfg.Valid {
 				cfg.LogConfig("buffered presets")
@@ -483,9 +504,22 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 					RawData:  cfg.BuildRFC2217Packet(),
 				}
 			}
+		} else if IsUSRSetting(buffered) {
+			pkt := ParseUSRSetting(buffered)
+			pkt.LogConfig("buffered presets")
+			if err := pkt.Respond(conn); err != nil {
+				log.Printf("[client] %s: USR Setting response error: %v", remoteAddr, err)
+			}
+			pending = buffered[len(pkt.RawData):]
+			bufferedRFC2217 = &RFC2217Buffer{
+				Commands: pkt.ToRFC2217Commands(),
+				RawData:  pkt.BuildRFC2217Packet(),
+			}
 		} else if len(buffered) >= 3 && buffered[0] == 0xFF && buffered[1] == 0xFA && buffered[2] == 0x2C {
 			// RFC2217 data
 			bufferedRFC2217 = ParseRFC2217Commands(buffered)
+			bufferedClientRFC2217 = true
+			clientControl = ClientControlRFC2217
 		}
 
 		if bufferedRFC2217 != nil && len(bufferedRFC2217.Commands) > 0 {
@@ -506,10 +540,13 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 			for _, cmd := range bufferedRFC2217.Commands {
 				log.Printf("[client] %s:   - %s", remoteAddr, cmd.String())
 			}
-			// Forward RFC2217 to device
-			if err := ForwardRFC2217ToDevice(dev.Conn, bufferedRFC2217); err != nil {
+			// Forward RFC2217 to device (translated to device dialect)
+			if err := h.applyPortSettings(conn, dev, bufferedRFC2217, bufferedClientRFC2217, remoteAddr); err != nil {
 				log.Printf("[client] %s: RFC2217 forward error: %v", remoteAddr, err)
 			}
+		} else if bufferedRFC2217 != nil && IsUSRSetting(buffered) {
+			// Setting Agreement command without serial parameters - already acknowledged
+			log.Printf("[client] %s: USR Setting packet without serial parameters, not forwarded", remoteAddr)
 		} else {
 			// Unknown data, log hex and forward as-is
 			log.Printf("[client] %s: forwarding %d buffered bytes to device: %x", remoteAddr, len(buffered), buffered)
@@ -518,8 +555,10 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 	}
 
 	// Start the bridge - blocks until session ends
-	bridge := session.NewBridge(sess)
-	bridge.Run()
+	if len(pending) > 0 {
+		log.Printf("[client] %s: %d bytes after USR Setting packet passed to session", remoteAddr, len(pending))
+	}
+	h.runBridge(sess, dev, clientControl, remoteAddr, modem, pending)
 
 	// Clean up
 	h.sessions.End(sess.ID)
@@ -532,3 +571,73 @@ func (h *Handler) handleClient(_ context.Context, conn net.Conn, reader *bufio.R
 
 	log.Printf("[client] %s: session %s ended", remoteAddr, sess.ID)
 }
+
+// runBridge bridges client and device with serial control filters until session ends
+// Passthrough devices are bridged as is, without filters
+// Modem clients get NO CARRIER when limits or the API end the session
+// pending is client data read before the bridge started
+func (h *Handler) runBridge(sess *session.Session, dev *device.Device, clientControl int32, remoteAddr string, modem *ModemState, pending []byte) {
+	bridge := session.NewBridge(sess)
+	bridge.SetPending(pending)
+	if modem != nil {
+		bridge.SetEndNotice(modem.NoCarrier())
+	}
+	cfg := h.cfg.Current()
+	h.sessions.SetLimits(sess,
+		session.Limits(cfg.LimitsForDevice(dev.ID)),
+		session.Limits(cfg.LimitsForClient(sess.ClientIP())))
+	if cfg.PassthroughEnabled(dev.ID) {
+		log.Printf("[client] %s: passthrough, serial control is not translated", remoteAddr)
+		bridge.Run()
+		return
+	}
+	bridge.AddFilter(NewControlTranslator(sess, dev, clientControl))
+	if cfg.IECAssistEnabled(dev.ID) {
+		log.Printf("[client] %s: IEC 62056-21 speed switching enabled", remoteAddr)
+		bridge.AddFilter(NewIECAssistant(sess, dev))
+	}
+	bridge.Run()
+}
+
+// applyPortSettings sends client port settings to device in its serial control dialect
+// clientRFC2217 is set when the client speaks RFC2217 and waits for server replies
+func (h *Handler) applyPortSettings(conn net.Conn, dev *device.Device, buf *RFC2217Buffer, clientRFC2217 bool, remoteAddr string) error {
+	dialect := dev.Dialect()
+	if dialect == device.DialectRFC2217 {
+		// Device understands RFC2217 itself - keep track of settings and forward as-is
+		if profile, changed := ApplyRFC2217Commands(h.deviceProfile(dev), buf.Commands); changed {
+			profile.Source = "client"
+			profile.UpdatedAt = time.Now()
+			dev.SetSerialProfile(profile)
+		}
+		return ForwardRFC2217ToDevice(dev.Conn, buf)
+	}
+
+	settings := TranslatePortSettings(dialect, buf.Commands, buf.RawData, dev.SerialProfile(), clientRFC2217)
+	settings.LogTranslation("[client] "+remoteAddr, dialect)
+
+	if settings.Changed {
+		settings.Profile.Source = "client"
+		settings.Profile.UpdatedAt = time.Now()
+		dev.SetSerialProfile(settings.Profile)
+	}
+	if len(settings.ToDevice) > 0 {
+		if _, err := dev.Conn.Write(settings.ToDevice); err != nil {
+			return err
+		}
+	}
+	if len(settings.ToClient) > 0 {
+		if _, err := conn.Write(settings.ToClient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceProfile returns last known device serial settings or defaults
+func (h *Handler) deviceProfile(dev *device.Device) device.SerialProfile {
+	if profile := dev.SerialProfile(); profile != nil {
+		return *profile
+	}
+	return defaultSerialProfile
+}
@@ -1,10 +1,14 @@
 package connection
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -50,10 +54,9 @@ func (e *testEnv) registerDevice(t *testing.T, deviceID string) net.Conn {
 	t.Helper()
 	devClient, devServer := createTCPPair(t)
 	dev := &device.Device{
-		ID:            deviceID,
-		Conn:          devServer,
-		RegisteredAt:  time.Now(),
-		StopKeepalive: make(chan struct{}),
+		ID:           deviceID,
+		Conn:         devServer,
+		RegisteredAt: time.Now(),
 	}
 	e.registry.Register(dev)
 	t.Cleanup(func() {
@@ -333,6 +336,68 @@ func TestDeviceWithATDTParam(t *testing.T) {
 	waitDone(t, done, 5*time.Second)
 }
 
+func TestDeviceRegistrationPipelined(t *testing.T) {
+	env := newTestEnv()
+	client, server := createTCPPair(t)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := runHandler(ctx, env.handler, server)
+
+	// ATDT in the same packet as AT+REG must not be lost in the registration buffer
+	client.Write([]byte("AT+REG=device123\r\nATDT\r\n"))
+	resp := readUntilContains(t, client, "OK\r\nOK\r\n", 2*time.Second)
+	if resp != "OK\r\nOK\r\n" {
+		t.Fatalf("expected OK for REG and ATDT, got %q", resp)
+	}
+
+	cancel()
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestClientDuringPostConnectWait(t *testing.T) {
+	env := newTestEnv()
+	devClient, devServer := createTCPPair(t)
+	defer devClient.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	devDone := runHandler(ctx, env.handler, devServer)
+
+	// Device registers without ATDT: the handler waits for it while the device is available
+	sendCmd(t, devClient, "AT+REG=device123")
+	if resp := readResponse(t, devClient, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("expected OK for REG, got %q", resp)
+	}
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(ctx, env.handler, server)
+	sendCmd(t, client, "AT+CONNECT=device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+
+	// Every byte of the device reply reaches the client
+	for i := 0; i < 20; i++ {
+		client.Write([]byte("ping"))
+		// Keepalive NOP may come along
+		if got := readUntilContains(t, devClient, "ping", 2*time.Second); !strings.Contains(got, "ping") {
+			t.Fatalf("device got %q", got)
+		}
+		devClient.Write([]byte("0123456789"))
+		if got := readUntilContains(t, client, "0123456789", 2*time.Second); got != "0123456789" {
+			t.Fatalf("round %d: client got %q", i, got)
+		}
+	}
+
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+	cancel()
+	waitDone(t, devDone, 5*time.Second)
+}
+
 // === Client RFC-2217 tests ===
 
 func TestClientConnect(t *testing.T) {
@@ -363,6 +428,84 @@ func TestClientConnect(t *testing.T) {
 	waitDone(t, done, 5*time.Second)
 }
 
+func TestClientPassthrough(t *testing.T) {
+	env := newTestEnv()
+	env.cfg.PassthroughDevices = []string{"device123"}
+	env.sessions.SetOptions(false, 0) // no NOP inside the payload
+	devConn := env.registerDevice(t, "device123")
+
+	client, server := createTCPPair(t)
+	done := runHandler(context.Background(), env.handler, server)
+
+	sendCmd(t, client, "AT+CONNECT=device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+	sess, ok := env.sessions.GetByDevice("device123")
+	if !ok {
+		t.Fatal("session not found")
+	}
+
+	// Telnet bytes pass as is: no translation, no escaping
+	payload := make([]byte, 1<<20)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	transfer := func(dst, src net.Conn) []byte {
+		t.Helper()
+		go src.Write(payload)
+		got := make([]byte, len(payload))
+		dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(dst, got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return got
+	}
+	if got := transfer(devConn, client); !bytes.Equal(got, payload) {
+		t.Fatal("device got corrupted data")
+	}
+	if got := transfer(client, devConn); !bytes.Equal(got, payload) {
+		t.Fatal("client got corrupted data")
+	}
+	if in, out := atomic.LoadInt64(&sess.BytesIn), atomic.LoadInt64(&sess.BytesOut); in != int64(len(payload)) || out != int64(len(payload)) {
+		t.Errorf("counters in=%d out=%d, want %d", in, out, len(payload))
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestClientSessionQuota(t *testing.T) {
+	env := newTestEnv()
+	env.cfg.DeviceLimits = config.SessionLimits{SessionQuota: 10}
+	devConn := env.registerDevice(t, "device123")
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(context.Background(), env.handler, server)
+
+	sendCmd(t, client, "AT+CONNECT=device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+	sess, ok := env.sessions.GetByDevice("device123")
+	if !ok {
+		t.Fatal("session not found")
+	}
+
+	client.Write([]byte("0123456789abcdef"))
+	devConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, _ := io.ReadAll(devConn)
+	if string(got) != "0123456789" {
+		t.Errorf("device got %q, want data up to the quota", got)
+	}
+	waitDone(t, done, 5*time.Second)
+	if sess.EndReason() != session.EndSessionQuota {
+		t.Errorf("EndReason = %q", sess.EndReason())
+	}
+}
+
 func TestClientConnectDeviceNotFound(t *testing.T) {
 	env := newTestEnv()
 	client, server := createTCPPair(t)
@@ -399,6 +542,51 @@ func TestClientConnectDeviceBusy(t *testing.T) {
 	waitDone(t, done, 5*time.Second)
 }
 
+func TestClientConnectRacesExec(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+	dev, _ := env.registry.Get("device123")
+
+	// Exec transaction arrives while the client session is being created:
+	// the client must already hold the device, so exec is refused
+	var execErr error
+	execClaimed := false
+	env.sessions.SetCallbacks(func(s *session.Session) {
+		if s.Kind != session.KindClient {
+			return
+		}
+		id := env.sessions.NewInternalID()
+		if !dev.TrySetSession(id) {
+			return
+		}
+		execClaimed = true
+		defer dev.ClearSession()
+		sess := env.sessions.CreateInternal(id, dev.ID, ExecSessionKind, dev.SessionConn())
+		defer env.sessions.End(sess.ID)
+		_, execErr = Exec(sess, dev, []byte("ping"), ExecOptions{Timeout: 100 * time.Millisecond})
+	}, nil)
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(context.Background(), env.handler, server)
+
+	sendCmd(t, client, "AT+CONNECT=device123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+	if execClaimed {
+		t.Fatalf("exec claimed the device held by the client (exec error %v)", execErr)
+	}
+
+	client.Write([]byte("hello"))
+	if got := readUntilContains(t, devConn, "hello", 2*time.Second); got != "hello" {
+		t.Fatalf("device received %q", got)
+	}
+
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
 func TestClientConnectWithAuth(t *testing.T) {
 	env := newTestEnvWithAuth("secret")
 	devConn := env.registerDevice(t, "device123")
@@ -634,6 +822,37 @@ func TestModemDialDeviceBusy(t *testing.T) {
 	waitDone(t, done, 5*time.Second)
 }
 
+func TestModemDialMaxDuration(t *testing.T) {
+	env := newTestEnv()
+	env.cfg.ClientLimits = config.SessionLimits{MaxDuration: 300 * time.Millisecond, WarnBefore: 100 * time.Millisecond, Banner: "BYE"}
+	env.registerDevice(t, "device123")
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	done := runHandler(context.Background(), env.handler, server)
+
+	expectExact(t, client, "ATZ", "\r\nOK\r\n")
+	sendCmd(t, client, "ATDTdevice123")
+	if resp := readResponse(t, client, 2*time.Second); resp != "\r\nCONNECT 9600\r\n" {
+		t.Fatalf("expected CONNECT 9600, got %q", resp)
+	}
+	sess, ok := env.sessions.GetByDevice("device123")
+	if !ok {
+		t.Fatal("session not found")
+	}
+
+	// Modem client gets NO CARRIER instead of the banner
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, _ := io.ReadAll(client)
+	if string(got) != "\r\nNO CARRIER\r\n" {
+		t.Errorf("client got %q, want NO CARRIER", got)
+	}
+	waitDone(t, done, 5*time.Second)
+	if sess.EndReason() != session.EndMaxDuration {
+		t.Errorf("EndReason = %q", sess.EndReason())
+	}
+}
+
 func TestModemDialWithAuth(t *testing.T) {
 	env := newTestEnvWithAuth("secret")
 	devConn := env.registerDevice(t, "device123")
@@ -1018,3 +1237,169 @@ func TestUnknownCommandNoModem(t *testing.T) {
 
 	waitDone(t, done, 5*time.Second)
 }
+
+// === USR Setting Agreement tests ===
+
+func TestUSRSettingBeforeConnect(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+
+	client, server := createTCPPair(t)
+
+	done := runHandler(context.Background(), env.handler, server)
+
+	// Serial Port 0 packet (9600 8N1) + AT+CONNECT on same line
+	client.Write(append(append([]byte{}, usrSettingSerialPort0...), []byte("AT+CONNECT=device123\r\n")...))
+
+	resp := readUntilContains(t, client, "OK\r\n", 2*time.Second)
+	if !strings.HasPrefix(resp, "\xFF\x01\x06\x4B") {
+		t.Fatalf("expected Setting Agreement status response first, got %q", resp)
+	}
+	if !strings.HasSuffix(resp, "OK\r\n") {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+
+	// Device should receive RFC2217 data (converted from Setting Agreement)
+	devBuf := make([]byte, 4096)
+	devConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := devConn.Read(devBuf)
+	if err != nil {
+		t.Fatalf("device read: %v", err)
+	}
+	if n < 3 || devBuf[0] != 0xFF || devBuf[1] != 0xFA || devBuf[2] != 0x2C {
+		t.Fatalf("expected RFC2217 data (FF FA 2C...), got %x", devBuf[:n])
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestUSRSettingAfterConnect(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+
+	client, server := createTCPPair(t)
+
+	done := runHandler(context.Background(), env.handler, server)
+
+	// Data after the Setting Agreement packet in the same write goes to the device
+	data := []byte("AT+CONNECT=device123\r\n")
+	data = append(data, usrSettingSerialPort0...)
+	client.Write(append(data, "hello"...))
+
+	resp := readUntilContains(t, client, "\xFF\x01\x06\x4B", 2*time.Second)
+	if !strings.HasPrefix(resp, "OK\r\n") {
+		t.Fatalf("expected OK first, got %q", resp)
+	}
+	got := readUntilContains(t, devConn, "hello", 2*time.Second)
+	if !strings.HasPrefix(got, "\xFF\xFA\x2C") || !strings.HasSuffix(got, "hello") {
+		t.Errorf("device got %x, want RFC2217 settings then data", got)
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestLoneFFBeforeATCommand(t *testing.T) {
+	client, server := createTCPPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// 0xFF and a length byte look like the start of a Setting Agreement packet longer than the data
+	client.Write([]byte("\xFF\x20AT+REG=device123\r\n"))
+	start := time.Now()
+	cmd, err := ReadATCommandWithPresets(bufio.NewReader(server), server, 5*time.Second)
+	if err != nil {
+		t.Fatalf("ReadATCommandWithPresets: %v", err)
+	}
+	if cmd.Cmd != CmdReg || cmd.Param != "device123" {
+		t.Errorf("cmd = %+v", cmd)
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("AT command read after %v, want the packet wait bounded", elapsed)
+	}
+}
+
+// === Serial control dialect ===
+
+func TestRFC2217ToUSRVCOMDevice(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+	dev, _ := env.registry.Get("device123")
+	dev.SetDialect(device.DialectUSRVCOM)
+
+	client, server := createTCPPair(t)
+
+	done := runHandler(context.Background(), env.handler, server)
+
+	// RFC2217 SET-BAUDRATE 2400 + SET-PARITY EVEN + AT+CONNECT
+	rfc2217 := []byte{
+		0xFF, 0xFA, 0x2C, 0x01, 0x00, 0x00, 0x09, 0x60, 0xFF, 0xF0,
+		0xFF, 0xFA, 0x2C, 0x03, 0x03, 0xFF, 0xF0,
+	}
+	client.Write(append(rfc2217, []byte("AT+CONNECT=device123\r\n")...))
+
+	// Proxy answers RFC2217 itself since device doesn't speak it
+	resp := readUntilContains(t, client, "\xFF\xFA\x2C\x67\x03\xFF\xF0", 2*time.Second)
+	if !strings.HasPrefix(resp, "OK\r\n") {
+		t.Fatalf("expected OK first, got %q", resp)
+	}
+	if !strings.Contains(resp, "\xFF\xFA\x2C\x65\x00\x00\x09\x60\xFF\xF0") {
+		t.Errorf("expected SET-BAUDRATE reply, got %x", resp)
+	}
+
+	// Device should receive USR-VCOM Baud Rate Sync packet
+	devBuf := make([]byte, 4096)
+	devConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := devConn.Read(devBuf)
+	if err != nil {
+		t.Fatalf("device read: %v", err)
+	}
+	cfg := ParseUSRVCOM(devBuf[:n])
+	if cfg == nil || !cfg.Valid {
+		t.Fatalf("expected USR-VCOM packet, got %x", devBuf[:n])
+	}
+	if cfg.BaudRate != 2400 || cfg.ModeString() != "8E1" {
+		t.Errorf("device settings = %d %s, want 2400 8E1", cfg.BaudRate, cfg.ModeString())
+	}
+
+	if profile := dev.SerialProfile(); profile == nil || profile.BaudRate != 2400 {
+		t.Errorf("device serial profile = %+v, want 2400 baud", profile)
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestRFC2217ToNoneDialectDevice(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+	dev, _ := env.registry.Get("device123")
+	dev.SetDialect(device.DialectNone)
+
+	client, server := createTCPPair(t)
+
+	done := runHandler(context.Background(), env.handler, server)
+
+	rfc2217 := []byte{0xFF, 0xFA, 0x2C, 0x01, 0x00, 0x00, 0x25, 0x80, 0xFF, 0xF0}
+	client.Write(append(rfc2217, []byte("AT+CONNECT=device123\r\n")...))
+
+	resp := readUntilContains(t, client, "\xFF\xF0", 2*time.Second)
+	if !strings.HasPrefix(resp, "OK\r\n") {
+		t.Fatalf("expected OK first, got %q", resp)
+	}
+
+	// Nothing must reach the device
+	devBuf := make([]byte, 4096)
+	devConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _ := devConn.Read(devBuf); n > 0 {
+		t.Errorf("device should not receive control data, got %x", devBuf[:n])
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// Keepalives of all idle devices share one timer wheel: 100ms ticks, one minute per turn
+const (
+	keepaliveTick  = 100 * time.Millisecond
+	keepaliveSlots = 600
+)
+
+// telnetNOP is sent to idle devices to detect dead connections
+var telnetNOP = []byte{0xFF, 0xF1}
+
+// idleDevice serves registered device until its connection is closed
+// The handler goroutine is the only one per idle device: it blocks in read without
+// deadline to notice device close at once, keepalive runs on the shared wheel,
+// context and drain interrupt it by callbacks instead of waiting goroutines
+func (h *Handler) idleDevice(ctx context.Context, dev *device.Device) {
+	if h.cfg.Current().IdleTimeout > 0 {
+		timer := h.wheel.EveryFunc(h.keepaliveInterval, func() { h.deviceKeepalive(dev) })
+		defer timer.Stop()
+	}
+	stopCtx := context.AfterFunc(ctx, func() {
+		log.Printf("[device] %s: context cancelled", dev.ID)
+		dev.Close()
+	})
+	defer stopCtx()
+	stopDrain := h.drain.AfterDone(func() { h.releaseDevice(ctx, dev) })
+	defer stopDrain()
+
+	buf := make([]byte, 256)
+	for {
+		// Data from device while waiting is discarded
+		// (device shouldn't send data outside of session)
+		if _, err := dev.IdleRead(buf); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[device] %s: read error: %v", dev.ID, err)
+				log.Printf("[device] %s: connection closed by device", dev.ID)
+			}
+			return
+		}
+	}
+}
+
+// keepaliveInterval returns IDLE_TIMEOUT of the current config, so reload applies
+// to registered devices from the next keepalive. Keepalive disabled by reload
+// is checked once per wheel turn
+func (h *Handler) keepaliveInterval() time.Duration {
+	if interval := h.cfg.Current().IdleTimeout; interval > 0 {
+		return interval
+	}
+	return keepaliveTick * keepaliveSlots
+}
+
+// deviceKeepalive sends Telnet NOP to idle device, dead connection is closed
+// Device in session is kept alive by the bridge
+func (h *Handler) deviceKeepalive(dev *device.Device) {
+	if dev.IsInSession() || h.cfg.Current().IdleTimeout <= 0 {
+		return
+	}
+	// Set write deadline to detect dead connections faster
+	dev.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := dev.Conn.Write(telnetNOP); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			log.Printf("[device] %s: keepalive failed: %v", dev.ID, err)
+			log.Printf("[device] %s: connection closed by keepalive", dev.ID)
+		}
+		dev.Close()
+		return
+	}
+	dev.Conn.SetWriteDeadline(time.Time{}) // Clear deadline
+}
@@ -0,0 +1,54 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+)
+
+func TestIdleKeepaliveReload(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("IDLE_TIMEOUT", "100ms")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	env := newTestEnv()
+	handler := NewHandler(cfg, env.registry, env.sessions)
+
+	client, server := createTCPPair(t)
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := runHandler(ctx, handler, server)
+
+	for _, cmd := range []string{"AT+REG=device123", "ATDT"} {
+		sendCmd(t, client, cmd)
+		if resp := readResponse(t, client, 2*time.Second); resp != "OK\r\n" {
+			t.Fatalf("%s: expected OK, got %q", cmd, resp)
+		}
+	}
+	if got := readDevice(t, client); !bytes.Contains(got, telnetNOP) {
+		t.Fatalf("device got %x, want keepalive NOP", got)
+	}
+
+	// Longer interval applies to the registered device after the already scheduled keepalive
+	t.Setenv("IDLE_TIMEOUT", "1h")
+	if _, _, err := cfg.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	client.Read(make([]byte, 64))
+
+	client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 64)); err == nil {
+		t.Errorf("device got %d bytes after keepalive interval grew to an hour", n)
+	}
+
+	cancel()
+	waitDone(t, done, 5*time.Second)
+}
@@ -0,0 +1,118 @@
+//go:build unix
+
+package connection
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// idleDevices registers n devices through the handler and returns device sides of connections
+func idleDevices(b *testing.B, env *testEnv, ctx context.Context, n int) []net.Conn {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go env.handler.Handle(ctx, conn)
+		}
+	}()
+
+	conns := make([]net.Conn, n)
+	buf := make([]byte, 16)
+	for i := range conns {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns[i] = conn
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, cmd := range []string{fmt.Sprintf("AT+REG=meter%d", i), "ATDT"} {
+			fmt.Fprintf(conn, "%s\r\n", cmd)
+			if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+				b.Fatalf("device %d: %s: %v", i, cmd, err)
+			}
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	for env.registry.Count() != n {
+		time.Sleep(time.Millisecond)
+	}
+	return conns
+}
+
+// cpuTime returns user and system CPU time of the process
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// idleCPU returns CPU time of the process while it sleeps for d
+func idleCPU(d time.Duration) time.Duration {
+	cpu := cpuTime()
+	time.Sleep(d)
+	return cpuTime() - cpu
+}
+
+// BenchmarkIdleDevices reports goroutines, memory and CPU time held by one idle registered device
+// CPU time of the process without devices is subtracted
+func BenchmarkIdleDevices(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	b.Run("keepalive=off", func(b *testing.B) { benchmarkIdleDevices(b, 0) })
+	b.Run("keepalive=30s", func(b *testing.B) { benchmarkIdleDevices(b, 30*time.Second) })
+}
+
+func benchmarkIdleDevices(b *testing.B, keepalive time.Duration) {
+	const n = 1000
+	env := newTestEnv()
+	env.cfg.IdleTimeout = keepalive
+	ctx, cancel := context.WithCancel(context.Background())
+	window := time.Duration(b.N) * 10 * time.Millisecond
+
+	runtime.GC()
+	floor := idleCPU(window)
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	conns := idleDevices(b, env, ctx, n)
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	perDevice := float64(runtime.NumGoroutine()-goroutines) / n
+	memory := float64(after.HeapInuse+after.StackInuse-before.HeapInuse-before.StackInuse) / n
+
+	// Idle window: devices send nothing, only timers and keepalives run
+	b.ResetTimer()
+	cpu := idleCPU(window)
+	b.StopTimer()
+	b.ReportMetric(float64(cpu-floor)/n/window.Seconds(), "cpu-ns/device/s")
+	b.ReportMetric(perDevice, "goroutines/device")
+	b.ReportMetric(memory, "B/device")
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	cancel()
+	for env.registry.Count() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
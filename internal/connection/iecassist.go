@@ -0,0 +1,153 @@
+package connection
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/iec62056"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+const (
+	// iecSwitchMargin is added to transmission time of option select before switching speed
+	iecSwitchMargin = 50 * time.Millisecond
+	// iecReplyTimeout limits waiting for RFC2217 device replies to assistant commands
+	iecReplyTimeout = 3 * time.Second
+	// iecBitsPerChar is the character length for 7E1 (start + 7 data + parity + stop)
+	iecBitsPerChar = 10
+)
+
+// IECAssistant follows IEC 62056-21 mode C exchange in a bridged session
+// and switches device port speed when the polling program can't do it itself
+// Implements session.Filter, must be added after ControlTranslator
+type IECAssistant struct {
+	sess    *session.Session
+	dev     *device.Device
+	watcher iec62056.Watcher
+
+	mu           sync.Mutex
+	pending      int       // RFC2217 replies to own commands still expected from device
+	pendingUntil time.Time // stop waiting for replies after this time
+}
+
+// NewIECAssistant creates mode C assistant for a session
+func NewIECAssistant(sess *session.Session, dev *device.Device) *IECAssistant {
+	return &IECAssistant{sess: sess, dev: dev}
+}
+
+// ClientToDevice watches request, option select and break messages
+func (a *IECAssistant) ClientToDevice(data []byte) ([]byte, []byte) {
+	for _, ev := range a.watcher.Client(data) {
+		switch ev.Type {
+		case iec62056.EventRequest:
+			log.Printf("[iec62056] %s: request %q", a.sess.ID, bytes.TrimSpace(ev.Message))
+			// Exchange always starts at 300 baud - reset device port before the request
+			if settings := a.settings(iec62056.InitialBaudRate); settings != nil {
+				data = append(settings, data...)
+			}
+		case iec62056.EventOptionSelect:
+			log.Printf("[iec62056] %s: option select %q, switching to %d baud",
+				a.sess.ID, bytes.TrimSpace(ev.Message), ev.Option.BaudRate)
+			a.switchAfter(data, ev.Option.BaudRate)
+		case iec62056.EventBreak:
+			log.Printf("[iec62056] %s: break, back to %d baud", a.sess.ID, iec62056.InitialBaudRate)
+			a.switchAfter(data, iec62056.InitialBaudRate)
+		}
+	}
+	return data, nil
+}
+
+// DeviceToClient watches identification and hides device replies to assistant commands
+func (a *IECAssistant) DeviceToClient(data []byte) ([]byte, []byte) {
+	for _, ev := range a.watcher.Device(data) {
+		id := ev.Identification
+		if id.BaudRate > 0 {
+			log.Printf("[iec62056] %s: identification %s, meter proposes %d baud", a.sess.ID, id, id.BaudRate)
+		} else {
+			log.Printf("[iec62056] %s: identification %s (not mode C)", a.sess.ID, id)
+		}
+	}
+	return a.stripReplies(data), nil
+}
+
+// switchAfter changes device speed once data is transmitted at the current speed
+func (a *IECAssistant) switchAfter(data []byte, baudRate uint32) {
+	current := uint32(iec62056.InitialBaudRate)
+	if profile := a.dev.SerialProfile(); profile != nil && profile.BaudRate > 0 {
+		current = profile.BaudRate
+	}
+	delay := time.Duration(len(data)*iecBitsPerChar)*time.Second/time.Duration(current) + iecSwitchMargin
+
+	time.AfterFunc(delay, func() {
+		settings := a.settings(baudRate)
+		if settings == nil {
+			return
+		}
+		if _, err := a.sess.DeviceConn.Write(settings); err != nil {
+			log.Printf("[iec62056] %s: speed switch error: %v", a.sess.ID, err)
+		}
+	})
+}
+
+// settings builds port settings for the device dialect and records them
+// Returns nil if device port already has these settings
+func (a *IECAssistant) settings(baudRate uint32) []byte {
+	profile := device.SerialProfile{
+		BaudRate: baudRate,
+		DataBits: iec62056.DataBits,
+		Parity:   3, // EVEN
+		StopBits: iec62056.StopBits,
+	}
+	if current := a.dev.SerialProfile(); current != nil &&
+		current.BaudRate == profile.BaudRate && current.ModeString() == profile.ModeString() {
+		return nil
+	}
+
+	cmds := PortSettingsCommands(profile)
+
+	dialect := a.dev.Dialect()
+	result := TranslatePortSettings(dialect, cmds, nil, a.dev.SerialProfile(), false)
+	result.LogTranslation("[iec62056] "+a.sess.ID, dialect)
+	recordPortSettings(a.sess, a.dev, result.Profile, "iec62056")
+
+	if dialect == device.DialectRFC2217 {
+		a.mu.Lock()
+		a.pending += len(cmds)
+		a.pendingUntil = time.Now().Add(iecReplyTimeout)
+		a.mu.Unlock()
+	}
+	return result.ToDevice
+}
+
+// stripReplies removes RFC2217 server replies to assistant commands from device data
+// The client didn't send these commands and must not see the replies
+func (a *IECAssistant) stripReplies(data []byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pending > 0 && time.Now().After(a.pendingUntil) {
+		a.pending = 0
+	}
+	if a.pending == 0 {
+		return data
+	}
+
+	var out []byte
+	for a.pending > 0 {
+		idx := bytes.Index(data, comPortFrameStart)
+		if idx < 0 || idx+3 >= len(data) || data[idx+3] <= ServerResponseOffset {
+			break
+		}
+		end := bytes.Index(data[idx:], []byte{IAC, SE})
+		if end < 0 {
+			break
+		}
+		out = append(out, data[:idx]...)
+		data = data[idx+end+2:]
+		a.pending--
+	}
+	return append(out, data...)
+}
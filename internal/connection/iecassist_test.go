@@ -0,0 +1,83 @@
+package connection
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/iec62056"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+func TestIECAssistantModeC(t *testing.T) {
+	proxySide, deviceSide := net.Pipe()
+	defer proxySide.Close()
+	defer deviceSide.Close()
+
+	dev := &device.Device{ID: "meter1"}
+	dev.SetDialect(device.DialectUSRVCOM)
+	sess := &session.Session{ID: "sess_test", DeviceID: dev.ID, DeviceConn: proxySide}
+	a := NewIECAssistant(sess, dev)
+
+	// Request: device port is reset to 300 7E1 before it
+	out, _ := a.ClientToDevice([]byte("/?!\r\n"))
+	reset := BuildUSRVCOMPacket(device.SerialProfile{BaudRate: 300, DataBits: 7, Parity: 3, StopBits: 1})
+	if !bytes.Equal(out, append(reset, "/?!\r\n"...)) {
+		t.Fatalf("to device = %x, want reset + request", out)
+	}
+
+	if out, _ := a.DeviceToClient([]byte("/EKT5CE301\r\n")); string(out) != "/EKT5CE301\r\n" {
+		t.Errorf("identification changed: %q", out)
+	}
+
+	// Option select is passed at 300 baud, speed switch follows after transmission
+	ack := []byte{iec62056.ACK, '0', '5', '0', '\r', '\n'}
+	start := time.Now()
+	if out, _ := a.ClientToDevice(ack); !bytes.Equal(out, ack) {
+		t.Errorf("option select changed: %x", out)
+	}
+
+	buf := make([]byte, 64)
+	deviceSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := deviceSide.Read(buf)
+	if err != nil {
+		t.Fatalf("device read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("speed switched after %v, before option select was transmitted", elapsed)
+	}
+	if cfg := ParseUSRVCOM(buf[:n]); cfg == nil || cfg.BaudRate != 9600 || cfg.ModeString() != "7E1" {
+		t.Errorf("device got %x, want USR-VCOM 9600 7E1", buf[:n])
+	}
+	if profile := dev.SerialProfile(); profile.BaudRate != 9600 || profile.Source != "iec62056" {
+		t.Errorf("profile = %+v", profile)
+	}
+}
+
+func TestIECAssistantStripsDeviceReplies(t *testing.T) {
+	dev := &device.Device{ID: "meter1"}
+	sess := &session.Session{ID: "sess_test", DeviceID: dev.ID}
+	a := NewIECAssistant(sess, dev)
+
+	out, _ := a.ClientToDevice([]byte("/?!\r\n"))
+	buf := ParseRFC2217Commands(out)
+	if buf == nil || len(buf.Commands) != 4 {
+		t.Fatalf("to device = %x, want 4 RFC2217 commands", out)
+	}
+
+	var replies []byte
+	for _, cmd := range buf.Commands {
+		replies = append(replies, cmd.BuildResponse()...)
+	}
+	if got, _ := a.DeviceToClient(append(replies, "/EKT5\r\n"...)); string(got) != "/EKT5\r\n" {
+		t.Errorf("to client = %q, want identification only", got)
+	}
+
+	// Replies to client's own commands are passed
+	own := (&RFC2217Command{Command: SetBaudrate, Data: []byte{0, 0, 0x25, 0x80}}).BuildResponse()
+	if got, _ := a.DeviceToClient(own); !bytes.Equal(got, own) {
+		t.Errorf("to client = %x, want %x", got, own)
+	}
+}
@@ -10,7 +10,7 @@ import (
 // interval: time between probes
 // count: number of probes before connection is considered dead
 func SetTCPKeepalive(conn net.Conn, idle, interval time.Duration, count int) error {
-	tcpConn, ok := conn.(*net.TCPConn)
+	tcpConn, ok := tcpConnOf(conn)
 	if !ok {
 		return nil // Not a TCP connection, skip
 	}
@@ -28,3 +28,19 @@ func SetTCPKeepalive(conn net.Conn, idle, interval time.Duration, count int) err
 	// Set platform-specific options (TCP_KEEPIDLE, TCP_KEEPCNT)
 	return setKeepaliveOptions(tcpConn, idle, interval, count)
 }
+
+// tcpConnOf unwraps TLS and PROXY protocol connections to the TCP connection
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }: // *tls.Conn
+			conn = c.NetConn()
+		case interface{ Raw() net.Conn }: // *proxyproto.Conn
+			conn = c.Raw()
+		default:
+			return nil, false
+		}
+	}
+}
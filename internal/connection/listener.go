@@ -0,0 +1,115 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+)
+
+// Role is a set of connection kinds allowed on a listener
+type Role uint8
+
+const (
+	RoleDevice Role = 1 << iota // device registration AT+REG
+	RoleClient                  // client connection AT+CONNECT
+	RoleModem                   // client with modem emulation: AT commands and ATD<number>
+	RoleAny    = RoleDevice | RoleClient | RoleModem
+)
+
+// parseRoles converts configured role names, empty list allows any role
+func parseRoles(names []string) (Role, error) {
+	if len(names) == 0 {
+		return RoleAny, nil
+	}
+	var roles Role
+	for _, name := range names {
+		switch name {
+		case config.RoleDevice:
+			roles |= RoleDevice
+		case config.RoleClient:
+			roles |= RoleClient
+		case config.RoleModem:
+			roles |= RoleModem
+		case config.RoleAny:
+			roles |= RoleAny
+		default:
+			return 0, fmt.Errorf("unknown role %q", name)
+		}
+	}
+	return roles, nil
+}
+
+// String returns comma separated role names
+func (r Role) String() string {
+	if r == RoleAny {
+		return config.RoleAny
+	}
+	var names []string
+	for _, role := range []struct {
+		role Role
+		name string
+	}{{RoleDevice, config.RoleDevice}, {RoleClient, config.RoleClient}, {RoleModem, config.RoleModem}} {
+		if r&role.role != 0 {
+			names = append(names, role.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// listener is a device and client listener with its accept loop state
+type listener struct {
+	net.Listener
+	name     string
+	roles    Role
+	maxConns int
+
+	conns    atomic.Int64 // open connections
+	rejected atomic.Int64 // connections closed over the limit
+
+	// Accept loop progress for health checks
+	listening atomic.Bool
+	waiting   atomic.Bool  // accept loop is blocked in Accept
+	loopAt    atomic.Int64 // last accept loop iteration, unix nanoseconds
+	accepted  atomic.Int64
+	errMu     sync.Mutex
+	lastErr   error // last accept error, cleared by successful accept
+	lastErrAt time.Time
+}
+
+func (l *listener) setAcceptError(err error) {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	l.lastErr = err
+	l.lastErrAt = time.Now()
+}
+
+// check reports whether the listener is open and the accept loop makes progress
+func (l *listener) check() (string, error) {
+	detail := fmt.Sprintf("%s: %d accepted, %d open", l.name, l.accepted.Load(), l.conns.Load())
+	if n := l.rejected.Load(); n > 0 {
+		detail += fmt.Sprintf(", %d over limit", n)
+	}
+	if !l.listening.Load() {
+		return detail, errors.New("not listening")
+	}
+
+	l.errMu.Lock()
+	lastErr, lastErrAt := l.lastErr, l.lastErrAt
+	l.errMu.Unlock()
+	if lastErr != nil && time.Since(lastErrAt) < acceptErrorWindow {
+		return detail, fmt.Errorf("accept failing: %v", lastErr)
+	}
+
+	if !l.waiting.Load() {
+		if stalled := time.Since(time.Unix(0, l.loopAt.Load())); stalled > acceptStallTimeout {
+			return detail, fmt.Errorf("accept loop stalled for %v", stalled.Round(time.Second))
+		}
+	}
+	return detail, nil
+}
@@ -52,12 +52,16 @@ func (m *ModemState) WriteModemConnect(conn net.Conn) error {
 
 // WriteModemNoCarrier sends NO CARRIER response respecting verbose mode
 func (m *ModemState) WriteModemNoCarrier(conn net.Conn) error {
+	_, err := conn.Write(m.NoCarrier())
+	return err
+}
+
+// NoCarrier returns NO CARRIER response in the current result code format
+func (m *ModemState) NoCarrier() []byte {
 	if m.Verbose {
-		_, err := conn.Write([]byte("\r\nNO CARRIER\r\n"))
-		return err
+		return []byte("\r\nNO CARRIER\r\n")
 	}
-	_, err := conn.Write([]byte("3\r"))
-	return err
+	return []byte("3\r")
 }
 
 // HandleCommand processes a generic modem AT command.
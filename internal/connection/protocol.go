@@ -22,19 +22,26 @@ const (
 	RespError = "ERROR\r\n"
 )
 
+// usrSettingWait bounds waiting for the rest of a Setting Agreement packet after a leading 0xFF
+const usrSettingWait = 200 * time.Millisecond
+
 // ATCommand represents a parsed AT command
 type ATCommand struct {
-	Cmd        string         // Command name (AT+REG, AT+CONNECT)
-	Param      string         // Parameter value (token)
-	Skipped    []byte         // Bytes received before AT command (may contain RFC2217 data)
-	USRVCOMCfg *USRVCOMConfig // USR-VCOM configuration if received before AT command
+	Cmd           string            // Command name (AT+REG, AT+CONNECT)
+	Param         string            // Parameter value (token)
+	Skipped       []byte            // Bytes received before AT command (may contain RFC2217 data)
+	USRVCOMCfg    *USRVCOMConfig    // USR-VCOM configuration if received before AT command
+	USRSettingCfg *USRSettingPacket // USR Setting Agreement serial port settings if received before AT command
+	RFC2217       bool              // Client is known to speak RFC2217 (WebSocket client forwarded by another node)
 }
 
 // ReadATCommandWithPresets reads AT command, handling USR-VCOM and RFC2217 data before it
 // USR-VCOM packets (55 AA 55) are accepted silently (no response)
+// USR Setting Agreement packets (FF [len] [cmd] ...) are acknowledged with a status response
 // RFC2217 data is collected and returned in Skipped field
 func ReadATCommandWithPresets(reader *bufio.Reader, conn net.Conn, timeout time.Duration) (*ATCommand, error) {
 	var usrvcomCfg *USRVCOMConfig
+	var usrSettingCfg *USRSettingPacket
 	var allSkipped []byte
 	startTime := time.Now()
 
@@ -48,16 +55,18 @@ func ReadATCommandWithPresets(reader *bufio.Reader, conn net.Conn, timeout time.
 		// When timeout>0: use a short per-line deadline (1s) to quickly detect
 		// data without CR/LF (e.g., +++ escape sequence). Overall timeout enforced above.
 		// When timeout=0: don't set any deadline — caller manages the deadline.
+		var deadline time.Time
 		if timeout > 0 {
 			lineDeadline := 1 * time.Second
 			remaining := timeout - time.Since(startTime)
 			if remaining < lineDeadline {
 				lineDeadline = remaining
 			}
-			conn.SetReadDeadline(time.Now().Add(lineDeadline))
+			deadline = time.Now().Add(lineDeadline)
+			conn.SetReadDeadline(deadline)
 		}
 
-		line, skipped, err := readLineWithSkipped(reader)
+		line, skipped, err := readLineWithSkipped(reader, conn, deadline)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Timeout with skipped bytes but no line — data without CR/LF
@@ -77,9 +86,9 @@ func ReadATCommandWithPresets(reader *bufio.Reader, conn net.Conn, timeout time.
 					allSkipped = append(allSkipped, skipped...)
 					continue
 				}
-				// USR-VCOM timeout — keep waiting
-				if usrvcomCfg != nil {
-					log.Printf("[protocol] timeout after USR-VCOM, continuing...")
+				// USR-VCOM / Setting Agreement timeout — keep waiting
+				if usrvcomCfg != nil || usrSettingCfg != nil {
+					log.Printf("[protocol] timeout after USR presets, continuing...")
 					continue
 				}
 				// No data at all within lineDeadline — check overall timeout
@@ -103,6 +112,16 @@ func ReadATCommandWithPresets(reader *bufio.Reader, conn net.Conn, timeout time.
 				} else {
 					log.Printf("[protocol] USR-VCOM parse failed: %s", hex.EncodeToString(skipped))
 				}
+			} else if IsUSRSetting(skipped) {
+				// USR Setting Agreement packet - acknowledge to sender
+				pkt := ParseUSRSetting(skipped)
+				pkt.LogConfig("received")
+				if err := pkt.Respond(conn); err != nil {
+					return nil, fmt.Errorf("write USR Setting response: %w", err)
+				}
+				if pkt.Serial != nil {
+					usrSettingCfg = pkt
+				}
 			} else if isRFC2217Data(skipped) {
 				// RFC2217 data - collect it
 				log.Printf("[protocol] RFC2217 data before AT: %s", hex.EncodeToString(skipped))
@@ -127,17 +146,18 @@ func ReadATCommandWithPresets(reader *bufio.Reader, conn net.Conn, timeout time.
 		if cmd := parseATCommand(cmdLine); cmd != nil {
 			cmd.Skipped = allSkipped
 			cmd.USRVCOMCfg = usrvcomCfg
+			cmd.USRSettingCfg = usrSettingCfg
 			return cmd, nil
 		}
 
 		// Not an AT command
-		// If we already have USR-VCOM config, ignore unknown data and keep waiting
-		if usrvcomCfg != nil {
-			log.Printf("[protocol] ignoring non-AT data after USR-VCOM: %q", cmdLine)
+		// If we already have USR-VCOM / Setting Agreement config, ignore unknown data and keep waiting
+		if usrvcomCfg != nil || usrSettingCfg != nil {
+			log.Printf("[protocol] ignoring non-AT data after USR presets: %q", cmdLine)
 			continue
 		}
 
-		// No USR-VCOM received - this is an error
+		// No USR presets received - this is an error
 		return nil, fmt.Errorf("unknown command: %q", cmdLine)
 	}
 }
@@ -148,10 +168,24 @@ func ReadATCommand(reader *bufio.Reader, conn net.Conn) (*ATCommand, error) {
 }
 
 // readLineWithSkipped reads bytes until CR/LF, separating skipped bytes from AT command
-func readLineWithSkipped(reader *bufio.Reader) (line []byte, skipped []byte, err error) {
+// A complete USR Setting Agreement packet is returned on its own as skipped bytes,
+// since its binary body may contain CR/LF bytes
+// deadline is the read deadline of conn, zero if managed by the caller
+func readLineWithSkipped(reader *bufio.Reader, conn net.Conn, deadline time.Time) (line []byte, skipped []byte, err error) {
 	inATCommand := false
 
 	for {
+		if !inATCommand {
+			if packet := peekUSRSetting(reader, conn, deadline); packet != nil {
+				if len(skipped) > 0 {
+					// Return preceding bytes first, packet is read by the next call
+					return line, skipped, nil
+				}
+				reader.Discard(len(packet))
+				return line, packet, nil
+			}
+		}
+
 		b, err := reader.ReadByte()
 		if err != nil {
 			return line, skipped, err
@@ -185,6 +219,43 @@ func readLineWithSkipped(reader *bufio.Reader) (line []byte, skipped []byte, err
 	}
 }
 
+// peekUSRSetting returns a complete USR Setting Agreement packet at the reader position
+// without consuming it, or nil if data doesn't start with one
+// The rest of a packet is waited for usrSettingWait at most, so a lone 0xFF doesn't stall
+// the AT command after it; with zero deadline only buffered data is checked
+func peekUSRSetting(reader *bufio.Reader, conn net.Conn, deadline time.Time) []byte {
+	if first, err := reader.Peek(1); err != nil || first[0] != USRSettingHeader {
+		return nil
+	}
+	peek := func(n int) []byte {
+		if reader.Buffered() < n {
+			if deadline.IsZero() {
+				return nil
+			}
+			wait := time.Now().Add(usrSettingWait)
+			if deadline.Before(wait) {
+				wait = deadline
+			}
+			conn.SetReadDeadline(wait)
+			defer conn.SetReadDeadline(deadline)
+		}
+		data, err := reader.Peek(n)
+		if err != nil {
+			return nil
+		}
+		return data
+	}
+	header := peek(2)
+	if header == nil || header[1] == 0 || header[1] >= SE {
+		return nil
+	}
+	packet := peek(usrSettingPacketLen(header[1]))
+	if packet == nil || !IsUSRSetting(packet) {
+		return nil
+	}
+	return packet
+}
+
 // parseATCommand parses AT command string and returns ATCommand or nil
 func parseATCommand(cmdLine string) *ATCommand {
 	upper := strings.ToUpper(cmdLine)
@@ -78,6 +78,18 @@ func ParseRFC2217Commands(data []byte) *RFC2217Buffer {
 	return buf
 }
 
+// BuildRFC2217Packet encodes commands as RFC2217 subnegotiations
+// IAC SB COM-PORT-OPTION <cmd> <data...> IAC SE
+func BuildRFC2217Packet(commands []RFC2217Command) []byte {
+	var packet []byte
+	for _, cmd := range commands {
+		packet = append(packet, IAC, SB, ComPortOption, cmd.Command)
+		packet = append(packet, cmd.Data...)
+		packet = append(packet, IAC, SE)
+	}
+	return packet
+}
+
 // BuildResponse builds RFC2217 server response for a command
 // Server responses use command code + 100
 func (c *RFC2217Command) BuildResponse() []byte {
@@ -2,21 +2,38 @@ package connection
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pires/go-proxyproto"
 
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/cluster"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/drain"
 	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
 )
 
+const (
+	acceptBackoffMin   = 5 * time.Millisecond
+	acceptBackoffMax   = time.Second
+	acceptStallTimeout = 5 * time.Second  // accept loop busy outside Accept for longer is wedged
+	acceptErrorWindow  = 10 * time.Second // accept error is reported for this long unless accept succeeds
+)
+
 // Server listens for all connections (devices and clients)
 type Server struct {
-	cfg      *config.Config
-	handler  *Handler
-	listener net.Listener
+	cfg     *config.Config
+	handler *Handler
+
+	mu        sync.Mutex
+	listeners []*listener
 }
 
 // NewServer creates a new connection server
@@ -27,49 +44,176 @@ func NewServer(cfg *config.Config, registry *device.Registry, sessions *session.
 	}
 }
 
-// Start starts the connection server
+// Handler returns connection handler shared with WebSocket client sessions
+func (s *Server) Handler() *Handler {
+	return s.handler
+}
+
+// SetCluster enables cluster mode: clients of devices on other nodes are forwarded
+func (s *Server) SetCluster(node *cluster.Node) {
+	s.handler.SetCluster(node)
+}
+
+// SetDrain sets drain controller: listeners are closed and devices are released on drain
+func (s *Server) SetDrain(ctl *drain.Controller) {
+	s.handler.SetDrain(ctl)
+}
+
+// Start listens on all configured listeners and serves them until one fails
 func (s *Server) Start(ctx context.Context) error {
-	addr := ":" + s.cfg.Port
-	listener, err := net.Listen("tcp", addr)
+	listeners := s.cfg.ProxyListeners()
+	errCh := make(chan error, len(listeners))
+	for _, lc := range listeners {
+		l, err := net.Listen("tcp", lc.Address)
+		if err != nil {
+			return err
+		}
+		go func() { errCh <- s.ServeListener(ctx, l, lc) }()
+	}
+	for range listeners {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve accepts device and client connections of any role on listener
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	return s.ServeListener(ctx, l, config.Listener{
+		Name:          "proxy",
+		Roles:         []string{config.RoleAny},
+		ProxyProtocol: s.cfg.ProxyProtocol,
+	})
+}
+
+// ServeListener accepts connections on listener with PROXY protocol, TLS,
+// allowed roles and connection limit of the listener configuration
+func (s *Server) ServeListener(ctx context.Context, l net.Listener, lc config.Listener) error {
+	roles, err := parseRoles(lc.Roles)
 	if err != nil {
-		return err
+		return fmt.Errorf("listener %s: %w", lc.Name, err)
 	}
 
-	// Wrap with PROXY Protocol support if enabled
-	if s.cfg.ProxyProtocol {
-		listener = &proxyproto.Listener{Listener: listener}
-		log.Printf("[server] PROXY Protocol enabled")
+	var options []string
+	if lc.ProxyProtocol {
+		l = &proxyproto.Listener{Listener: l}
+		options = append(options, "PROXY protocol")
+	}
+	if lc.TLS {
+		cert, err := tls.LoadX509KeyPair(lc.TLSCert, lc.TLSKey)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("listener %s: %w", lc.Name, err)
+		}
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		options = append(options, "TLS")
+	}
+	if lc.MaxConns > 0 {
+		options = append(options, fmt.Sprintf("max %d connections", lc.MaxConns))
 	}
 
-	s.listener = listener
+	ln := &listener{Listener: l, name: lc.Name, roles: roles, maxConns: lc.MaxConns}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+	ln.listening.Store(true)
+	defer ln.listening.Store(false)
 
-	log.Printf("[server] listening on %s", addr)
+	if len(options) > 0 {
+		log.Printf("[server] %s: listening on %s (roles %s; %s)", ln.name, l.Addr(), roles, strings.Join(options, ", "))
+	} else {
+		log.Printf("[server] %s: listening on %s (roles %s)", ln.name, l.Addr(), roles)
+	}
 
 	go func() {
-		<-ctx.Done()
-		listener.Close()
+		select {
+		case <-ctx.Done():
+		case <-s.handler.drain.Done():
+			log.Printf("[server] %s: draining, no longer accepting connections", ln.name)
+		}
+		l.Close()
 	}()
 
+	var backoff time.Duration
 	for {
-		conn, err := listener.Accept()
+		ln.loopAt.Store(time.Now().UnixNano())
+		ln.waiting.Store(true)
+		conn, err := l.Accept()
+		ln.waiting.Store(false)
+		ln.loopAt.Store(time.Now().UnixNano())
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				return nil
+			case <-s.handler.drain.Done():
+				ln.listening.Store(false)
+				<-ctx.Done()
+				return nil
 			default:
-				log.Printf("[server] accept error: %v", err)
-				continue
 			}
+			// Back off on persistent errors such as exhausted file descriptors
+			if backoff == 0 {
+				backoff = acceptBackoffMin
+			} else if backoff *= 2; backoff > acceptBackoffMax {
+				backoff = acceptBackoffMax
+			}
+			ln.setAcceptError(err)
+			log.Printf("[server] %s: accept error: %v; retrying in %v", ln.name, err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		ln.accepted.Add(1)
+		ln.setAcceptError(nil)
+
+		// Remote address is not logged here: with PROXY protocol it waits for the header
+		if ln.maxConns > 0 && ln.conns.Load() >= int64(ln.maxConns) {
+			if n := ln.rejected.Add(1); n == 1 || n%100 == 0 {
+				log.Printf("[server] %s: connection limit %d reached, %d connections rejected", ln.name, ln.maxConns, n)
+			}
+			conn.Close()
+			continue
 		}
+		ln.conns.Add(1)
+		go func() {
+			defer ln.conns.Add(-1)
+			s.handler.HandleRoles(ctx, conn, ln.roles)
+		}()
+	}
+}
+
+// CheckAccept reports whether listeners are open and accept loops make progress
+func (s *Server) CheckAccept() (string, error) {
+	if s.handler.drain.Stopped() {
+		return "stopped on drain", nil
+	}
 
-		go s.handler.Handle(ctx, conn)
+	s.mu.Lock()
+	listeners := append([]*listener(nil), s.listeners...)
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return "", errors.New("not listening")
+	}
+
+	var details []string
+	var errs []error
+	for _, l := range listeners {
+		detail, err := l.check()
+		details = append(details, detail)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.name, err))
+		}
 	}
+	return strings.Join(details, "; "), errors.Join(errs...)
 }
 
-// Addr returns the server address
+// Addr returns address of the first listener
 func (s *Server) Addr() net.Addr {
-	if s.listener == nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
 		return nil
 	}
-	return s.listener.Addr()
+	return s.listeners[0].Addr()
 }
@@ -0,0 +1,280 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+)
+
+// failingListener returns an error from every Accept
+type failingListener struct {
+	net.Listener
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, errors.New("too many open files")
+}
+
+// waitCheck polls CheckAccept until it returns the expected result
+func waitCheck(t *testing.T, s *Server, wantErr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := s.CheckAccept()
+		if (wantErr == "" && err == nil) || (err != nil && wantErr != "" && strings.Contains(err.Error(), wantErr)) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("CheckAccept = %v, want %q", err, wantErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerCheckAccept(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	env := newTestEnv()
+	s := NewServer(env.cfg, env.registry, env.sessions)
+	waitCheck(t, s, "not listening")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() { s.Serve(ctx, listener); close(done) }()
+	waitCheck(t, s, "")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for testListener(t, s, "proxy").accepted.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	waitDone(t, done, 2*time.Second)
+	waitCheck(t, s, "not listening")
+}
+
+func TestServerCheckAcceptErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	env := newTestEnv()
+	s := NewServer(env.cfg, env.registry, env.sessions)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() { s.Serve(ctx, failingListener{listener}); close(done) }()
+	waitCheck(t, s, "accept failing: too many open files")
+
+	cancel()
+	waitDone(t, done, 3*time.Second)
+}
+
+// testListener waits for the named listener to be served
+func testListener(t *testing.T, s *Server, name string) *listener {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		for _, l := range s.listeners {
+			if l.name == name {
+				s.mu.Unlock()
+				return l
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("listener %s not served", name)
+	return nil
+}
+
+// serveListener starts listener on a random localhost port
+func serveListener(t *testing.T, ctx context.Context, s *Server, lc config.Listener) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ctx, l, lc)
+	return l.Addr().String()
+}
+
+// command sends AT command over a new connection and returns the response line
+func command(t *testing.T, addr, cmd string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return commandConn(t, conn, cmd)
+}
+
+func commandConn(t *testing.T, conn net.Conn, cmd string) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte(cmd + "\r\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	return line
+}
+
+func TestServerListenerRoles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env := newTestEnv()
+	s := NewServer(env.cfg, env.registry, env.sessions)
+
+	devices := serveListener(t, ctx, s, config.Listener{Name: "public", Roles: []string{"device"}})
+	clients := serveListener(t, ctx, s, config.Listener{Name: "internal", Roles: []string{"client"}})
+
+	if resp := command(t, devices, "AT+CONNECT=device123"); resp != "ERROR\r\n" {
+		t.Errorf("client on device listener: %q", resp)
+	}
+	if resp := command(t, devices, "ATZ"); resp != "ERROR\r\n" {
+		t.Errorf("modem on device listener: %q", resp)
+	}
+	if resp := command(t, clients, "AT+REG=device123"); resp != "ERROR\r\n" {
+		t.Errorf("device on client listener: %q", resp)
+	}
+
+	devConn, err := net.Dial("tcp", devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devConn.Close()
+	if resp := commandConn(t, devConn, "AT+REG=device123"); resp != "OK\r\n" {
+		t.Fatalf("device on device listener: %q", resp)
+	}
+	waitCheck(t, s, "")
+	if detail, _ := s.CheckAccept(); !strings.Contains(detail, "public: 3 accepted, 1 open") || !strings.Contains(detail, "internal: 1 accepted") {
+		t.Errorf("CheckAccept detail = %q", detail)
+	}
+}
+
+func TestServerListenerMaxConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env := newTestEnv()
+	s := NewServer(env.cfg, env.registry, env.sessions)
+	addr := serveListener(t, ctx, s, config.Listener{Name: "limited", MaxConns: 1})
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for testListener(t, s, "limited").conns.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("first connection not handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection over limit: %v", err)
+	}
+
+	// Slot is released when the first connection ends
+	first.Close()
+	for testListener(t, s, "limited").conns.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first connection not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := command(t, addr, "AT+CONNECT=nodevice"); resp != "ERROR\r\n" {
+		t.Errorf("connection after release: %q", resp)
+	}
+}
+
+// writeTestCert writes self-signed certificate and key for localhost
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestServerListenerTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env := newTestEnv()
+	s := NewServer(env.cfg, env.registry, env.sessions)
+	certFile, keyFile := writeTestCert(t)
+	addr := serveListener(t, ctx, s, config.Listener{Name: "secure", TLS: true, TLSCert: certFile, TLSKey: keyFile})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	defer conn.Close()
+	if resp := commandConn(t, conn, "AT+REG=device123"); resp != "OK\r\n" {
+		t.Fatalf("registration over TLS: %q", resp)
+	}
+
+	// Missing certificate fails the listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ServeListener(ctx, l, config.Listener{Name: "broken", TLS: true, TLSCert: "/nonexistent", TLSKey: "/nonexistent"}); err == nil {
+		t.Error("listener without certificate started")
+	}
+}
@@ -0,0 +1,307 @@
+package connection
+
+import (
+	"bytes"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+// Serial control protocol spoken by the client
+const (
+	ClientControlUnknown int32 = iota // raw data, no control frames seen yet
+	ClientControlRFC2217              // Telnet with COM-PORT-OPTION
+	ClientControlUSRVCOM              // inline 55 AA 55 Baud Rate Sync packets
+)
+
+// Telnet options accepted by the proxy on behalf of non-RFC2217 devices
+var acceptedTelnetOptions = map[byte]bool{
+	0:             true, // BINARY
+	3:             true, // SUPPRESS-GO-AHEAD
+	ComPortOption: true,
+}
+
+// comPortFrameStart is the beginning of RFC2217 subnegotiation
+var comPortFrameStart = []byte{IAC, SB, ComPortOption}
+
+// ControlTranslator translates serial control frames inside a bridged session
+// according to the device dialect and tracks port setting changes
+// Implements session.Filter
+type ControlTranslator struct {
+	sess   *session.Session
+	dev    *device.Device
+	client int32 // ClientControl*, accessed atomically
+
+	clientDec  rfc2217.Decoder // client Telnet stream
+	deviceDec  rfc2217.Decoder // device Telnet stream
+	negotiated map[[2]byte]bool
+}
+
+// NewControlTranslator creates translator for a session
+// client is the control protocol detected from client presets
+func NewControlTranslator(sess *session.Session, dev *device.Device, client int32) *ControlTranslator {
+	return &ControlTranslator{
+		sess:       sess,
+		dev:        dev,
+		client:     client,
+		negotiated: make(map[[2]byte]bool),
+	}
+}
+
+// clientControl returns detected client control protocol
+func (t *ControlTranslator) clientControl() int32 {
+	return atomic.LoadInt32(&t.client)
+}
+
+// setClientControl remembers detected client control protocol
+func (t *ControlTranslator) setClientControl(c int32) {
+	if atomic.SwapInt32(&t.client, c) != c {
+		name := "RFC2217"
+		if c == ClientControlUSRVCOM {
+			name = "USR-VCOM"
+		}
+		log.Printf("[bridge] %s: client speaks %s", t.sess.ID, name)
+	}
+}
+
+// ClientToDevice translates client control frames for the device
+func (t *ControlTranslator) ClientToDevice(data []byte) ([]byte, []byte) {
+	dialect := t.dev.Dialect()
+	client := t.clientControl()
+
+	if client != ClientControlRFC2217 && bytes.Contains(data, comPortFrameStart) {
+		t.setClientControl(ClientControlRFC2217)
+		client = ClientControlRFC2217
+	}
+
+	switch {
+	case client == ClientControlRFC2217 && dialect == device.DialectRFC2217:
+		// Device handles RFC2217 itself - only track settings
+		for _, ev := range t.clientDec.Feed(data) {
+			if cmds := comPortCommands(ev); cmds != nil {
+				t.logCommands("client", cmds)
+				profile, changed := ApplyRFC2217Commands(t.profile(), cmds)
+				if changed {
+					t.record(profile, "client")
+				}
+			}
+		}
+		return data, nil
+	case client == ClientControlRFC2217:
+		return t.translateRFC2217(data, dialect)
+	case dialect == device.DialectUSRVCOM:
+		// USR-VCOM device gets Baud Rate Sync as is - only track settings
+		t.trackUSRVCOM(data)
+		return data, nil
+	case client == ClientControlUSRVCOM:
+		return t.translateUSRVCOM(data, dialect), nil
+	default:
+		// Unknown client sends raw serial data, 55 AA 55 in it is not a control packet
+		return data, nil
+	}
+}
+
+// DeviceToClient adapts device stream to the client control protocol
+func (t *ControlTranslator) DeviceToClient(data []byte) ([]byte, []byte) {
+	dialect := t.dev.Dialect()
+	client := t.clientControl()
+
+	if dialect == device.DialectRFC2217 {
+		// Every byte goes through the decoder to keep Telnet state in sync
+		var out []byte
+		for _, ev := range t.deviceDec.Feed(data) {
+			switch ev.Type {
+			case rfc2217.EventData:
+				out = append(out, ev.Data...)
+			case rfc2217.EventSubneg:
+				if cmds := comPortCommands(ev); cmds != nil {
+					t.trackDeviceReplies(cmds)
+				}
+			}
+		}
+		if client == ClientControlUSRVCOM {
+			// USR-VCOM client doesn't understand Telnet
+			return out, nil
+		}
+		// Telnet client gets device stream as is
+		return data, nil
+	}
+
+	if client == ClientControlRFC2217 {
+		// Device sends raw data, Telnet client expects IAC escaped
+		return rfc2217.Escape(data), nil
+	}
+	return data, nil
+}
+
+// translateRFC2217 decodes client Telnet stream for non-RFC2217 device
+func (t *ControlTranslator) translateRFC2217(data []byte, dialect string) ([]byte, []byte) {
+	var out, reply []byte
+	for _, ev := range t.clientDec.Feed(data) {
+		switch ev.Type {
+		case rfc2217.EventData:
+			out = append(out, ev.Data...)
+		case rfc2217.EventSubneg:
+			cmds := comPortCommands(ev)
+			if cmds == nil {
+				continue
+			}
+			t.logCommands("client", cmds)
+			settings := TranslatePortSettings(dialect, cmds, nil, t.dev.SerialProfile(), true)
+			settings.LogTranslation("[bridge] "+t.sess.ID, dialect)
+			if settings.Changed {
+				t.record(settings.Profile, "client")
+			}
+			out = append(out, settings.ToDevice...)
+			reply = append(reply, settings.ToClient...)
+		case rfc2217.EventCommand:
+			reply = append(reply, t.negotiate(ev)...)
+		}
+	}
+	return out, reply
+}
+
+// negotiate answers Telnet option negotiation on behalf of the device
+func (t *ControlTranslator) negotiate(ev rfc2217.Event) []byte {
+	var answer byte
+	switch ev.Command {
+	case rfc2217.WILL:
+		answer = rfc2217.DONT
+		if acceptedTelnetOptions[ev.Option] {
+			answer = rfc2217.DO
+		}
+	case rfc2217.DO:
+		answer = rfc2217.WONT
+		if acceptedTelnetOptions[ev.Option] {
+			answer = rfc2217.WILL
+		}
+	default:
+		return nil // NOP, WONT, DONT etc.
+	}
+
+	// Answer once per option to avoid negotiation loops
+	key := [2]byte{ev.Command, ev.Option}
+	if t.negotiated[key] {
+		return nil
+	}
+	t.negotiated[key] = true
+	return []byte{IAC, answer, ev.Option}
+}
+
+// translateUSRVCOM replaces inline Baud Rate Sync packets for RFC2217 or none device
+func (t *ControlTranslator) translateUSRVCOM(data []byte, dialect string) []byte {
+	idx := FindUSRVCOMPacket(data)
+	if idx < 0 {
+		return data
+	}
+	t.setClientControl(ClientControlUSRVCOM)
+
+	out := append([]byte(nil), data[:idx]...)
+	for idx >= 0 {
+		cfg := ParseUSRVCOM(data[idx : idx+USRVCOMPacketLen])
+		cfg.LogConfig("[bridge] " + t.sess.ID)
+		cmds := cfg.ToRFC2217Commands()
+		settings := TranslatePortSettings(dialect, cmds, cfg.BuildRFC2217Packet(), t.dev.SerialProfile(), false)
+		settings.LogTranslation("[bridge] "+t.sess.ID, dialect)
+		if settings.Changed {
+			t.record(settings.Profile, "client")
+		}
+		out = append(out, settings.ToDevice...)
+
+		data = data[idx+USRVCOMPacketLen:]
+		idx = FindUSRVCOMPacket(data)
+		if idx < 0 {
+			out = append(out, data...)
+		} else {
+			out = append(out, data[:idx]...)
+		}
+	}
+	return out
+}
+
+// trackUSRVCOM records settings of Baud Rate Sync packets passed to USR-VCOM device
+func (t *ControlTranslator) trackUSRVCOM(data []byte) {
+	for idx := FindUSRVCOMPacket(data); idx >= 0; idx = FindUSRVCOMPacket(data) {
+		t.setClientControl(ClientControlUSRVCOM)
+		cfg := ParseUSRVCOM(data[idx : idx+USRVCOMPacketLen])
+		profile, changed := ApplyRFC2217Commands(t.profile(), cfg.ToRFC2217Commands())
+		if changed {
+			t.record(profile, "client")
+		}
+		data = data[idx+USRVCOMPacketLen:]
+	}
+}
+
+// trackDeviceReplies records settings confirmed by RFC2217 device
+func (t *ControlTranslator) trackDeviceReplies(cmds []RFC2217Command) {
+	var confirmed []RFC2217Command
+	for _, cmd := range cmds {
+		if cmd.Command > ServerResponseOffset {
+			confirmed = append(confirmed, RFC2217Command{Command: cmd.Command - ServerResponseOffset, Data: cmd.Data})
+		}
+	}
+	t.logCommands("device", confirmed)
+	if profile, changed := ApplyRFC2217Commands(t.profile(), confirmed); changed {
+		t.record(profile, "device")
+	}
+}
+
+// logCommands logs RFC2217 commands seen inside the session
+func (t *ControlTranslator) logCommands(side string, cmds []RFC2217Command) {
+	for _, cmd := range cmds {
+		log.Printf("[bridge] %s: %s RFC2217 %s", t.sess.ID, side, cmd.String())
+	}
+}
+
+// profile returns current device serial settings or defaults
+func (t *ControlTranslator) profile() device.SerialProfile {
+	if profile := t.dev.SerialProfile(); profile != nil {
+		return *profile
+	}
+	return defaultSerialProfile
+}
+
+// record stores changed serial settings of the device
+func (t *ControlTranslator) record(profile device.SerialProfile, source string) {
+	recordPortSettings(t.sess, t.dev, profile, source)
+}
+
+// recordPortSettings stores changed serial settings of the device and counts the change in session
+func recordPortSettings(sess *session.Session, dev *device.Device, profile device.SerialProfile, source string) {
+	if current := dev.SerialProfile(); current != nil &&
+		current.BaudRate == profile.BaudRate && current.ModeString() == profile.ModeString() {
+		return
+	}
+	profile.Source = source
+	profile.UpdatedAt = time.Now()
+	dev.SetSerialProfile(profile)
+	atomic.AddInt64(&sess.PortChanges, 1)
+	log.Printf("[bridge] %s: port settings changed by %s: %d %s",
+		sess.ID, source, profile.BaudRate, profile.ModeString())
+}
+
+// comPortCommands extracts RFC2217 command from COM-PORT-OPTION subnegotiation
+func comPortCommands(ev rfc2217.Event) []RFC2217Command {
+	if ev.Type != rfc2217.EventSubneg || ev.Option != ComPortOption || len(ev.Data) == 0 {
+		return nil
+	}
+	return []RFC2217Command{{Command: ev.Data[0], Data: ev.Data[1:]}}
+}
+
+// FindUSRVCOMPacket returns index of the first Baud Rate Sync packet with valid checksum, -1 if none
+func FindUSRVCOMPacket(data []byte) int {
+	for i := 0; i+USRVCOMPacketLen <= len(data); i++ {
+		if !IsUSRVCOM(data[i:]) {
+			continue
+		}
+		p := data[i : i+USRVCOMPacketLen]
+		if p[3]+p[4]+p[5]+p[6] == p[7] {
+			return i
+		}
+	}
+	return -1
+}
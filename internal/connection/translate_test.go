@@ -0,0 +1,174 @@
+package connection
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+func newTestTranslator(dialect string, client int32) (*ControlTranslator, *device.Device, *session.Session) {
+	dev := &device.Device{ID: "device123"}
+	dev.SetDialect(dialect)
+	sess := &session.Session{ID: "sess_test", DeviceID: dev.ID}
+	return NewControlTranslator(sess, dev, client), dev, sess
+}
+
+func TestTranslatorRFC2217ClientToUSRVCOMDevice(t *testing.T) {
+	tr, dev, sess := newTestTranslator(device.DialectUSRVCOM, ClientControlRFC2217)
+
+	// Escaped data byte, SET-BAUDRATE 300 split across reads, more data
+	out1, reply1 := tr.ClientToDevice([]byte{'/', IAC, IAC, IAC, SB, ComPortOption, SetBaudrate, 0x00})
+	out2, reply2 := tr.ClientToDevice([]byte{0x00, 0x01, 0x2C, IAC, SE, '!'})
+
+	want := append([]byte{'/', 0xFF}, BuildUSRVCOMPacket(device.SerialProfile{BaudRate: 300, DataBits: 8, Parity: 1, StopBits: 1})...)
+	want = append(want, '!')
+	if got := append(out1, out2...); !bytes.Equal(got, want) {
+		t.Errorf("to device = %x, want %x", got, want)
+	}
+	if len(reply1) != 0 {
+		t.Errorf("unexpected reply to incomplete frame: %x", reply1)
+	}
+	wantReply := []byte{IAC, SB, ComPortOption, SetBaudrate + ServerResponseOffset, 0x00, 0x00, 0x01, 0x2C, IAC, SE}
+	if !bytes.Equal(reply2, wantReply) {
+		t.Errorf("reply = %x, want %x", reply2, wantReply)
+	}
+
+	if profile := dev.SerialProfile(); profile == nil || profile.BaudRate != 300 {
+		t.Errorf("profile = %+v, want 300 baud", profile)
+	}
+	if sess.PortChanges != 1 {
+		t.Errorf("port changes = %d, want 1", sess.PortChanges)
+	}
+
+	// Device data is IAC escaped for the Telnet client
+	if got, _ := tr.DeviceToClient([]byte{0x01, 0xFF}); !bytes.Equal(got, []byte{0x01, 0xFF, 0xFF}) {
+		t.Errorf("to client = %x, want 01ffff", got)
+	}
+
+	// Option negotiation is answered once by the proxy
+	if _, reply := tr.ClientToDevice([]byte{IAC, 0xFB, ComPortOption}); !bytes.Equal(reply, []byte{IAC, 0xFD, ComPortOption}) {
+		t.Errorf("negotiation reply = %x, want IAC DO COM-PORT", reply)
+	}
+	if _, reply := tr.ClientToDevice([]byte{IAC, 0xFB, ComPortOption}); len(reply) != 0 {
+		t.Errorf("repeated negotiation reply = %x, want none", reply)
+	}
+}
+
+func TestTranslatorUSRVCOMClientToRFC2217Device(t *testing.T) {
+	tr, dev, _ := newTestTranslator(device.DialectRFC2217, ClientControlUSRVCOM)
+
+	sync := BuildUSRVCOMPacket(device.SerialProfile{BaudRate: 2400, DataBits: 7, Parity: 3, StopBits: 1})
+	in := append(append([]byte("ab"), sync...), 'c')
+	out, reply := tr.ClientToDevice(in)
+	if len(reply) != 0 {
+		t.Errorf("unexpected reply: %x", reply)
+	}
+
+	cfg := ParseUSRVCOM(sync)
+	want := append(append([]byte("ab"), cfg.BuildRFC2217Packet()...), 'c')
+	if !bytes.Equal(out, want) {
+		t.Errorf("to device = %x, want %x", out, want)
+	}
+	if profile := dev.SerialProfile(); profile == nil || profile.ModeString() != "7E1" {
+		t.Errorf("profile = %+v, want 7E1", profile)
+	}
+
+	// Device Telnet replies are stripped for USR-VCOM client
+	resp := append([]byte{'x'}, BuildRFC2217Packet([]RFC2217Command{{Command: SetBaudrate + ServerResponseOffset, Data: []byte{0, 0, 0x09, 0x60}}})...)
+	resp = append(resp, IAC, IAC)
+	if got, _ := tr.DeviceToClient(resp); !bytes.Equal(got, []byte{'x', 0xFF}) {
+		t.Errorf("to client = %x, want 78ff", got)
+	}
+
+	// Data with broken checksum is not a control packet
+	bad := append([]byte(nil), sync...)
+	bad[7]++
+	if out, _ := tr.ClientToDevice(bad); !bytes.Equal(out, bad) {
+		t.Errorf("to device = %x, want unchanged", out)
+	}
+}
+
+func TestTranslatorUnknownClientRawData(t *testing.T) {
+	sync := BuildUSRVCOMPacket(device.SerialProfile{BaudRate: 2400, DataBits: 7, Parity: 3, StopBits: 1})
+	in := append(append([]byte{0x01, 0x03}, sync...), 0x7A)
+
+	for _, dialect := range []string{device.DialectRFC2217, device.DialectNone} {
+		tr, dev, _ := newTestTranslator(dialect, ClientControlUnknown)
+		// Serial data may contain a valid looking Baud Rate Sync packet
+		if out, _ := tr.ClientToDevice(in); !bytes.Equal(out, in) {
+			t.Errorf("%s: to device = %x, want unchanged", dialect, out)
+		}
+		if profile := dev.SerialProfile(); profile != nil {
+			t.Errorf("%s: profile = %+v, want none", dialect, profile)
+		}
+		if c := tr.clientControl(); c != ClientControlUnknown {
+			t.Errorf("%s: client control = %d, want unknown", dialect, c)
+		}
+	}
+}
+
+func TestTranslatorDeviceDecoderSync(t *testing.T) {
+	tr, dev, _ := newTestTranslator(device.DialectRFC2217, ClientControlUnknown)
+
+	// Device reply split right before COM-PORT-OPTION
+	chunks := [][]byte{
+		{'x', IAC, SB},
+		{ComPortOption, SetBaudrate + ServerResponseOffset, 0x00, 0x00, 0x25, 0x80, IAC, SE, 'y'},
+	}
+	for _, chunk := range chunks {
+		if got, _ := tr.DeviceToClient(chunk); !bytes.Equal(got, chunk) {
+			t.Errorf("to client = %x, want unchanged %x", got, chunk)
+		}
+	}
+	if profile := dev.SerialProfile(); profile == nil || profile.BaudRate != 9600 {
+		t.Errorf("profile = %+v, want 9600 baud confirmed by device", profile)
+	}
+}
+
+func TestRFC2217MidSessionToUSRVCOMDevice(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+	dev, _ := env.registry.Get("device123")
+	dev.SetDialect(device.DialectUSRVCOM)
+
+	client, server := createTCPPair(t)
+	done := runHandler(t.Context(), env.handler, server)
+
+	// RFC2217 presets mark the client as Telnet
+	preset := []byte{IAC, SB, ComPortOption, SetBaudrate, 0x00, 0x00, 0x25, 0x80, IAC, SE}
+	client.Write(append(preset, []byte("AT+CONNECT=device123\r\n")...))
+	readUntilContains(t, client, "\xFF\xFA\x2C\x65\x00\x00\x25\x80\xFF\xF0", 2*time.Second)
+	readDevice(t, devConn) // initial Baud Rate Sync
+
+	// IEC 62056-21 style speed switch in the middle of the session
+	client.Write([]byte{IAC, SB, ComPortOption, SetBaudrate, 0x00, 0x00, 0x12, 0xC0, IAC, SE})
+	got := readDevice(t, devConn)
+	cfg := ParseUSRVCOM(got)
+	if cfg == nil || cfg.BaudRate != 4800 {
+		t.Fatalf("device got %x, want USR-VCOM 4800", got)
+	}
+	if resp := readUntilContains(t, client, "\xFF\xF0", 2*time.Second); resp != "\xFF\xFA\x2C\x65\x00\x00\x12\xC0\xFF\xF0" {
+		t.Errorf("client reply = %x", resp)
+	}
+
+	devConn.Close()
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
+
+// readDevice reads one chunk from device side of the connection
+func readDevice(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatalf("device read: %v", err)
+	}
+	return buf[:n]
+}
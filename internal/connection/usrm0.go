@@ -0,0 +1,338 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// USR M0/T24 Series Configuration Protocol (TCP232-302/304/306, T24)
+// Read Basic:           55 BD [password 6] [checksum]
+// Read Basic response:  55 BD [basic params 32] [checksum]                 (35 bytes)
+// Write Basic:          55 BF [password 6] [basic params 32] [reserved 25] [checksum] (65 bytes + checksum)
+// Write Basic response: FF 01 06 4B (OK) or FF 01 05 50 (wrong password)
+// Reset:                55 B1 5A -> BA 4B
+// Checksum is the sum of all bytes before it, low byte
+//
+// Basic params layout (32 bytes):
+//   0-3   local IP (reversed byte order)
+//   4-5   local port (LE)
+//   6-9   remote IP (reversed byte order)
+//   10-11 remote port (LE)
+//   12-14 baud rate (24-bit LE)
+//   15    serial parameter byte (same bit layout as USR-VCOM Baud Rate Sync)
+//   16    work mode
+//   17-31 device name (zero padded)
+
+const (
+	M0Header        = 0x55
+	M0CmdReadBasic  = 0xBD
+	M0CmdWriteBasic = 0xBF
+	M0CmdReset      = 0xB1
+
+	M0PasswordLen       = 6
+	M0BasicParamsLen    = 32
+	M0WriteParamsLen    = 63 // password + basic params + reserved
+	M0ReadResponseLen   = 35 // 55 BD + basic params + checksum
+	M0StatusResponseLen = 4  // FF 01 [cmd] [status]
+	M0DeviceNameLen     = 15
+
+	M0StatusOK            = 0x4B // 'K'
+	M0StatusError         = 0x45 // 'E'
+	M0StatusWrongPassword = 0x50 // 'P'
+
+	// M0DefaultTimeout is the default response timeout for configuration commands
+	M0DefaultTimeout = 3 * time.Second
+)
+
+// M0 work modes
+const (
+	M0WorkModeUDP         = 0
+	M0WorkModeTCPClient   = 1
+	M0WorkModeUDPServer   = 2
+	M0WorkModeTCPServer   = 3
+	M0WorkModeHTTPDClient = 4
+)
+
+// M0 configuration errors
+var (
+	ErrM0WrongPassword = errors.New("usr m0: wrong password")
+	ErrM0Failed        = errors.New("usr m0: command failed")
+	ErrM0BadResponse   = errors.New("usr m0: invalid response")
+)
+
+var m0ResetResponse = []byte{0xBA, M0StatusOK}
+
+// M0BasicParams represents basic parameters of USR M0/T24 module
+type M0BasicParams struct {
+	LocalIP    net.IP `json:"local_ip"`
+	LocalPort  uint16 `json:"local_port"`
+	RemoteIP   net.IP `json:"remote_ip"`
+	RemotePort uint16 `json:"remote_port"`
+	BaudRate   uint32 `json:"baud_rate"`
+	DataBits   uint8  `json:"data_bits"`
+	Parity     uint8  `json:"parity"` // 0=None, 1=Odd, 2=Even, 3=Mark, 4=Space
+	StopBits   uint8  `json:"stop_bits"`
+	WorkMode   uint8  `json:"work_mode"`
+	DeviceName string `json:"device_name"`
+}
+
+// ModeString returns mode string like "8N1", "8E1", etc.
+func (p *M0BasicParams) ModeString() string {
+	cfg := USRVCOMConfig{DataBits: p.DataBits, Parity: p.Parity, StopBits: p.StopBits}
+	return cfg.ModeString()
+}
+
+// WorkModeString returns human-readable work mode
+func (p *M0BasicParams) WorkModeString() string {
+	switch p.WorkMode {
+	case M0WorkModeUDP:
+		return "UDP"
+	case M0WorkModeTCPClient:
+		return "TCP Client"
+	case M0WorkModeUDPServer:
+		return "UDP Server"
+	case M0WorkModeTCPServer:
+		return "TCP Server"
+	case M0WorkModeHTTPDClient:
+		return "HTTPD Client"
+	default:
+		return fmt.Sprintf("Unknown(%d)", p.WorkMode)
+	}
+}
+
+// SerialProfile converts serial parameters to device serial profile
+func (p *M0BasicParams) SerialProfile() device.SerialProfile {
+	return device.SerialProfile{
+		BaudRate: p.BaudRate,
+		DataBits: p.DataBits,
+		Parity:   p.Parity + 1, // M0 0=None -> RFC2217 1=NONE
+		StopBits: p.StopBits,
+		Source:   "usr-m0",
+	}
+}
+
+// Encode encodes basic parameters (32 bytes)
+func (p *M0BasicParams) Encode() []byte {
+	buf := make([]byte, M0BasicParamsLen)
+	putM0IP(buf[0:4], p.LocalIP)
+	binary.LittleEndian.PutUint16(buf[4:6], p.LocalPort)
+	putM0IP(buf[6:10], p.RemoteIP)
+	binary.LittleEndian.PutUint16(buf[10:12], p.RemotePort)
+	buf[12] = byte(p.BaudRate)
+	buf[13] = byte(p.BaudRate >> 8)
+	buf[14] = byte(p.BaudRate >> 16)
+	buf[15] = buildUSRSerialParam(p.DataBits, p.Parity, p.StopBits)
+	buf[16] = p.WorkMode
+	copy(buf[17:17+M0DeviceNameLen], p.DeviceName)
+	return buf
+}
+
+// DecodeM0BasicParams decodes basic parameters (32 bytes)
+func DecodeM0BasicParams(data []byte) (*M0BasicParams, error) {
+	if len(data) < M0BasicParamsLen {
+		return nil, fmt.Errorf("%w: basic params %d bytes, want %d", ErrM0BadResponse, len(data), M0BasicParamsLen)
+	}
+	p := &M0BasicParams{
+		LocalIP:    getM0IP(data[0:4]),
+		LocalPort:  binary.LittleEndian.Uint16(data[4:6]),
+		RemoteIP:   getM0IP(data[6:10]),
+		RemotePort: binary.LittleEndian.Uint16(data[10:12]),
+		BaudRate:   uint32(data[12]) | uint32(data[13])<<8 | uint32(data[14])<<16,
+		WorkMode:   data[16],
+		DeviceName: trimUSRString(data[17 : 17+M0DeviceNameLen]),
+	}
+	p.DataBits, p.Parity, p.StopBits = parseUSRSerialParam(data[15])
+	return p, nil
+}
+
+// putM0IP writes IPv4 address in reversed byte order
+func putM0IP(dst []byte, ip net.IP) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return
+	}
+	for i := 0; i < 4; i++ {
+		dst[i] = ip4[3-i]
+	}
+}
+
+// getM0IP reads IPv4 address in reversed byte order
+func getM0IP(src []byte) net.IP {
+	return net.IPv4(src[3], src[2], src[1], src[0])
+}
+
+// m0Checksum calculates sum of all bytes, low byte
+func m0Checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+// m0Password encodes password field (5 characters + 00 padding)
+func m0Password(password string) []byte {
+	return padUSRString(password)
+}
+
+// BuildM0ReadBasic builds Read Basic command
+func BuildM0ReadBasic(password string) []byte {
+	packet := []byte{M0Header, M0CmdReadBasic}
+	packet = append(packet, m0Password(password)...)
+	return append(packet, m0Checksum(packet))
+}
+
+// BuildM0WriteBasic builds Write Basic command (65 bytes + checksum)
+func BuildM0WriteBasic(password string, params *M0BasicParams) []byte {
+	packet := make([]byte, 2+M0WriteParamsLen, 2+M0WriteParamsLen+1)
+	packet[0] = M0Header
+	packet[1] = M0CmdWriteBasic
+	copy(packet[2:2+M0PasswordLen], m0Password(password))
+	copy(packet[2+M0PasswordLen:], params.Encode())
+	return append(packet, m0Checksum(packet))
+}
+
+// BuildM0Reset builds Reset command
+func BuildM0Reset() []byte {
+	return []byte{M0Header, M0CmdReset, 0x5A}
+}
+
+// ParseM0ReadResponse parses Read Basic response (35 bytes)
+func ParseM0ReadResponse(data []byte) (*M0BasicParams, error) {
+	if err := ParseM0Status(data); err != nil {
+		return nil, err
+	}
+	if len(data) < M0ReadResponseLen || data[0] != M0Header || data[1] != M0CmdReadBasic {
+		return nil, fmt.Errorf("%w: %s", ErrM0BadResponse, hex.EncodeToString(data))
+	}
+	if sum := m0Checksum(data[:M0ReadResponseLen-1]); sum != data[M0ReadResponseLen-1] {
+		return nil, fmt.Errorf("%w: checksum %02X, expected %02X", ErrM0BadResponse, data[M0ReadResponseLen-1], sum)
+	}
+	return DecodeM0BasicParams(data[2 : 2+M0BasicParamsLen])
+}
+
+// ParseM0Status checks status response FF 01 [cmd] [status]
+// Returns nil for data that is not a status response or reports success
+func ParseM0Status(data []byte) error {
+	if len(data) < M0StatusResponseLen || data[0] != 0xFF || data[1] != 0x01 {
+		return nil
+	}
+	switch data[3] {
+	case M0StatusOK:
+		return nil
+	case M0StatusWrongPassword:
+		return ErrM0WrongPassword
+	default:
+		return fmt.Errorf("%w: status %02X", ErrM0Failed, data[3])
+	}
+}
+
+// M0Client sends configuration commands to USR M0/T24 module over a connection
+type M0Client struct {
+	Conn     net.Conn
+	Password string
+	Timeout  time.Duration
+}
+
+// ReadBasic reads basic parameters
+func (c *M0Client) ReadBasic() (*M0BasicParams, error) {
+	resp, err := c.exchange(BuildM0ReadBasic(c.Password), func(buf []byte) bool {
+		return len(buf) >= M0ReadResponseLen || isM0StatusResponse(buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseM0ReadResponse(resp)
+}
+
+// WriteBasic writes basic parameters
+func (c *M0Client) WriteBasic(params *M0BasicParams) error {
+	resp, err := c.exchange(BuildM0WriteBasic(c.Password, params), isM0StatusResponse)
+	if err != nil {
+		return err
+	}
+	if !isM0StatusResponse(resp) {
+		return fmt.Errorf("%w: %s", ErrM0BadResponse, hex.EncodeToString(resp))
+	}
+	return ParseM0Status(resp)
+}
+
+// Reset restarts the module
+func (c *M0Client) Reset() error {
+	resp, err := c.exchange(BuildM0Reset(), func(buf []byte) bool {
+		return len(buf) >= len(m0ResetResponse)
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(resp[:len(m0ResetResponse)], m0ResetResponse) {
+		return fmt.Errorf("%w: %s", ErrM0BadResponse, hex.EncodeToString(resp))
+	}
+	return nil
+}
+
+// isM0StatusResponse checks if buffer holds complete status response
+func isM0StatusResponse(buf []byte) bool {
+	return len(buf) >= M0StatusResponseLen && buf[0] == 0xFF && buf[1] == 0x01
+}
+
+// exchange writes a command and reads response until complete returns true
+// Leading bytes before the response header (e.g. Telnet NOP echo) are dropped
+func (c *M0Client) exchange(cmd []byte, complete func([]byte) bool) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = M0DefaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	log.Printf("[usrm0] sending: %s", hex.EncodeToString(cmd))
+	c.Conn.SetWriteDeadline(deadline)
+	_, err := c.Conn.Write(cmd)
+	c.Conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("usr m0: write: %w", err)
+	}
+
+	var resp []byte
+	buf := make([]byte, 256)
+	c.Conn.SetReadDeadline(deadline)
+	defer c.Conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			resp = append(resp, buf[:n]...)
+			resp = trimM0Garbage(resp)
+			if complete(resp) {
+				log.Printf("[usrm0] received: %s", hex.EncodeToString(resp))
+				return resp, nil
+			}
+		}
+		if err != nil {
+			if len(resp) > 0 {
+				log.Printf("[usrm0] partial response: %s", hex.EncodeToString(resp))
+			}
+			return nil, fmt.Errorf("usr m0: read: %w", err)
+		}
+	}
+}
+
+// trimM0Garbage drops bytes before the first possible response header (55, FF 01, BA)
+func trimM0Garbage(buf []byte) []byte {
+	for i, b := range buf {
+		switch {
+		case b == M0Header, b == m0ResetResponse[0]:
+			return buf[i:]
+		case b == 0xFF && (i+1 == len(buf) || buf[i+1] == 0x01):
+			return buf[i:]
+		}
+	}
+	return buf[:0]
+}
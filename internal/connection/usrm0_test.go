@@ -0,0 +1,196 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testM0Params() *M0BasicParams {
+	return &M0BasicParams{
+		LocalIP:    net.IPv4(192, 168, 0, 7),
+		LocalPort:  20108,
+		RemoteIP:   net.IPv4(192, 168, 0, 201),
+		RemotePort: 2217,
+		BaudRate:   9600,
+		DataBits:   8,
+		Parity:     2, // Even
+		StopBits:   1,
+		WorkMode:   M0WorkModeTCPClient,
+		DeviceName: "METER01",
+	}
+}
+
+func TestM0BasicParamsEncode(t *testing.T) {
+	buf := testM0Params().Encode()
+	if len(buf) != M0BasicParamsLen {
+		t.Fatalf("len = %d, want %d", len(buf), M0BasicParamsLen)
+	}
+
+	// IP in reversed byte order: 192.168.0.7 -> 07 00 A8 C0
+	if !bytes.Equal(buf[0:4], []byte{0x07, 0x00, 0xA8, 0xC0}) {
+		t.Errorf("local IP = %x", buf[0:4])
+	}
+	// Baud rate 9600 (24-bit LE): 80 25 00
+	if !bytes.Equal(buf[12:15], []byte{0x80, 0x25, 0x00}) {
+		t.Errorf("baud rate = %x, want 802500", buf[12:15])
+	}
+	// 8E1 parameter byte: 1B
+	if buf[15] != 0x1B {
+		t.Errorf("serial param = %02X, want 1B", buf[15])
+	}
+
+	decoded, err := DecodeM0BasicParams(buf)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := testM0Params()
+	if !decoded.LocalIP.Equal(want.LocalIP) || !decoded.RemoteIP.Equal(want.RemoteIP) ||
+		decoded.LocalPort != want.LocalPort || decoded.RemotePort != want.RemotePort ||
+		decoded.BaudRate != want.BaudRate || decoded.ModeString() != "8E1" ||
+		decoded.WorkMode != want.WorkMode || decoded.DeviceName != want.DeviceName {
+		t.Errorf("round trip mismatch: %+v", decoded)
+	}
+}
+
+func TestBuildM0Commands(t *testing.T) {
+	read := BuildM0ReadBasic("admin")
+	wantRead := []byte{0x55, 0xBD, 0x61, 0x64, 0x6D, 0x69, 0x6E, 0x00, 0x00}
+	wantRead[8] = m0Checksum(wantRead[:8])
+	if !bytes.Equal(read, wantRead) {
+		t.Errorf("read basic = %x, want %x", read, wantRead)
+	}
+
+	write := BuildM0WriteBasic("admin", testM0Params())
+	if len(write) != 66 {
+		t.Fatalf("write basic len = %d, want 65 + checksum", len(write))
+	}
+	if write[0] != 0x55 || write[1] != 0xBF {
+		t.Errorf("write basic header = %x, want 55bf", write[:2])
+	}
+	if write[65] != m0Checksum(write[:65]) {
+		t.Errorf("write basic checksum = %02X", write[65])
+	}
+
+	if reset := BuildM0Reset(); !bytes.Equal(reset, []byte{0x55, 0xB1, 0x5A}) {
+		t.Errorf("reset = %x, want 55b15a", reset)
+	}
+}
+
+func TestParseM0Status(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"write ok", []byte{0xFF, 0x01, 0x06, 0x4B}, nil},
+		{"wrong password", []byte{0xFF, 0x01, 0x05, 0x50}, ErrM0WrongPassword},
+		{"error", []byte{0xFF, 0x01, 0x06, 0x45}, ErrM0Failed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ParseM0Status(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("ParseM0Status() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseM0ReadResponse(t *testing.T) {
+	resp := []byte{0x55, 0xBD}
+	resp = append(resp, testM0Params().Encode()...)
+	resp = append(resp, m0Checksum(resp))
+	if len(resp) != M0ReadResponseLen {
+		t.Fatalf("response len = %d, want %d", len(resp), M0ReadResponseLen)
+	}
+
+	params, err := ParseM0ReadResponse(resp)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if params.BaudRate != 9600 || params.ModeString() != "8E1" {
+		t.Errorf("params = %d %s, want 9600 8E1", params.BaudRate, params.ModeString())
+	}
+
+	profile := params.SerialProfile()
+	if profile.Parity != 3 || profile.ModeString() != "8E1" {
+		t.Errorf("profile parity = %d (%s), want RFC2217 EVEN(3)", profile.Parity, profile.ModeString())
+	}
+
+	resp[10] ^= 0xFF
+	if _, err := ParseM0ReadResponse(resp); !errors.Is(err, ErrM0BadResponse) {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+
+	if _, err := ParseM0ReadResponse([]byte{0xFF, 0x01, 0x05, 0x50}); !errors.Is(err, ErrM0WrongPassword) {
+		t.Errorf("expected wrong password, got %v", err)
+	}
+}
+
+// fakeM0Module answers configuration commands like USR M0 module
+func fakeM0Module(t *testing.T, conn net.Conn, params *M0BasicParams, password string) {
+	t.Helper()
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			cmd := buf[:n]
+			switch {
+			case bytes.Equal(cmd, BuildM0Reset()):
+				conn.Write([]byte{0xBA, 0x4B})
+			case len(cmd) > 8 && trimUSRString(cmd[2:8]) != password:
+				conn.Write([]byte{0xFF, 0x01, 0x05, 0x50})
+			case cmd[1] == M0CmdReadBasic:
+				resp := append([]byte{0x55, 0xBD}, params.Encode()...)
+				// Telnet NOP before response must be skipped by the client
+				conn.Write(append([]byte{0xFF, 0xF1}, append(resp, m0Checksum(resp))...))
+			case cmd[1] == M0CmdWriteBasic:
+				p, _ := DecodeM0BasicParams(cmd[8:])
+				*params = *p
+				conn.Write([]byte{0xFF, 0x01, 0x06, 0x4B})
+			}
+		}
+	}()
+}
+
+func TestM0Client(t *testing.T) {
+	proxySide, moduleSide := net.Pipe()
+	defer proxySide.Close()
+	defer moduleSide.Close()
+
+	params := testM0Params()
+	fakeM0Module(t, moduleSide, params, "admin")
+
+	client := &M0Client{Conn: proxySide, Password: "admin", Timeout: time.Second}
+
+	got, err := client.ReadBasic()
+	if err != nil {
+		t.Fatalf("ReadBasic: %v", err)
+	}
+	if got.DeviceName != "METER01" || got.BaudRate != 9600 {
+		t.Errorf("ReadBasic = %+v", got)
+	}
+
+	got.BaudRate = 2400
+	if err := client.WriteBasic(got); err != nil {
+		t.Fatalf("WriteBasic: %v", err)
+	}
+	if params.BaudRate != 2400 {
+		t.Errorf("module baud rate = %d, want 2400", params.BaudRate)
+	}
+
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+
+	client.Password = "wrong"
+	if _, err := client.ReadBasic(); !errors.Is(err, ErrM0WrongPassword) {
+		t.Errorf("expected wrong password, got %v", err)
+	}
+}
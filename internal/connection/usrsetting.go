@@ -0,0 +1,376 @@
+package connection
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// USR Setting Agreement Protocol (USR-TCP232-410s, N5xx, E2, ED2)
+// Request format:  FF [len] [cmd] [MAC 6] [username 6] [password 6] [params...] [checksum]
+// Response format: FF [len] [cmd] [status] [data...] [checksum]
+// len counts bytes from cmd to the last parameter (checksum excluded)
+// Request checksum is the sum of bytes from len to the last parameter
+
+const (
+	USRSettingHeader            = 0xFF
+	USRSettingMinPacketLen      = 4  // FF 01 01 02 (Search)
+	USRSettingAuthLen           = 18 // MAC + username + password
+	USRSettingSearchResponseLen = 36
+	USRSettingSerialParamsLen   = 8 // baud(4) + data + parity + stop + flow
+
+	// Setting Agreement commands
+	USRSettingCmdSearch      = 0x01
+	USRSettingCmdReset       = 0x02
+	USRSettingCmdReadConfig  = 0x03
+	USRSettingCmdStore       = 0x04
+	USRSettingCmdBasic       = 0x05
+	USRSettingCmdSerialPort0 = 0x06
+	USRSettingCmdSerialPort1 = 0x07
+	USRSettingCmdSerialPort2 = 0x08
+	USRSettingCmdCloud       = 0x10
+
+	// Response status codes
+	USRSettingStatusOK            = 0x4B // 'K'
+	USRSettingStatusError         = 0x45 // 'E'
+	USRSettingStatusWrongPassword = 0x50 // 'P'
+)
+
+// USRSettingSerial represents serial port parameters from a Serial Port command
+type USRSettingSerial struct {
+	Port        int    // serial port index (0-2)
+	BaudRate    uint32 // little-endian 32-bit in packet
+	DataBits    uint8  // 5-8
+	Parity      uint8  // 1=None, 2=Odd, 3=Even, 4=Mark, 5=Space (same as RFC2217)
+	StopBits    uint8  // 1 or 2
+	FlowControl uint8  // 1=None, 3=Hardware
+}
+
+// ModeString returns mode string like "8N1", "8E1", etc.
+func (s *USRSettingSerial) ModeString() string {
+	parityChar := []byte{'N', 'O', 'E', 'M', 'S'}
+	p := byte('?')
+	if s.Parity >= 1 && int(s.Parity) <= len(parityChar) {
+		p = parityChar[s.Parity-1]
+	}
+	return fmt.Sprintf("%d%c%d", s.DataBits, p, s.StopBits)
+}
+
+// USRSettingPacket represents a parsed Setting Agreement request
+type USRSettingPacket struct {
+	Command  byte
+	MAC      []byte // 6 bytes, empty for Search
+	Username string
+	Password string
+	Params   []byte
+	Serial   *USRSettingSerial // parsed for Serial Port commands
+	Valid    bool              // true if packet was valid
+	RawData  []byte            // original packet data
+}
+
+// CommandName returns human-readable command name
+func (p *USRSettingPacket) CommandName() string {
+	switch p.Command {
+	case USRSettingCmdSearch:
+		return "Search"
+	case USRSettingCmdReset:
+		return "Reset"
+	case USRSettingCmdReadConfig:
+		return "Read Config"
+	case USRSettingCmdStore:
+		return "Store Settings"
+	case USRSettingCmdBasic:
+		return "Basic Settings"
+	case USRSettingCmdSerialPort0, USRSettingCmdSerialPort1, USRSettingCmdSerialPort2:
+		return fmt.Sprintf("Serial Port %d", p.Command-USRSettingCmdSerialPort0)
+	case USRSettingCmdCloud:
+		return "USR Cloud"
+	default:
+		return fmt.Sprintf("Unknown(%02X)", p.Command)
+	}
+}
+
+// String returns human-readable description
+func (p *USRSettingPacket) String() string {
+	if !p.Valid {
+		return "USR-Setting: <invalid>"
+	}
+	if p.Serial != nil {
+		return fmt.Sprintf("USR-Setting: %s, %d baud, %s",
+			p.CommandName(), p.Serial.BaudRate, p.Serial.ModeString())
+	}
+	return fmt.Sprintf("USR-Setting: %s", p.CommandName())
+}
+
+// isUSRSettingCommand checks if cmd is a known Setting Agreement command
+func isUSRSettingCommand(cmd byte) bool {
+	switch cmd {
+	case USRSettingCmdSearch, USRSettingCmdReset, USRSettingCmdReadConfig,
+		USRSettingCmdStore, USRSettingCmdBasic, USRSettingCmdSerialPort0,
+		USRSettingCmdSerialPort1, USRSettingCmdSerialPort2, USRSettingCmdCloud:
+		return true
+	}
+	return false
+}
+
+// usrSettingPacketLen returns full packet length from the length byte
+func usrSettingPacketLen(lenByte byte) int {
+	return int(lenByte) + 3 // header + len + checksum
+}
+
+// usrSettingChecksum calculates request checksum (sum of bytes, low byte)
+func usrSettingChecksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+// usrSettingResponseChecksum calculates response checksum (subtraction from 0x00)
+func usrSettingResponseChecksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum -= b
+	}
+	return sum
+}
+
+// IsUSRSetting checks if data starts with a complete Setting Agreement request
+// The length byte must not look like a Telnet command (F0-FF) and the checksum must match,
+// so RFC2217 data (FF FA 2C ...) is never mistaken for a Setting Agreement packet
+func IsUSRSetting(data []byte) bool {
+	if len(data) < USRSettingMinPacketLen || data[0] != USRSettingHeader {
+		return false
+	}
+	length := data[1]
+	if length == 0 || length >= SE {
+		return false
+	}
+	total := usrSettingPacketLen(length)
+	if len(data) < total {
+		return false
+	}
+	if !isUSRSettingCommand(data[2]) {
+		return false
+	}
+	// Only Search has no authentication block
+	if data[2] != USRSettingCmdSearch && int(length) < 1+USRSettingAuthLen {
+		return false
+	}
+	return usrSettingChecksum(data[1:total-1]) == data[total-1]
+}
+
+// ParseUSRSetting parses Setting Agreement request from data
+// Returns nil if data doesn't contain valid Setting Agreement packet
+func ParseUSRSetting(data []byte) *USRSettingPacket {
+	idx := -1
+	for i := 0; i <= len(data)-USRSettingMinPacketLen; i++ {
+		if data[i] == USRSettingHeader && IsUSRSetting(data[i:]) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil
+	}
+
+	total := usrSettingPacketLen(data[idx+1])
+	packet := data[idx : idx+total]
+	body := packet[3 : total-1] // after cmd, before checksum
+
+	p := &USRSettingPacket{
+		Command: packet[2],
+		Valid:   true,
+		RawData: packet,
+	}
+
+	if p.Command == USRSettingCmdSearch {
+		return p
+	}
+
+	p.MAC = body[0:6]
+	p.Username = trimUSRString(body[6:12])
+	p.Password = trimUSRString(body[12:18])
+	p.Params = body[USRSettingAuthLen:]
+
+	if p.Command >= USRSettingCmdSerialPort0 && p.Command <= USRSettingCmdSerialPort2 {
+		if len(p.Params) >= USRSettingSerialParamsLen {
+			p.Serial = &USRSettingSerial{
+				Port:        int(p.Command - USRSettingCmdSerialPort0),
+				BaudRate:    binary.LittleEndian.Uint32(p.Params[0:4]),
+				DataBits:    p.Params[4],
+				Parity:      p.Params[5],
+				StopBits:    p.Params[6],
+				FlowControl: p.Params[7],
+			}
+		} else {
+			log.Printf("[usrsetting] %s: short serial parameters (%d bytes)", p.CommandName(), len(p.Params))
+		}
+	}
+
+	return p
+}
+
+// trimUSRString converts zero-padded field to string
+func trimUSRString(field []byte) string {
+	if i := strings.IndexByte(string(field), 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+// padUSRString converts string to 6-byte field (5 characters + 00 padding)
+func padUSRString(s string) []byte {
+	field := make([]byte, 6)
+	copy(field[:5], s)
+	return field
+}
+
+// BuildUSRSettingPacket encodes Setting Agreement request
+// mac, username and password are ignored for Search
+func BuildUSRSettingPacket(cmd byte, mac []byte, username, password string, params []byte) []byte {
+	var body []byte
+	body = append(body, cmd)
+	if cmd != USRSettingCmdSearch {
+		macField := make([]byte, 6)
+		copy(macField, mac)
+		body = append(body, macField...)
+		body = append(body, padUSRString(username)...)
+		body = append(body, padUSRString(password)...)
+		body = append(body, params...)
+	}
+
+	packet := []byte{USRSettingHeader, byte(len(body))}
+	packet = append(packet, body...)
+	return append(packet, usrSettingChecksum(packet[1:]))
+}
+
+// EncodeParams encodes serial port parameters for Serial Port command
+func (s *USRSettingSerial) EncodeParams() []byte {
+	params := make([]byte, USRSettingSerialParamsLen)
+	binary.LittleEndian.PutUint32(params[0:4], s.BaudRate)
+	params[4] = s.DataBits
+	params[5] = s.Parity
+	params[6] = s.StopBits
+	params[7] = s.FlowControl
+	return params
+}
+
+// BuildStatusResponse builds short status response: FF 01 [cmd] [status]
+func (p *USRSettingPacket) BuildStatusResponse(status byte) []byte {
+	return []byte{USRSettingHeader, 0x01, p.Command, status}
+}
+
+// BuildUSRSettingSearchResponse builds 36-byte Search response
+// FF 24 01 [status] [IP 4 bytes] [MAC 6 bytes] [firmware] [device_name...] [checksum]
+func BuildUSRSettingSearchResponse(ip net.IP, mac []byte, firmware byte, name string) []byte {
+	resp := make([]byte, USRSettingSearchResponseLen)
+	resp[0] = USRSettingHeader
+	resp[1] = USRSettingSearchResponseLen
+	resp[2] = USRSettingCmdSearch
+	resp[3] = 0x00 // status
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(resp[4:8], ip4)
+	}
+	copy(resp[8:14], mac)
+	resp[14] = firmware
+	copy(resp[15:USRSettingSearchResponseLen-1], name)
+	resp[USRSettingSearchResponseLen-1] = usrSettingResponseChecksum(resp[1 : USRSettingSearchResponseLen-1])
+	return resp
+}
+
+// BuildResponse builds the proxy response for a Setting Agreement request
+// Serial Port and other write commands are acknowledged, Read Config is not supported
+func (p *USRSettingPacket) BuildResponse(localAddr net.Addr) []byte {
+	switch p.Command {
+	case USRSettingCmdSearch:
+		var ip net.IP
+		if tcpAddr, ok := localAddr.(*net.TCPAddr); ok {
+			ip = tcpAddr.IP
+		}
+		return BuildUSRSettingSearchResponse(ip, nil, 0, "RFC2217-PROXY")
+	case USRSettingCmdReadConfig:
+		return p.BuildStatusResponse(USRSettingStatusError)
+	default:
+		return p.BuildStatusResponse(USRSettingStatusOK)
+	}
+}
+
+// Respond sends status response back to the sender
+func (p *USRSettingPacket) Respond(conn net.Conn) error {
+	resp := p.BuildResponse(conn.LocalAddr())
+	log.Printf("[usrsetting] %s: sending response: %s", p.CommandName(), hex.EncodeToString(resp))
+	_, err := conn.Write(resp)
+	return err
+}
+
+// ToRFC2217Commands converts Serial Port parameters to RFC2217 commands
+// Returns nil for commands without serial parameters
+func (p *USRSettingPacket) ToRFC2217Commands() []RFC2217Command {
+	if !p.Valid || p.Serial == nil {
+		return nil
+	}
+
+	var commands []RFC2217Command
+
+	// SET-BAUDRATE (command 1)
+	baudData := make([]byte, 4)
+	binary.BigEndian.PutUint32(baudData, p.Serial.BaudRate)
+	commands = append(commands, RFC2217Command{
+		Command: SetBaudrate,
+		Data:    baudData,
+	})
+
+	// SET-DATASIZE (command 2)
+	commands = append(commands, RFC2217Command{
+		Command: SetDatasize,
+		Data:    []byte{p.Serial.DataBits},
+	})
+
+	// SET-PARITY (command 3) - Setting Agreement uses RFC2217 values as is
+	commands = append(commands, RFC2217Command{
+		Command: SetParity,
+		Data:    []byte{p.Serial.Parity},
+	})
+
+	// SET-STOPSIZE (command 4)
+	commands = append(commands, RFC2217Command{
+		Command: SetStopsize,
+		Data:    []byte{p.Serial.StopBits},
+	})
+
+	// SET-CONTROL (command 5): 1=no flow control, 3=hardware flow control
+	// Setting Agreement flow control values match RFC2217 SET-CONTROL values
+	if p.Serial.FlowControl == 1 || p.Serial.FlowControl == 3 {
+		commands = append(commands, RFC2217Command{
+			Command: SetControl,
+			Data:    []byte{p.Serial.FlowControl},
+		})
+	}
+
+	return commands
+}
+
+// BuildRFC2217Packet builds RFC2217 packet for sending to device
+func (p *USRSettingPacket) BuildRFC2217Packet() []byte {
+	return BuildRFC2217Packet(p.ToRFC2217Commands())
+}
+
+// LogConfig logs the parsed packet
+func (p *USRSettingPacket) LogConfig(prefix string) {
+	if !p.Valid {
+		return
+	}
+	if p.Serial != nil {
+		log.Printf("[usrsetting] %s: %s (port %d): %d baud, %d data bits, parity %d, %d stop bits, flow %d (%s)",
+			prefix, p.CommandName(), p.Serial.Port, p.Serial.BaudRate, p.Serial.DataBits,
+			p.Serial.Parity, p.Serial.StopBits, p.Serial.FlowControl, p.Serial.ModeString())
+	} else {
+		log.Printf("[usrsetting] %s: %s", prefix, p.CommandName())
+	}
+	log.Printf("[usrsetting] %s: raw packet: %s", prefix, hex.EncodeToString(p.RawData))
+}
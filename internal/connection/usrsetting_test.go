@@ -0,0 +1,197 @@
+package connection
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// Serial Port 0: MAC AC CF 23 66 66 67, admin/admin, 9600 8N1, no flow control
+var usrSettingSerialPort0 = []byte{
+	0xFF, 0x1B, 0x06,
+	0xAC, 0xCF, 0x23, 0x66, 0x66, 0x67, // MAC
+	0x61, 0x64, 0x6D, 0x69, 0x6E, 0x00, // admin
+	0x61, 0x64, 0x6D, 0x69, 0x6E, 0x00, // admin
+	0x80, 0x25, 0x00, 0x00, 0x08, 0x01, 0x01, 0x01, // 9600 8N1, flow none
+	0xB4, // checksum
+}
+
+func TestParseUSRSetting(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCmd  byte
+		wantBaud uint32
+		wantMode string
+		wantNil  bool
+	}{
+		{
+			name:    "search",
+			data:    []byte{0xFF, 0x01, 0x01, 0x02},
+			wantCmd: USRSettingCmdSearch,
+		},
+		{
+			name:     "serial port 0 9600 8N1",
+			data:     usrSettingSerialPort0,
+			wantCmd:  USRSettingCmdSerialPort0,
+			wantBaud: 9600,
+			wantMode: "8N1",
+		},
+		{
+			name:     "with prefix garbage",
+			data:     append([]byte{0x00, 0x13}, usrSettingSerialPort0...),
+			wantCmd:  USRSettingCmdSerialPort0,
+			wantBaud: 9600,
+			wantMode: "8N1",
+		},
+		{
+			name:    "bad checksum",
+			data:    []byte{0xFF, 0x01, 0x01, 0x03},
+			wantNil: true,
+		},
+		{
+			name:    "unknown command",
+			data:    []byte{0xFF, 0x01, 0x20, 0x21},
+			wantNil: true,
+		},
+		{
+			name:    "too short",
+			data:    []byte{0xFF, 0x01, 0x01},
+			wantNil: true,
+		},
+		{
+			name:    "reset without auth block",
+			data:    []byte{0xFF, 0x01, 0x02, 0x03},
+			wantNil: true,
+		},
+		{
+			name:    "RFC2217 data",
+			data:    []byte{0xFF, 0xFA, 0x2C, 0x01, 0x00, 0x00, 0x25, 0x80, 0xFF, 0xF0},
+			wantNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := ParseUSRSetting(tt.data)
+
+			if tt.wantNil {
+				if pkt != nil {
+					t.Errorf("expected nil, got %+v", pkt)
+				}
+				return
+			}
+
+			if pkt == nil {
+				t.Fatal("expected packet, got nil")
+			}
+			if pkt.Command != tt.wantCmd {
+				t.Errorf("Command = %02X, want %02X", pkt.Command, tt.wantCmd)
+			}
+			if tt.wantBaud == 0 {
+				if pkt.Serial != nil {
+					t.Errorf("expected no serial parameters, got %+v", pkt.Serial)
+				}
+				return
+			}
+			if pkt.Serial == nil {
+				t.Fatal("expected serial parameters")
+			}
+			if pkt.Serial.BaudRate != tt.wantBaud {
+				t.Errorf("BaudRate = %d, want %d", pkt.Serial.BaudRate, tt.wantBaud)
+			}
+			if pkt.Serial.ModeString() != tt.wantMode {
+				t.Errorf("ModeString() = %q, want %q", pkt.Serial.ModeString(), tt.wantMode)
+			}
+			if pkt.Username != "admin" || pkt.Password != "admin" {
+				t.Errorf("credentials = %q/%q, want admin/admin", pkt.Username, pkt.Password)
+			}
+			if !bytes.Equal(pkt.MAC, []byte{0xAC, 0xCF, 0x23, 0x66, 0x66, 0x67}) {
+				t.Errorf("MAC = %x", pkt.MAC)
+			}
+		})
+	}
+}
+
+func TestBuildUSRSettingPacket(t *testing.T) {
+	search := BuildUSRSettingPacket(USRSettingCmdSearch, nil, "", "", nil)
+	if !bytes.Equal(search, []byte{0xFF, 0x01, 0x01, 0x02}) {
+		t.Errorf("search = %x, want ff010102", search)
+	}
+
+	serial := &USRSettingSerial{BaudRate: 9600, DataBits: 8, Parity: 1, StopBits: 1, FlowControl: 1}
+	mac := []byte{0xAC, 0xCF, 0x23, 0x66, 0x66, 0x67}
+	packet := BuildUSRSettingPacket(USRSettingCmdSerialPort0, mac, "admin", "admin", serial.EncodeParams())
+	if !bytes.Equal(packet, usrSettingSerialPort0) {
+		t.Errorf("serial port 0 =\n%x\nwant\n%x", packet, usrSettingSerialPort0)
+	}
+}
+
+func TestUSRSettingResponses(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  byte
+		want []byte
+	}{
+		{"reset", USRSettingCmdReset, []byte{0xFF, 0x01, 0x02, 0x4B}},
+		{"store", USRSettingCmdStore, []byte{0xFF, 0x01, 0x04, 0x4B}},
+		{"basic", USRSettingCmdBasic, []byte{0xFF, 0x01, 0x05, 0x4B}},
+		{"serial port 0", USRSettingCmdSerialPort0, []byte{0xFF, 0x01, 0x06, 0x4B}},
+		{"read config unsupported", USRSettingCmdReadConfig, []byte{0xFF, 0x01, 0x03, 0x45}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := &USRSettingPacket{Command: tt.cmd, Valid: true}
+			if got := pkt.BuildResponse(nil); !bytes.Equal(got, tt.want) {
+				t.Errorf("BuildResponse() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildUSRSettingSearchResponse(t *testing.T) {
+	mac := []byte{0xD8, 0xB0, 0x4C, 0xC0, 0x0D, 0x65}
+	resp := BuildUSRSettingSearchResponse(net.IPv4(192, 168, 1, 107), mac, 0x01, "USR-N510")
+
+	if len(resp) != USRSettingSearchResponseLen {
+		t.Fatalf("len = %d, want %d", len(resp), USRSettingSearchResponseLen)
+	}
+	// FF 24 01 00 C0 A8 01 6B D8 B0 4C C0 0D 65 ...
+	wantPrefix := []byte{0xFF, 0x24, 0x01, 0x00, 0xC0, 0xA8, 0x01, 0x6B, 0xD8, 0xB0, 0x4C, 0xC0, 0x0D, 0x65}
+	if !bytes.HasPrefix(resp, wantPrefix) {
+		t.Errorf("response = %x, want prefix %x", resp, wantPrefix)
+	}
+
+	// Subtraction checksum: 0x00 minus all bytes from len to checksum is zero
+	var sum byte
+	for _, b := range resp[1:] {
+		sum += b
+	}
+	if sum != 0 {
+		t.Errorf("checksum mismatch: sum = %02X", sum)
+	}
+}
+
+func TestUSRSettingPacket_ToRFC2217Commands(t *testing.T) {
+	pkt := ParseUSRSetting(usrSettingSerialPort0)
+	if pkt == nil {
+		t.Fatal("expected packet")
+	}
+
+	want := BuildRFC2217Packet([]RFC2217Command{
+		{Command: SetBaudrate, Data: []byte{0x00, 0x00, 0x25, 0x80}},
+		{Command: SetDatasize, Data: []byte{8}},
+		{Command: SetParity, Data: []byte{1}},
+		{Command: SetStopsize, Data: []byte{1}},
+		{Command: SetControl, Data: []byte{1}},
+	})
+	if got := pkt.BuildRFC2217Packet(); !bytes.Equal(got, want) {
+		t.Errorf("BuildRFC2217Packet() =\n%x\nwant\n%x", got, want)
+	}
+
+	search := ParseUSRSetting([]byte{0xFF, 0x01, 0x01, 0x02})
+	if cmds := search.ToRFC2217Commands(); cmds != nil {
+		t.Errorf("search should not produce RFC2217 commands, got %d", len(cmds))
+	}
+}
@@ -91,31 +91,7 @@ func ParseUSRVCOM(data []byte) *USRVCOMConfig {
 	baudRate := uint32(packet[3])<<16 | uint32(packet[4])<<8 | uint32(packet[5])
 
 	// Parse parameter byte
-	param := packet[6]
-	// Bit 1-0: Data bits (00=5, 01=6, 10=7, 11=8)
-	// Bit 2:   Stop bits (0=1 bit, 1=2 bits)
-	// Bit 3:   Parity enable (0=disabled, 1=enabled)
-	// Bit 5-4: Parity type (00=ODD, 01=EVEN, 10=Mark, 11=Space)
-	dataBits := uint8(5 + (param & 0x03))
-	stopBits := uint8(1)
-	if param&0x04 != 0 {
-		stopBits = 2
-	}
-	parity := uint8(0) // None
-	if param&0x08 != 0 {
-		// Parity enabled
-		parityType := (param >> 4) & 0x03
-		switch parityType {
-		case 0:
-			parity = 1 // Odd
-		case 1:
-			parity = 2 // Even
-		case 2:
-			parity = 3 // Mark
-		case 3:
-			parity = 4 // Space
-		}
-	}
+	dataBits, parity, stopBits := parseUSRSerialParam(packet[6])
 
 	// Verify checksum
 	checksum := packet[7]
@@ -135,6 +111,42 @@ func ParseUSRVCOM(data []byte) *USRVCOMConfig {
 	}
 }
 
+// parseUSRSerialParam decodes USR serial parameter byte
+// Bit 1-0: Data bits (00=5, 01=6, 10=7, 11=8)
+// Bit 2:   Stop bits (0=1 bit, 1=2 bits)
+// Bit 3:   Parity enable (0=disabled, 1=enabled)
+// Bit 5-4: Parity type (00=ODD, 01=EVEN, 10=Mark, 11=Space)
+// Returned parity: 0=None, 1=Odd, 2=Even, 3=Mark, 4=Space
+func parseUSRSerialParam(param byte) (dataBits, parity, stopBits uint8) {
+	dataBits = 5 + (param & 0x03)
+	stopBits = 1
+	if param&0x04 != 0 {
+		stopBits = 2
+	}
+	if param&0x08 != 0 {
+		// Parity enabled: type 0-3 maps to Odd, Even, Mark, Space
+		parity = 1 + (param>>4)&0x03
+	}
+	return dataBits, parity, stopBits
+}
+
+// buildUSRSerialParam encodes USR serial parameter byte (inverse of parseUSRSerialParam)
+func buildUSRSerialParam(dataBits, parity, stopBits uint8) byte {
+	var param byte
+	if dataBits >= 5 && dataBits <= 8 {
+		param = dataBits - 5
+	} else {
+		param = 0x03 // 8 data bits
+	}
+	if stopBits == 2 {
+		param |= 0x04
+	}
+	if parity >= 1 && parity <= 4 {
+		param |= 0x08 | (parity-1)<<4
+	}
+	return param
+}
+
 // IsUSRVCOM checks if data starts with USR-VCOM header
 func IsUSRVCOM(data []byte) bool {
 	if len(data) < USRVCOMHeaderLen {
@@ -185,19 +197,7 @@ func (c *USRVCOMConfig) ToRFC2217Commands() []RFC2217Command {
 
 // BuildRFC2217Packet builds RFC2217 packet for sending to device
 func (c *USRVCOMConfig) BuildRFC2217Packet() []byte {
-	commands := c.ToRFC2217Commands()
-	if len(commands) == 0 {
-		return nil
-	}
-
-	var packet []byte
-	for _, cmd := range commands {
-		// IAC SB COM-PORT-OPTION <cmd> <data...> IAC SE
-		packet = append(packet, IAC, SB, ComPortOption, cmd.Command)
-		packet = append(packet, cmd.Data...)
-		packet = append(packet, IAC, SE)
-	}
-	return packet
+	return BuildRFC2217Packet(c.ToRFC2217Commands())
 }
 
 // SendToDevice sends RFC2217 commands to device based on USR-VCOM config
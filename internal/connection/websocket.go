@@ -0,0 +1,268 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/wsconn"
+)
+
+// WebSocket control message types
+const (
+	WSControlConnected = "connected" // proxy -> client: session established
+	WSControlSerial    = "serial"    // client -> proxy: port settings, proxy -> client: confirmed settings
+	WSControlError     = "error"     // proxy -> client: error description
+)
+
+// wsWriteTimeout limits WebSocket control frame writes
+const wsWriteTimeout = 10 * time.Second
+
+// wsReadLimit limits a received WebSocket frame to a few bridge buffers,
+// a larger frame closes the connection before it is read into memory
+const wsReadLimit = 16 << 10
+
+// WSControl is a JSON control message in a WebSocket text frame
+// Zero port settings in client messages query current values
+type WSControl struct {
+	Type      string `json:"type"`
+	BaudRate  uint32 `json:"baud_rate,omitempty"`
+	DataBits  uint8  `json:"data_bits,omitempty"`
+	Parity    uint8  `json:"parity,omitempty"` // 1=None, 2=Odd, 3=Even, 4=Mark, 5=Space
+	StopBits  uint8  `json:"stop_bits,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// commands converts port settings of control message to RFC2217 commands
+func (c *WSControl) commands() []RFC2217Command {
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, c.BaudRate)
+	return []RFC2217Command{
+		{Command: SetBaudrate, Data: baud},
+		{Command: SetDatasize, Data: []byte{c.DataBits}},
+		{Command: SetParity, Data: []byte{c.Parity}},
+		{Command: SetStopsize, Data: []byte{c.StopBits}},
+	}
+}
+
+// applyReply stores value of RFC2217 server reply in control message
+func (c *WSControl) applyReply(cmd RFC2217Command) bool {
+	if len(cmd.Data) == 0 {
+		return false
+	}
+	switch cmd.Command - ServerResponseOffset {
+	case SetBaudrate:
+		if len(cmd.Data) < 4 {
+			return false
+		}
+		c.BaudRate = binary.BigEndian.Uint32(cmd.Data)
+	case SetDatasize:
+		c.DataBits = cmd.Data[0]
+	case SetParity:
+		c.Parity = cmd.Data[0]
+	case SetStopsize:
+		c.StopBits = cmd.Data[0]
+	default:
+		return false
+	}
+	return true
+}
+
+// WSClientConn presents a WebSocket client to the bridge as RFC2217 Telnet client
+// Binary frames carry serial data, text frames carry WSControl messages
+// translated to and from COM-PORT-OPTION subnegotiations
+type WSClientConn struct {
+	ws      *websocket.Conn
+	pending []byte // data for Read
+
+	wmu sync.Mutex // serializes writes and decoder state
+	dec rfc2217.Decoder
+}
+
+// NewWSClientConn wraps WebSocket connection
+func NewWSClientConn(ws *websocket.Conn) *WSClientConn {
+	return &WSClientConn{ws: ws}
+}
+
+// Read returns client data as Telnet stream (IAC escaped, settings as RFC2217)
+func (c *WSClientConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msgType, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		switch msgType {
+		case websocket.BinaryMessage:
+			c.pending = rfc2217.Escape(msg)
+		case websocket.TextMessage:
+			var ctl WSControl
+			if err := json.Unmarshal(msg, &ctl); err != nil || ctl.Type != WSControlSerial {
+				c.WriteControl(WSControl{Type: WSControlError, Error: "invalid control message"})
+				continue
+			}
+			c.pending = BuildRFC2217Packet(ctl.commands())
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends Telnet stream to the client: data as binary frames,
+// RFC2217 replies as serial control message, NOP keepalive as ping
+func (c *WSClientConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var data []byte
+	var reply WSControl
+	hasReply, keepalive := false, false
+	for _, ev := range c.dec.Feed(p) {
+		switch ev.Type {
+		case rfc2217.EventData:
+			data = append(data, ev.Data...)
+		case rfc2217.EventSubneg:
+			for _, cmd := range comPortCommands(ev) {
+				if reply.applyReply(cmd) {
+					hasReply = true
+				}
+			}
+		case rfc2217.EventCommand:
+			keepalive = keepalive || ev.Command == rfc2217.NOP
+		}
+	}
+
+	if len(data) > 0 {
+		if err := c.ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			return 0, err
+		}
+	}
+	if hasReply {
+		reply.Type = WSControlSerial
+		if err := c.ws.WriteJSON(reply); err != nil {
+			return 0, err
+		}
+	}
+	if keepalive && len(data) == 0 {
+		if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteControl sends control message to the client
+func (c *WSClientConn) WriteControl(ctl WSControl) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	defer c.ws.SetWriteDeadline(time.Time{})
+	return c.ws.WriteJSON(ctl)
+}
+
+// Close sends close frame and closes the connection
+func (c *WSClientConn) Close() error {
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *WSClientConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *WSClientConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *WSClientConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *WSClientConn) SetReadDeadline(t time.Time) error { return c.ws.SetReadDeadline(t) }
+
+func (c *WSClientConn) SetWriteDeadline(t time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.ws.SetWriteDeadline(t)
+}
+
+// ServeWebSocket runs a client session with the device over WebSocket connection
+// The connection is closed when the session ends
+func (h *Handler) ServeWebSocket(ctx context.Context, ws *websocket.Conn, deviceID string) {
+	ws.SetReadLimit(wsReadLimit)
+	conn := NewWSClientConn(ws)
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+
+	if h.drain.Stopped() {
+		log.Printf("[ws] %s: draining, session with device %s rejected", remoteAddr, deviceID)
+		conn.WriteControl(WSControl{Type: WSControlError, Error: "server is draining"})
+		return
+	}
+
+	dev, ok := h.registry.Get(deviceID)
+	if !ok {
+		if h.forwardWebSocket(ctx, conn, deviceID, remoteAddr) {
+			return
+		}
+		log.Printf("[ws] %s: device %s not found", remoteAddr, deviceID)
+		conn.WriteControl(WSControl{Type: WSControlError, Error: "device not found"})
+		return
+	}
+
+	id := h.sessions.NewID()
+	if !dev.TrySetSession(id) {
+		log.Printf("[ws] %s: device %s is busy", remoteAddr, deviceID)
+		conn.WriteControl(WSControl{Type: WSControlError, Error: "device is busy"})
+		return
+	}
+	sess := h.sessions.CreateKind(id, deviceID, session.KindWebSocket, conn, dev.SessionConn())
+	log.Printf("[ws] %s: created session %s with device %s", remoteAddr, sess.ID, deviceID)
+
+	if err := conn.WriteControl(WSControl{Type: WSControlConnected, SessionID: sess.ID, DeviceID: deviceID}); err != nil {
+		log.Printf("[ws] %s: write connected error: %v", remoteAddr, err)
+	} else {
+		h.runBridge(sess, dev, ClientControlRFC2217, remoteAddr, nil, nil)
+	}
+
+	h.sessions.End(sess.ID)
+	dev.ClearSession()
+	log.Printf("[ws] %s: session %s ended", remoteAddr, sess.ID)
+}
+
+// ServeDeviceWebSocket registers a device connected over WebSocket
+// Binary frames carry the same byte stream as device TCP connection: AT+REG=<token>,
+// then serial data and RFC2217 / USR-VCOM commands. Blocks until the device disconnects
+func (h *Handler) ServeDeviceWebSocket(ctx context.Context, ws *websocket.Conn) {
+	// Set before reading starts: the socket is not authenticated until AT+REG
+	ws.SetReadLimit(wsReadLimit)
+	conn := wsconn.New(ws)
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	log.Printf("[ws] new device connection from %s", remoteAddr)
+
+	reader := bufio.NewReader(conn)
+	cmd, err := ReadATCommandWithPresets(reader, conn, h.cfg.Current().InitTimeout)
+	if err != nil {
+		log.Printf("[ws] %s: read command: %v", remoteAddr, err)
+		WriteError(conn)
+		return
+	}
+	if cmd.Cmd != CmdReg {
+		log.Printf("[ws] %s: unexpected command: %s", remoteAddr, cmd.Cmd)
+		WriteError(conn)
+		return
+	}
+
+	h.handleDevice(ctx, conn, buffered(reader), cmd.Param, remoteAddr)
+}
@@ -0,0 +1,257 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/wsconn"
+)
+
+// dialWebSocket starts WebSocket server running client sessions and connects to device
+func dialWebSocket(t *testing.T, env *testEnv, deviceID string) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		env.handler.ServeWebSocket(r.Context(), ws, deviceID)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func readWSControl(t *testing.T, ws *websocket.Conn) WSControl {
+	t.Helper()
+	var ctl WSControl
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := ws.ReadJSON(&ctl); err != nil {
+		t.Fatalf("read control: %v", err)
+	}
+	return ctl
+}
+
+func readWSBinary(t *testing.T, ws *websocket.Conn) []byte {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msgType, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if msgType != websocket.BinaryMessage {
+		t.Fatalf("got message type %d %q, want binary", msgType, msg)
+	}
+	return msg
+}
+
+func TestWebSocketUSRVCOMDevice(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+	dev, _ := env.registry.Get("device123")
+	dev.SetDialect(device.DialectUSRVCOM)
+
+	ws := dialWebSocket(t, env, "device123")
+	if ctl := readWSControl(t, ws); ctl.Type != WSControlConnected || ctl.SessionID == "" {
+		t.Fatalf("first message = %+v, want connected", ctl)
+	}
+
+	// Port settings become Baud Rate Sync packets (one per changed setting), proxy confirms them
+	ws.WriteJSON(WSControl{Type: WSControlSerial, BaudRate: 2400, Parity: 3})
+	devBuf := readDevice(t, devConn)
+	if len(devBuf) > USRVCOMPacketLen {
+		devBuf = devBuf[len(devBuf)-USRVCOMPacketLen:]
+	}
+	if cfg := ParseUSRVCOM(devBuf); cfg == nil || cfg.BaudRate != 2400 || cfg.ModeString() != "8E1" {
+		t.Fatalf("device got %x, want USR-VCOM 2400 8E1", devBuf)
+	}
+	if ctl := readWSControl(t, ws); ctl.Type != WSControlSerial || ctl.BaudRate != 2400 || ctl.DataBits != 8 || ctl.Parity != 3 {
+		t.Errorf("reply = %+v, want serial 2400 8E1", ctl)
+	}
+
+	// Binary data passes unchanged in both directions
+	ws.WriteMessage(websocket.BinaryMessage, []byte{0xFF, 0x01})
+	if got := readDevice(t, devConn); !bytes.Equal(got, []byte{0xFF, 0x01}) {
+		t.Errorf("device got %x, want ff01", got)
+	}
+	devConn.Write([]byte{0xFF, 0x02})
+	if got := readWSBinary(t, ws); !bytes.Equal(got, []byte{0xFF, 0x02}) {
+		t.Errorf("client got %x, want ff02", got)
+	}
+
+	if sessions := env.sessions.ListInfo(); len(sessions) != 1 || sessions[0].Kind != "websocket" {
+		t.Errorf("sessions = %+v, want one websocket session", sessions)
+	}
+}
+
+func TestWebSocketRFC2217Device(t *testing.T) {
+	env := newTestEnv()
+	devConn := env.registerDevice(t, "device123")
+
+	ws := dialWebSocket(t, env, "device123")
+	connected := readWSControl(t, ws)
+
+	// Data is IAC escaped for RFC2217 device
+	ws.WriteMessage(websocket.BinaryMessage, []byte{0xFF, 0x01})
+	if got := readDevice(t, devConn); !bytes.Equal(got, []byte{0xFF, 0xFF, 0x01}) {
+		t.Errorf("device got %x, want ffff01", got)
+	}
+
+	// Device reply becomes control message, escaped data becomes binary frame
+	devConn.Write([]byte{IAC, SB, ComPortOption, SetBaudrate + ServerResponseOffset, 0, 0, 0x4B, 0, IAC, SE})
+	if ctl := readWSControl(t, ws); ctl.Type != WSControlSerial || ctl.BaudRate != 19200 {
+		t.Errorf("reply = %+v, want serial 19200", ctl)
+	}
+	devConn.Write([]byte{0x01, IAC, IAC, 0x02})
+	if got := readWSBinary(t, ws); !bytes.Equal(got, []byte{0x01, 0xFF, 0x02}) {
+		t.Errorf("client got %x, want 01ff02", got)
+	}
+
+	// Terminated session closes WebSocket
+	env.sessions.Terminate(connected.SessionID)
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("read after terminate: %v, want normal close", err)
+	}
+}
+
+func TestWebSocketDeviceBusy(t *testing.T) {
+	env := newTestEnv()
+	env.registerDevice(t, "device123")
+	dev, _ := env.registry.Get("device123")
+	dev.SetSession("other")
+	var started atomic.Int32
+	env.sessions.SetCallbacks(func(*session.Session) { started.Add(1) }, nil)
+
+	ws := dialWebSocket(t, env, "device123")
+	if ctl := readWSControl(t, ws); ctl.Type != WSControlError || ctl.Error != "device is busy" {
+		t.Errorf("message = %+v, want busy error", ctl)
+	}
+	if n := started.Load(); n != 0 {
+		t.Errorf("%d sessions started for busy device", n)
+	}
+}
+
+func TestWebSocketClientFrameLimit(t *testing.T) {
+	env := newTestEnv()
+	env.registerDevice(t, "device123")
+
+	ws := dialWebSocket(t, env, "device123")
+	if ctl := readWSControl(t, ws); ctl.Type != WSControlConnected {
+		t.Fatalf("message = %+v, want connected", ctl)
+	}
+	ws.WriteMessage(websocket.BinaryMessage, make([]byte, wsReadLimit+1))
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("read after oversized frame: %v, want close 1009", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for env.sessions.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := env.sessions.Count(); n != 0 {
+		t.Errorf("%d sessions after oversized frame", n)
+	}
+}
+
+func TestWebSocketDeviceFrameLimit(t *testing.T) {
+	env := newTestEnv()
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		env.handler.ServeDeviceWebSocket(r.Context(), ws)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// Oversized frame before AT+REG closes the connection
+	ws.WriteMessage(websocket.BinaryMessage, make([]byte, wsReadLimit+1))
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("read after oversized frame: %v, want close 1009", err)
+			}
+			break
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("device connection not closed")
+	}
+}
+
+func TestWebSocketDeviceRegistration(t *testing.T) {
+	env := newTestEnv()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		env.handler.ServeDeviceWebSocket(r.Context(), ws)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	devConn := wsconn.New(ws)
+	defer devConn.Close()
+
+	expectExact(t, devConn, "AT+REG=device123", "OK\r\n")
+	expectExact(t, devConn, "ATDT", "OK\r\n")
+	if _, ok := env.registry.Get("device123"); !ok {
+		t.Fatal("device123 not registered")
+	}
+
+	// WebSocket device serves TCP clients like a TCP device
+	client, server := createTCPPair(t)
+	done := runHandler(context.Background(), env.handler, server)
+	expectExact(t, client, "AT+CONNECT=device123", "OK\r\n")
+	client.Write([]byte("ping"))
+	if got := readUntilContains(t, devConn, "ping", 2*time.Second); !strings.Contains(got, "ping") {
+		t.Errorf("device got %q, want ping", got)
+	}
+
+	// Closing WebSocket unregisters the device
+	devConn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for env.registry.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := env.registry.Get("device123"); ok {
+		t.Error("device123 still registered after WebSocket close")
+	}
+
+	client.Close()
+	waitDone(t, done, 5*time.Second)
+}
@@ -0,0 +1,73 @@
+// Package ctl implements rfc2217ctl: HTTP API client, interactive and scripted device sessions
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/api"
+)
+
+// API is a client of the proxy HTTP API with Basic Auth
+type API struct {
+	BaseURL    string // e.g. http://localhost:8080
+	User, Pass string // WEB_USER / WEB_PASS, empty - anonymous (IP addresses masked)
+	Client     *http.Client
+}
+
+// Devices returns registered devices
+func (a *API) Devices(ctx context.Context) (*api.DevicesResponse, error) {
+	var resp api.DevicesResponse
+	if err := a.do(ctx, http.MethodGet, "/api/v1/devices", &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Sessions returns active sessions
+func (a *API) Sessions(ctx context.Context) (*api.SessionsResponse, error) {
+	var resp api.SessionsResponse
+	if err := a.do(ctx, http.MethodGet, "/api/v1/sessions", &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Terminate closes session, requires credentials
+func (a *API) Terminate(ctx context.Context, sessionID string) error {
+	return a.do(ctx, http.MethodDelete, "/api/v1/sessions/"+url.PathEscape(sessionID), nil)
+}
+
+// do sends request and decodes JSON response into out (if not nil)
+func (a *API) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if a.User != "" {
+		req.SetBasicAuth(a.User, a.Pass)
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
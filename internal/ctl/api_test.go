@@ -0,0 +1,47 @@
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/api"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+func TestAPI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/devices":
+			json.NewEncoder(w).Encode(api.DevicesResponse{Count: 1, Devices: []device.DeviceInfo{{ID: "meter1"}}})
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/v1/sessions/sess_1":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "terminated"})
+		default:
+			http.Error(w, "session not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	a := &API{BaseURL: srv.URL + "/"}
+	devices, err := a.Devices(ctx)
+	if err != nil || devices.Count != 1 || devices.Devices[0].ID != "meter1" {
+		t.Errorf("Devices = %+v, %v", devices, err)
+	}
+	if err := a.Terminate(ctx, "sess_1"); err == nil {
+		t.Error("Terminate without credentials should fail")
+	}
+	a.User, a.Pass = "admin", "secret"
+	if err := a.Terminate(ctx, "sess_1"); err != nil {
+		t.Errorf("Terminate: %v", err)
+	}
+	if err := a.Terminate(ctx, "sess_2"); err == nil {
+		t.Error("Terminate of unknown session should fail")
+	}
+}
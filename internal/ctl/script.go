@@ -0,0 +1,225 @@
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+)
+
+// DefaultExpectTimeout limits expect steps until a timeout step
+const DefaultExpectTimeout = 5 * time.Second
+
+// Script step operations
+const (
+	OpSend    = "send"    // send <data>
+	OpExpect  = "expect"  // expect <data>: wait until received data contains it
+	OpWait    = "wait"    // wait <duration>
+	OpTimeout = "timeout" // timeout <duration>: limit of the following expect steps
+	OpSerial  = "serial"  // serial <baud> [mode]: send port settings
+)
+
+// Step is a parsed script line
+type Step struct {
+	Line     int
+	Op       string
+	Data     []byte
+	Duration time.Duration
+	Profile  device.SerialProfile
+}
+
+// ParseScript parses script, one step per line, # starts a comment
+// Data is a sequence of hex bytes (2F 3F or 2F3F) and Go quoted strings ("/?!\r\n")
+func ParseScript(r io.Reader) ([]Step, error) {
+	var steps []Step
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		op, args, _ := strings.Cut(line, " ")
+		args = strings.TrimSpace(args)
+		step := Step{Line: n, Op: strings.ToLower(op)}
+
+		var err error
+		switch step.Op {
+		case OpSend, OpExpect:
+			step.Data, err = ParseData(args)
+			if err == nil && len(step.Data) == 0 {
+				err = errors.New("no data")
+			}
+		case OpWait, OpTimeout:
+			step.Duration, err = time.ParseDuration(args)
+		case OpSerial:
+			step.Profile, err = parseSerial(args)
+		default:
+			err = fmt.Errorf("unknown step %q", op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
+
+// stripComment removes # comment outside of quoted strings
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// parseSerial parses "<baud> [mode]", mode defaults to 8N1
+func parseSerial(args string) (device.SerialProfile, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		return device.SerialProfile{}, errors.New("want <baud> [mode]")
+	}
+	baud, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil || baud == 0 {
+		return device.SerialProfile{}, fmt.Errorf("invalid baud rate %q", fields[0])
+	}
+	mode := "8N1"
+	if len(fields) == 2 {
+		mode = fields[1]
+	}
+	return serial.ParseMode(mode, uint32(baud))
+}
+
+// ParseData parses hex bytes and Go quoted strings
+func ParseData(s string) ([]byte, error) {
+	var data []byte
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] == '"' {
+			q, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s", s)
+			}
+			v, _ := strconv.Unquote(q)
+			data = append(data, v...)
+			s = s[len(q):]
+			continue
+		}
+		token, rest, _ := strings.Cut(s, " ")
+		b, err := hex.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("bad hex %q", token)
+		}
+		data = append(data, b...)
+		s = rest
+	}
+	return data, nil
+}
+
+// Port is the session side used by scripts
+type Port interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+	SetSerial(profile device.SerialProfile) error
+}
+
+// StepResult is the outcome of a script step
+type StepResult struct {
+	Line     int     `json:"line"`
+	Op       string  `json:"op"`
+	Data     string  `json:"data,omitempty"`     // hex of sent or expected bytes
+	Received string  `json:"received,omitempty"` // hex of bytes read by expect
+	Elapsed  float64 `json:"elapsed_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// ScriptResult is the outcome of a script
+type ScriptResult struct {
+	OK       bool         `json:"ok"`
+	Sent     int          `json:"sent"`
+	Received int          `json:"received"`
+	Steps    []StepResult `json:"steps"`
+}
+
+// RunScript runs steps until the end or the first failed step
+// Received bytes not consumed by expect are kept for the next expect
+func RunScript(port Port, steps []Step) *ScriptResult {
+	res := &ScriptResult{OK: true}
+	timeout := DefaultExpectTimeout
+	var buf []byte
+	chunk := make([]byte, 4096)
+
+	for _, step := range steps {
+		start := time.Now()
+		sr := StepResult{Line: step.Line, Op: step.Op}
+		var err error
+
+		switch step.Op {
+		case OpSend:
+			sr.Data = hex.EncodeToString(step.Data)
+			_, err = port.Write(step.Data)
+			if err == nil {
+				res.Sent += len(step.Data)
+			}
+		case OpExpect:
+			sr.Data = hex.EncodeToString(step.Data)
+			port.SetReadDeadline(time.Now().Add(timeout))
+			for {
+				if idx := bytes.Index(buf, step.Data); idx >= 0 {
+					end := idx + len(step.Data)
+					sr.Received = hex.EncodeToString(buf[:end])
+					buf = buf[end:]
+					break
+				}
+				var n int
+				n, err = port.Read(chunk)
+				buf = append(buf, chunk[:n]...)
+				res.Received += n
+				if err != nil {
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						err = fmt.Errorf("expected %x not received in %s", step.Data, timeout)
+					}
+					sr.Received = hex.EncodeToString(buf)
+					break
+				}
+			}
+			port.SetReadDeadline(time.Time{})
+		case OpWait:
+			time.Sleep(step.Duration)
+		case OpTimeout:
+			timeout = step.Duration
+		case OpSerial:
+			err = port.SetSerial(step.Profile)
+		}
+
+		sr.Elapsed = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			sr.Error = err.Error()
+			res.OK = false
+		}
+		res.Steps = append(res.Steps, sr)
+		if err != nil {
+			break
+		}
+	}
+	return res
+}
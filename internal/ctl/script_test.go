@@ -0,0 +1,95 @@
+package ctl
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+func TestParseData(t *testing.T) {
+	data, err := ParseData(`2F 3F21 "\r\n#" ff`)
+	if err != nil {
+		t.Fatalf("ParseData: %v", err)
+	}
+	if want := []byte("/?!\r\n#\xff"); !bytes.Equal(data, want) {
+		t.Errorf("data %q, want %q", data, want)
+	}
+	for _, bad := range []string{"2", "zz", `"open`} {
+		if _, err := ParseData(bad); err == nil {
+			t.Errorf("ParseData(%s) should fail", bad)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	steps, err := ParseScript(strings.NewReader(`
+# IEC readout
+serial 300 7E1
+send "/?!\r\n"   # request
+timeout 2s
+expect "#" 0D0A
+wait 10ms
+`))
+	if err != nil {
+		t.Fatalf("ParseScript: %v", err)
+	}
+	if len(steps) != 5 || steps[0].Profile.BaudRate != 300 || steps[0].Profile.ModeString() != "7E1" ||
+		string(steps[1].Data) != "/?!\r\n" || steps[2].Duration != 2*time.Second ||
+		string(steps[3].Data) != "#\r\n" || steps[4].Line != 7 {
+		t.Errorf("steps = %+v", steps)
+	}
+
+	for _, bad := range []string{"send", "expect zz", "wait 1", "serial fast", "jump 1"} {
+		if _, err := ParseScript(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseScript(%q) should fail", bad)
+		}
+	}
+}
+
+// pipePort is the script side of net.Pipe
+type pipePort struct {
+	net.Conn
+	serial []device.SerialProfile
+}
+
+func (p *pipePort) SetSerial(profile device.SerialProfile) error {
+	p.serial = append(p.serial, profile)
+	return nil
+}
+
+func TestRunScript(t *testing.T) {
+	conn, dev := net.Pipe()
+	defer conn.Close()
+	defer dev.Close()
+	port := &pipePort{Conn: conn}
+
+	// Device answers every request with two chunks
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := dev.Read(buf); err != nil {
+				return
+			}
+			dev.Write([]byte("/SIM"))
+			dev.Write([]byte("5\r\nextra"))
+		}
+	}()
+
+	steps, _ := ParseScript(strings.NewReader("serial 9600\nsend \"/?!\\r\\n\"\nexpect \"5\\r\\n\"\nexpect \"extra\"\ntimeout 50ms\nexpect \"never\""))
+	res := RunScript(port, steps)
+	if res.OK || len(res.Steps) != 6 || res.Steps[5].Error == "" {
+		t.Fatalf("result = %+v, want failure at the last step", res)
+	}
+	for _, sr := range res.Steps[:5] {
+		if sr.Error != "" {
+			t.Errorf("line %d: %s", sr.Line, sr.Error)
+		}
+	}
+	if res.Steps[2].Received != "2f53494d350d0a" || res.Sent != 5 || res.Received != 12 || len(port.serial) != 1 {
+		t.Errorf("result = %+v", res)
+	}
+}
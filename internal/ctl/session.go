@@ -0,0 +1,52 @@
+package ctl
+
+import (
+	"context"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/vcom"
+)
+
+// Session is an RFC2217 client session with a device
+// Reads return device data, writes are IAC escaped
+type Session struct {
+	*rfc2217.Conn
+}
+
+// Connect opens session with AT+CONNECT=<token> ([AUTH_TOKEN+]DEVICE_ID)
+// onReply gets RFC2217 replies (port settings confirmed by the device or the proxy)
+// A baud rate query is sent right away so the proxy handles the session as RFC2217
+// and escapes device data for any device dialect
+func Connect(ctx context.Context, server, token string, timeout time.Duration, onReply func(connection.RFC2217Command)) (*Session, error) {
+	conn, err := vcom.Connect(ctx, server, token, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{Conn: rfc2217.NewConn(conn)}
+	s.OnEvent = func(ev rfc2217.Event) {
+		if onReply != nil && ev.Type == rfc2217.EventSubneg && ev.Option == connection.ComPortOption &&
+			len(ev.Data) > 0 && ev.Data[0] > connection.ServerResponseOffset {
+			onReply(connection.RFC2217Command{Command: ev.Data[0] - connection.ServerResponseOffset, Data: ev.Data[1:]})
+		}
+	}
+	query := connection.RFC2217Command{Command: connection.SetBaudrate, Data: make([]byte, 4)}
+	if err := s.WriteRaw(connection.BuildRFC2217Packet([]connection.RFC2217Command{query})); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetSerial sends port settings
+func (s *Session) SetSerial(profile device.SerialProfile) error {
+	return s.WriteRaw(connection.BuildRFC2217Packet(connection.PortSettingsCommands(profile)))
+}
+
+// SetControl sends SET-CONTROL value (DTR, RTS, BREAK, flow control)
+func (s *Session) SetControl(value byte) error {
+	cmd := connection.RFC2217Command{Command: connection.SetControl, Data: []byte{value}}
+	return s.WriteRaw(connection.BuildRFC2217Packet([]connection.RFC2217Command{cmd}))
+}
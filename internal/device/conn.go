@@ -0,0 +1,165 @@
+package device
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrNotOwner is returned by session connection read after the session ended
+var ErrNotOwner = errors.New("device connection is not owned by session")
+
+// errReplayPending is returned by SyscallConn while replayed data is not read,
+// reading the socket directly would skip it
+var errReplayPending = errors.New("device data read before the session is not replayed yet")
+
+// Ownership of the device connection read side:
+//   - not in session: IdleRead, called by one goroutine that serves the device
+//   - in session: SessionConn of the session
+//
+// SetSession and TrySetSession interrupt the idle read and wait until it returns,
+// data it has read by then belongs to the session and is replayed by SessionConn.
+// ClearSession returns the connection to IdleRead with its deadlines reset.
+// Writes are not owned.
+
+// stopIdleRead interrupts the idle read in progress and waits until it returns
+// Called with mu held after InSession is set, so no new idle read starts
+func (d *Device) stopIdleRead() {
+	reading := d.reading
+	if reading == nil {
+		return
+	}
+	d.Conn.SetReadDeadline(time.Now())
+	d.mu.Unlock()
+	<-reading
+	d.mu.Lock()
+	d.Conn.SetReadDeadline(time.Time{})
+}
+
+// wakeIdleRead resumes IdleRead waiting for the session end, called with mu held
+func (d *Device) wakeIdleRead() {
+	if d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// IdleRead reads from the device connection while the device is not in session
+// Waits while a session owns the connection, returns net.ErrClosed after Close
+func (d *Device) IdleRead(buf []byte) (int, error) {
+	for {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if d.InSession {
+			if d.idle == nil {
+				d.idle = make(chan struct{})
+			}
+			idle := d.idle
+			d.mu.Unlock()
+			<-idle // ClearSession restores the idle read deadline
+			continue
+		}
+		reading := make(chan struct{})
+		d.reading = reading
+		d.mu.Unlock()
+
+		n, err := d.Conn.Read(buf)
+
+		d.mu.Lock()
+		d.reading = nil
+		close(reading)
+		if d.InSession {
+			// Session started during the read: data is the session's, the error
+			// is the interruption or is seen by the session on its own read
+			d.replay = append(d.replay, buf[:n]...)
+			d.mu.Unlock()
+			continue
+		}
+		d.mu.Unlock()
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// IdleReader returns reader of the connection through IdleRead
+func (d *Device) IdleReader() io.Reader {
+	return idleReader{d}
+}
+
+type idleReader struct{ d *Device }
+
+func (r idleReader) Read(p []byte) (int, error) { return r.d.IdleRead(p) }
+
+// SetIdleReadDeadline sets read deadline of IdleRead, it is kept across sessions
+func (d *Device) SetIdleReadDeadline(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.idleDeadline = t
+	if !d.InSession {
+		d.Conn.SetReadDeadline(t)
+	}
+}
+
+// SessionConn returns device connection for the session
+// Read returns data left by the interrupted idle read first and fails with
+// ErrNotOwner when the device is not in session
+func (d *Device) SessionConn() net.Conn {
+	return &sessionConn{Conn: d.Conn, d: d}
+}
+
+type sessionConn struct {
+	net.Conn
+	d *Device
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	d := c.d
+	d.mu.Lock()
+	if !d.InSession {
+		d.mu.Unlock()
+		return 0, ErrNotOwner
+	}
+	if len(d.replay) > 0 {
+		n := copy(p, d.replay)
+		d.replay = d.replay[n:]
+		d.mu.Unlock()
+		return n, nil
+	}
+	d.mu.Unlock()
+	return c.Conn.Read(p)
+}
+
+// SyscallConn returns raw device connection for zero-copy transfer
+// Fails when the session doesn't own the connection, replayed data is left
+// or the connection is not a socket (TLS)
+func (c *sessionConn) SyscallConn() (syscall.RawConn, error) {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.InSession {
+		return nil, ErrNotOwner
+	}
+	if len(d.replay) > 0 {
+		return nil, errReplayPending
+	}
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return sc.SyscallConn()
+}
+
+// Close closes the device connection and ends IdleRead
+func (d *Device) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.wakeIdleRead()
+	d.mu.Unlock()
+	return d.Conn.Close()
+}
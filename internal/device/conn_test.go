@@ -0,0 +1,286 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair returns device side and proxy side of a TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	devSide, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxySide := <-accepted
+	if proxySide == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		devSide.Close()
+		proxySide.Close()
+	})
+	return devSide, proxySide
+}
+
+// idleLoop reads the device like the connection handler, sending idle data to the channel
+func idleLoop(dev *Device) (<-chan []byte, <-chan error) {
+	data := make(chan []byte, 16)
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := dev.IdleRead(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			data <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	return data, done
+}
+
+// waitReading waits until the idle read is blocked in the connection read
+func waitReading(t *testing.T, dev *Device) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dev.mu.Lock()
+		reading := dev.reading != nil
+		dev.mu.Unlock()
+		if reading {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle read not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readFull(t *testing.T, conn net.Conn, n int) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v (got %q)", err, buf)
+	}
+	return string(buf)
+}
+
+func TestSessionTakesOverIdleRead(t *testing.T) {
+	devSide, proxySide := tcpPair(t)
+	dev := &Device{ID: "meter1", Conn: proxySide}
+	idle, done := idleLoop(dev)
+
+	devSide.Write([]byte("noise"))
+	if got := <-idle; string(got) != "noise" {
+		t.Fatalf("idle read %q", got)
+	}
+
+	waitReading(t, dev)
+	if !dev.TrySetSession("s1") {
+		t.Fatal("TrySetSession failed")
+	}
+	conn := dev.SessionConn()
+	for i := 0; i < 100; i++ {
+		devSide.Write([]byte("reply"))
+		if got := readFull(t, conn, 5); got != "reply" {
+			t.Fatalf("session read %q", got)
+		}
+	}
+	select {
+	case got := <-idle:
+		t.Fatalf("idle reader read %q during session", got)
+	default:
+	}
+
+	dev.ClearSession()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("read after session end: %v", err)
+	}
+	devSide.Write([]byte("after"))
+	if got := <-idle; string(got) != "after" {
+		t.Fatalf("idle read after session %q", got)
+	}
+
+	dev.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("IdleRead after Close: %v", err)
+	}
+}
+
+// racingConn returns data from the read interrupted by the session start,
+// as a device reply arriving at the same moment
+type racingConn struct {
+	net.Conn
+	data        []byte
+	interrupted chan struct{}
+	once        sync.Once
+}
+
+func (c *racingConn) Read(p []byte) (int, error) {
+	if c.data != nil {
+		<-c.interrupted
+		n := copy(p, c.data)
+		c.data = nil
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *racingConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() && !t.After(time.Now()) {
+		c.once.Do(func() { close(c.interrupted) })
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestSessionReplaysInterruptedRead(t *testing.T) {
+	devSide, proxySide := tcpPair(t)
+	conn := &racingConn{Conn: proxySide, data: []byte("first"), interrupted: make(chan struct{})}
+	dev := &Device{ID: "meter1", Conn: conn}
+	idle, _ := idleLoop(dev)
+	waitReading(t, dev)
+
+	dev.SetSession("s1")
+	devSide.Write([]byte(" second"))
+	if got := readFull(t, dev.SessionConn(), 12); got != "first second" {
+		t.Fatalf("session read %q, want replayed data first", got)
+	}
+	select {
+	case got := <-idle:
+		t.Fatalf("idle reader returned %q read during session start", got)
+	default:
+	}
+}
+
+func TestSyscallConnAfterReplay(t *testing.T) {
+	devSide, proxySide := tcpPair(t)
+	conn := &racingConn{Conn: proxySide, data: []byte("first"), interrupted: make(chan struct{})}
+	dev := &Device{ID: "meter1", Conn: conn}
+	idleLoop(dev)
+	waitReading(t, dev)
+	dev.SetSession("s1")
+
+	// Direct socket access would skip replayed data
+	sc := dev.SessionConn().(syscall.Conn)
+	if _, err := sc.SyscallConn(); err == nil {
+		t.Fatal("SyscallConn succeeded with replayed data left")
+	}
+	devSide.Write([]byte("x"))
+	if got := readFull(t, dev.SessionConn(), 5); got != "first" {
+		t.Fatalf("session read %q", got)
+	}
+	// racingConn is not a socket
+	if _, err := sc.SyscallConn(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("SyscallConn after replay: %v", err)
+	}
+
+	dev.ClearSession()
+	if _, err := sc.SyscallConn(); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("SyscallConn after session end: %v", err)
+	}
+}
+
+func TestSessionStressNoLoss(t *testing.T) {
+	devSide, proxySide := tcpPair(t)
+	dev := &Device{ID: "meter1", Conn: proxySide}
+	idleLoop(dev)
+
+	// Device answers every request at once: any byte the idle reader keeps is lost
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := devSide.Read(buf); err != nil {
+				return
+			}
+			devSide.Write(bytes.Repeat(buf, 64))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if !dev.TrySetSession("s") {
+			t.Fatal("TrySetSession failed")
+		}
+		conn := dev.SessionConn()
+		req := []byte{byte('a' + i%26)}
+		conn.Write(req)
+		if got := readFull(t, conn, 64); got != string(bytes.Repeat(req, 64)) {
+			t.Fatalf("round %d: session read %q", i, got)
+		}
+		dev.ClearSession()
+	}
+}
+
+func TestIdleReadDeadlineKeptAcrossSession(t *testing.T) {
+	_, proxySide := tcpPair(t)
+	dev := &Device{ID: "meter1", Conn: proxySide}
+	dev.SetIdleReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, done := idleLoop(dev)
+	waitReading(t, dev)
+
+	dev.SetSession("s1")
+	// Session reads without the idle deadline
+	proxySide.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	if _, err := dev.SessionConn().Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("session read: %v", err)
+	}
+	dev.ClearSession()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("IdleRead: %v, want deadline exceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle deadline lost after session")
+	}
+}
+
+func TestClearSessionResetsDeadlines(t *testing.T) {
+	// Internal session terminated after its own deadline reset leaves a past deadline
+	devSide, proxySide := tcpPair(t)
+	dev := &Device{ID: "meter1", Conn: proxySide}
+	idle, done := idleLoop(dev)
+	waitReading(t, dev)
+
+	if !dev.TrySetSession("int_1") {
+		t.Fatal("TrySetSession failed")
+	}
+	dev.SessionConn().SetDeadline(time.Now())
+	dev.ClearSession()
+
+	devSide.Write([]byte("after"))
+	select {
+	case got := <-idle:
+		if string(got) != "after" {
+			t.Fatalf("idle read %q", got)
+		}
+	case err := <-done:
+		t.Fatalf("IdleRead after terminated session: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle read got no data")
+	}
+	if _, err := proxySide.Write([]byte("nop")); err != nil {
+		t.Errorf("write after terminated session: %v", err)
+	}
+}
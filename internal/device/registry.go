@@ -1,21 +1,73 @@
 package device
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"time"
 )
 
+// Serial control dialects - how port settings are sent to the device
+const (
+	DialectRFC2217 = "rfc2217" // RFC2217 COM-PORT-OPTION subnegotiations (default)
+	DialectUSRVCOM = "usrvcom" // USR-VCOM Baud Rate Sync packets (55 AA 55)
+	DialectNone    = "none"    // device doesn't accept port settings
+)
+
+// ValidDialect checks if dialect name is known
+func ValidDialect(dialect string) bool {
+	switch dialect {
+	case DialectRFC2217, DialectUSRVCOM, DialectNone:
+		return true
+	}
+	return false
+}
+
+// SerialProfile describes the serial port settings of a device
+// Values use RFC2217 encoding (parity 1=None..5=Space, stop bits 1=1, 2=2, 3=1.5)
+type SerialProfile struct {
+	BaudRate  uint32    `json:"baud_rate"`
+	DataBits  uint8     `json:"data_bits"`
+	Parity    uint8     `json:"parity"`
+	StopBits  uint8     `json:"stop_bits"`
+	Source    string    `json:"source"` // where settings came from (usr-m0, rfc2217, ...)
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ModeString returns mode string like "8N1", "8E1", etc.
+func (p *SerialProfile) ModeString() string {
+	parityChar := []byte{'N', 'O', 'E', 'M', 'S'}
+	parity := byte('?')
+	if p.Parity >= 1 && int(p.Parity) <= len(parityChar) {
+		parity = parityChar[p.Parity-1]
+	}
+	stop := []string{"1", "2", "1.5"}
+	stopBits := "?"
+	if p.StopBits >= 1 && int(p.StopBits) <= len(stop) {
+		stopBits = stop[p.StopBits-1]
+	}
+	return fmt.Sprintf("%d%c%s", p.DataBits, parity, stopBits)
+}
+
 // Device represents a connected IoT device
+// Exactly one consumer reads the connection at a time, see conn.go:
+// IdleRead while the device is not in session, SessionConn while it is
 type Device struct {
-	ID            string
-	Conn          net.Conn
-	RegisteredAt  time.Time
-	InSession     bool
-	SessionID     string
-	StopKeepalive chan struct{} // Signal to stop keepalive goroutine
+	ID           string
+	Conn         net.Conn
+	RegisteredAt time.Time
+	InSession    bool
+	SessionID    string
+
+	serial  *SerialProfile // last known serial port settings
+	dialect string         // serial control dialect, empty means RFC2217
+	reading chan struct{}  // closed when the idle read in progress returns
+	idle    chan struct{}  // closed when the session ends
+	replay  []byte         // read by the idle read interrupted by session start
+	closed  bool
+	mu      sync.Mutex
 
-	mu sync.Mutex
+	idleDeadline time.Time // read deadline of IdleRead, restored after session
 }
 
 // SetSession marks device as in session
@@ -24,14 +76,35 @@ func (d *Device) SetSession(sessionID string) {
 	defer d.mu.Unlock()
 	d.InSession = true
 	d.SessionID = sessionID
+	d.stopIdleRead()
+}
+
+// TrySetSession marks device as in session only if it is not in session already
+// Returns false if device is busy
+func (d *Device) TrySetSession(sessionID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.InSession {
+		return false
+	}
+	d.InSession = true
+	d.SessionID = sessionID
+	d.stopIdleRead()
+	return true
 }
 
 // ClearSession marks device as not in session
+// Deadlines left by the session (e.g. terminated internal session) are reset,
+// the idle read deadline is restored
 func (d *Device) ClearSession() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.InSession = false
 	d.SessionID = ""
+	d.replay = nil
+	d.Conn.SetReadDeadline(d.idleDeadline)
+	d.Conn.SetWriteDeadline(time.Time{})
+	d.wakeIdleRead()
 }
 
 // IsInSession returns true if device is in active session
@@ -41,6 +114,44 @@ func (d *Device) IsInSession() bool {
 	return d.InSession
 }
 
+// SetSerialProfile stores serial port settings of the device
+func (d *Device) SetSerialProfile(profile SerialProfile) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if profile.UpdatedAt.IsZero() {
+		profile.UpdatedAt = time.Now()
+	}
+	d.serial = &profile
+}
+
+// SerialProfile returns a copy of the last known serial port settings or nil
+func (d *Device) SerialProfile() *SerialProfile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.serial == nil {
+		return nil
+	}
+	profile := *d.serial
+	return &profile
+}
+
+// SetDialect sets serial control dialect of the device
+func (d *Device) SetDialect(dialect string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialect = dialect
+}
+
+// Dialect returns serial control dialect of the device
+func (d *Device) Dialect() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dialect == "" {
+		return DialectRFC2217
+	}
+	return d.dialect
+}
+
 // Registry manages connected devices
 type Registry struct {
 	devices sync.Map // map[string]*Device
@@ -61,6 +172,11 @@ func (r *Registry) Unregister(deviceID string) {
 	r.devices.Delete(deviceID)
 }
 
+// UnregisterDevice removes the device if it was not replaced by a new registration with the same ID
+func (r *Registry) UnregisterDevice(device *Device) {
+	r.devices.CompareAndDelete(device.ID, device)
+}
+
 // Get returns a device by ID
 func (r *Registry) Get(deviceID string) (*Device, bool) {
 	val, ok := r.devices.Load(deviceID)
@@ -92,11 +208,14 @@ func (r *Registry) Count() int {
 
 // DeviceInfo is used for API responses
 type DeviceInfo struct {
-	ID           string    `json:"id"`
-	RegisteredAt time.Time `json:"registered_at"`
-	InSession    bool      `json:"in_session"`
-	SessionID    string    `json:"session_id,omitempty"`
-	RemoteAddr   string    `json:"remote_addr"`
+	ID           string         `json:"id"`
+	RegisteredAt time.Time      `json:"registered_at"`
+	InSession    bool           `json:"in_session"`
+	SessionID    string         `json:"session_id,omitempty"`
+	RemoteAddr   string         `json:"remote_addr"`
+	Dialect      string         `json:"dialect"`
+	SerialMode   string         `json:"serial_mode,omitempty"`
+	Serial       *SerialProfile `json:"serial,omitempty"`
 }
 
 // ListInfo returns device info for API
@@ -111,6 +230,15 @@ func (r *Registry) ListInfo() []DeviceInfo {
 			InSession:    d.InSession,
 			SessionID:    d.SessionID,
 			RemoteAddr:   d.Conn.RemoteAddr().String(),
+			Dialect:      d.dialect,
+		}
+		if info.Dialect == "" {
+			info.Dialect = DialectRFC2217
+		}
+		if d.serial != nil {
+			profile := *d.serial
+			info.Serial = &profile
+			info.SerialMode = profile.ModeString()
 		}
 		d.mu.Unlock()
 		infos = append(infos, info)
@@ -0,0 +1,273 @@
+package devsim
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/iec62056"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/vcom"
+)
+
+// Scenario selects peripheral of simulated devices and the matching client workload
+type Scenario struct {
+	Kind      string // Peripheral*
+	Rules     []Rule // script rules, clients send the first one
+	Unit      byte   // Modbus unit id
+	Registers int    // Modbus register count, clients read all of them (up to 125)
+	Payload   int    // echo request size
+}
+
+// Validate checks scenario parameters for the kind
+func (s Scenario) Validate() error {
+	switch s.Kind {
+	case PeripheralEcho:
+		if s.Payload < 1 {
+			return errors.New("echo payload must be positive")
+		}
+	case PeripheralScript:
+		if len(s.Rules) == 0 {
+			return errors.New("script has no rules")
+		}
+	case PeripheralModbus:
+		if s.Registers < 1 || s.Registers > 65536 {
+			return errors.New("register count must be 1..65536")
+		}
+	case PeripheralIEC:
+	default:
+		return fmt.Errorf("unknown peripheral %q", s.Kind)
+	}
+	return nil
+}
+
+// Peripheral creates peripheral of a simulated device
+func (s Scenario) Peripheral(deviceID string) Peripheral {
+	switch s.Kind {
+	case PeripheralScript:
+		return &Script{Rules: s.Rules}
+	case PeripheralModbus:
+		return NewModbusSlave(s.Unit, s.Registers)
+	case PeripheralIEC:
+		return NewIECMeter(deviceID)
+	}
+	return Echo{}
+}
+
+// Profile returns port settings sent by clients after connect
+func (s Scenario) Profile() device.SerialProfile {
+	if s.Kind == PeripheralIEC {
+		return device.SerialProfile{BaudRate: iec62056.InitialBaudRate, DataBits: 7, Parity: 3, StopBits: 1}
+	}
+	return device.SerialProfile{BaudRate: 9600, DataBits: 8, Parity: 1, StopBits: 1}
+}
+
+// Transact performs one request/response exchange, returns bytes sent and received
+func (s Scenario) Transact(rw io.ReadWriter) (int, int, error) {
+	switch s.Kind {
+	case PeripheralScript:
+		rule := s.Rules[0]
+		return exchange(rw, rule.Request, len(rule.Response), func(resp []byte) bool {
+			return bytes.Equal(resp, rule.Response)
+		})
+	case PeripheralModbus:
+		return s.transactModbus(rw)
+	case PeripheralIEC:
+		return transactIEC(rw)
+	}
+	req := make([]byte, s.Payload)
+	rand.Read(req)
+	return exchange(rw, req, len(req), func(resp []byte) bool {
+		return bytes.Equal(resp, req)
+	})
+}
+
+// exchange writes request and reads response of n bytes
+func exchange(rw io.ReadWriter, req []byte, n int, valid func([]byte) bool) (int, int, error) {
+	if _, err := rw.Write(req); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, n)
+	got, err := io.ReadFull(rw, resp)
+	if err != nil {
+		return len(req), got, err
+	}
+	if !valid(resp) {
+		return len(req), got, fmt.Errorf("unexpected response %q", resp)
+	}
+	return len(req), got, nil
+}
+
+func (s Scenario) transactModbus(rw io.ReadWriter) (int, int, error) {
+	count := min(s.Registers, 125)
+	pdu := []byte{modbus.FuncReadHoldingRegisters}
+	pdu = binary.BigEndian.AppendUint16(pdu, 0)
+	pdu = binary.BigEndian.AppendUint16(pdu, uint16(count))
+	req := modbus.BuildRTUFrame(s.Unit, pdu)
+	if _, err := rw.Write(req); err != nil {
+		return 0, 0, err
+	}
+
+	resp := make([]byte, 3, modbus.MaxRTULen)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return len(req), 0, err
+	}
+	n := modbus.ResponseLen(pdu, resp)
+	if n < len(resp) || n > modbus.MaxRTULen {
+		return len(req), len(resp), fmt.Errorf("bad response header % x", resp)
+	}
+	resp = resp[:n]
+	if _, err := io.ReadFull(rw, resp[3:]); err != nil {
+		return len(req), 3, err
+	}
+	_, rpdu, err := modbus.ParseRTUFrame(resp)
+	if err == nil {
+		err = modbus.PDUError(rpdu)
+	}
+	return len(req), n, err
+}
+
+func transactIEC(rw io.ReadWriter) (int, int, error) {
+	req := []byte("/?!\r\n")
+	if _, err := rw.Write(req); err != nil {
+		return 0, 0, err
+	}
+	ident, err := readUntil(rw, func(p []byte) bool { return bytes.HasSuffix(p, []byte("\r\n")) })
+	if err != nil {
+		return len(req), len(ident), err
+	}
+	if _, err := iec62056.ParseIdentification(ident); err != nil {
+		return len(req), len(ident), err
+	}
+
+	ack := []byte{iec62056.ACK, '0', ident[4], '0', '\r', '\n'}
+	if _, err := rw.Write(ack); err != nil {
+		return len(req), len(ident), err
+	}
+	block, err := readUntil(rw, func(p []byte) bool {
+		return len(p) >= 2 && p[len(p)-2] == iec62056.ETX
+	})
+	sent, received := len(req)+len(ack), len(ident)+len(block)
+	if err != nil {
+		return sent, received, err
+	}
+	if block[0] != iec62056.STX || iec62056.BCC(block[1:len(block)-1]) != block[len(block)-1] {
+		return sent, received, errors.New("bad data block")
+	}
+	return sent, received, nil
+}
+
+// readUntil reads byte by byte until done reports a complete message
+func readUntil(r io.Reader, done func([]byte) bool) ([]byte, error) {
+	var msg []byte
+	b := make([]byte, 1)
+	for len(msg) < maxPending {
+		if _, err := r.Read(b); err != nil {
+			return msg, err
+		}
+		msg = append(msg, b[0])
+		if done(msg) {
+			return msg, nil
+		}
+	}
+	return msg, errors.New("response too long")
+}
+
+// ClientConfig describes a simulated client
+type ClientConfig struct {
+	Server   string // proxy address host:2217
+	Token    string // AT+CONNECT token: DEVICE_ID or AUTH_TOKEN+DEVICE_ID
+	Requests int    // transactions per session, 0 until ctx is done
+	Interval time.Duration
+	Timeout  time.Duration // connect and transaction timeout
+	Retry    time.Duration // delay before reconnect
+}
+
+// Client opens sessions with a simulated device and runs scenario transactions
+// It speaks RFC2217: port settings are sent after connect, data is IAC escaped
+type Client struct {
+	cfg      ClientConfig
+	scenario Scenario
+	stats    *Stats
+}
+
+func NewClient(cfg ClientConfig, scenario Scenario, stats *Stats) *Client {
+	return &Client{cfg: cfg, scenario: scenario, stats: stats}
+}
+
+// Run repeats sessions until ctx is done or Requests transactions succeeded
+func (c *Client) Run(ctx context.Context) {
+	for done := 0; c.cfg.Requests == 0 || done < c.cfg.Requests; {
+		n, err := c.session(ctx, c.cfg.Requests-done)
+		done += n
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[devsim] client %s: %v", c.cfg.Token, err)
+		}
+		if c.cfg.Requests > 0 && done >= c.cfg.Requests {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.Retry):
+		}
+	}
+}
+
+// session runs up to limit transactions (0 - unlimited) in one session
+func (c *Client) session(ctx context.Context, limit int) (int, error) {
+	start := time.Now()
+	conn, err := vcom.Connect(ctx, c.cfg.Server, c.cfg.Token, c.cfg.Timeout)
+	if err != nil {
+		c.stats.Connect.Fail()
+		return 0, err
+	}
+	defer conn.Close()
+	c.stats.Connect.Add(time.Since(start))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	tc := rfc2217.NewConn(conn)
+	if err := tc.WriteRaw(connection.BuildRFC2217Packet(connection.PortSettingsCommands(c.scenario.Profile()))); err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for limit <= 0 || done < limit {
+		conn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+		start := time.Now()
+		sent, received, err := c.scenario.Transact(tc)
+		c.stats.BytesSent.Add(int64(sent))
+		c.stats.BytesReceived.Add(int64(received))
+		if err != nil {
+			if ctx.Err() != nil {
+				return done, nil
+			}
+			c.stats.Transaction.Fail()
+			return done, err
+		}
+		c.stats.Transaction.Add(time.Since(start))
+		done++
+
+		if c.cfg.Interval > 0 {
+			select {
+			case <-ctx.Done():
+				return done, nil
+			case <-time.After(c.cfg.Interval):
+			}
+		}
+	}
+	return done, nil
+}
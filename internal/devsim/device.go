@@ -0,0 +1,132 @@
+package devsim
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/agent"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// DeviceConfig describes a simulated device
+type DeviceConfig struct {
+	Server  string // proxy address for agent.Dial: host:2217 or ws(s)://.../ws/register
+	Token   string // AT+REG token: DEVICE_ID or AUTH_TOKEN+DEVICE_ID
+	Dialect string // device dialect configured in the proxy
+	Timeout time.Duration
+	Retry   time.Duration // delay before reconnect
+}
+
+// Device registers at the proxy as agent would and answers sessions with a peripheral
+type Device struct {
+	cfg        DeviceConfig
+	peripheral Peripheral
+	stats      *Stats
+
+	registered chan struct{}
+	once       sync.Once
+}
+
+func NewDevice(cfg DeviceConfig, peripheral Peripheral, stats *Stats) *Device {
+	return &Device{
+		cfg:        cfg,
+		peripheral: peripheral,
+		stats:      stats,
+		registered: make(chan struct{}),
+	}
+}
+
+// Registered is closed after the first successful registration
+func (d *Device) Registered() <-chan struct{} {
+	return d.registered
+}
+
+// Run keeps the device registered until ctx is done
+func (d *Device) Run(ctx context.Context) {
+	for {
+		if err := d.serve(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("[devsim] device %s: %v", d.cfg.Token, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.cfg.Retry):
+		}
+	}
+}
+
+func (d *Device) serve(ctx context.Context) error {
+	start := time.Now()
+	conn, err := agent.Dial(ctx, d.cfg.Server)
+	if err != nil {
+		d.stats.Register.Fail()
+		return err
+	}
+	defer conn.Close()
+	if err := agent.Register(conn, d.cfg.Token, d.cfg.Timeout); err != nil {
+		d.stats.Register.Fail()
+		return err
+	}
+	d.stats.Register.Add(time.Since(start))
+	d.once.Do(func() { close(d.registered) })
+
+	port := newPort(d.peripheral)
+	defer port.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	profile := device.SerialProfile{BaudRate: 9600, DataBits: 8, Parity: 1, StopBits: 1}
+	return agent.NewBridge(conn, port, d.cfg.Dialect, profile).Run()
+}
+
+// port connects a peripheral to agent.Bridge: writes are answered synchronously,
+// answers are returned by Read
+type port struct {
+	peripheral Peripheral
+	out        chan []byte
+	pending    []byte
+	closed     chan struct{}
+	once       sync.Once
+}
+
+func newPort(p Peripheral) *port {
+	return &port{
+		peripheral: p,
+		out:        make(chan []byte, 16),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (p *port) Write(b []byte) (int, error) {
+	resp := p.peripheral.Handle(b)
+	if len(resp) == 0 {
+		return len(b), nil
+	}
+	select {
+	case p.out <- resp:
+		return len(b), nil
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (p *port) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		select {
+		case p.pending = <-p.out:
+		case <-p.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *port) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
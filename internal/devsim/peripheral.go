@@ -0,0 +1,296 @@
+// Package devsim simulates devices and clients of the proxy for load and integration testing
+package devsim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/iec62056"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
+)
+
+// Simulated peripheral kinds
+const (
+	PeripheralEcho   = "echo"
+	PeripheralScript = "script"
+	PeripheralModbus = "modbus"
+	PeripheralIEC    = "iec"
+)
+
+// maxPending limits buffered input of request/response peripherals
+const maxPending = 4096
+
+// Peripheral emulates a serial device behind the port
+// Handle gets bytes written to the port and returns the device output
+type Peripheral interface {
+	Handle(p []byte) []byte
+}
+
+// Echo returns all received bytes
+type Echo struct{}
+
+func (Echo) Handle(p []byte) []byte {
+	return append([]byte(nil), p...)
+}
+
+// Rule is a scripted response to a request
+type Rule struct {
+	Request  []byte
+	Response []byte
+}
+
+// ParseScript reads rules, one per line: "request" "response" (Go quoted strings)
+// Empty lines and lines starting with # are skipped
+func ParseScript(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		req, rest, err := unquotePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: request: %w", n, err)
+		}
+		resp, rest, err := unquotePrefix(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: response: %w", n, err)
+		}
+		if req == "" || strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("line %d: want \"request\" \"response\"", n)
+		}
+		rules = append(rules, Rule{Request: []byte(req), Response: []byte(resp)})
+	}
+	return rules, scanner.Err()
+}
+
+func unquotePrefix(s string) (string, string, error) {
+	q, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", err
+	}
+	v, err := strconv.Unquote(q)
+	return v, s[len(q):], err
+}
+
+// Script answers requests found in the input with their responses
+type Script struct {
+	Rules []Rule
+
+	pending []byte
+}
+
+func (s *Script) Handle(p []byte) []byte {
+	s.pending = append(s.pending, p...)
+	var out []byte
+	for {
+		idx, rule := -1, Rule{}
+		for _, r := range s.Rules {
+			if i := bytes.Index(s.pending, r.Request); i >= 0 && (idx < 0 || i < idx) {
+				idx, rule = i, r
+			}
+		}
+		if idx < 0 {
+			break
+		}
+		out = append(out, rule.Response...)
+		s.pending = s.pending[idx+len(rule.Request):]
+	}
+	if len(s.pending) > maxPending {
+		s.pending = s.pending[len(s.pending)-maxPending:]
+	}
+	return out
+}
+
+// ModbusSlave is a Modbus RTU slave with holding and input registers at
+// addresses 0..len(Registers)-1 (the same map for both)
+// Supports functions 03, 04, 06 and 16; requests for other units are ignored
+type ModbusSlave struct {
+	Unit      byte
+	Registers []uint16
+
+	pending []byte
+}
+
+// NewModbusSlave creates slave with count registers, each holding its own address
+func NewModbusSlave(unit byte, count int) *ModbusSlave {
+	regs := make([]uint16, count)
+	for i := range regs {
+		regs[i] = uint16(i)
+	}
+	return &ModbusSlave{Unit: unit, Registers: regs}
+}
+
+func (m *ModbusSlave) Handle(p []byte) []byte {
+	m.pending = append(m.pending, p...)
+	var out []byte
+	for len(m.pending) >= modbus.MinRTULen {
+		n := rtuRequestLen(m.pending)
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			m.pending = nil // garbage, wait for the next frame
+			break
+		}
+		if n > len(m.pending) {
+			break
+		}
+		unit, pdu, err := modbus.ParseRTUFrame(m.pending[:n])
+		m.pending = m.pending[n:]
+		if err != nil || unit != m.Unit {
+			continue
+		}
+		out = append(out, modbus.BuildRTUFrame(unit, m.execute(pdu))...)
+	}
+	return out
+}
+
+// execute returns response PDU for request PDU
+func (m *ModbusSlave) execute(pdu []byte) []byte {
+	fn := pdu[0]
+	switch fn {
+	case modbus.FuncReadHoldingRegisters, modbus.FuncReadInputRegisters:
+		if len(pdu) < 5 {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalValue)
+		}
+		addr, count := int(binary.BigEndian.Uint16(pdu[1:])), int(binary.BigEndian.Uint16(pdu[3:]))
+		if count < 1 || count > 125 {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalValue)
+		}
+		if addr+count > len(m.Registers) {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalAddress)
+		}
+		resp := []byte{fn, byte(count * 2)}
+		for _, v := range m.Registers[addr : addr+count] {
+			resp = binary.BigEndian.AppendUint16(resp, v)
+		}
+		return resp
+	case modbus.FuncWriteSingleRegister:
+		if len(pdu) < 5 {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalValue)
+		}
+		addr := int(binary.BigEndian.Uint16(pdu[1:]))
+		if addr >= len(m.Registers) {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalAddress)
+		}
+		m.Registers[addr] = binary.BigEndian.Uint16(pdu[3:])
+		return pdu[:5]
+	case modbus.FuncWriteMultipleRegisters:
+		if len(pdu) < 6 {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalValue)
+		}
+		addr, count := int(binary.BigEndian.Uint16(pdu[1:])), int(binary.BigEndian.Uint16(pdu[3:]))
+		if count < 1 || int(pdu[5]) != count*2 || len(pdu) < 6+count*2 {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalValue)
+		}
+		if addr+count > len(m.Registers) {
+			return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalAddress)
+		}
+		for i := 0; i < count; i++ {
+			m.Registers[addr+i] = binary.BigEndian.Uint16(pdu[6+i*2:])
+		}
+		return pdu[:5]
+	}
+	return modbus.ExceptionPDU(fn, modbus.ExceptionIllegalFunction)
+}
+
+// rtuRequestLen returns length of RTU request at the start of p,
+// 0 if more bytes are needed, -1 for unknown function
+func rtuRequestLen(p []byte) int {
+	if len(p) < 2 {
+		return 0
+	}
+	switch p[1] {
+	case modbus.FuncReadCoils, modbus.FuncReadDiscreteInputs,
+		modbus.FuncReadHoldingRegisters, modbus.FuncReadInputRegisters,
+		modbus.FuncWriteSingleCoil, modbus.FuncWriteSingleRegister:
+		return 8 // unit, function, address, count/value, CRC
+	case modbus.FuncWriteMultipleCoils, modbus.FuncWriteMultipleRegisters:
+		if len(p) < 7 {
+			return 0
+		}
+		return 7 + int(p[6]) + 2 // unit, function, address, count, byte count, data, CRC
+	}
+	return -1
+}
+
+// IECMeter is an IEC 62056-21 mode C meter answering data readout
+type IECMeter struct {
+	Ident string   // identification after "/SIM5"
+	Data  []string // data lines like "1.8.0(001234.567*kWh)"
+
+	pending []byte
+	idented bool // identification sent, waiting for option select
+}
+
+// NewIECMeter creates meter with identification and data lines derived from id
+func NewIECMeter(id string) *IECMeter {
+	return &IECMeter{
+		Ident: id,
+		Data: []string{
+			"0.0.0(" + id + ")",
+			"1.8.0(001234.567*kWh)",
+			"2.8.0(000012.345*kWh)",
+		},
+	}
+}
+
+func (m *IECMeter) Handle(p []byte) []byte {
+	m.pending = append(m.pending, p...)
+	var out []byte
+	for len(m.pending) > 0 {
+		if m.idented && m.pending[0] == iec62056.ACK {
+			// Option select: ACK V Z Y CR LF
+			if len(m.pending) < 6 {
+				break
+			}
+			m.idented = false
+			opt, err := iec62056.ParseOptionSelect(m.pending[:6])
+			m.pending = m.pending[6:]
+			if err != nil || opt.Mode != '0' {
+				out = append(out, iec62056.NAK)
+				continue
+			}
+			out = append(out, m.readout()...)
+			continue
+		}
+
+		n := iec62056.MessageLen(m.pending)
+		if n == 0 {
+			if len(m.pending) > maxPending {
+				m.pending = nil
+			}
+			break
+		}
+		if n < 0 {
+			m.pending = m.pending[1:] // skip noise
+			continue
+		}
+		msg := m.pending[:n]
+		m.pending = m.pending[n:]
+
+		switch {
+		case iec62056.IsRequest(msg):
+			m.idented = true
+			out = append(out, "/SIM5"+m.Ident+"\r\n"...)
+		case iec62056.IsBreak(msg):
+			m.idented = false
+		}
+	}
+	return out
+}
+
+// readout builds data block: STX data "!" CR LF ETX BCC
+func (m *IECMeter) readout() []byte {
+	block := []byte(strings.Join(m.Data, "\r\n") + "\r\n!\r\n")
+	block = append(block, iec62056.ETX)
+	block = append(block, iec62056.BCC(block))
+	return append([]byte{iec62056.STX}, block...)
+}
@@ -0,0 +1,122 @@
+package devsim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/modbus"
+)
+
+func TestParseScript(t *testing.T) {
+	rules, err := ParseScript(strings.NewReader(`
+# comment
+"PING\r" "PONG\r\n"
+"\x01\x02"   "\xff"
+`))
+	if err != nil {
+		t.Fatalf("ParseScript: %v", err)
+	}
+	if len(rules) != 2 || string(rules[0].Request) != "PING\r" || !bytes.Equal(rules[1].Response, []byte{0xFF}) {
+		t.Errorf("rules = %q", rules)
+	}
+
+	for _, bad := range []string{`PING PONG`, `"PING"`, `"" "x"`, `"a" "b" "c"`} {
+		if _, err := ParseScript(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseScript(%s) should fail", bad)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := &Script{Rules: []Rule{{Request: []byte("AB"), Response: []byte("1")}, {Request: []byte("C"), Response: []byte("2")}}}
+	out := s.Handle([]byte("xA"))
+	out = append(out, s.Handle([]byte("BCyAB"))...)
+	if string(out) != "121" {
+		t.Errorf("output %q, want 121", out)
+	}
+}
+
+func TestModbusSlave(t *testing.T) {
+	m := NewModbusSlave(1, 10)
+
+	// Write register 2, then read 2..3 in two chunks
+	out := m.Handle(modbus.BuildRTUFrame(1, []byte{0x06, 0, 2, 0x12, 0x34}))
+	if want := modbus.BuildRTUFrame(1, []byte{0x06, 0, 2, 0x12, 0x34}); !bytes.Equal(out, want) {
+		t.Errorf("write response % x, want % x", out, want)
+	}
+	req := modbus.BuildRTUFrame(1, []byte{0x03, 0, 2, 0, 2})
+	if out := m.Handle(req[:3]); out != nil {
+		t.Errorf("partial request answered % x", out)
+	}
+	out = m.Handle(req[3:])
+	if want := modbus.BuildRTUFrame(1, []byte{0x03, 4, 0x12, 0x34, 0, 3}); !bytes.Equal(out, want) {
+		t.Errorf("read response % x, want % x", out, want)
+	}
+
+	// Other units are ignored, out of range is an exception
+	if out := m.Handle(modbus.BuildRTUFrame(2, []byte{0x03, 0, 0, 0, 1})); out != nil {
+		t.Errorf("unit 2 answered % x", out)
+	}
+	out = m.Handle(modbus.BuildRTUFrame(1, []byte{0x03, 0, 9, 0, 2}))
+	if want := modbus.BuildRTUFrame(1, modbus.ExceptionPDU(0x03, modbus.ExceptionIllegalAddress)); !bytes.Equal(out, want) {
+		t.Errorf("exception % x, want % x", out, want)
+	}
+}
+
+func TestIECMeter(t *testing.T) {
+	m := NewIECMeter("sim1")
+	if out := m.Handle([]byte("/?!\r\n")); string(out) != "/SIM5sim1\r\n" {
+		t.Errorf("identification %q", out)
+	}
+	out := m.Handle([]byte{0x06, '0', '5', '0', '\r'})
+	out = append(out, m.Handle([]byte{'\n'})...)
+	if len(out) < 3 || out[0] != 0x02 || out[len(out)-2] != 0x03 || !bytes.Contains(out, []byte("0.0.0(sim1)")) {
+		t.Errorf("readout %q", out)
+	}
+
+	// Option select without request is ignored, programming mode is refused
+	if out := m.Handle([]byte{0x06, '0', '5', '0', '\r', '\n'}); out != nil {
+		t.Errorf("unexpected output %q", out)
+	}
+	m.Handle([]byte("/?!\r\n"))
+	if out := m.Handle([]byte{0x06, '0', '5', '1', '\r', '\n'}); !bytes.Equal(out, []byte{0x15}) {
+		t.Errorf("programming mode answer %q, want NAK", out)
+	}
+}
+
+// loopback answers writes with the peripheral output
+type loopback struct {
+	p   Peripheral
+	out bytes.Buffer
+}
+
+func (l *loopback) Write(b []byte) (int, error) {
+	l.out.Write(l.p.Handle(b))
+	return len(b), nil
+}
+
+func (l *loopback) Read(b []byte) (int, error) {
+	return l.out.Read(b)
+}
+
+func TestScenarioTransact(t *testing.T) {
+	for _, s := range []Scenario{
+		{Kind: PeripheralEcho, Payload: 100},
+		{Kind: PeripheralScript, Rules: []Rule{{Request: []byte("?"), Response: []byte("42\r\n")}}},
+		{Kind: PeripheralModbus, Unit: 3, Registers: 200},
+		{Kind: PeripheralIEC},
+	} {
+		if err := s.Validate(); err != nil {
+			t.Fatalf("%s: Validate: %v", s.Kind, err)
+		}
+		sent, received, err := s.Transact(&loopback{p: s.Peripheral("meter1")})
+		if err != nil || sent == 0 || received == 0 {
+			t.Errorf("%s: sent %d, received %d, %v", s.Kind, sent, received, err)
+		}
+	}
+
+	if err := (Scenario{Kind: "printer"}).Validate(); err == nil {
+		t.Error("unknown kind should fail validation")
+	}
+}
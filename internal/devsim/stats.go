@@ -0,0 +1,97 @@
+package devsim
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric collects latency samples and failures of one operation
+type Metric struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	errors  int
+}
+
+// Add records successful operation
+func (m *Metric) Add(d time.Duration) {
+	m.mu.Lock()
+	m.samples = append(m.samples, d)
+	m.mu.Unlock()
+}
+
+// Fail records failed operation
+func (m *Metric) Fail() {
+	m.mu.Lock()
+	m.errors++
+	m.mu.Unlock()
+}
+
+// Summary is a latency distribution
+type Summary struct {
+	Count, Errors      int
+	P50, P95, P99, Max time.Duration
+}
+
+// Summary returns percentiles of recorded samples
+func (m *Metric) Summary() Summary {
+	m.mu.Lock()
+	samples := slices.Clone(m.samples)
+	s := Summary{Count: len(samples), Errors: m.errors}
+	m.mu.Unlock()
+
+	if len(samples) == 0 {
+		return s
+	}
+	slices.Sort(samples)
+	at := func(q float64) time.Duration {
+		return samples[int(q*float64(len(samples)-1))]
+	}
+	s.P50, s.P95, s.P99, s.Max = at(0.50), at(0.95), at(0.99), samples[len(samples)-1]
+	return s
+}
+
+// Stats aggregates measurements of all simulated devices and clients
+type Stats struct {
+	Register    Metric // connect and AT+REG/ATDT of a device
+	Connect     Metric // connect and AT+CONNECT of a client (session setup)
+	Transaction Metric // client request until complete response
+
+	BytesSent     atomic.Int64 // client requests
+	BytesReceived atomic.Int64 // device responses received by clients
+
+	start time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{start: time.Now()}
+}
+
+// Report writes latency table and client throughput since start
+func (s *Stats) Report(w io.Writer) {
+	fmt.Fprintf(w, "%-12s %8s %7s %10s %10s %10s %10s\n", "", "count", "errors", "p50", "p95", "p99", "max")
+	for _, m := range []struct {
+		name   string
+		metric *Metric
+	}{
+		{"register", &s.Register},
+		{"connect", &s.Connect},
+		{"transaction", &s.Transaction},
+	} {
+		sum := m.metric.Summary()
+		fmt.Fprintf(w, "%-12s %8d %7d %10s %10s %10s %10s\n", m.name, sum.Count, sum.Errors,
+			round(sum.P50), round(sum.P95), round(sum.P99), round(sum.Max))
+	}
+
+	elapsed := time.Since(s.start).Seconds()
+	sent, received := s.BytesSent.Load(), s.BytesReceived.Load()
+	fmt.Fprintf(w, "throughput   sent %d B (%.0f B/s), received %d B (%.0f B/s) in %.1fs\n",
+		sent, float64(sent)/elapsed, received, float64(received)/elapsed, elapsed)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,29 @@
+package devsim
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricSummary(t *testing.T) {
+	var m Metric
+	for i := 100; i >= 1; i-- {
+		m.Add(time.Duration(i) * time.Millisecond)
+	}
+	m.Fail()
+
+	s := m.Summary()
+	if s.Count != 100 || s.Errors != 1 || s.P50 != 50*time.Millisecond ||
+		s.P95 != 95*time.Millisecond || s.P99 != 99*time.Millisecond || s.Max != 100*time.Millisecond {
+		t.Errorf("summary = %+v", s)
+	}
+
+	stats := NewStats()
+	stats.BytesSent.Add(10)
+	var report strings.Builder
+	stats.Report(&report)
+	if !strings.Contains(report.String(), "transaction") || !strings.Contains(report.String(), "sent 10 B") {
+		t.Errorf("report:\n%s", report.String())
+	}
+}
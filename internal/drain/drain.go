@@ -0,0 +1,192 @@
+// Package drain implements graceful shutdown: readiness withdrawal, stop of accepting
+// connections and hand-over of listening sockets to a new process
+package drain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Socket inheritance uses systemd socket activation variables, so the proxy also
+// accepts sockets passed by systemd: descriptors start at 3, names are colon separated
+const (
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	envListenPID     = "LISTEN_PID"
+	listenFDsStart   = 3
+)
+
+// Controller tracks drain state and listening sockets of the process
+// Nil controller never drains and opens new sockets
+type Controller struct {
+	draining atomic.Bool
+	ctx      context.Context // done when servers must stop accepting connections
+	stop     context.CancelFunc
+
+	mu        sync.Mutex
+	inherited map[string]*os.File     // sockets passed by parent process, by name
+	listeners map[string]net.Listener // opened listeners, by name
+}
+
+// New creates a controller and takes over sockets passed by the parent process
+func New() *Controller {
+	c := &Controller{
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]net.Listener),
+	}
+	c.ctx, c.stop = context.WithCancel(context.Background())
+
+	n, _ := strconv.Atoi(os.Getenv(envListenFDs))
+	if pid := os.Getenv(envListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		n = 0 // sockets were passed to another process
+	}
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		c.inherited[name] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+	os.Unsetenv(envListenPID)
+	return c
+}
+
+// Listen returns inherited listener with the name or listens on TCP address
+func (c *Controller) Listen(name, addr string) (net.Listener, error) {
+	if c == nil {
+		return net.Listen("tcp", addr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var listener net.Listener
+	if f, ok := c.inherited[name]; ok {
+		delete(c.inherited, name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s socket: %w", name, err)
+		}
+		log.Printf("[drain] using inherited %s socket %s", name, l.Addr())
+		listener = l
+	} else {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener = l
+	}
+	c.listeners[name] = listener
+	return listener, nil
+}
+
+// Start begins draining: readiness is withdrawn at once,
+// after delay Done is closed and servers stop accepting connections
+func (c *Controller) Start(delay time.Duration) {
+	if c == nil || c.draining.Swap(true) {
+		return
+	}
+	time.AfterFunc(delay, c.stop)
+}
+
+// Draining returns true after drain started
+func (c *Controller) Draining() bool {
+	return c != nil && c.draining.Load()
+}
+
+// Done returns channel closed when servers must stop accepting connections
+func (c *Controller) Done() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.ctx.Done()
+}
+
+// AfterDone calls f in its own goroutine when servers must stop accepting connections
+// Unlike waiting on Done it holds no goroutine until then; stop cancels the call
+func (c *Controller) AfterDone(f func()) (stop func() bool) {
+	if c == nil {
+		return func() bool { return false }
+	}
+	return context.AfterFunc(c.ctx, f)
+}
+
+// Stopped returns true when servers must stop accepting connections
+func (c *Controller) Stopped() bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// filer is implemented by listeners backed by a socket descriptor
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Spawn starts a new process of the same executable with the same arguments
+// and hands over all opened listeners to it
+func (c *Controller) Spawn() (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	names := make([]string, 0, len(c.listeners))
+	for name := range c.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for _, name := range names {
+		l, ok := c.listeners[name].(filer)
+		if !ok {
+			c.mu.Unlock()
+			closeFiles(files[listenFDsStart:])
+			return nil, fmt.Errorf("%s socket can't be handed over", name)
+		}
+		f, err := l.File()
+		if err != nil {
+			c.mu.Unlock()
+			closeFiles(files[listenFDsStart:])
+			return nil, fmt.Errorf("%s socket: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	c.mu.Unlock()
+	defer closeFiles(files[listenFDsStart:])
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envListenFDs+"="+strconv.Itoa(len(names)),
+		envListenFDNames+"="+strings.Join(names, ":"))
+
+	return os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
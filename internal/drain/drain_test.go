@@ -0,0 +1,108 @@
+package drain
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Child process of TestSpawn: accepts one connection on the inherited socket
+func TestMain(m *testing.M) {
+	if os.Getenv("DRAIN_TEST_CHILD") == "1" {
+		l, err := New().Listen("test", "127.0.0.1:0")
+		if err != nil {
+			os.Exit(1)
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Fprintf(conn, "child %d\n", os.Getpid())
+		conn.Close()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestControllerStart(t *testing.T) {
+	c := New()
+	if c.Draining() || c.Stopped() {
+		t.Fatal("new controller is draining")
+	}
+	called := make(chan struct{})
+	c.AfterDone(func() { close(called) })
+	c.AfterDone(func() { t.Error("stopped AfterDone called") })()
+
+	c.Start(50 * time.Millisecond)
+	if !c.Draining() {
+		t.Fatal("Draining = false after Start")
+	}
+	if c.Stopped() {
+		t.Fatal("stopped before delay")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed after delay")
+	}
+	if !c.Stopped() {
+		t.Fatal("Stopped = false after delay")
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("AfterDone not called")
+	}
+	c.Start(0) // repeated start is ignored
+}
+
+func TestNilController(t *testing.T) {
+	var c *Controller
+	c.Start(0)
+	if c.Draining() || c.Stopped() {
+		t.Fatal("nil controller is draining")
+	}
+	c.AfterDone(func() { t.Error("nil controller called AfterDone") })()
+	l, err := c.Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	l.Close()
+}
+
+func TestSpawn(t *testing.T) {
+	c := New()
+	l, err := c.Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	t.Setenv("DRAIN_TEST_CHILD", "1")
+	proc, err := c.Spawn()
+	if err != nil {
+		t.Fatalf("Spawn: %v", err)
+	}
+	// Parent stops accepting, the socket stays open in the child
+	l.Close()
+
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial handed over socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != fmt.Sprintf("child %d\n", proc.Pid) {
+		t.Fatalf("child reply = %q, %v", strings.TrimSpace(line), err)
+	}
+
+	state, err := proc.Wait()
+	if err != nil || !state.Success() {
+		t.Fatalf("child exit: %v %v", state, err)
+	}
+}
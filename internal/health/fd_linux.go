@@ -0,0 +1,20 @@
+package health
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFiles returns number of open file descriptors and the soft limit
+func openFiles() (used, limit int, err error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+	// ReadDir holds one descriptor of the directory itself
+	return len(entries) - 1, int(rlimit.Cur), nil
+}
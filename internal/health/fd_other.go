@@ -0,0 +1,8 @@
+//go:build !linux
+
+package health
+
+// openFiles is not supported on this platform
+func openFiles() (used, limit int, err error) {
+	return 0, 0, errUnsupported
+}
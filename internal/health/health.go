@@ -0,0 +1,136 @@
+// Package health runs named checks for liveness and readiness probes
+package health
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// errUnsupported is returned by platform specific checks that are not available
+var errUnsupported = errors.New("not supported")
+
+// CheckFunc returns check details or error if the check fails
+type CheckFunc func() (string, error)
+
+// check is a registered named check
+type check struct {
+	name     string
+	liveness bool
+	fn       CheckFunc
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Checker runs registered checks
+type Checker struct {
+	mu     sync.Mutex
+	checks []check
+}
+
+// NewChecker creates a checker without checks
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a check, liveness checks fail both liveness and readiness probes
+func (c *Checker) Add(name string, liveness bool, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, liveness: liveness, fn: fn})
+}
+
+// Live runs liveness checks
+func (c *Checker) Live() (bool, []Result) {
+	return c.run(true)
+}
+
+// Ready runs all checks
+func (c *Checker) Ready() (bool, []Result) {
+	return c.run(false)
+}
+
+func (c *Checker) run(liveness bool) (bool, []Result) {
+	c.mu.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.Unlock()
+
+	ok := true
+	results := []Result{}
+	for _, ch := range checks {
+		if liveness && !ch.liveness {
+			continue
+		}
+		detail, err := ch.fn()
+		result := Result{Name: ch.name, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Error = err.Error()
+			ok = false
+		}
+		results = append(results, result)
+	}
+	return ok, results
+}
+
+// Failed returns names of failed checks
+func Failed(results []Result) []string {
+	var names []string
+	for _, r := range results {
+		if !r.OK {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// Goroutines fails when the number of goroutines reaches max, 0 disables the limit
+func Goroutines(max int) CheckFunc {
+	return func() (string, error) {
+		n := runtime.NumGoroutine()
+		if max <= 0 {
+			return fmt.Sprintf("%d", n), nil
+		}
+		detail := fmt.Sprintf("%d of %d", n, max)
+		if n >= max {
+			return detail, errors.New("too many goroutines")
+		}
+		return detail, nil
+	}
+}
+
+// FileDescriptors fails when less than headroom percent of the open files limit is free
+func FileDescriptors(headroom int) CheckFunc {
+	return func() (string, error) {
+		used, limit, err := openFiles()
+		if err == errUnsupported {
+			return "not supported", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		detail := fmt.Sprintf("%d of %d", used, limit)
+		if limit > 0 && (limit-used)*100 < limit*headroom {
+			return detail, fmt.Errorf("less than %d%% of open files limit free", headroom)
+		}
+		return detail, nil
+	}
+}
+
+// MinCount fails when count is below min
+func MinCount(what string, min int, count func() int) CheckFunc {
+	return func() (string, error) {
+		n := count()
+		detail := fmt.Sprintf("%d %s", n, what)
+		if n < min {
+			return detail, fmt.Errorf("%d %s, need at least %d", n, what, min)
+		}
+		return detail, nil
+	}
+}
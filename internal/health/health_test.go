@@ -0,0 +1,73 @@
+package health
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestCheckerLiveReady(t *testing.T) {
+	c := NewChecker()
+	c.Add("listener", true, func() (string, error) { return "5 accepted", nil })
+	c.Add("drain", false, func() (string, error) { return "", errors.New("draining") })
+
+	ok, results := c.Live()
+	if !ok || len(results) != 1 || results[0].Name != "listener" || results[0].Detail != "5 accepted" {
+		t.Fatalf("Live = %v %+v", ok, results)
+	}
+
+	ok, results = c.Ready()
+	if ok || len(results) != 2 {
+		t.Fatalf("Ready = %v %+v", ok, results)
+	}
+	if r := results[1]; r.OK || r.Error != "draining" {
+		t.Errorf("drain result = %+v", r)
+	}
+	if failed := Failed(results); len(failed) != 1 || failed[0] != "drain" {
+		t.Errorf("Failed = %v", failed)
+	}
+}
+
+func TestEmptyChecker(t *testing.T) {
+	ok, results := NewChecker().Ready()
+	if !ok || len(results) != 0 {
+		t.Fatalf("Ready = %v %+v", ok, results)
+	}
+}
+
+func TestGoroutines(t *testing.T) {
+	if _, err := Goroutines(0)(); err != nil {
+		t.Errorf("unlimited: %v", err)
+	}
+	if _, err := Goroutines(1 << 20)(); err != nil {
+		t.Errorf("under limit: %v", err)
+	}
+	if _, err := Goroutines(runtime.NumGoroutine())(); err == nil {
+		t.Error("limit reached but check passed")
+	}
+}
+
+func TestMinCount(t *testing.T) {
+	n := 2
+	check := MinCount("devices", 3, func() int { return n })
+	if detail, err := check(); err == nil || detail != "2 devices" {
+		t.Errorf("below min: %q %v", detail, err)
+	}
+	n = 3
+	if _, err := check(); err != nil {
+		t.Errorf("at min: %v", err)
+	}
+}
+
+func TestFileDescriptors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("open files are counted on linux only")
+	}
+	detail, err := FileDescriptors(0)()
+	if err != nil || detail == "" {
+		t.Fatalf("headroom 0: %q %v", detail, err)
+	}
+	if _, err := FileDescriptors(101)(); err == nil {
+		t.Error("headroom over 100% passed")
+	}
+}
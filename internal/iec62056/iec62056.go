@@ -0,0 +1,171 @@
+// Package iec62056 recognizes IEC 62056-21 (mode C) messages in a data stream
+//
+// Mode C exchange:
+//
+//	client: /?[address]!<CR><LF>           request at 300 baud 7E1
+//	meter:  /XXXZ<identification><CR><LF> Z - proposed baud rate character
+//	client: <ACK>VZY<CR><LF>               option select, both sides switch to Z
+//	client: <SOH>B0<ETX><BCC>              break, back to 300 baud
+package iec62056
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Control characters
+const (
+	SOH = 0x01
+	STX = 0x02
+	ETX = 0x03
+	EOT = 0x04
+	ACK = 0x06
+	NAK = 0x15
+)
+
+// Initial serial settings of mode C exchange
+const (
+	InitialBaudRate = 300
+	DataBits        = 7
+	StopBits        = 1
+)
+
+const (
+	optionSelectLen   = 6  // ACK V Z Y CR LF
+	breakLen          = 5  // SOH B 0 ETX BCC
+	maxRequestLen     = 40 // "/?" + 32 address chars + "!" CR LF
+	maxIdentLen       = 23 // "/" XXX Z + 16 identification chars + CR LF
+	maxPendingMessage = 64
+)
+
+// Mode C baud rate characters
+var modeCBaudRates = map[byte]uint32{
+	'0': 300,
+	'1': 600,
+	'2': 1200,
+	'3': 2400,
+	'4': 4800,
+	'5': 9600,
+	'6': 19200,
+}
+
+// BaudRate returns mode C baud rate for baud rate character
+func BaudRate(z byte) (uint32, bool) {
+	baud, ok := modeCBaudRates[z]
+	return baud, ok
+}
+
+// Identification is the meter identification message
+type Identification struct {
+	Manufacturer string // three letters, lowercase third letter means 20 ms reaction time
+	BaudChar     byte
+	BaudRate     uint32 // 0 if baud character is not mode C
+	Ident        string
+}
+
+// String returns identification as shown by the meter
+func (id *Identification) String() string {
+	return fmt.Sprintf("/%s%c%s", id.Manufacturer, id.BaudChar, id.Ident)
+}
+
+// ParseIdentification parses "/XXXZident\r\n" message
+func ParseIdentification(msg []byte) (*Identification, error) {
+	msg = bytes.TrimSuffix(msg, []byte("\r\n"))
+	if len(msg) < 5 || msg[0] != '/' {
+		return nil, fmt.Errorf("not an identification message")
+	}
+	for _, c := range msg[1:4] {
+		if !isLetter(c) {
+			return nil, fmt.Errorf("invalid manufacturer id %q", msg[1:4])
+		}
+	}
+	if len(msg) > maxIdentLen-2 {
+		return nil, fmt.Errorf("identification too long")
+	}
+	id := &Identification{
+		Manufacturer: string(msg[1:4]),
+		BaudChar:     msg[4],
+		Ident:        string(msg[5:]),
+	}
+	id.BaudRate, _ = BaudRate(msg[4])
+	return id, nil
+}
+
+// OptionSelect is the acknowledgement/option select message
+type OptionSelect struct {
+	ProtocolControl byte // '0' normal, '1' secondary, '2' HDLC
+	BaudChar        byte
+	BaudRate        uint32
+	Mode            byte // '0' data readout, '1' programming, '2' binary (HDLC)
+}
+
+// ParseOptionSelect parses "<ACK>VZY\r\n" message
+func ParseOptionSelect(msg []byte) (*OptionSelect, error) {
+	if len(msg) != optionSelectLen || msg[0] != ACK || msg[4] != '\r' || msg[5] != '\n' {
+		return nil, fmt.Errorf("not an option select message")
+	}
+	baud, ok := BaudRate(msg[2])
+	if !ok {
+		return nil, fmt.Errorf("invalid baud rate character %q", msg[2])
+	}
+	if msg[1] < '0' || msg[1] > '9' || msg[3] < '0' || msg[3] > '9' {
+		return nil, fmt.Errorf("invalid option select %q", msg[1:4])
+	}
+	return &OptionSelect{
+		ProtocolControl: msg[1],
+		BaudChar:        msg[2],
+		BaudRate:        baud,
+		Mode:            msg[3],
+	}, nil
+}
+
+// IsRequest checks "/?[address]!\r\n" request message
+func IsRequest(msg []byte) bool {
+	return len(msg) >= 5 && len(msg) <= maxRequestLen &&
+		msg[0] == '/' && msg[1] == '?' && bytes.HasSuffix(msg, []byte("!\r\n"))
+}
+
+// IsBreak checks "<SOH>B0<ETX><BCC>" break message
+func IsBreak(msg []byte) bool {
+	return len(msg) == breakLen && msg[0] == SOH && msg[1] == 'B' && msg[2] == '0' &&
+		msg[3] == ETX && msg[4] == BCC(msg[1:4])
+}
+
+// MessageLen returns length of the complete message at the start of p:
+// ACK/NAK, "/...\r\n" line or SOH/STX block ending with ETX/EOT and BCC
+// Returns 0 if more bytes are needed, -1 if p doesn't start with a known message
+func MessageLen(p []byte) int {
+	if len(p) == 0 {
+		return 0
+	}
+	switch p[0] {
+	case ACK, NAK:
+		return 1
+	case '/':
+		if i := bytes.Index(p, []byte("\r\n")); i >= 0 {
+			return i + 2
+		}
+		return 0
+	case SOH, STX:
+		if i := bytes.IndexAny(p[1:], string([]byte{ETX, EOT})); i >= 0 {
+			if n := i + 3; len(p) >= n { // start, data, end, BCC
+				return n
+			}
+		}
+		return 0
+	}
+	return -1
+}
+
+// BCC calculates block check character (XOR of bytes after SOH/STX up to ETX)
+func BCC(data []byte) byte {
+	var bcc byte
+	for _, b := range data {
+		bcc ^= b
+	}
+	return bcc
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
@@ -0,0 +1,95 @@
+package iec62056
+
+import "testing"
+
+func TestParseIdentification(t *testing.T) {
+	id, err := ParseIdentification([]byte("/EKT5CE301v12\r\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if id.Manufacturer != "EKT" || id.BaudRate != 9600 || id.Ident != "CE301v12" {
+		t.Errorf("identification = %+v", id)
+	}
+
+	if _, err := ParseIdentification([]byte("/1.8.0(000123.4*kWh)\r\n")); err == nil {
+		t.Error("expected error for data line")
+	}
+}
+
+func TestParseOptionSelect(t *testing.T) {
+	opt, err := ParseOptionSelect([]byte{ACK, '0', '5', '0', '\r', '\n'})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if opt.BaudRate != 9600 || opt.Mode != '0' {
+		t.Errorf("option select = %+v", opt)
+	}
+
+	if _, err := ParseOptionSelect([]byte{ACK, '0', 'Z', '0', '\r', '\n'}); err == nil {
+		t.Error("expected error for invalid baud character")
+	}
+}
+
+func TestMessageLen(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want int
+	}{
+		{"", 0},
+		{"\x06", 1},
+		{"\x15rest", 1},
+		{"/ISK5ME", 0},
+		{"/ISK5ME382-1000\r\nrest", 17},
+		{"\x02data\x03", 0},
+		{"\x02data\x03X", 7},
+		{"\x01B0\x03q", 5},
+		{"\x02part\x04Xmore", 7},
+		{"garbage", -1},
+	}
+	for _, tt := range tests {
+		if got := MessageLen([]byte(tt.msg)); got != tt.want {
+			t.Errorf("MessageLen(%q) = %d, want %d", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestIsBreak(t *testing.T) {
+	if !IsBreak([]byte{SOH, 'B', '0', ETX, 0x71}) {
+		t.Error("expected break message")
+	}
+	if IsBreak([]byte{SOH, 'B', '0', ETX, 0x00}) {
+		t.Error("bad BCC accepted")
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	var w Watcher
+
+	// Request split across chunks, with data before it
+	if events := w.Client([]byte("xx/?12")); len(events) != 0 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	events := w.Client([]byte("345!\r\n"))
+	if len(events) != 1 || events[0].Type != EventRequest || string(events[0].Message) != "/?12345!\r\n" {
+		t.Fatalf("events = %+v, want request", events)
+	}
+
+	events = w.Device([]byte("/EKT5CE3"))
+	events = append(events, w.Device([]byte("01\r\n"))...)
+	if len(events) != 1 || events[0].Type != EventIdentification || events[0].Identification.BaudRate != 9600 {
+		t.Fatalf("events = %+v, want identification", events)
+	}
+
+	// Data readout after identification is not parsed
+	if events := w.Device([]byte("/EKT5XYZ\r\n")); len(events) != 0 {
+		t.Errorf("identification without request: %+v", events)
+	}
+
+	events = w.Client([]byte{ACK, '0', '5', '0', '\r', '\n', SOH, 'B', '0', ETX, 0x71})
+	if len(events) != 2 || events[0].Type != EventOptionSelect || events[1].Type != EventBreak {
+		t.Fatalf("events = %+v, want option select and break", events)
+	}
+	if events[0].Option.BaudRate != 9600 {
+		t.Errorf("option baud = %d, want 9600", events[0].Option.BaudRate)
+	}
+}
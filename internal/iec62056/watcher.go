@@ -0,0 +1,152 @@
+package iec62056
+
+import "bytes"
+
+// EventType identifies a recognized mode C message
+type EventType int
+
+const (
+	EventRequest        EventType = iota // client request "/?...!"
+	EventIdentification                  // meter identification "/XXXZ..."
+	EventOptionSelect                    // client ACK option select
+	EventBreak                           // client break "SOH B0 ETX"
+)
+
+// Event is a recognized mode C message
+type Event struct {
+	Type           EventType
+	Message        []byte
+	Identification *Identification // for EventIdentification
+	Option         *OptionSelect   // for EventOptionSelect
+}
+
+// Watcher recognizes mode C messages in both directions of a session
+// Messages may be split across chunks
+type Watcher struct {
+	client    []byte
+	device    []byte
+	requested bool // request seen, waiting for identification
+}
+
+// Client processes data sent by the client (polling program)
+func (w *Watcher) Client(p []byte) []Event {
+	var events []Event
+	buf := append(w.client, p...)
+
+	for {
+		idx := bytes.IndexAny(buf, "/\x06\x01")
+		if idx < 0 {
+			buf = nil
+			break
+		}
+		buf = buf[idx:]
+
+		var n int
+		var ev *Event
+		switch buf[0] {
+		case '/':
+			n, ev = w.scanLine(buf, maxRequestLen, func(msg []byte) *Event {
+				if !IsRequest(msg) {
+					return nil
+				}
+				w.requested = true
+				return &Event{Type: EventRequest}
+			})
+		case ACK:
+			n = optionSelectLen
+			if len(buf) >= n {
+				if opt, err := ParseOptionSelect(buf[:n]); err == nil {
+					w.requested = false
+					ev = &Event{Type: EventOptionSelect, Option: opt}
+				}
+			}
+		case SOH:
+			n = breakLen
+			if len(buf) >= n && IsBreak(buf[:n]) {
+				w.requested = false
+				ev = &Event{Type: EventBreak}
+			}
+		}
+
+		if len(buf) < n {
+			break // wait for the rest of the message
+		}
+		if ev == nil {
+			buf = buf[1:]
+			continue
+		}
+		ev.Message = append([]byte(nil), buf[:n]...)
+		events = append(events, *ev)
+		buf = buf[n:]
+	}
+
+	w.client = keepPending(buf)
+	return events
+}
+
+// Device processes data sent by the meter
+func (w *Watcher) Device(p []byte) []Event {
+	if !w.requested {
+		w.device = nil
+		return nil
+	}
+
+	var events []Event
+	buf := append(w.device, p...)
+
+	for w.requested {
+		idx := bytes.IndexByte(buf, '/')
+		if idx < 0 {
+			buf = nil
+			break
+		}
+		buf = buf[idx:]
+
+		n, ev := w.scanLine(buf, maxIdentLen, func(msg []byte) *Event {
+			id, err := ParseIdentification(msg)
+			if err != nil {
+				return nil
+			}
+			w.requested = false
+			return &Event{Type: EventIdentification, Identification: id}
+		})
+		if len(buf) < n {
+			break
+		}
+		if ev == nil {
+			buf = buf[1:]
+			continue
+		}
+		ev.Message = append([]byte(nil), buf[:n]...)
+		events = append(events, *ev)
+		buf = buf[n:]
+	}
+
+	w.device = keepPending(buf)
+	return events
+}
+
+// scanLine finds CR LF terminated message at the start of buf
+// Returns message length (larger than buf if incomplete) and parsed event
+func (w *Watcher) scanLine(buf []byte, maxLen int, parse func([]byte) *Event) (int, *Event) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) >= maxLen {
+			return 1, nil // too long, not a message
+		}
+		return len(buf) + 1, nil
+	}
+	n := end + 2
+	if n > maxLen {
+		return 1, nil
+	}
+	return n, parse(buf[:n])
+}
+
+// keepPending keeps beginning of an incomplete message for the next chunk
+func keepPending(buf []byte) []byte {
+	if len(buf) == 0 || len(buf) > maxPendingMessage {
+		return nil
+	}
+	return append([]byte(nil), buf...)
+}
@@ -0,0 +1,213 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+// SessionKind is the internal session kind of Modbus transactions
+const SessionKind = "modbus"
+
+const (
+	// DefaultTimeout is the RTU response timeout
+	DefaultTimeout = 2 * time.Second
+	// defaultBaudRate is assumed when device serial settings are unknown
+	defaultBaudRate = 9600
+	// broadcastTurnaround is the delay after broadcast request (no response expected)
+	broadcastTurnaround = 100 * time.Millisecond
+	// unknownLengthGap ends response of unknown length when no more data arrives
+	unknownLengthGap = 50 * time.Millisecond
+)
+
+// Transaction errors
+var (
+	ErrDeviceOffline = errors.New("modbus: device not connected")
+	ErrDeviceBusy    = errors.New("modbus: device is busy")
+	ErrTimeout       = errors.New("modbus: response timeout")
+)
+
+// Client performs Modbus RTU transactions over registered devices
+// Transactions to one device are serialized and hold the device in an internal session
+type Client struct {
+	registry *device.Registry
+	sessions *session.Manager
+	Timeout  time.Duration
+
+	lines sync.Map // device ID -> *line
+}
+
+// line serializes access to the RS-485 line behind a device
+type line struct {
+	mu        sync.Mutex
+	lastFrame time.Time // end of the last frame on the line
+}
+
+// NewClient creates Modbus RTU client
+func NewClient(registry *device.Registry, sessions *session.Manager, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{registry: registry, sessions: sessions, Timeout: timeout}
+}
+
+// Transact sends request PDU to the unit behind a device and returns response PDU
+// Exception responses are returned as PDU, not as error
+// Broadcast (unit 0) returns nil PDU
+func (c *Client) Transact(deviceID string, unitID byte, pdu []byte) ([]byte, error) {
+	dev, ok := c.registry.Get(deviceID)
+	if !ok {
+		return nil, ErrDeviceOffline
+	}
+
+	val, _ := c.lines.LoadOrStore(deviceID, &line{})
+	l := val.(*line)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Hold the device in an internal session so clients see it as busy
+	id := c.sessions.NewInternalID()
+	if !dev.TrySetSession(id) {
+		return nil, ErrDeviceBusy
+	}
+	defer dev.ClearSession()
+	sess := c.sessions.CreateInternal(id, deviceID, SessionKind, dev.SessionConn())
+	defer c.sessions.End(sess.ID)
+
+	baudRate := uint32(defaultBaudRate)
+	if profile := dev.SerialProfile(); profile != nil && profile.BaudRate > 0 {
+		baudRate = profile.BaudRate
+	}
+
+	// RTU frames must be separated by at least 3.5 characters of silence
+	if wait := InterFrameDelay(baudRate) - time.Since(l.lastFrame); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	request := BuildRTUFrame(unitID, pdu)
+	if sess.Debug {
+		log.Printf("[modbus] %s: request to unit %d: %x", deviceID, unitID, request)
+	}
+	// RFC2217 device speaks Telnet: 0xFF of the frame is escaped, replies are decoded
+	wire := request
+	var dec *rfc2217.Decoder
+	if dev.Dialect() == device.DialectRFC2217 {
+		wire = rfc2217.Escape(request)
+		dec = &rfc2217.Decoder{}
+	}
+	conn := sess.DeviceConn
+	conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err := conn.Write(wire)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("modbus: write request: %w", err)
+	}
+	atomic.AddInt64(&sess.BytesIn, int64(len(wire)))
+
+	if unitID == 0 {
+		time.Sleep(broadcastTurnaround)
+		l.lastFrame = time.Now()
+		return nil, nil
+	}
+
+	frame, err := c.readResponse(conn, dec, pdu)
+	l.lastFrame = time.Now()
+	atomic.AddInt64(&sess.BytesOut, int64(len(frame)))
+	if err != nil {
+		return nil, err
+	}
+	if sess.Debug {
+		log.Printf("[modbus] %s: response from unit %d: %x", deviceID, unitID, frame)
+	}
+
+	unit, resp, err := ParseRTUFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if unit != unitID {
+		return nil, ErrUnitMismatch
+	}
+	return resp, nil
+}
+
+// readResponse reads RTU response frame for request PDU
+// dec removes Telnet framing of RFC2217 devices (replies, NOP keepalives, escaped IAC), nil for raw devices
+func (c *Client) readResponse(conn net.Conn, dec *rfc2217.Decoder, request []byte) ([]byte, error) {
+	deadline := time.Now().Add(c.Timeout)
+	defer conn.SetReadDeadline(time.Time{})
+
+	var frame []byte
+	buf := make([]byte, MaxRTULen)
+	for {
+		readDeadline := deadline
+		expected := ResponseLen(request, frame)
+		if expected < 0 {
+			// Unknown length - response ends with a gap
+			if gap := time.Now().Add(unknownLengthGap); gap.Before(deadline) {
+				readDeadline = gap
+			}
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if dec != nil {
+				for _, ev := range dec.Feed(buf[:n]) {
+					if ev.Type == rfc2217.EventData {
+						frame = append(frame, ev.Data...)
+					}
+				}
+			} else {
+				frame = trimTelnetNOP(append(frame, buf[:n]...))
+			}
+			if expected = ResponseLen(request, frame); expected > 0 && len(frame) >= expected {
+				return frame[:expected], nil
+			}
+			if len(frame) >= MaxRTULen {
+				return frame, nil
+			}
+		}
+		if err != nil {
+			if isTimeout(err) {
+				if expected < 0 && len(frame) >= MinRTULen {
+					return frame, nil
+				}
+				if time.Now().Before(deadline) {
+					continue
+				}
+				return frame, ErrTimeout
+			}
+			return frame, fmt.Errorf("modbus: read response: %w", err)
+		}
+	}
+}
+
+// InterFrameDelay returns 3.5 character time for baud rate (fixed 1.75 ms above 19200)
+func InterFrameDelay(baudRate uint32) time.Duration {
+	if baudRate == 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	// 11 bits per character
+	return time.Duration(35*11) * time.Second / time.Duration(10*baudRate)
+}
+
+// trimTelnetNOP removes Telnet NOP keepalives sent by a raw device before the response
+func trimTelnetNOP(frame []byte) []byte {
+	for len(frame) >= 2 && frame[0] == 0xFF && frame[1] == 0xF1 {
+		frame = frame[2:]
+	}
+	return frame
+}
+
+func isTimeout(err error) bool {
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,67 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+func TestClientTelnetEscaping(t *testing.T) {
+	// Register 0x08FF = 0x08FF: request address, response data and CRC (FF C4) contain 0xFF
+	pdu := []byte{FuncReadHoldingRegisters, 0x08, 0xFF, 0x00, 0x01}
+	want := []byte{FuncReadHoldingRegisters, 0x02, 0x08, 0xFF}
+
+	for _, dialect := range []string{device.DialectRFC2217, device.DialectUSRVCOM, device.DialectNone} {
+		t.Run(dialect, func(t *testing.T) {
+			registry := device.NewRegistry()
+			client := NewClient(registry, session.NewManager(false, time.Second), 300*time.Millisecond)
+			registerFakeDevice(t, registry, "meter1", 1, dialect)
+
+			resp, err := client.Transact("meter1", 1, pdu)
+			if err != nil {
+				t.Fatalf("Transact: %v", err)
+			}
+			if !bytes.Equal(resp, want) {
+				t.Errorf("response = %x, want %x", resp, want)
+			}
+		})
+	}
+}
+
+func TestClientTelnetRequest(t *testing.T) {
+	// RFC2217 device gets 0xFF of the frame doubled, raw device gets the frame as is
+	frame := BuildRTUFrame(1, []byte{FuncReadHoldingRegisters, 0x08, 0xFF, 0x00, 0x01})
+	for dialect, want := range map[string][]byte{
+		device.DialectRFC2217: rfc2217.Escape(frame),
+		device.DialectNone:    frame,
+	} {
+		t.Run(dialect, func(t *testing.T) {
+			proxySide, deviceSide := net.Pipe()
+			defer proxySide.Close()
+			defer deviceSide.Close()
+			registry := device.NewRegistry()
+			dev := &device.Device{ID: "meter1", Conn: proxySide, RegisteredAt: time.Now()}
+			dev.SetDialect(dialect)
+			registry.Register(dev)
+			client := NewClient(registry, session.NewManager(false, time.Second), 100*time.Millisecond)
+
+			got := make(chan []byte, 1)
+			go func() {
+				buf := make([]byte, 64)
+				n, _ := deviceSide.Read(buf)
+				got <- buf[:n]
+			}()
+			if _, err := client.Transact("meter1", 1, frame[1:len(frame)-2]); err != ErrTimeout {
+				t.Errorf("Transact error = %v, want timeout", err)
+			}
+			if req := <-got; !bytes.Equal(req, want) {
+				t.Errorf("device got %x, want %x", req, want)
+			}
+		})
+	}
+}
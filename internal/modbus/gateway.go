@@ -0,0 +1,210 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+// gatewayIdleTimeout closes Modbus TCP connections without requests
+const gatewayIdleTimeout = 5 * time.Minute
+
+// Route is a target of Modbus TCP requests
+type Route struct {
+	DeviceID string
+	UnitID   int // RTU unit id, -1 keeps unit id of the request
+}
+
+// Gateway is a Modbus TCP server forwarding requests to RTU units behind devices
+type Gateway struct {
+	cfg      *config.Config
+	client   *Client
+	units    map[byte]Route   // unit id -> route
+	clients  map[string]Route // client IP -> route (connection level mapping)
+	listener net.Listener
+}
+
+// NewGateway creates Modbus TCP gateway
+func NewGateway(cfg *config.Config, registry *device.Registry, sessions *session.Manager) (*Gateway, error) {
+	g := &Gateway{
+		cfg:     cfg,
+		client:  NewClient(registry, sessions, cfg.ModbusTimeout),
+		units:   make(map[byte]Route),
+		clients: make(map[string]Route),
+	}
+	for unit, target := range cfg.ModbusUnits {
+		id, err := strconv.Atoi(unit)
+		if err != nil || id < 0 || id > 255 {
+			return nil, fmt.Errorf("modbus: invalid unit id %q", unit)
+		}
+		route, err := ParseRoute(target)
+		if err != nil {
+			return nil, err
+		}
+		g.units[byte(id)] = route
+	}
+	for ip, target := range cfg.ModbusClients {
+		route, err := ParseRoute(target)
+		if err != nil {
+			return nil, err
+		}
+		g.clients[ip] = route
+	}
+	return g, nil
+}
+
+// ParseRoute parses "DEVICE_ID" or "DEVICE_ID:UNIT" route
+func ParseRoute(s string) (Route, error) {
+	route := Route{DeviceID: s, UnitID: -1}
+	if id, unit, ok := strings.Cut(s, ":"); ok {
+		n, err := strconv.Atoi(unit)
+		if err != nil || n < 0 || n > 247 {
+			return route, fmt.Errorf("modbus: invalid unit id in route %q", s)
+		}
+		route.DeviceID, route.UnitID = id, n
+	}
+	if route.DeviceID == "" {
+		return route, fmt.Errorf("modbus: empty device id in route %q", s)
+	}
+	return route, nil
+}
+
+// Client returns RTU client of the gateway
+func (g *Gateway) Client() *Client {
+	return g.client
+}
+
+// Start starts Modbus TCP listener
+func (g *Gateway) Start(ctx context.Context) error {
+	addr := ":" + g.cfg.ModbusPort
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return g.Serve(ctx, listener)
+}
+
+// Serve accepts Modbus TCP connections on listener
+func (g *Gateway) Serve(ctx context.Context, listener net.Listener) error {
+	g.listener = listener
+
+	log.Printf("[modbus] gateway listening on %s (%d unit routes, %d client routes)",
+		listener.Addr(), len(g.units), len(g.clients))
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				log.Printf("[modbus] accept error: %v", err)
+				continue
+			}
+		}
+
+		go g.handleConn(ctx, conn)
+	}
+}
+
+// Addr returns the gateway address
+func (g *Gateway) Addr() net.Addr {
+	if g.listener == nil {
+		return nil
+	}
+	return g.listener.Addr()
+}
+
+// handleConn serves requests of one Modbus TCP connection
+func (g *Gateway) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	log.Printf("[modbus] %s: connected", remoteAddr)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(gatewayIdleTimeout))
+		hdr, pdu, err := ReadTCPFrame(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("[modbus] %s: %v", remoteAddr, err)
+			}
+			log.Printf("[modbus] %s: disconnected", remoteAddr)
+			return
+		}
+
+		resp := g.handleRequest(remoteAddr, hdr.UnitID, pdu)
+		if resp == nil {
+			continue // broadcast, no response
+		}
+		if _, err := conn.Write(BuildTCPFrame(hdr.TransactionID, hdr.UnitID, resp)); err != nil {
+			log.Printf("[modbus] %s: write error: %v", remoteAddr, err)
+			return
+		}
+	}
+}
+
+// handleRequest forwards request PDU and returns response or exception PDU
+func (g *Gateway) handleRequest(remoteAddr string, unitID byte, pdu []byte) []byte {
+	route, ok := g.route(remoteAddr, unitID)
+	if !ok {
+		log.Printf("[modbus] %s: no route for unit %d", remoteAddr, unitID)
+		return ExceptionPDU(pdu[0], ExceptionGatewayPath)
+	}
+
+	rtuUnit := unitID
+	if route.UnitID >= 0 {
+		rtuUnit = byte(route.UnitID)
+	}
+
+	resp, err := g.client.Transact(route.DeviceID, rtuUnit, pdu)
+	if err == nil {
+		return resp
+	}
+
+	log.Printf("[modbus] %s: unit %d via %s: %v", remoteAddr, rtuUnit, route.DeviceID, err)
+	switch {
+	case errors.Is(err, ErrDeviceOffline):
+		return ExceptionPDU(pdu[0], ExceptionGatewayPath)
+	case errors.Is(err, ErrDeviceBusy):
+		return ExceptionPDU(pdu[0], ExceptionDeviceBusy)
+	default:
+		return ExceptionPDU(pdu[0], ExceptionGatewayNoResponse)
+	}
+}
+
+// route finds target device for a request
+// Connection level mapping (by client IP) has priority over unit mapping
+func (g *Gateway) route(remoteAddr string, unitID byte) (Route, bool) {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		if route, ok := g.clients[host]; ok {
+			return route, true
+		}
+	}
+	route, ok := g.units[unitID]
+	return route, ok
+}
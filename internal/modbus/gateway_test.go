@@ -0,0 +1,174 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/config"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+// fakeRTUSlave answers read holding registers with register = address
+// RFC2217 device escapes 0xFF of its frames and sends NOP keepalive before the response
+func fakeRTUSlave(conn net.Conn, unitID byte, dialect string) {
+	telnet := dialect == device.DialectRFC2217
+	write := func(frame []byte) {
+		if telnet {
+			frame = append([]byte{0xFF, 0xF1}, rfc2217.Escape(frame)...)
+		}
+		// Response split in two parts like a slow serial line
+		conn.Write(frame[:3])
+		time.Sleep(5 * time.Millisecond)
+		conn.Write(frame[3:])
+	}
+	var dec rfc2217.Decoder
+	buf := make([]byte, 256)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		request := buf[:n]
+		if telnet {
+			request = nil
+			for _, ev := range dec.Feed(buf[:n]) {
+				if ev.Type == rfc2217.EventData {
+					request = append(request, ev.Data...)
+				}
+			}
+		}
+		unit, pdu, err := ParseRTUFrame(request)
+		if err != nil || unit != unitID {
+			continue // not for us - no response
+		}
+		if pdu[0] != FuncReadHoldingRegisters {
+			write(BuildRTUFrame(unit, ExceptionPDU(pdu[0], ExceptionIllegalFunction)))
+			continue
+		}
+		addr := uint16(pdu[1])<<8 | uint16(pdu[2])
+		count := int(pdu[4])
+		resp := []byte{pdu[0], byte(count * 2)}
+		for i := 0; i < count; i++ {
+			resp = append(resp, byte((addr+uint16(i))>>8), byte(addr+uint16(i)))
+		}
+		write(BuildRTUFrame(unit, resp))
+	}
+}
+
+func startTestGateway(t *testing.T, units map[string]string) (net.Addr, *device.Registry, *session.Manager) {
+	t.Helper()
+	cfg := &config.Config{ModbusPort: "0", ModbusUnits: units, ModbusTimeout: 300 * time.Millisecond}
+	registry := device.NewRegistry()
+	sessions := session.NewManager(false, time.Second)
+	g, err := NewGateway(cfg, registry, sessions)
+	if err != nil {
+		t.Fatalf("NewGateway: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go g.Serve(ctx, listener)
+	return listener.Addr(), registry, sessions
+}
+
+func registerFakeDevice(t *testing.T, registry *device.Registry, id string, unitID byte, dialect string) *device.Device {
+	t.Helper()
+	proxySide, deviceSide := net.Pipe()
+	t.Cleanup(func() {
+		proxySide.Close()
+		deviceSide.Close()
+	})
+	dev := &device.Device{ID: id, Conn: proxySide, RegisteredAt: time.Now()}
+	dev.SetDialect(dialect)
+	registry.Register(dev)
+	go fakeRTUSlave(deviceSide, unitID, dialect)
+	return dev
+}
+
+func modbusRequest(t *testing.T, conn net.Conn, txID uint16, unitID byte, pdu []byte) []byte {
+	t.Helper()
+	if _, err := conn.Write(BuildTCPFrame(txID, unitID, pdu)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	hdr, resp, err := ReadTCPFrame(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if hdr.TransactionID != txID || hdr.UnitID != unitID {
+		t.Errorf("header = %+v, want transaction %d unit %d", hdr, txID, unitID)
+	}
+	return resp
+}
+
+func TestGateway(t *testing.T) {
+	addr, registry, sessions := startTestGateway(t, map[string]string{
+		"1": "meter1",
+		"2": "meter1:7", // unit 2 on TCP side is RTU unit 7
+		"3": "offline",
+	})
+	dev := registerFakeDevice(t, registry, "meter1", 1, device.DialectNone)
+	var started atomic.Int32
+	sessions.SetCallbacks(func(*session.Session) { started.Add(1) }, nil)
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	readReq := []byte{FuncReadHoldingRegisters, 0x00, 0x10, 0x00, 0x02}
+
+	resp := modbusRequest(t, conn, 1, 1, readReq)
+	if !bytes.Equal(resp, []byte{0x03, 0x04, 0x00, 0x10, 0x00, 0x11}) {
+		t.Errorf("response = %x", resp)
+	}
+
+	// Device exception is passed through
+	resp = modbusRequest(t, conn, 2, 1, []byte{0x2B, 0x0E, 0x01, 0x00})
+	if !bytes.Equal(resp, []byte{0xAB, ExceptionIllegalFunction}) {
+		t.Errorf("response = %x, want illegal function", resp)
+	}
+
+	// RTU unit 7 doesn't answer
+	resp = modbusRequest(t, conn, 3, 2, readReq)
+	if !bytes.Equal(resp, []byte{0x83, ExceptionGatewayNoResponse}) {
+		t.Errorf("response = %x, want gateway target failed to respond", resp)
+	}
+
+	resp = modbusRequest(t, conn, 4, 3, readReq)
+	if !bytes.Equal(resp, []byte{0x83, ExceptionGatewayPath}) {
+		t.Errorf("response = %x, want gateway path unavailable", resp)
+	}
+
+	resp = modbusRequest(t, conn, 5, 9, readReq)
+	if !bytes.Equal(resp, []byte{0x83, ExceptionGatewayPath}) {
+		t.Errorf("response = %x, want gateway path unavailable for unmapped unit", resp)
+	}
+
+	// Device in client session is busy
+	dev.SetSession("sess_client")
+	resp = modbusRequest(t, conn, 6, 1, readReq)
+	if !bytes.Equal(resp, []byte{0x83, ExceptionDeviceBusy}) {
+		t.Errorf("response = %x, want device busy", resp)
+	}
+	dev.ClearSession()
+	// Sessions of the three transactions with the device, none for the busy one
+	if n := started.Load(); n != 3 {
+		t.Errorf("%d sessions started, want 3", n)
+	}
+
+	if dev.IsInSession() {
+		t.Error("device must be released after transaction")
+	}
+}
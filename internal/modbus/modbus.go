@@ -0,0 +1,185 @@
+// Package modbus converts Modbus TCP (MBAP) requests to Modbus RTU frames
+// and performs RTU transactions over registered devices
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Function codes with known response length
+const (
+	FuncReadCoils              = 0x01
+	FuncReadDiscreteInputs     = 0x02
+	FuncReadHoldingRegisters   = 0x03
+	FuncReadInputRegisters     = 0x04
+	FuncWriteSingleCoil        = 0x05
+	FuncWriteSingleRegister    = 0x06
+	FuncWriteMultipleCoils     = 0x0F
+	FuncWriteMultipleRegisters = 0x10
+)
+
+// Exception codes
+const (
+	ExceptionIllegalFunction   = 0x01
+	ExceptionIllegalAddress    = 0x02
+	ExceptionIllegalValue      = 0x03
+	ExceptionDeviceFailure     = 0x04
+	ExceptionDeviceBusy        = 0x06
+	ExceptionGatewayPath       = 0x0A // Gateway Path Unavailable
+	ExceptionGatewayNoResponse = 0x0B // Gateway Target Device Failed to Respond
+)
+
+// exceptionFlag is set in function code of exception responses
+const exceptionFlag byte = 0x80
+
+const (
+	MBAPHeaderLen = 7   // transaction id, protocol id, length, unit id
+	MaxPDULen     = 253 // function code + data
+	MinRTULen     = 4   // unit, function, CRC
+	MaxRTULen     = 256
+)
+
+// Errors
+var (
+	ErrBadCRC       = errors.New("modbus: CRC mismatch")
+	ErrShortFrame   = errors.New("modbus: frame too short")
+	ErrBadProtocol  = errors.New("modbus: not a Modbus TCP frame")
+	ErrUnitMismatch = errors.New("modbus: response from another unit")
+)
+
+// ExceptionError is a Modbus exception response
+type ExceptionError struct {
+	Function byte
+	Code     byte
+}
+
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("modbus: exception %02X for function %02X", e.Code, e.Function)
+}
+
+// MBAPHeader is Modbus TCP application protocol header
+type MBAPHeader struct {
+	TransactionID uint16
+	ProtocolID    uint16
+	Length        uint16 // unit id + PDU length
+	UnitID        byte
+}
+
+// ReadTCPFrame reads one Modbus TCP frame and returns header and PDU
+func ReadTCPFrame(r io.Reader) (MBAPHeader, []byte, error) {
+	var hdr MBAPHeader
+	buf := make([]byte, MBAPHeaderLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return hdr, nil, err
+	}
+	hdr.TransactionID = binary.BigEndian.Uint16(buf[0:2])
+	hdr.ProtocolID = binary.BigEndian.Uint16(buf[2:4])
+	hdr.Length = binary.BigEndian.Uint16(buf[4:6])
+	hdr.UnitID = buf[6]
+
+	if hdr.ProtocolID != 0 || hdr.Length < 2 || hdr.Length > MaxPDULen+1 {
+		return hdr, nil, ErrBadProtocol
+	}
+	pdu := make([]byte, hdr.Length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return hdr, nil, err
+	}
+	return hdr, pdu, nil
+}
+
+// BuildTCPFrame builds Modbus TCP frame with PDU
+func BuildTCPFrame(transactionID uint16, unitID byte, pdu []byte) []byte {
+	frame := make([]byte, MBAPHeaderLen+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:2], transactionID)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu)+1))
+	frame[6] = unitID
+	copy(frame[MBAPHeaderLen:], pdu)
+	return frame
+}
+
+// BuildRTUFrame builds RTU frame: unit, PDU, CRC (little-endian)
+func BuildRTUFrame(unitID byte, pdu []byte) []byte {
+	frame := make([]byte, 0, len(pdu)+3)
+	frame = append(frame, unitID)
+	frame = append(frame, pdu...)
+	crc := CRC16(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+// ParseRTUFrame checks CRC and returns unit id and PDU
+func ParseRTUFrame(frame []byte) (byte, []byte, error) {
+	if len(frame) < MinRTULen {
+		return 0, nil, ErrShortFrame
+	}
+	n := len(frame) - 2
+	if CRC16(frame[:n]) != binary.LittleEndian.Uint16(frame[n:]) {
+		return 0, nil, ErrBadCRC
+	}
+	return frame[0], frame[1:n], nil
+}
+
+// ExceptionPDU builds exception response PDU for a function
+func ExceptionPDU(function, code byte) []byte {
+	return []byte{function | exceptionFlag, code}
+}
+
+// IsException checks if PDU is an exception response
+func IsException(pdu []byte) bool {
+	return len(pdu) >= 1 && pdu[0]&exceptionFlag != 0
+}
+
+// PDUError returns ExceptionError for exception response PDU, nil otherwise
+func PDUError(pdu []byte) error {
+	if !IsException(pdu) {
+		return nil
+	}
+	e := &ExceptionError{Function: pdu[0] &^ exceptionFlag}
+	if len(pdu) > 1 {
+		e.Code = pdu[1]
+	}
+	return e
+}
+
+// ResponseLen returns expected RTU response length for a request PDU
+// once the first bytes of the response are received
+// Returns 0 if more bytes are needed to know, -1 if length is unknown
+func ResponseLen(request []byte, resp []byte) int {
+	if len(resp) < 2 {
+		return 0
+	}
+	if resp[1]&exceptionFlag != 0 {
+		return 5 // unit, function, code, CRC
+	}
+	if len(request) == 0 {
+		return -1
+	}
+	switch request[0] {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if len(resp) < 3 {
+			return 0
+		}
+		return 3 + int(resp[2]) + 2 // unit, function, byte count, data, CRC
+	case FuncWriteSingleCoil, FuncWriteSingleRegister, FuncWriteMultipleCoils, FuncWriteMultipleRegisters:
+		return 8 // unit, function, address, value/quantity, CRC
+	}
+	return -1
+}
+
+// CRC16 calculates Modbus RTU CRC (polynomial 0xA001, initial 0xFFFF)
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
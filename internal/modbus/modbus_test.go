@@ -0,0 +1,98 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	// Read 10 holding registers from unit 1: 01 03 00 00 00 0A C5 CD
+	frame := BuildRTUFrame(1, []byte{0x03, 0x00, 0x00, 0x00, 0x0A})
+	want := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A, 0xC5, 0xCD}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("frame = %x, want %x", frame, want)
+	}
+
+	unit, pdu, err := ParseRTUFrame(frame)
+	if err != nil || unit != 1 || !bytes.Equal(pdu, want[1:6]) {
+		t.Errorf("parse = %d %x %v", unit, pdu, err)
+	}
+
+	frame[6] ^= 0xFF
+	if _, _, err := ParseRTUFrame(frame); !errors.Is(err, ErrBadCRC) {
+		t.Errorf("expected CRC error, got %v", err)
+	}
+}
+
+func TestTCPFrame(t *testing.T) {
+	frame := BuildTCPFrame(0x1234, 5, []byte{0x03, 0x00, 0x10, 0x00, 0x02})
+	want := []byte{0x12, 0x34, 0x00, 0x00, 0x00, 0x06, 0x05, 0x03, 0x00, 0x10, 0x00, 0x02}
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("frame = %x, want %x", frame, want)
+	}
+
+	hdr, pdu, err := ReadTCPFrame(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if hdr.TransactionID != 0x1234 || hdr.UnitID != 5 || !bytes.Equal(pdu, want[7:]) {
+		t.Errorf("header = %+v pdu = %x", hdr, pdu)
+	}
+
+	bad := append([]byte(nil), frame...)
+	bad[2] = 1 // protocol id
+	if _, _, err := ReadTCPFrame(bytes.NewReader(bad)); !errors.Is(err, ErrBadProtocol) {
+		t.Errorf("expected protocol error, got %v", err)
+	}
+}
+
+func TestResponseLen(t *testing.T) {
+	readReq := []byte{FuncReadHoldingRegisters, 0x00, 0x00, 0x00, 0x02}
+	tests := []struct {
+		name    string
+		request []byte
+		resp    []byte
+		want    int
+	}{
+		{"need more", readReq, []byte{0x01}, 0},
+		{"need byte count", readReq, []byte{0x01, 0x03}, 0},
+		{"read", readReq, []byte{0x01, 0x03, 0x04}, 9},
+		{"exception", readReq, []byte{0x01, 0x83}, 5},
+		{"write", []byte{FuncWriteSingleRegister, 0, 1, 0, 3}, []byte{0x01, 0x06}, 8},
+		{"unknown", []byte{0x2B, 0x0E}, []byte{0x01, 0x2B}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ResponseLen(tt.request, tt.resp); got != tt.want {
+				t.Errorf("ResponseLen() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterFrameDelay(t *testing.T) {
+	// 3.5 characters of 11 bits at 9600 baud ~ 4 ms
+	if d := InterFrameDelay(9600); d < 4*time.Millisecond || d > 4100*time.Microsecond {
+		t.Errorf("delay at 9600 = %v", d)
+	}
+	if d := InterFrameDelay(115200); d != 1750*time.Microsecond {
+		t.Errorf("delay at 115200 = %v, want 1.75ms", d)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	route, err := ParseRoute("meter1:5")
+	if err != nil || route.DeviceID != "meter1" || route.UnitID != 5 {
+		t.Errorf("route = %+v %v", route, err)
+	}
+	route, err = ParseRoute("meter2")
+	if err != nil || route.DeviceID != "meter2" || route.UnitID != -1 {
+		t.Errorf("route = %+v %v", route, err)
+	}
+	if _, err := ParseRoute("meter1:300"); err == nil {
+		t.Error("expected error for invalid unit")
+	}
+}
@@ -0,0 +1,277 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// Register types
+const (
+	RegisterHolding  = "holding"
+	RegisterInput    = "input"
+	RegisterCoil     = "coil"
+	RegisterDiscrete = "discrete"
+)
+
+// DefaultPollInterval is the register polling interval
+const DefaultPollInterval = 60 * time.Second
+
+// maxPollCount limits registers (bits for coils) read by one request
+const maxPollCount = 125
+
+// registerFunctions maps register type to read function code
+var registerFunctions = map[string]byte{
+	RegisterHolding:  FuncReadHoldingRegisters,
+	RegisterInput:    FuncReadInputRegisters,
+	RegisterCoil:     FuncReadCoils,
+	RegisterDiscrete: FuncReadDiscreteInputs,
+}
+
+// PollItem is a block of registers polled on a device
+type PollItem struct {
+	DeviceID string
+	UnitID   byte
+	Type     string
+	Address  uint16
+	Count    uint16
+}
+
+// ParsePollItem parses "DEVICE_ID:UNIT:TYPE:ADDRESS:COUNT"
+func ParsePollItem(s string) (PollItem, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 5 || parts[0] == "" {
+		return PollItem{}, fmt.Errorf("modbus: invalid poll item %q, want DEVICE_ID:UNIT:TYPE:ADDRESS:COUNT", s)
+	}
+	unit, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil || unit == 0 || unit > 247 {
+		return PollItem{}, fmt.Errorf("modbus: invalid unit id in poll item %q", s)
+	}
+	if _, ok := registerFunctions[parts[2]]; !ok {
+		return PollItem{}, fmt.Errorf("modbus: invalid register type in poll item %q", s)
+	}
+	addr, err := strconv.ParseUint(parts[3], 10, 16)
+	if err != nil {
+		return PollItem{}, fmt.Errorf("modbus: invalid address in poll item %q", s)
+	}
+	count, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil || count == 0 || count > maxPollCount {
+		return PollItem{}, fmt.Errorf("modbus: invalid count in poll item %q", s)
+	}
+	return PollItem{
+		DeviceID: parts[0],
+		UnitID:   byte(unit),
+		Type:     parts[2],
+		Address:  uint16(addr),
+		Count:    uint16(count),
+	}, nil
+}
+
+// RegisterValue is the latest polled value of one register
+type RegisterValue struct {
+	UnitID    byte      `json:"unit"`
+	Type      string    `json:"type"`
+	Address   uint16    `json:"address"`
+	Value     uint16    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PollStatus is the result of the last poll of an item
+type PollStatus struct {
+	UnitID   byte       `json:"unit"`
+	Type     string     `json:"type"`
+	Address  uint16     `json:"address"`
+	Count    uint16     `json:"count"`
+	PolledAt *time.Time `json:"polled_at,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// Poller polls configured registers when devices have no client session
+type Poller struct {
+	client   *Client
+	registry *device.Registry
+	items    []PollItem
+	interval time.Duration
+
+	mu     sync.RWMutex
+	values map[string]map[registerKey]RegisterValue // device ID -> registers
+	status map[string][]PollStatus                  // device ID -> item status
+}
+
+type registerKey struct {
+	unit    byte
+	typ     string
+	address uint16
+}
+
+// NewPoller creates register poller
+func NewPoller(client *Client, registry *device.Registry, items []PollItem, interval time.Duration) *Poller {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	p := &Poller{
+		client:   client,
+		registry: registry,
+		items:    items,
+		interval: interval,
+		values:   make(map[string]map[registerKey]RegisterValue),
+		status:   make(map[string][]PollStatus),
+	}
+	for _, item := range items {
+		p.status[item.DeviceID] = append(p.status[item.DeviceID], PollStatus{
+			UnitID: item.UnitID, Type: item.Type, Address: item.Address, Count: item.Count,
+		})
+	}
+	return p
+}
+
+// Start polls registers until context is cancelled
+func (p *Poller) Start(ctx context.Context) {
+	log.Printf("[modbus] polling %d register blocks every %v", len(p.items), p.interval)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.PollOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PollOnce polls all items of connected devices without client session
+func (p *Poller) PollOnce() {
+	index := make(map[string]int)
+	for _, item := range p.items {
+		i := index[item.DeviceID]
+		index[item.DeviceID]++
+
+		dev, ok := p.registry.Get(item.DeviceID)
+		if !ok || dev.IsInSession() {
+			continue // offline or used by a client - keep cached values
+		}
+
+		pdu := []byte{registerFunctions[item.Type], 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:3], item.Address)
+		binary.BigEndian.PutUint16(pdu[3:5], item.Count)
+
+		resp, err := p.client.Transact(item.DeviceID, item.UnitID, pdu)
+		if err == nil {
+			err = PDUError(resp)
+		}
+		var values []uint16
+		if err == nil {
+			values, err = decodeReadResponse(item, resp)
+		}
+
+		now := time.Now()
+		p.mu.Lock()
+		st := &p.status[item.DeviceID][i]
+		st.PolledAt = &now
+		st.Error = ""
+		if err != nil {
+			st.Error = err.Error()
+			log.Printf("[modbus] %s: poll unit %d %s %d/%d: %v",
+				item.DeviceID, item.UnitID, item.Type, item.Address, item.Count, err)
+		} else {
+			regs := p.values[item.DeviceID]
+			if regs == nil {
+				regs = make(map[registerKey]RegisterValue)
+				p.values[item.DeviceID] = regs
+			}
+			for j, v := range values {
+				addr := item.Address + uint16(j)
+				regs[registerKey{item.UnitID, item.Type, addr}] = RegisterValue{
+					UnitID: item.UnitID, Type: item.Type, Address: addr, Value: v, UpdatedAt: now,
+				}
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// decodeReadResponse extracts register or bit values from read response PDU
+func decodeReadResponse(item PollItem, resp []byte) ([]uint16, error) {
+	if len(resp) < 2 || resp[0] != registerFunctions[item.Type] || int(resp[1]) != len(resp)-2 {
+		return nil, fmt.Errorf("modbus: malformed response %x", resp)
+	}
+	data := resp[2:]
+	values := make([]uint16, item.Count)
+
+	switch item.Type {
+	case RegisterHolding, RegisterInput:
+		if len(data) < int(item.Count)*2 {
+			return nil, fmt.Errorf("modbus: short response %x", resp)
+		}
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(data[i*2:])
+		}
+	default:
+		if len(data) < (int(item.Count)+7)/8 {
+			return nil, fmt.Errorf("modbus: short response %x", resp)
+		}
+		for i := range values {
+			values[i] = uint16(data[i/8]>>(i%8)) & 1
+		}
+	}
+	return values, nil
+}
+
+// Registers returns cached register values of a device sorted by unit, type and address
+// ok is false if no registers are polled on the device
+func (p *Poller) Registers(deviceID string) ([]RegisterValue, []PollStatus, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status, ok := p.status[deviceID]
+	if !ok {
+		return nil, nil, false
+	}
+	values := make([]RegisterValue, 0, len(p.values[deviceID]))
+	for _, v := range p.values[deviceID] {
+		values = append(values, v)
+	}
+	sortRegisters(values)
+	return values, append([]PollStatus(nil), status...), true
+}
+
+// AllRegisters returns cached register values of all devices
+func (p *Poller) AllRegisters() map[string][]RegisterValue {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	result := make(map[string][]RegisterValue, len(p.values))
+	for deviceID, regs := range p.values {
+		values := make([]RegisterValue, 0, len(regs))
+		for _, v := range regs {
+			values = append(values, v)
+		}
+		sortRegisters(values)
+		result[deviceID] = values
+	}
+	return result
+}
+
+func sortRegisters(values []RegisterValue) {
+	sort.Slice(values, func(i, j int) bool {
+		a, b := values[i], values[j]
+		if a.UnitID != b.UnitID {
+			return a.UnitID < b.UnitID
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Address < b.Address
+	})
+}
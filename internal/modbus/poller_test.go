@@ -0,0 +1,107 @@
+package modbus
+
+import (
+	"testing"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/session"
+)
+
+func TestParsePollItem(t *testing.T) {
+	item, err := ParsePollItem("meter1:3:holding:100:2")
+	if err != nil {
+		t.Fatalf("ParsePollItem: %v", err)
+	}
+	want := PollItem{DeviceID: "meter1", UnitID: 3, Type: RegisterHolding, Address: 100, Count: 2}
+	if item != want {
+		t.Errorf("item = %+v, want %+v", item, want)
+	}
+
+	for _, s := range []string{
+		"meter1:3:holding:100",
+		":3:holding:100:2",
+		"meter1:0:holding:100:2",
+		"meter1:3:unknown:100:2",
+		"meter1:3:input:70000:2",
+		"meter1:3:input:1:0",
+		"meter1:3:input:1:200",
+	} {
+		if _, err := ParsePollItem(s); err == nil {
+			t.Errorf("ParsePollItem(%q) should fail", s)
+		}
+	}
+}
+
+func TestDecodeReadResponse(t *testing.T) {
+	coils := PollItem{Type: RegisterCoil, Count: 10}
+	values, err := decodeReadResponse(coils, []byte{FuncReadCoils, 0x02, 0x05, 0x02})
+	if err != nil {
+		t.Fatalf("decode coils: %v", err)
+	}
+	want := []uint16{1, 0, 1, 0, 0, 0, 0, 0, 0, 1}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("coils = %v, want %v", values, want)
+			break
+		}
+	}
+
+	if _, err := decodeReadResponse(PollItem{Type: RegisterInput, Count: 2}, []byte{FuncReadInputRegisters, 0x02, 0x00, 0x01}); err == nil {
+		t.Error("short response should fail")
+	}
+}
+
+func TestPoller(t *testing.T) {
+	registry := device.NewRegistry()
+	sessions := session.NewManager(false, time.Second)
+	client := NewClient(registry, sessions, 300*time.Millisecond)
+	items := []PollItem{
+		{DeviceID: "meter1", UnitID: 1, Type: RegisterHolding, Address: 0x10, Count: 2},
+		{DeviceID: "meter1", UnitID: 1, Type: RegisterInput, Address: 0, Count: 1}, // illegal function on fake slave
+		{DeviceID: "offline", UnitID: 1, Type: RegisterHolding, Address: 0, Count: 1},
+		// Register 0x08FF = 0x08FF: response 01 03 02 08 FF, CRC FF C4 is escaped by RFC2217 device
+		{DeviceID: "meter1", UnitID: 1, Type: RegisterHolding, Address: 0x08FF, Count: 1},
+	}
+	p := NewPoller(client, registry, items, time.Minute)
+	dev := registerFakeDevice(t, registry, "meter1", 1, device.DialectRFC2217)
+
+	p.PollOnce()
+
+	values, polls, ok := p.Registers("meter1")
+	if !ok {
+		t.Fatal("meter1 registers not found")
+	}
+	if len(values) != 3 || values[0].Address != 0x10 || values[0].Value != 0x10 || values[1].Value != 0x11 || values[2].Value != 0x08FF {
+		t.Errorf("values = %+v", values)
+	}
+	if values[0].UpdatedAt.IsZero() {
+		t.Error("updated_at not set")
+	}
+	if len(polls) != 3 || polls[0].Error != "" || polls[1].Error == "" || polls[2].Error != "" {
+		t.Errorf("polls = %+v", polls)
+	}
+
+	// Offline device keeps configured polls without values
+	values, polls, ok = p.Registers("offline")
+	if !ok || len(values) != 0 || polls[0].PolledAt != nil {
+		t.Errorf("offline: ok=%v values=%+v polls=%+v", ok, values, polls)
+	}
+	if _, _, ok := p.Registers("unknown"); ok {
+		t.Error("unknown device should not have registers")
+	}
+
+	// Device in a client session is not polled, cached values are kept
+	dev.TrySetSession("client")
+	before, _, _ := p.Registers("meter1")
+	p.PollOnce()
+	after, _, _ := p.Registers("meter1")
+	if !after[0].UpdatedAt.Equal(before[0].UpdatedAt) {
+		t.Error("device in session was polled")
+	}
+	dev.ClearSession()
+
+	if all := p.AllRegisters(); len(all) != 1 || len(all["meter1"]) != 3 {
+		t.Errorf("AllRegisters = %+v", all)
+	}
+}
@@ -0,0 +1,52 @@
+package rfc2217
+
+import "net"
+
+// Conn passes data over a Telnet connection: writes are IAC escaped,
+// reads return data only, commands and subnegotiations go to OnEvent
+type Conn struct {
+	net.Conn
+	OnEvent func(Event) // optional, called from Read
+
+	dec     Decoder
+	buf     []byte
+	pending []byte
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, buf: make([]byte, 4096)}
+}
+
+// Read returns data bytes of the stream
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		n, err := c.Conn.Read(c.buf)
+		for _, ev := range c.dec.Feed(c.buf[:n]) {
+			if ev.Type == EventData {
+				c.pending = append(c.pending, ev.Data...)
+			} else if c.OnEvent != nil {
+				c.OnEvent(ev)
+			}
+		}
+		if err != nil && len(c.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends data IAC escaped
+func (c *Conn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(Escape(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteRaw sends Telnet commands as is
+func (c *Conn) WriteRaw(b []byte) error {
+	_, err := c.Conn.Write(b)
+	return err
+}
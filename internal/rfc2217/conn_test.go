@@ -0,0 +1,43 @@
+package rfc2217
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var events []Event
+	conn := NewConn(a)
+	conn.OnEvent = func(ev Event) { events = append(events, ev) }
+
+	go b.Write([]byte{'x', IAC, NOP, IAC, IAC, IAC, SB, 44, 101, 0, 0, 0x25, 0x80, IAC, SE, 'y'})
+	buf := make([]byte, 16)
+	var got []byte
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < 3 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, []byte{'x', IAC, 'y'}) {
+		t.Errorf("data %x, want 78ff79", got)
+	}
+	if len(events) != 2 || events[0].Command != NOP || events[1].Type != EventSubneg || events[1].Option != 44 {
+		t.Errorf("events %+v", events)
+	}
+
+	go conn.Write([]byte{1, IAC})
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _ := b.Read(buf)
+	if !bytes.Equal(buf[:n], []byte{1, IAC, IAC}) {
+		t.Errorf("written %x, want 01ffff", buf[:n])
+	}
+}
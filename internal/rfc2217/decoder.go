@@ -0,0 +1,149 @@
+package rfc2217
+
+// EventType identifies an element of decoded Telnet stream
+type EventType int
+
+const (
+	EventData    EventType = iota // data bytes (IAC IAC unescaped)
+	EventCommand                  // IAC <cmd> or IAC <WILL/WONT/DO/DONT> <option>
+	EventSubneg                   // IAC SB <option> <payload> IAC SE
+)
+
+// maxPendingLen limits buffered incomplete sequence (malformed stream protection)
+const maxPendingLen = 1024
+
+// Event is a decoded Telnet stream element
+type Event struct {
+	Type    EventType
+	Data    []byte // data bytes or subnegotiation payload (without option)
+	Command byte   // Telnet command for EventCommand
+	Option  byte   // option for negotiation commands and subnegotiations
+}
+
+// Decoder splits Telnet stream into data, commands and subnegotiations
+// Incomplete sequences are kept until the next Feed call
+type Decoder struct {
+	pending []byte
+}
+
+// Feed decodes next chunk of the stream
+func (d *Decoder) Feed(p []byte) []Event {
+	buf := append(d.pending, p...)
+	d.pending = nil
+
+	var events []Event
+	var data []byte
+	flushData := func() {
+		if len(data) > 0 {
+			events = append(events, Event{Type: EventData, Data: data})
+			data = nil
+		}
+	}
+
+	i := 0
+loop:
+	for i < len(buf) {
+		if buf[i] != IAC {
+			data = append(data, buf[i])
+			i++
+			continue
+		}
+		if i+1 >= len(buf) {
+			break // incomplete
+		}
+
+		switch cmd := buf[i+1]; cmd {
+		case IAC:
+			data = append(data, IAC)
+			i += 2
+			continue
+		case SB:
+			payload, end := subnegotiation(buf, i+2)
+			if end < 0 {
+				break loop
+			}
+			flushData()
+			ev := Event{Type: EventSubneg}
+			if len(payload) > 0 {
+				ev.Option = payload[0]
+				ev.Data = payload[1:]
+			}
+			events = append(events, ev)
+			i = end
+		case WILL, WONT, DO, DONT:
+			if i+2 >= len(buf) {
+				break loop
+			}
+			flushData()
+			events = append(events, Event{Type: EventCommand, Command: cmd, Option: buf[i+2]})
+			i += 3
+		default:
+			flushData()
+			events = append(events, Event{Type: EventCommand, Command: cmd})
+			i += 2
+		}
+	}
+
+	flushData()
+	if i < len(buf) {
+		if len(buf)-i > maxPendingLen {
+			// Never terminated - pass as data
+			events = append(events, Event{Type: EventData, Data: append([]byte(nil), buf[i:]...)})
+		} else {
+			d.pending = append([]byte(nil), buf[i:]...)
+		}
+	}
+	return events
+}
+
+// Pending returns the number of bytes waiting for the rest of a sequence
+func (d *Decoder) Pending() int {
+	return len(d.pending)
+}
+
+// subnegotiation unescapes payload starting at pos up to IAC SE
+// Returns payload and position after IAC SE, or -1 if SE not received yet
+func subnegotiation(buf []byte, pos int) ([]byte, int) {
+	var payload []byte
+	for i := pos; i < len(buf); i++ {
+		if buf[i] != IAC {
+			payload = append(payload, buf[i])
+			continue
+		}
+		if i+1 >= len(buf) {
+			return nil, -1
+		}
+		i++
+		switch buf[i] {
+		case SE:
+			return payload, i + 1
+		case IAC:
+			payload = append(payload, IAC)
+		default:
+			// Protocol violation - keep byte as is
+			payload = append(payload, IAC, buf[i])
+		}
+	}
+	return nil, -1
+}
+
+// Escape doubles IAC bytes of data for sending over Telnet
+func Escape(p []byte) []byte {
+	n := 0
+	for _, b := range p {
+		if b == IAC {
+			n++
+		}
+	}
+	if n == 0 {
+		return p
+	}
+	out := make([]byte, 0, len(p)+n)
+	for _, b := range p {
+		out = append(out, b)
+		if b == IAC {
+			out = append(out, IAC)
+		}
+	}
+	return out
+}
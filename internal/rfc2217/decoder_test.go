@@ -0,0 +1,74 @@
+package rfc2217
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecoderFeed(t *testing.T) {
+	var d Decoder
+	stream := []byte{
+		'a', IAC, IAC, 'b', // escaped data byte
+		IAC, WILL, ComPortOption,
+		IAC, SB, ComPortOption, SetBaudrateC, 0x00, 0x00, 0x25, 0x80, IAC, SE,
+		IAC, NOP,
+		'c',
+	}
+
+	events := d.Feed(stream)
+	if len(events) != 5 {
+		t.Fatalf("events = %d, want 5: %+v", len(events), events)
+	}
+	if events[0].Type != EventData || !bytes.Equal(events[0].Data, []byte{'a', IAC, 'b'}) {
+		t.Errorf("event 0 = %+v, want data a FF b", events[0])
+	}
+	if events[1].Type != EventCommand || events[1].Command != WILL || events[1].Option != ComPortOption {
+		t.Errorf("event 1 = %+v, want WILL COM-PORT", events[1])
+	}
+	if events[2].Type != EventSubneg || events[2].Option != ComPortOption ||
+		!bytes.Equal(events[2].Data, []byte{SetBaudrateC, 0x00, 0x00, 0x25, 0x80}) {
+		t.Errorf("event 2 = %+v, want SET-BAUDRATE 9600", events[2])
+	}
+	if events[3].Type != EventCommand || events[3].Command != NOP {
+		t.Errorf("event 3 = %+v, want NOP", events[3])
+	}
+	if events[4].Type != EventData || !bytes.Equal(events[4].Data, []byte{'c'}) {
+		t.Errorf("event 4 = %+v, want data c", events[4])
+	}
+}
+
+func TestDecoderSplitSequence(t *testing.T) {
+	var d Decoder
+	frame := []byte{IAC, SB, ComPortOption, SetParityC, ParityEven, IAC, SE}
+
+	// Feed byte by byte - frame must be reported once, complete
+	var events []Event
+	for i := range frame {
+		events = append(events, d.Feed(frame[i:i+1])...)
+	}
+	if len(events) != 1 || events[0].Type != EventSubneg ||
+		!bytes.Equal(events[0].Data, []byte{SetParityC, ParityEven}) {
+		t.Fatalf("events = %+v, want single SET-PARITY subnegotiation", events)
+	}
+	if d.Pending() != 0 {
+		t.Errorf("pending = %d, want 0", d.Pending())
+	}
+
+	// Trailing IAC waits for next byte
+	if events := d.Feed([]byte{'x', IAC}); len(events) != 1 || d.Pending() != 1 {
+		t.Errorf("events = %+v pending = %d, want data and 1 pending", events, d.Pending())
+	}
+	if events := d.Feed([]byte{IAC}); len(events) != 1 || !bytes.Equal(events[0].Data, []byte{IAC}) {
+		t.Errorf("events = %+v, want escaped FF", events)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	if got := Escape([]byte{0x01, IAC, 0x02}); !bytes.Equal(got, []byte{0x01, IAC, IAC, 0x02}) {
+		t.Errorf("Escape() = %x", got)
+	}
+	plain := []byte("hello")
+	if got := Escape(plain); !bytes.Equal(got, plain) {
+		t.Errorf("Escape() = %x, want unchanged", got)
+	}
+}
@@ -0,0 +1,33 @@
+package serial
+
+import (
+	"fmt"
+	"strings"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// ParseMode parses serial mode like "8N1", "7E1" or "8N2"
+func ParseMode(mode string, baudRate uint32) (device.SerialProfile, error) {
+	profile := device.SerialProfile{BaudRate: baudRate}
+	if len(mode) != 3 || mode[0] < '5' || mode[0] > '8' {
+		return profile, fmt.Errorf("invalid mode %q", mode)
+	}
+	profile.DataBits = mode[0] - '0'
+
+	parity := strings.IndexByte("NOEMS", mode[1]&^0x20) // upper case
+	if parity < 0 {
+		return profile, fmt.Errorf("invalid parity in mode %q", mode)
+	}
+	profile.Parity = uint8(parity) + 1
+
+	switch mode[2] {
+	case '1':
+		profile.StopBits = 1
+	case '2':
+		profile.StopBits = 2
+	default:
+		return profile, fmt.Errorf("invalid stop bits in mode %q", mode)
+	}
+	return profile, nil
+}
@@ -0,0 +1,19 @@
+package serial
+
+import "testing"
+
+func TestParseMode(t *testing.T) {
+	profile, err := ParseMode("7e1", 300)
+	if err != nil {
+		t.Fatalf("ParseMode: %v", err)
+	}
+	if profile.BaudRate != 300 || profile.ModeString() != "7E1" {
+		t.Errorf("profile = %+v, want 300 7E1", profile)
+	}
+
+	for _, mode := range []string{"", "9N1", "8X1", "8N3", "8N1x"} {
+		if _, err := ParseMode(mode, 9600); err == nil {
+			t.Errorf("ParseMode(%q) should fail", mode)
+		}
+	}
+}
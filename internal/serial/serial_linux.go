@@ -0,0 +1,190 @@
+//go:build linux
+
+// Package serial configures local serial ports (termios) from RFC2217 port settings
+package serial
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+// RFC2217 SET-CONTROL values handled by SetControl
+const (
+	controlFlowNone     = 1
+	controlFlowXONXOFF  = 2
+	controlFlowHardware = 3
+	controlBreakOn      = 5
+	controlBreakOff     = 6
+	controlDTROn        = 8
+	controlDTROff       = 9
+	controlRTSOn        = 11
+	controlRTSOff       = 12
+)
+
+// Port is a local serial port in raw mode
+type Port struct {
+	f    *os.File
+	name string
+}
+
+// Open opens serial port in raw mode with profile settings
+// The port is opened non-blocking, so a missing carrier doesn't block open and reads support deadlines
+func Open(name string, profile device.SerialProfile) (*Port, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &Port{f: f, name: name}
+	if err := p.SetProfile(profile); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Name returns device path
+func (p *Port) Name() string {
+	return p.name
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	return p.f.Read(b)
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	return p.f.Write(b)
+}
+
+// SetReadDeadline interrupts pending and future Read calls at t
+func (p *Port) SetReadDeadline(t time.Time) error {
+	return p.f.SetReadDeadline(t)
+}
+
+func (p *Port) Close() error {
+	return p.f.Close()
+}
+
+// SetProfile applies baud rate, data bits, parity and stop bits (RFC2217 encoding)
+// Stop bits 1.5 are set as 2, non-standard baud rates are rejected
+func (p *Port) SetProfile(profile device.SerialProfile) error {
+	baud, ok := BaudCode(profile.BaudRate)
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", profile.BaudRate)
+	}
+	var size uint32
+	switch profile.DataBits {
+	case 5:
+		size = syscall.CS5
+	case 6:
+		size = syscall.CS6
+	case 7:
+		size = syscall.CS7
+	case 8:
+		size = syscall.CS8
+	default:
+		return fmt.Errorf("unsupported data bits %d", profile.DataBits)
+	}
+	var parity uint32
+	switch profile.Parity {
+	case 1: // none
+	case 2:
+		parity = syscall.PARENB | syscall.PARODD
+	case 3:
+		parity = syscall.PARENB
+	case 4:
+		parity = syscall.PARENB | CMSPAR | syscall.PARODD
+	case 5:
+		parity = syscall.PARENB | CMSPAR
+	default:
+		return fmt.Errorf("unsupported parity %d", profile.Parity)
+	}
+
+	return p.termios(func(t *syscall.Termios) {
+		// Raw mode like cfmakeraw, flow control bits are kept
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cc[syscall.VMIN] = 1
+		t.Cc[syscall.VTIME] = 0
+
+		t.Cflag &^= CBAUD | syscall.CSIZE | syscall.PARENB | syscall.PARODD | CMSPAR | syscall.CSTOPB
+		t.Cflag |= baud | size | parity | syscall.CLOCAL | syscall.CREAD
+		if profile.StopBits >= 2 {
+			t.Cflag |= syscall.CSTOPB
+		}
+		t.Ispeed = baud
+		t.Ospeed = baud
+	})
+}
+
+// SetControl applies RFC2217 SET-CONTROL value: flow control, BREAK, DTR and RTS
+// Queries and values without a termios equivalent are ignored
+func (p *Port) SetControl(value byte) error {
+	switch value {
+	case controlFlowNone, controlFlowXONXOFF, controlFlowHardware:
+		return p.termios(func(t *syscall.Termios) {
+			t.Iflag &^= syscall.IXON | syscall.IXOFF
+			t.Cflag &^= CRTSCTS
+			switch value {
+			case controlFlowXONXOFF:
+				t.Iflag |= syscall.IXON | syscall.IXOFF
+			case controlFlowHardware:
+				t.Cflag |= CRTSCTS
+			}
+		})
+	case controlBreakOn:
+		return p.ioctl(syscall.TIOCSBRK, nil)
+	case controlBreakOff:
+		return p.ioctl(syscall.TIOCCBRK, nil)
+	case controlDTROn, controlRTSOn:
+		return p.modemBits(syscall.TIOCMBIS, value)
+	case controlDTROff, controlRTSOff:
+		return p.modemBits(syscall.TIOCMBIC, value)
+	}
+	return nil
+}
+
+func (p *Port) modemBits(req uintptr, value byte) error {
+	bits := int32(syscall.TIOCM_DTR)
+	if value == controlRTSOn || value == controlRTSOff {
+		bits = syscall.TIOCM_RTS
+	}
+	return p.ioctl(req, unsafe.Pointer(&bits))
+}
+
+// termios reads port attributes, lets f modify them and writes them back
+func (p *Port) termios(f func(t *syscall.Termios)) error {
+	var t syscall.Termios
+	if err := p.ioctl(syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return fmt.Errorf("TCGETS: %w", err)
+	}
+	f(&t)
+	if err := p.ioctl(syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+		return fmt.Errorf("TCSETS: %w", err)
+	}
+	return nil
+}
+
+// ioctl runs request with the descriptor without switching it to blocking mode
+func (p *Port) ioctl(req uintptr, arg unsafe.Pointer) error {
+	raw, err := p.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sysErr error
+	err = raw.Control(func(fd uintptr) {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+			sysErr = errno
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
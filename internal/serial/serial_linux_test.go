@@ -0,0 +1,86 @@
+package serial_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/vcom"
+)
+
+// slaveTermios reads termios of serial port path
+func slaveTermios(t *testing.T, path string) syscall.Termios {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	raw, err := f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tio syscall.Termios
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&tio)))
+	})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	return tio
+}
+
+func TestSetProfile(t *testing.T) {
+	pty, err := vcom.OpenPTY("", 9600)
+	if err != nil {
+		t.Skipf("no PTY: %v", err)
+	}
+	defer pty.Close()
+
+	// The PTY driver keeps baud rate, CSTOPB and PARODD; data bits and PARENB are forced
+	port, err := serial.Open(pty.Name(), device.SerialProfile{BaudRate: 2400, DataBits: 8, Parity: 2, StopBits: 2})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer port.Close()
+
+	tio := slaveTermios(t, pty.Name())
+	if rate, _ := serial.BaudRate(tio.Cflag); rate != 2400 {
+		t.Errorf("baud rate = %d, want 2400", rate)
+	}
+	if tio.Cflag&syscall.CSTOPB == 0 || tio.Cflag&syscall.PARODD == 0 {
+		t.Errorf("cflag = %o, want CSTOPB and PARODD", tio.Cflag)
+	}
+	if tio.Lflag&syscall.ICANON != 0 || tio.Cflag&syscall.CLOCAL == 0 {
+		t.Errorf("port is not in raw mode: lflag %o, cflag %o", tio.Lflag, tio.Cflag)
+	}
+
+	if err := port.SetProfile(device.SerialProfile{BaudRate: 115200, DataBits: 8, Parity: 1, StopBits: 1}); err != nil {
+		t.Fatalf("SetProfile: %v", err)
+	}
+	tio = slaveTermios(t, pty.Name())
+	if rate, _ := serial.BaudRate(tio.Cflag); rate != 115200 || tio.Cflag&(syscall.CSTOPB|syscall.PARODD) != 0 {
+		t.Errorf("cflag = %o, want 115200 8N1", tio.Cflag)
+	}
+
+	if err := port.SetControl(3); err != nil {
+		t.Fatalf("SetControl: %v", err)
+	}
+	if tio = slaveTermios(t, pty.Name()); tio.Cflag&serial.CRTSCTS == 0 {
+		t.Errorf("cflag = %o, want CRTSCTS", tio.Cflag)
+	}
+
+	for _, bad := range []device.SerialProfile{
+		{BaudRate: 12345, DataBits: 8, Parity: 1, StopBits: 1},
+		{BaudRate: 9600, DataBits: 9, Parity: 1, StopBits: 1},
+		{BaudRate: 9600, DataBits: 8, Parity: 6, StopBits: 1},
+	} {
+		if err := port.SetProfile(bad); err == nil {
+			t.Errorf("SetProfile(%d %s) should fail", bad.BaudRate, bad.ModeString())
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+// Package serial configures local serial ports (termios) from RFC2217 port settings
+package serial
+
+import (
+	"errors"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+var errNotSupported = errors.New("serial ports are supported on Linux only")
+
+// Port is not available on this platform
+type Port struct{}
+
+func Open(name string, profile device.SerialProfile) (*Port, error) {
+	return nil, errNotSupported
+}
+
+func (p *Port) Name() string                                  { return "" }
+func (p *Port) Read(b []byte) (int, error)                    { return 0, errNotSupported }
+func (p *Port) Write(b []byte) (int, error)                   { return 0, errNotSupported }
+func (p *Port) SetReadDeadline(t time.Time) error             { return nil }
+func (p *Port) Close() error                                  { return nil }
+func (p *Port) SetProfile(profile device.SerialProfile) error { return errNotSupported }
+func (p *Port) SetControl(value byte) error                   { return errNotSupported }
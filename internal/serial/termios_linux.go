@@ -0,0 +1,54 @@
+//go:build linux
+
+package serial
+
+import "syscall"
+
+// termios flags missing in package syscall
+const (
+	CBAUD   = 0o10017       // baud rate bits of c_cflag
+	CMSPAR  = 0o10000000000 // mark/space parity
+	CRTSCTS = 0o20000000000 // RTS/CTS flow control
+)
+
+// baudRates maps termios baud rate codes to bits per second
+var baudRates = map[uint32]uint32{
+	syscall.B50:     50,
+	syscall.B75:     75,
+	syscall.B110:    110,
+	syscall.B134:    134,
+	syscall.B150:    150,
+	syscall.B200:    200,
+	syscall.B300:    300,
+	syscall.B600:    600,
+	syscall.B1200:   1200,
+	syscall.B1800:   1800,
+	syscall.B2400:   2400,
+	syscall.B4800:   4800,
+	syscall.B9600:   9600,
+	syscall.B19200:  19200,
+	syscall.B38400:  38400,
+	syscall.B57600:  57600,
+	syscall.B115200: 115200,
+	syscall.B230400: 230400,
+	syscall.B460800: 460800,
+	syscall.B500000: 500000,
+	syscall.B576000: 576000,
+	syscall.B921600: 921600,
+}
+
+// BaudCode returns termios code of a standard baud rate
+func BaudCode(rate uint32) (uint32, bool) {
+	for code, r := range baudRates {
+		if r == rate {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// BaudRate returns baud rate of termios c_cflag, false for B0 and non-standard rates
+func BaudRate(cflag uint32) (uint32, bool) {
+	rate, ok := baudRates[cflag&CBAUD]
+	return rate, ok
+}
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"bytes"
 	"encoding/hex"
 	"io"
 	"log"
@@ -13,61 +14,152 @@ import (
 // Telnet NOP command for keepalive
 var telnetNOP = []byte{0xFF, 0xF1}
 
+// Filter inspects and rewrites bridged data (e.g. serial control translation)
+// out is passed on in the same direction, reply is written back to the sender
+type Filter interface {
+	ClientToDevice(data []byte) (out, reply []byte)
+	DeviceToClient(data []byte) (out, reply []byte)
+}
+
 // Bridge creates a bidirectional data bridge between client and device
 type Bridge struct {
 	session          *Session
-	lastClientActive int64 // Unix timestamp of last client activity
-	lastDeviceActive int64 // Unix timestamp of last device activity
+	filters          []Filter
+	lastClientActive int64         // Unix timestamp of last client activity
+	lastDeviceActive int64         // Unix timestamp of last device activity
+	lastPayload      int64         // UnixNano timestamp of last payload data in either direction
+	stop             chan struct{} // closed when Run stops, interrupts rate limit waits
+	expired          chan struct{} // closed when a time limit ends the session
+	endNotice        []byte        // written to the client when the proxy ends the session
+	pending          []byte        // client data read before the bridge started
+}
+
+// pendingConn returns client data read before the bridge started, then reads the connection
+type pendingConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *pendingConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
 }
 
 // NewBridge creates a new bridge for a session
 func NewBridge(session *Session) *Bridge {
-	now := time.Now().Unix()
+	now := time.Now()
 	return &Bridge{
 		session:          session,
-		lastClientActive: now,
-		lastDeviceActive: now,
+		lastClientActive: now.Unix(),
+		lastDeviceActive: now.Unix(),
+		lastPayload:      now.UnixNano(),
+		stop:             make(chan struct{}),
+		expired:          make(chan struct{}),
+	}
+}
+
+// SetEndNotice sets text written to the client when the proxy ends the session (NO CARRIER of modem mode)
+// The client gets no banner then
+// Must be called before Run
+func (b *Bridge) SetEndNotice(text []byte) {
+	b.endNotice = text
+}
+
+// SetPending sets client data read before the bridge started, it is passed to the device first
+// Must be called before Run
+func (b *Bridge) SetPending(data []byte) {
+	b.pending = data
+}
+
+// AddFilter adds a data filter, filters are applied in order of addition
+// Must be called before Run
+func (b *Bridge) AddFilter(f Filter) {
+	b.filters = append(b.filters, f)
+}
+
+// filterClient applies filters to client->device data
+func (b *Bridge) filterClient(data []byte) ([]byte, []byte) {
+	var reply []byte
+	for _, f := range b.filters {
+		var r []byte
+		data, r = f.ClientToDevice(data)
+		reply = append(reply, r...)
 	}
+	return data, reply
+}
+
+// filterDevice applies filters to device->client data
+func (b *Bridge) filterDevice(data []byte) ([]byte, []byte) {
+	var reply []byte
+	for _, f := range b.filters {
+		var r []byte
+		data, r = f.DeviceToClient(data)
+		reply = append(reply, r...)
+	}
+	return data, reply
 }
 
 // Run starts the bidirectional data transfer
 // Blocks until one side closes or an error occurs
 func (b *Bridge) Run() {
+	limits := b.session.timeLimits()
+	if reason := b.session.exhausted(); reason != "" {
+		log.Printf("[bridge] %s: %s exhausted", b.session.ID, reason)
+		b.session.SetEndReason(reason)
+		b.notify(limits)
+		b.session.ClientConn.Close()
+		b.session.DeviceConn.Close()
+		return
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
+	// Closed when either direction stops: the session ends when one side closes,
+	// device connection is read only by the bridge while in session
+	done := make(chan struct{})
+	var doneOnce sync.Once
 
 	// Client -> Device
+	clientConn := b.session.ClientConn
+	if len(b.pending) > 0 {
+		clientConn = &pendingConn{Conn: clientConn, pending: b.pending}
+	}
 	go func() {
 		defer wg.Done()
-		n := b.copyWithActivity(b.session.DeviceConn, b.session.ClientConn, &b.session.BytesIn, &b.lastClientActive, "client->device")
+		defer doneOnce.Do(func() { close(done) })
+		n := b.copyWithActivity(b.session.DeviceConn, clientConn, b.filterClient, &b.session.BytesIn, &b.lastClientActive, "client->device")
 		log.Printf("[bridge] %s: client->device total: %d bytes", b.session.ID, n)
 	}()
 
 	// Device -> Client
 	go func() {
 		defer wg.Done()
-		n := b.copyWithActivity(b.session.ClientConn, b.session.DeviceConn, &b.session.BytesOut, &b.lastDeviceActive, "device->client")
+		defer doneOnce.Do(func() { close(done) })
+		n := b.copyWithActivity(b.session.ClientConn, b.session.DeviceConn, b.filterDevice, &b.session.BytesOut, &b.lastDeviceActive, "device->client")
 		log.Printf("[bridge] %s: device->client total: %d bytes", b.session.ID, n)
 	}()
 
-	// Wait for either direction to close
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
 	// Start keepalive goroutine
 	stopKeepalive := make(chan struct{})
 	go b.keepalive(stopKeepalive)
+	if limits.maxDuration > 0 || limits.dataTimeout > 0 {
+		go b.watchTime(limits)
+	}
 
 	select {
 	case <-done:
 	case <-b.session.done:
+	case <-b.expired:
 	}
 
-	// Stop keepalive
+	// Stop keepalive, time limits and rate limit waits
 	close(stopKeepalive)
+	close(b.stop)
+	b.notify(limits)
 
 	// Close both connections to ensure both goroutines exit
 	b.session.ClientConn.Close()
@@ -81,7 +173,16 @@ func (b *Bridge) Run() {
 }
 
 // copyWithActivity transfers data from src to dst, counting bytes and updating activity timestamp
-func (b *Bridge) copyWithActivity(dst, src net.Conn, counter *int64, lastActive *int64, direction string) int64 {
+// Data passes through filter when bridge has filters, filter replies are written back to src
+// Without filters, limits, data timeout and debug dump data is copied in the kernel when connections allow it:
+// spliced chunks are not seen, so NOP keepalives can't be told from payload for the data timeout
+func (b *Bridge) copyWithActivity(dst, src net.Conn, filter func([]byte) ([]byte, []byte), counter *int64, lastActive *int64, direction string) int64 {
+	if len(b.filters) == 0 && !b.session.Debug && !b.session.limited() && b.session.timeLimits().dataTimeout == 0 {
+		if total, ok := b.copyDirect(dst, src, counter, lastActive, direction); ok {
+			return total
+		}
+	}
+
 	buf := make([]byte, 4096)
 	var total int64
 
@@ -95,12 +196,43 @@ func (b *Bridge) copyWithActivity(dst, src net.Conn, counter *int64, lastActive
 				log.Printf("[bridge] %s %s: %d bytes\n%s",
 					b.session.ID, direction, n, hex.Dump(buf[:n]))
 			}
-			written, writeErr := dst.Write(buf[:n])
-			if written > 0 {
-				atomic.AddInt64(counter, int64(written))
-				total += int64(written)
+			data := buf[:n]
+			if len(b.filters) > 0 {
+				var reply []byte
+				data, reply = filter(data)
+				if len(reply) > 0 {
+					if _, err := src.Write(reply); err != nil {
+						log.Printf("[bridge] %s %s: reply error: %v", b.session.ID, direction, err)
+					}
+				}
+			}
+			// Rate and quota limits, the session ends when a quota is exhausted
+			var reason string
+			if len(data) > 0 && b.session.limited() {
+				var allowed int
+				var wait time.Duration
+				allowed, wait, reason = b.session.take(len(data))
+				if wait > 0 && !b.wait(wait) {
+					return total
+				}
+				data = data[:allowed]
+			}
+			if len(data) > 0 {
+				written, writeErr := dst.Write(data)
+				if written > 0 {
+					atomic.AddInt64(counter, int64(written))
+					total += int64(written)
+					if !bytes.Equal(data, telnetNOP) {
+						atomic.StoreInt64(&b.lastPayload, time.Now().UnixNano())
+					}
+				}
+				if writeErr != nil {
+					return total
+				}
 			}
-			if writeErr != nil {
+			if reason != "" {
+				log.Printf("[bridge] %s %s: %s exhausted", b.session.ID, direction, reason)
+				b.session.SetEndReason(reason)
 				return total
 			}
 		}
@@ -113,6 +245,134 @@ func (b *Bridge) copyWithActivity(dst, src net.Conn, counter *int64, lastActive
 	}
 }
 
+// copyDirect transfers data from src to dst with splice, counting bytes and updating activity timestamp
+// Returns false, having read nothing, when splice is not available for the connections
+func (b *Bridge) copyDirect(dst, src net.Conn, counter *int64, lastActive *int64, direction string) (int64, bool) {
+	var total int64
+	handled, err := spliceCopy(dst, src, func(n int) {
+		atomic.StoreInt64(lastActive, time.Now().Unix())
+		atomic.AddInt64(counter, int64(n))
+		total += int64(n)
+	})
+	if !handled {
+		return 0, false
+	}
+	if err != nil {
+		log.Printf("[bridge] %s %s: splice error: %v", b.session.ID, direction, err)
+	}
+	return total, true
+}
+
+// wait pauses data transfer for the rate limit, returns false if the bridge stops
+func (b *Bridge) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-b.stop:
+		return false
+	}
+}
+
+// watchTime ends the session after the maximum duration or without payload data for the data timeout
+// Non-modem clients get the banner warnBefore ahead, once per data pause
+func (b *Bridge) watchTime(t timeLimits) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	warnedEnd := false
+	var warnedPause int64 // lastPayload of the pause the warning was sent for
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		var next time.Time
+		schedule := func(at time.Time) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+		if t.maxDuration > 0 {
+			end := b.session.StartedAt.Add(t.maxDuration)
+			if !now.Before(end) {
+				b.expire(EndMaxDuration)
+				return
+			}
+			schedule(end)
+			if warn := end.Add(-t.warnBefore); t.warnBefore > 0 && !warnedEnd {
+				if now.Before(warn) {
+					schedule(warn)
+				} else {
+					b.warn(t, end.Sub(now))
+					warnedEnd = true
+				}
+			}
+		}
+		if t.dataTimeout > 0 {
+			last := atomic.LoadInt64(&b.lastPayload)
+			end := time.Unix(0, last).Add(t.dataTimeout)
+			if !now.Before(end) {
+				b.expire(EndDataTimeout)
+				return
+			}
+			schedule(end)
+			if warn := end.Add(-t.warnBefore); t.warnBefore > 0 && warnedPause != last {
+				if now.Before(warn) {
+					schedule(warn)
+				} else {
+					b.warn(t, end.Sub(now))
+					warnedPause = last
+				}
+			}
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// expire ends the session by a time limit
+func (b *Bridge) expire(reason string) {
+	log.Printf("[bridge] %s: %s reached", b.session.ID, reason)
+	b.session.SetEndReason(reason)
+	close(b.expired)
+}
+
+// warn sends the banner before a time limit ends the session
+func (b *Bridge) warn(t timeLimits, left time.Duration) {
+	log.Printf("[bridge] %s: session ends in %v", b.session.ID, left.Round(time.Second))
+	if b.endNotice == nil && t.banner != "" {
+		b.writeClient([]byte(t.banner))
+	}
+}
+
+// notify tells the client that the proxy ends the session
+// Modem clients get the end notice, others the banner unless it was sent as a time limit warning
+func (b *Bridge) notify(t timeLimits) {
+	reason := b.session.EndReason()
+	switch {
+	case reason == "":
+	case b.endNotice != nil:
+		b.writeClient(b.endNotice)
+	case t.banner == "" || reason == EndTerminated:
+	case (reason == EndMaxDuration || reason == EndDataTimeout) && t.warnBefore > 0:
+	default:
+		b.writeClient([]byte(t.banner))
+	}
+}
+
+// writeClient writes a proxy message to the client
+func (b *Bridge) writeClient(text []byte) {
+	b.session.ClientConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := b.session.ClientConn.Write(text); err != nil && b.session.Debug {
+		log.Printf("[bridge] %s: client message failed: %v", b.session.ID, err)
+	}
+	b.session.ClientConn.SetWriteDeadline(time.Time{})
+}
+
 // keepalive sends Telnet NOP to both connections if idle
 func (b *Bridge) keepalive(stop chan struct{}) {
 	if b.session.IdleTimeout <= 0 {
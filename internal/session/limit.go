@@ -0,0 +1,305 @@
+package session
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits restrict bridged traffic and duration of sessions of a device or a client, zero is unlimited
+// Traffic is counted in both directions
+type Limits struct {
+	Rate         int64 // bytes per second
+	Burst        int64 // bytes passed at once above the rate, Rate if zero
+	SessionQuota int64 // bytes per session
+	DailyQuota   int64 // bytes per day, shared by sessions
+
+	// Session time
+	MaxDuration time.Duration // session length
+	DataTimeout time.Duration // time without payload data in both directions
+	WarnBefore  time.Duration // warning before MaxDuration or DataTimeout ends the session
+	Banner      string        // warning text to non-modem clients
+}
+
+// Session end reasons, empty reason means a side closed the connection
+const (
+	EndSessionQuota = "session_quota" // session quota exhausted
+	EndDailyQuota   = "daily_quota"   // daily quota of the device or the client exhausted
+	EndMaxDuration  = "max_duration"  // session lasted the maximum duration
+	EndDataTimeout  = "data_timeout"  // no payload data for the data timeout
+	EndTerminated   = "terminated"    // terminated via API
+)
+
+// Limit scopes
+const (
+	ScopeDevice = "device"
+	ScopeClient = "client"
+)
+
+// limiter is a token bucket and a daily counter of a device or a client, shared by its sessions
+type limiter struct {
+	mu      sync.Mutex
+	limits  Limits
+	tokens  float64   // bytes allowed at once, negative while waiting for the rate
+	last    time.Time // last tokens update
+	day     int       // day of dayUsed: year*1000 + day of year
+	dayUsed int64
+}
+
+// sessionLimit is limits of a scope applied to a session
+type sessionLimit struct {
+	scope   string
+	limiter *limiter // nil without traffic limits
+	limits  Limits   // session copy, limiter limits may change with a later session
+}
+
+// timeLimits is the earliest time limits of a session
+type timeLimits struct {
+	maxDuration time.Duration
+	dataTimeout time.Duration
+	warnBefore  time.Duration
+	banner      string
+}
+
+// LimitInfo is usage of a limit applied to a session
+type LimitInfo struct {
+	Scope        string `json:"scope"` // device or client
+	Rate         int64  `json:"rate,omitempty"`
+	Burst        int64  `json:"burst,omitempty"`
+	SessionQuota int64  `json:"session_quota,omitempty"`
+	SessionUsed  int64  `json:"session_used"`
+	DailyQuota   int64  `json:"daily_quota,omitempty"`
+	DailyUsed    int64  `json:"daily_used"`
+	MaxDuration  int64  `json:"max_duration,omitempty"` // seconds
+	DataTimeout  int64  `json:"data_timeout,omitempty"` // seconds
+}
+
+func dayOf(t time.Time) int {
+	return t.Year()*1000 + t.YearDay()
+}
+
+// traffic checks if limits restrict bridged traffic
+func (l Limits) traffic() bool {
+	return l.Rate > 0 || l.SessionQuota > 0 || l.DailyQuota > 0
+}
+
+func (l Limits) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Rate)
+}
+
+// setLimits updates limits, the bucket is refilled when they change
+func (l *limiter) setLimits(limits Limits, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits != limits || l.last.IsZero() {
+		l.limits = limits
+		l.tokens = limits.burst()
+		l.last = now
+	}
+}
+
+// dailyLeft returns bytes left of the daily quota, -1 if unlimited, called with mu held
+func (l *limiter) dailyLeft(now time.Time) int64 {
+	if d := dayOf(now); d != l.day {
+		l.day = d
+		l.dayUsed = 0
+	}
+	if l.limits.DailyQuota == 0 {
+		return -1
+	}
+	return max(l.limits.DailyQuota-l.dayUsed, 0)
+}
+
+// charge counts n bytes and returns wait for the rate, called with mu held
+func (l *limiter) charge(n int64, now time.Time) time.Duration {
+	l.dayUsed += n
+	if l.limits.Rate == 0 {
+		return 0
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.limits.Rate)
+	l.tokens = min(l.tokens, l.limits.burst())
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.limits.Rate) * float64(time.Second))
+}
+
+// SetLimits applies device and client limits to a session before its bridge runs
+// Daily usage is counted per device and per client IP across sessions
+func (m *Manager) SetLimits(sess *Session, device, client Limits) {
+	now := time.Now()
+	var limits []sessionLimit
+	if device != (Limits{}) {
+		limits = append(limits, m.sessionLimit(ScopeDevice, sess.DeviceID, device, now))
+	}
+	if client != (Limits{}) && !sess.IsInternal() {
+		limits = append(limits, m.sessionLimit(ScopeClient, sess.ClientIP(), client, now))
+	}
+	sess.limitsMu.Lock()
+	sess.limits = limits
+	sess.limitsMu.Unlock()
+}
+
+// sessionLimit returns limits of a scope with the shared limiter for traffic limits
+func (m *Manager) sessionLimit(scope, key string, limits Limits, now time.Time) sessionLimit {
+	l := sessionLimit{scope: scope, limits: limits}
+	if limits.traffic() {
+		l.limiter = m.limiter(scope+":"+key, limits, now)
+	}
+	return l
+}
+
+// limiter returns shared limiter, limiters unused since yesterday are dropped once a day
+func (m *Manager) limiter(key string, limits Limits, now time.Time) *limiter {
+	m.limMu.Lock()
+	if today := dayOf(now); today != m.limDay {
+		m.limDay = today
+		for k, l := range m.limiters {
+			l.mu.Lock()
+			old := l.day != today
+			l.mu.Unlock()
+			if old {
+				delete(m.limiters, k)
+			}
+		}
+	}
+	if m.limiters == nil {
+		m.limiters = make(map[string]*limiter)
+	}
+	l, ok := m.limiters[key]
+	if !ok {
+		l = &limiter{day: dayOf(now)}
+		m.limiters[key] = l
+	}
+	m.limMu.Unlock()
+
+	l.setLimits(limits, now)
+	return l
+}
+
+// limited checks if the session has traffic limits
+func (s *Session) limited() bool {
+	for _, l := range s.limits {
+		if l.limiter != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// timeLimits returns the earliest time limits of device and client
+// Warning is the longest of both, banner of the device is used first
+func (s *Session) timeLimits() timeLimits {
+	var t timeLimits
+	earliest := func(cur, d time.Duration) time.Duration {
+		if cur == 0 || d > 0 && d < cur {
+			return d
+		}
+		return cur
+	}
+	for _, l := range s.limits {
+		t.maxDuration = earliest(t.maxDuration, l.limits.MaxDuration)
+		t.dataTimeout = earliest(t.dataTimeout, l.limits.DataTimeout)
+		t.warnBefore = max(t.warnBefore, l.limits.WarnBefore)
+		if t.banner == "" {
+			t.banner = l.limits.Banner
+		}
+	}
+	return t
+}
+
+// take charges n bytes of bridged data to session limits
+// Returns bytes allowed to pass, wait before passing them and end reason when a quota is exhausted
+func (s *Session) take(n int) (int, time.Duration, string) {
+	now := time.Now()
+	used := atomic.LoadInt64(&s.limitUsed)
+	allowed := int64(n)
+	reason := ""
+	limit := func(left int64, why string) {
+		if left >= 0 && left <= allowed {
+			allowed = left
+			reason = why
+		}
+	}
+
+	// Limiters are locked in the order of scopes, device before client
+	for _, l := range s.limits {
+		if l.limiter != nil {
+			l.limiter.mu.Lock()
+		}
+	}
+	for _, l := range s.limits {
+		if l.limiter == nil {
+			continue
+		}
+		if l.limits.SessionQuota > 0 {
+			limit(max(l.limits.SessionQuota-used, 0), EndSessionQuota)
+		}
+		limit(l.limiter.dailyLeft(now), EndDailyQuota)
+	}
+	var wait time.Duration
+	for _, l := range s.limits {
+		if l.limiter != nil {
+			wait = max(wait, l.limiter.charge(allowed, now))
+			l.limiter.mu.Unlock()
+		}
+	}
+	atomic.AddInt64(&s.limitUsed, allowed)
+	return int(allowed), wait, reason
+}
+
+// exhausted returns end reason if a quota is used up before the session starts
+func (s *Session) exhausted() string {
+	_, _, reason := s.take(0)
+	return reason
+}
+
+// LimitUsage returns usage of limits applied to the session
+func (s *Session) LimitUsage() []LimitInfo {
+	s.limitsMu.Lock()
+	limits := s.limits
+	s.limitsMu.Unlock()
+
+	var infos []LimitInfo
+	used := atomic.LoadInt64(&s.limitUsed)
+	now := time.Now()
+	for _, l := range limits {
+		var dayUsed int64
+		if l.limiter != nil {
+			l.limiter.mu.Lock()
+			l.limiter.dailyLeft(now) // reset on a new day
+			dayUsed = l.limiter.dayUsed
+			l.limiter.mu.Unlock()
+		}
+		infos = append(infos, LimitInfo{
+			Scope:        l.scope,
+			Rate:         l.limits.Rate,
+			Burst:        l.limits.Burst,
+			SessionQuota: l.limits.SessionQuota,
+			SessionUsed:  used,
+			DailyQuota:   l.limits.DailyQuota,
+			DailyUsed:    dayUsed,
+			MaxDuration:  int64(l.limits.MaxDuration.Seconds()),
+			DataTimeout:  int64(l.limits.DataTimeout.Seconds()),
+		})
+	}
+	return infos
+}
+
+// SetEndReason records why the session ended, the first reason is kept
+func (s *Session) SetEndReason(reason string) {
+	s.endReason.CompareAndSwap(nil, &reason)
+}
+
+// EndReason returns why the session ended, empty if a side closed the connection
+func (s *Session) EndReason() string {
+	if r := s.endReason.Load(); r != nil {
+		return *r
+	}
+	return ""
+}
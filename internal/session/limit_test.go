@@ -0,0 +1,253 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// limitedSession starts a bridged session with limits
+// Returns client and device test sides and the channel closed when the bridge stops
+func limitedSession(t *testing.T, m *Manager, device, client Limits) (*Session, net.Conn, net.Conn, <-chan struct{}) {
+	t.Helper()
+	clientSide, clientConn := tcpPair(t)
+	deviceSide, deviceConn := tcpPair(t)
+	sess := m.Create("meter1", clientConn, deviceConn)
+	m.SetLimits(sess, device, client)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewBridge(sess).Run()
+		m.End(sess.ID)
+	}()
+	return sess, clientSide, deviceSide, done
+}
+
+// readAll reads until the bridge closes the connection
+func readAll(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return data
+}
+
+func waitBridge(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not stop")
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	m := NewManager(false, 0)
+	_, client, device, _ := limitedSession(t, m, Limits{Rate: 100 << 10, Burst: 10 << 10}, Limits{})
+
+	payload := make([]byte, 60<<10)
+	start := time.Now()
+	go client.Write(payload)
+	got := make([]byte, len(payload))
+	device.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(device, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	// 10 KB burst, then 50 KB at 100 KB/s
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("60 KB passed in %v, want about 500ms", elapsed)
+	}
+}
+
+func TestLimitSessionQuota(t *testing.T) {
+	m := NewManager(false, 0)
+	sess, client, device, done := limitedSession(t, m, Limits{}, Limits{SessionQuota: 1000})
+
+	usage := sess.LimitUsage()
+	if len(usage) != 1 || usage[0].Scope != ScopeClient || usage[0].SessionQuota != 1000 {
+		t.Fatalf("LimitUsage = %+v", usage)
+	}
+
+	// Both directions count: 300 bytes back, then 700 of 1000 forward
+	device.Write(bytes.Repeat([]byte{'b'}, 300))
+	got := make([]byte, 300)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	client.Write(bytes.Repeat([]byte{'a'}, 1000))
+	if got := readAll(t, device); len(got) != 700 {
+		t.Errorf("device got %d bytes, want 700", len(got))
+	}
+	waitBridge(t, done)
+	if sess.EndReason() != EndSessionQuota {
+		t.Errorf("EndReason = %q, want %q", sess.EndReason(), EndSessionQuota)
+	}
+}
+
+func TestLimitDailyQuota(t *testing.T) {
+	m := NewManager(false, 0)
+	device := Limits{DailyQuota: 1000}
+
+	// First session uses 600 bytes of the day
+	_, client, dev, done := limitedSession(t, m, device, Limits{})
+	client.Write(make([]byte, 600))
+	got := make([]byte, 600)
+	dev.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(dev, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	client.Close()
+	waitBridge(t, done)
+
+	// Second session gets the rest
+	sess, client, dev, done := limitedSession(t, m, device, Limits{})
+	client.Write(make([]byte, 600))
+	if got := readAll(t, dev); len(got) != 400 {
+		t.Errorf("second session passed %d bytes, want 400", len(got))
+	}
+	waitBridge(t, done)
+	if sess.EndReason() != EndDailyQuota {
+		t.Errorf("EndReason = %q, want %q", sess.EndReason(), EndDailyQuota)
+	}
+
+	// Third session ends at once
+	sess, _, _, done = limitedSession(t, m, device, Limits{})
+	waitBridge(t, done)
+	if sess.EndReason() != EndDailyQuota {
+		t.Errorf("EndReason = %q, want %q", sess.EndReason(), EndDailyQuota)
+	}
+	if usage := sess.LimitUsage(); len(usage) != 1 || usage[0].DailyUsed != 1000 {
+		t.Errorf("LimitUsage = %+v", usage)
+	}
+}
+
+func TestLimitMaxDuration(t *testing.T) {
+	m := NewManager(false, 0)
+	device := Limits{MaxDuration: 400 * time.Millisecond, WarnBefore: 200 * time.Millisecond, Banner: "ENDS SOON"}
+	sess, client, _, done := limitedSession(t, m, device, Limits{MaxDuration: time.Hour})
+
+	start := time.Now()
+	got := make([]byte, len(device.Banner))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, got); err != nil || string(got) != device.Banner {
+		t.Fatalf("warning %q, %v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Errorf("warning after %v, want about 200ms", elapsed)
+	}
+	// Banner is not repeated at the end
+	if rest := readAll(t, client); len(rest) != 0 {
+		t.Errorf("client got %q after warning", rest)
+	}
+	waitBridge(t, done)
+	if sess.EndReason() != EndMaxDuration {
+		t.Errorf("EndReason = %q, want %q", sess.EndReason(), EndMaxDuration)
+	}
+}
+
+func TestLimitDataTimeout(t *testing.T) {
+	m := NewManager(false, 0)
+	sess, client, device, done := limitedSession(t, m, Limits{}, Limits{DataTimeout: 300 * time.Millisecond, Banner: "IDLE"})
+
+	// Data keeps the session, Telnet NOP does not
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		client.Write([]byte{'a'})
+	}
+	client.Write(telnetNOP)
+	if got := readAll(t, device); string(got) != "aaa\xff\xf1" {
+		t.Errorf("device got %q", got)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("session lasted %v, want about 900ms", elapsed)
+	}
+	waitBridge(t, done)
+	if sess.EndReason() != EndDataTimeout {
+		t.Errorf("EndReason = %q, want %q", sess.EndReason(), EndDataTimeout)
+	}
+	// Without warn_before the banner comes at the end
+	if got := readAll(t, client); string(got) != "IDLE" {
+		t.Errorf("client got %q, want banner", got)
+	}
+}
+
+func TestLimitDataTimeoutKeepalive(t *testing.T) {
+	// Passthrough session of TCP connections: NOP keepalives of the device don't extend it either
+	m := NewManager(false, 0)
+	sess, _, device, done := limitedSession(t, m, Limits{}, Limits{DataTimeout: 300 * time.Millisecond})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				device.Write(telnetNOP)
+			}
+		}
+	}()
+
+	waitBridge(t, done)
+	if sess.EndReason() != EndDataTimeout {
+		t.Errorf("EndReason = %q, want %q", sess.EndReason(), EndDataTimeout)
+	}
+}
+
+func TestLimitEndNotice(t *testing.T) {
+	m := NewManager(false, 0)
+	clientSide, clientConn := tcpPair(t)
+	_, deviceConn := tcpPair(t)
+	sess := m.Create("meter1", clientConn, deviceConn)
+	m.SetLimits(sess, Limits{MaxDuration: 200 * time.Millisecond, WarnBefore: 100 * time.Millisecond, Banner: "ENDS SOON"}, Limits{})
+	bridge := NewBridge(sess)
+	bridge.SetEndNotice([]byte("NO CARRIER"))
+	go bridge.Run()
+
+	// Modem clients get no banner, only the end notice
+	if got := readAll(t, clientSide); string(got) != "NO CARRIER" {
+		t.Errorf("client got %q", got)
+	}
+	// Time limits alone keep the kernel copy
+	if sess.limited() {
+		t.Error("session with time limits only is limited")
+	}
+}
@@ -9,28 +9,46 @@ import (
 )
 
 // Session represents an active client-device session
+// Internal sessions (proxy acting as client, e.g. device configuration) have no ClientConn
 type Session struct {
 	ID          string
 	DeviceID    string
+	Kind        string // "client", "websocket" or internal session kind (usr-config, ...)
 	ClientConn  net.Conn
 	DeviceConn  net.Conn
 	StartedAt   time.Time
 	BytesIn     int64 // bytes from client to device
 	BytesOut    int64 // bytes from device to client
+	PortChanges int64 // serial port setting changes during session
 	Debug       bool
 	IdleTimeout time.Duration // Timeout for NOP keepalive
 
-	done chan struct{}
+	limitsMu  sync.Mutex     // SetLimits against API readers, the bridge reads after SetLimits
+	limits    []sessionLimit // set by SetLimits before the bridge runs
+	limitUsed int64          // bytes counted to limits
+	endReason atomic.Pointer[string]
+	done      chan struct{}
 }
 
+// Session kinds with client connection
+const (
+	KindClient    = "client"    // regular TCP client connection
+	KindWebSocket = "websocket" // client connected over WebSocket
+)
+
 // Manager manages active sessions
 type Manager struct {
 	sessions    sync.Map // map[string]*Session
 	counter     uint64
+	optMu       sync.Mutex
 	debug       bool
 	idleTimeout time.Duration
 	onStart     func(*Session)
 	onEnd       func(*Session)
+
+	limMu    sync.Mutex
+	limDay   int                 // day of the last cleanup of limiters
+	limiters map[string]*limiter // "device:ID" or "client:IP"
 }
 
 // NewManager creates a new session manager
@@ -38,24 +56,81 @@ func NewManager(debug bool, idleTimeout time.Duration) *Manager {
 	return &Manager{debug: debug, idleTimeout: idleTimeout}
 }
 
+// SetOptions changes debug logging and idle timeout of new sessions
+func (m *Manager) SetOptions(debug bool, idleTimeout time.Duration) {
+	m.optMu.Lock()
+	defer m.optMu.Unlock()
+	m.debug = debug
+	m.idleTimeout = idleTimeout
+}
+
+// options returns debug logging and idle timeout for a new session
+func (m *Manager) options() (bool, time.Duration) {
+	m.optMu.Lock()
+	defer m.optMu.Unlock()
+	return m.debug, m.idleTimeout
+}
+
 // SetCallbacks sets session lifecycle callbacks
 func (m *Manager) SetCallbacks(onStart, onEnd func(*Session)) {
 	m.onStart = onStart
 	m.onEnd = onEnd
 }
 
+// NewID returns ID for a client session
+// The device is claimed with the ID before the session is created, so a busy device creates no session
+func (m *Manager) NewID() string {
+	return fmt.Sprintf("sess_%d_%d", time.Now().Unix(), atomic.AddUint64(&m.counter, 1))
+}
+
+// NewInternalID returns ID for an internal session
+func (m *Manager) NewInternalID() string {
+	return fmt.Sprintf("int_%d_%d", time.Now().Unix(), atomic.AddUint64(&m.counter, 1))
+}
+
 // Create creates a new session
 func (m *Manager) Create(deviceID string, clientConn, deviceConn net.Conn) *Session {
-	id := fmt.Sprintf("sess_%d_%d", time.Now().Unix(), atomic.AddUint64(&m.counter, 1))
+	return m.CreateKind(m.NewID(), deviceID, KindClient, clientConn, deviceConn)
+}
+
+// CreateKind creates a new client session of a given kind with ID from NewID
+func (m *Manager) CreateKind(id, deviceID, kind string, clientConn, deviceConn net.Conn) *Session {
+	debug, idleTimeout := m.options()
 
 	sess := &Session{
 		ID:          id,
 		DeviceID:    deviceID,
+		Kind:        kind,
 		ClientConn:  clientConn,
 		DeviceConn:  deviceConn,
 		StartedAt:   time.Now(),
-		Debug:       m.debug,
-		IdleTimeout: m.idleTimeout,
+		Debug:       debug,
+		IdleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+	}
+
+	m.sessions.Store(id, sess)
+
+	if m.onStart != nil {
+		m.onStart(sess)
+	}
+
+	return sess
+}
+
+// CreateInternal creates a session where the proxy itself talks to the device
+// kind describes the purpose and is shown instead of the client address, id is from NewInternalID
+func (m *Manager) CreateInternal(id, deviceID, kind string, deviceConn net.Conn) *Session {
+	debug, idleTimeout := m.options()
+
+	sess := &Session{
+		ID:          id,
+		DeviceID:    deviceID,
+		Kind:        kind,
+		DeviceConn:  deviceConn,
+		StartedAt:   time.Now(),
+		Debug:       debug,
+		IdleTimeout: idleTimeout,
 		done:        make(chan struct{}),
 	}
 
@@ -68,6 +143,31 @@ func (m *Manager) Create(deviceID string, clientConn, deviceConn net.Conn) *Sess
 	return sess
 }
 
+// IsInternal returns true if the session has no client connection
+func (s *Session) IsInternal() bool {
+	return s.ClientConn == nil
+}
+
+// ClientAddr returns client address or internal session kind
+func (s *Session) ClientAddr() string {
+	if s.ClientConn == nil {
+		return "internal:" + s.Kind
+	}
+	return s.ClientConn.RemoteAddr().String()
+}
+
+// ClientIP returns client IP address, empty for internal sessions
+func (s *Session) ClientIP() string {
+	if s.ClientConn == nil {
+		return ""
+	}
+	addr := s.ClientConn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 // End ends a session
 func (m *Manager) End(sessionID string) {
 	val, ok := m.sessions.LoadAndDelete(sessionID)
@@ -91,6 +191,12 @@ func (m *Manager) Terminate(sessionID string) bool {
 	}
 
 	sess := val.(*Session)
+	sess.SetEndReason(EndTerminated)
+	if sess.IsInternal() {
+		// Abort pending device I/O, the device connection stays registered
+		sess.DeviceConn.SetDeadline(time.Now())
+		return true
+	}
 	// Closing connections will cause bridge to exit and call End()
 	sess.ClientConn.Close()
 	sess.DeviceConn.Close()
@@ -144,12 +250,16 @@ func (m *Manager) Count() int {
 type SessionInfo struct {
 	ID           string    `json:"id"`
 	DeviceID     string    `json:"device_id"`
+	Kind         string    `json:"kind"`
 	ClientAddr   string    `json:"client_addr"`
 	DeviceAddr   string    `json:"device_addr"`
 	StartedAt    time.Time `json:"started_at"`
 	DurationSecs float64   `json:"duration_secs"`
 	BytesIn      int64     `json:"bytes_in"`
 	BytesOut     int64     `json:"bytes_out"`
+	PortChanges  int64     `json:"port_changes"`
+	// Bandwidth and quota usage, absent without limits
+	Limits []LimitInfo `json:"limits,omitempty"`
 }
 
 // ListInfo returns session info for API
@@ -161,12 +271,15 @@ func (m *Manager) ListInfo() []SessionInfo {
 		info := SessionInfo{
 			ID:           sess.ID,
 			DeviceID:     sess.DeviceID,
-			ClientAddr:   sess.ClientConn.RemoteAddr().String(),
+			Kind:         sess.Kind,
+			ClientAddr:   sess.ClientAddr(),
 			DeviceAddr:   sess.DeviceConn.RemoteAddr().String(),
 			StartedAt:    sess.StartedAt,
 			DurationSecs: now.Sub(sess.StartedAt).Seconds(),
 			BytesIn:      atomic.LoadInt64(&sess.BytesIn),
 			BytesOut:     atomic.LoadInt64(&sess.BytesOut),
+			PortChanges:  atomic.LoadInt64(&sess.PortChanges),
+			Limits:       sess.LimitUsage(),
 		}
 		infos = append(infos, info)
 		return true
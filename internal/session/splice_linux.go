@@ -0,0 +1,103 @@
+//go:build linux
+
+package session
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+
+	spliceChunk = 64 << 10 // default pipe capacity
+)
+
+// spliceCopy copies src to dst through a pipe with splice(2), data doesn't enter user space
+// progress is called after each chunk written to dst
+// Returns handled false, having read nothing, when connections are not sockets
+// or their SyscallConn fails (e.g. device session with replayed data)
+//
+// (*net.TCPConn).ReadFrom splices too, but returns only after the whole requested length
+// or EOF, so byte counters and activity would stand still during a meter exchange and
+// the bridge keepalive would treat a busy session as idle. It also splices only between
+// *net.TCPConn values, while the device side is the session connection of the device
+func spliceCopy(dst, src net.Conn, progress func(n int)) (handled bool, err error) {
+	srcRaw, ok := rawConn(src)
+	if !ok {
+		return false, nil
+	}
+	dstRaw, ok := rawConn(dst)
+	if !ok {
+		return false, nil
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	first := true
+	for {
+		// Socket -> pipe, waits until src is readable
+		var inPipe int64
+		var serr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			inPipe, serr = syscall.Splice(int(fd), nil, pipe[1], nil, spliceChunk, spliceMove|spliceNonblock)
+			return serr != syscall.EAGAIN
+		})
+		if err != nil {
+			return true, err
+		}
+		if serr == syscall.EINTR {
+			continue
+		}
+		if serr == syscall.EINVAL && first {
+			// Socket type doesn't support splice, nothing was read
+			return false, nil
+		}
+		if serr != nil {
+			return true, serr
+		}
+		if inPipe == 0 {
+			return true, nil // EOF
+		}
+		first = false
+
+		// Pipe -> socket, waits until dst is writable
+		for inPipe > 0 {
+			var n int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				n, serr = syscall.Splice(pipe[0], nil, int(fd), nil, int(inPipe), spliceMove|spliceNonblock)
+				return serr != syscall.EAGAIN
+			})
+			if err != nil {
+				return true, err
+			}
+			if serr == syscall.EINTR {
+				continue
+			}
+			if serr != nil {
+				return true, serr
+			}
+			inPipe -= n
+			progress(int(n))
+		}
+	}
+}
+
+// rawConn returns raw connection of a socket that supports splice
+func rawConn(c net.Conn) (syscall.RawConn, bool) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	return raw, true
+}
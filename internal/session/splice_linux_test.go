@@ -0,0 +1,175 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// spliceResult is the outcome of spliceCopy run in background
+type spliceResult struct {
+	handled bool
+	err     error
+}
+
+// startSplice runs spliceCopy from src to dst, progress is summed into total
+func startSplice(dst, src net.Conn, total *int64) <-chan spliceResult {
+	done := make(chan spliceResult, 1)
+	go func() {
+		handled, err := spliceCopy(dst, src, func(n int) { atomic.AddInt64(total, int64(n)) })
+		done <- spliceResult{handled, err}
+	}()
+	return done
+}
+
+// waitSplice waits for spliceCopy to return
+func waitSplice(t *testing.T, done <-chan spliceResult) spliceResult {
+	t.Helper()
+	select {
+	case r := <-done:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("spliceCopy did not return")
+		return spliceResult{}
+	}
+}
+
+func TestSpliceCopy(t *testing.T) {
+	srcPeer, src := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+
+	var total int64
+	done := startSplice(dst, src, &total)
+
+	payload := bytes.Repeat([]byte{0xFF, 0x00, 0x55}, 200000)
+	go func() {
+		srcPeer.Write(payload)
+		srcPeer.Close()
+	}()
+	got := make([]byte, len(payload))
+	dstPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(dstPeer, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data corrupted")
+	}
+
+	r := waitSplice(t, done)
+	if !r.handled || r.err != nil || atomic.LoadInt64(&total) != int64(len(payload)) {
+		t.Errorf("spliceCopy = %v, %v, progress %d, want true, nil, %d", r.handled, r.err, total, len(payload))
+	}
+}
+
+func TestSpliceCopyEOF(t *testing.T) {
+	// Source closed before sending anything
+	srcPeer, src := tcpPair(t)
+	dst, _ := tcpPair(t)
+	srcPeer.Close()
+
+	var total int64
+	r := waitSplice(t, startSplice(dst, src, &total))
+	if !r.handled || r.err != nil || total != 0 {
+		t.Errorf("spliceCopy = %v, %v, progress %d, want true, nil, 0", r.handled, r.err, total)
+	}
+}
+
+func TestSpliceCopyReadError(t *testing.T) {
+	_, src := tcpPair(t)
+	dst, _ := tcpPair(t)
+
+	var total int64
+	done := startSplice(dst, src, &total)
+	time.Sleep(50 * time.Millisecond)
+	src.Close() // bridge closes connections when the session ends
+
+	r := waitSplice(t, done)
+	if !r.handled || !errors.Is(r.err, net.ErrClosed) {
+		t.Errorf("spliceCopy = %v, %v, want true, %v", r.handled, r.err, net.ErrClosed)
+	}
+}
+
+func TestSpliceCopyWriteError(t *testing.T) {
+	srcPeer, src := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+
+	// Destination peer resets the connection
+	dstPeer.(*net.TCPConn).SetLinger(0)
+	dstPeer.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	var total int64
+	done := startSplice(dst, src, &total)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := srcPeer.Write([]byte("data")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	r := waitSplice(t, done)
+	if !r.handled || r.err == nil {
+		t.Errorf("spliceCopy = %v, %v, want true and write error", r.handled, r.err)
+	}
+}
+
+func TestSpliceCopyPartialWrite(t *testing.T) {
+	srcPeer, src := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+
+	// Small send buffer: dst accepts only part of a chunk until the peer reads
+	dst.(*net.TCPConn).SetWriteBuffer(4096)
+
+	var total int64
+	done := startSplice(dst, src, &total)
+
+	payload := bytes.Repeat([]byte{0x01, 0xFF, 0x7E, 0x00}, 256<<10)
+	go func() {
+		srcPeer.Write(payload)
+		srcPeer.Close()
+	}()
+
+	// Progress is reported for written part while the peer doesn't read
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&total); n == 0 || n >= int64(len(payload)) {
+		t.Errorf("progress while destination is full = %d, want partial", n)
+	}
+
+	got := make([]byte, len(payload))
+	dstPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(dstPeer, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data corrupted")
+	}
+
+	r := waitSplice(t, done)
+	if !r.handled || r.err != nil || atomic.LoadInt64(&total) != int64(len(payload)) {
+		t.Errorf("spliceCopy = %v, %v, progress %d, want true, nil, %d", r.handled, r.err, total, len(payload))
+	}
+}
+
+func TestSpliceCopyUnsupported(t *testing.T) {
+	// net.Pipe has no socket: nothing is read, the bridge copies itself
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	_, dst := tcpPair(t)
+	if handled, err := spliceCopy(dst, a, func(int) {}); handled || err != nil {
+		t.Errorf("spliceCopy = %v, %v, want not handled", handled, err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package session
+
+import "net"
+
+// spliceCopy is not available, the bridge copies through user space
+func spliceCopy(dst, src net.Conn, progress func(n int)) (handled bool, err error) {
+	return false, nil
+}
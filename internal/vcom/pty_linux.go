@@ -0,0 +1,186 @@
+//go:build linux
+
+package vcom
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+)
+
+const pollHup = 0x10 // POLLHUP
+
+// PTY is the master side of a Unix98 pseudo-terminal
+// Local applications open the slave (/dev/pts/N or the symlink) as a serial port
+type PTY struct {
+	master *os.File
+	name   string // slave path
+	link   string // symlink to slave, removed on Close
+}
+
+// OpenPTY creates pseudo-terminal with the slave in raw mode at baudRate
+// If link is set, a symlink to the slave is created (replacing stale symlink)
+func OpenPTY(link string, baudRate uint32) (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &PTY{master: master}
+
+	var n uint32
+	if err := p.ioctl(syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("TIOCGPTN: %w", err)
+	}
+	var unlock int32
+	if err := p.ioctl(syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("unlock: %w", err)
+	}
+	p.name = fmt.Sprintf("/dev/pts/%d", n)
+
+	// Open slave once: configure raw mode and leave master in hangup state,
+	// so that opening by an application is visible in SlaveOpen
+	if err := p.initSlave(baudRate); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	if link != "" {
+		if fi, err := os.Lstat(link); err == nil {
+			if fi.Mode()&os.ModeSymlink == 0 {
+				master.Close()
+				return nil, fmt.Errorf("%s exists and is not a symlink", link)
+			}
+			os.Remove(link)
+		}
+		if err := os.Symlink(p.name, link); err != nil {
+			master.Close()
+			return nil, err
+		}
+		p.link = link
+	}
+	return p, nil
+}
+
+// initSlave sets raw mode (like cfmakeraw) with HUPCL, so closing the port drops DTR
+func (p *PTY) initSlave(baudRate uint32) error {
+	slave, err := os.OpenFile(p.name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer slave.Close()
+
+	raw, err := slave.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sysErr error
+	err = raw.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if sysErr = ioctl(fd, syscall.TCGETS, unsafe.Pointer(&t)); sysErr != nil {
+			return
+		}
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | serial.CBAUD
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.HUPCL | baudFlag(baudRate)
+		t.Cc[syscall.VMIN] = 1
+		t.Cc[syscall.VTIME] = 0
+		sysErr = ioctl(fd, syscall.TCSETS, unsafe.Pointer(&t))
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// Name returns slave device path
+func (p *PTY) Name() string {
+	return p.name
+}
+
+// Read reads data written by the application to the slave
+// Returns syscall.EIO while no application has the slave open
+func (p *PTY) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+// Write passes data to the application reading the slave
+func (p *PTY) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+// SetReadDeadline interrupts pending and future Read calls at t
+func (p *PTY) SetReadDeadline(t time.Time) error {
+	return p.master.SetReadDeadline(t)
+}
+
+// Close closes master side and removes the symlink
+func (p *PTY) Close() error {
+	if p.link != "" {
+		os.Remove(p.link)
+	}
+	return p.master.Close()
+}
+
+// SlaveOpen reports whether an application has the slave open
+func (p *PTY) SlaveOpen() bool {
+	open := false
+	p.control(func(fd uintptr) {
+		fds := struct {
+			fd              int32
+			events, revents int16
+		}{fd: int32(fd), events: 1} // POLLIN
+		var ts syscall.Timespec
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+		open = errno == 0 && fds.revents&pollHup == 0
+	})
+	return open
+}
+
+// Settings returns port settings and HUPCL flag of the slave, as set by the application
+func (p *PTY) Settings(defaults device.SerialProfile) (device.SerialProfile, bool, error) {
+	var t syscall.Termios
+	if err := p.ioctl(syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return defaults, false, err
+	}
+	return termiosProfile(&t, defaults), t.Cflag&syscall.HUPCL != 0, nil
+}
+
+// IsHangup checks for read error while the slave is closed
+func IsHangup(err error) bool {
+	return errors.Is(err, syscall.EIO)
+}
+
+func (p *PTY) ioctl(req uintptr, arg unsafe.Pointer) error {
+	var sysErr error
+	if err := p.control(func(fd uintptr) { sysErr = ioctl(fd, req, arg) }); err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// control runs f with master descriptor without switching it to blocking mode
+func (p *PTY) control(f func(fd uintptr)) error {
+	raw, err := p.master.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return raw.Control(f)
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
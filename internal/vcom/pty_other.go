@@ -0,0 +1,31 @@
+//go:build !linux
+
+package vcom
+
+import (
+	"errors"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+)
+
+var errNotSupported = errors.New("virtual serial port is supported on Linux only")
+
+// PTY is not available on this platform
+type PTY struct{}
+
+func OpenPTY(link string, baudRate uint32) (*PTY, error) {
+	return nil, errNotSupported
+}
+
+func (p *PTY) Name() string                      { return "" }
+func (p *PTY) Read(b []byte) (int, error)        { return 0, errNotSupported }
+func (p *PTY) Write(b []byte) (int, error)       { return 0, errNotSupported }
+func (p *PTY) SetReadDeadline(t time.Time) error { return nil }
+func (p *PTY) Close() error                      { return nil }
+func (p *PTY) SlaveOpen() bool                   { return false }
+func IsHangup(err error) bool                    { return false }
+
+func (p *PTY) Settings(defaults device.SerialProfile) (device.SerialProfile, bool, error) {
+	return defaults, false, errNotSupported
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package vcom
+
+import (
+	"syscall"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+)
+
+// baudFlag returns termios code of baud rate, B9600 for non-standard rates
+func baudFlag(rate uint32) uint32 {
+	if code, ok := serial.BaudCode(rate); ok {
+		return code
+	}
+	return syscall.B9600
+}
+
+// termiosProfile converts slave termios to serial port settings
+// The Linux PTY driver forces CS8 and clears PARENB on every termios change:
+// data bits and enabled parity can't be read back and come from defaults,
+// PARODD and CMSPAR are kept by the driver and select odd, mark and space parity
+// B0 (hang up) and non-standard rates (BOTHER) keep baud rate of defaults
+func termiosProfile(t *syscall.Termios, defaults device.SerialProfile) device.SerialProfile {
+	profile := defaults
+	if rate, ok := serial.BaudRate(t.Cflag); ok {
+		profile.BaudRate = rate
+	}
+
+	profile.StopBits = 1
+	if t.Cflag&syscall.CSTOPB != 0 {
+		profile.StopBits = 2
+	}
+
+	switch {
+	case t.Cflag&serial.CMSPAR != 0 && t.Cflag&syscall.PARODD != 0:
+		profile.Parity = 4 // mark
+	case t.Cflag&serial.CMSPAR != 0:
+		profile.Parity = 5 // space
+	case t.Cflag&syscall.PARODD != 0:
+		profile.Parity = 2 // odd
+	}
+	return profile
+}
@@ -0,0 +1,250 @@
+// Package vcom exposes a device session through the proxy as a local virtual
+// serial port (pseudo-terminal) for applications without RFC2217 support
+package vcom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/rfc2217"
+)
+
+// RFC2217 SET-CONTROL values for DTR and RTS
+const (
+	controlDTROn  = 8
+	controlDTROff = 9
+	controlRTSOn  = 11
+	controlRTSOff = 12
+)
+
+// maxResponseLen limits AT response line length
+const maxResponseLen = 256
+
+// Connect opens client session with the device: AT+CONNECT=<token> ([AUTH_TOKEN+]DEVICE_ID)
+func Connect(ctx context.Context, addr, token string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("AT+CONNECT=" + token + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := readResponse(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("AT+CONNECT: %w", err)
+	}
+	if resp != "OK" {
+		conn.Close()
+		return nil, fmt.Errorf("AT+CONNECT: proxy replied %q", resp)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// readResponse reads response line byte by byte so no session data is consumed
+func readResponse(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxResponseLen {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		switch b[0] {
+		case '\n':
+			return string(line), nil
+		case '\r':
+		default:
+			line = append(line, b[0])
+		}
+	}
+	return "", errors.New("response too long")
+}
+
+// Session forwards data between the PTY and a device session, translating
+// settings of the local application to RFC2217 commands
+// DTR and RTS follow the port being open (dropped on close with HUPCL),
+// since PTYs have no modem control lines
+type Session struct {
+	conn     net.Conn
+	pty      *PTY
+	defaults device.SerialProfile
+
+	wmu sync.Mutex // serializes writes to conn
+
+	profile device.SerialProfile // port settings sent to the device
+	open    bool                 // slave is open by an application
+	hupcl   bool                 // application keeps HUPCL (drop DTR on close)
+	done    chan struct{}
+}
+
+// NewSession creates session on connection returned by Connect
+// defaults provide data bits and parity (not visible on Linux PTY) and initial baud rate
+func NewSession(conn net.Conn, pty *PTY, defaults device.SerialProfile) *Session {
+	return &Session{
+		conn:     conn,
+		pty:      pty,
+		defaults: defaults,
+		done:     make(chan struct{}),
+	}
+}
+
+// Run forwards data until the connection fails or ctx is done
+// Settings are checked every poll interval; the caller closes the connection
+func (s *Session) Run(ctx context.Context, poll time.Duration) error {
+	errc := make(chan error, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.toProxy(errc, poll)
+	}()
+	go s.fromProxy(errc)
+
+	// Stop PTY reader, the PTY is reused by the next session
+	defer func() {
+		close(s.done)
+		s.pty.SetReadDeadline(time.Now())
+		wg.Wait()
+		s.pty.SetReadDeadline(time.Time{})
+	}()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		if err := s.sync(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync sends port settings and DTR/RTS changes made by the application
+// The first call always sends settings so the proxy handles the client as RFC2217
+func (s *Session) sync() error {
+	var cmds []connection.RFC2217Command
+
+	open := s.pty.SlaveOpen()
+	if open != s.open {
+		s.open = open
+		if open {
+			log.Printf("[vcom] %s opened", s.pty.Name())
+			cmds = append(cmds, controlCommand(controlDTROn), controlCommand(controlRTSOn))
+		} else {
+			log.Printf("[vcom] %s closed", s.pty.Name())
+			if s.hupcl {
+				cmds = append(cmds, controlCommand(controlDTROff), controlCommand(controlRTSOff))
+			}
+		}
+	}
+
+	base := s.defaults
+	if s.profile.BaudRate != 0 {
+		base.BaudRate = s.profile.BaudRate
+	}
+	profile, hupcl, err := s.pty.Settings(base)
+	if err != nil {
+		return fmt.Errorf("pty settings: %w", err)
+	}
+	s.hupcl = hupcl
+	if profile.BaudRate != s.profile.BaudRate || profile.DataBits != s.profile.DataBits ||
+		profile.Parity != s.profile.Parity || profile.StopBits != s.profile.StopBits {
+		log.Printf("[vcom] port settings: %d %s", profile.BaudRate, profile.ModeString())
+		s.profile = profile
+		cmds = append(connection.PortSettingsCommands(profile), cmds...)
+	}
+
+	if len(cmds) == 0 {
+		return nil
+	}
+	return s.write(connection.BuildRFC2217Packet(cmds))
+}
+
+func controlCommand(value byte) connection.RFC2217Command {
+	return connection.RFC2217Command{Command: connection.SetControl, Data: []byte{value}}
+}
+
+// toProxy sends data written by the application, IAC escaped
+func (s *Session) toProxy(errc chan<- error, poll time.Duration) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.pty.Read(buf)
+		if n > 0 {
+			if werr := s.write(rfc2217.Escape(buf[:n])); werr != nil {
+				errc <- fmt.Errorf("proxy write: %w", werr)
+				return
+			}
+		}
+		if err != nil {
+			if IsHangup(err) {
+				// No application has the port open
+				select {
+				case <-s.done:
+					return
+				case <-time.After(poll):
+				}
+				continue
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				errc <- fmt.Errorf("pty read: %w", err)
+			}
+			return
+		}
+	}
+}
+
+// fromProxy passes device data to the application while the port is open
+// Telnet commands (NOP keepalive) are dropped, RFC2217 replies are logged
+func (s *Session) fromProxy(errc chan<- error) {
+	var dec rfc2217.Decoder
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.conn.Read(buf)
+		for _, ev := range dec.Feed(buf[:n]) {
+			switch ev.Type {
+			case rfc2217.EventData:
+				if !s.pty.SlaveOpen() {
+					continue
+				}
+				if _, werr := s.pty.Write(ev.Data); werr != nil && !IsHangup(werr) {
+					errc <- fmt.Errorf("pty write: %w", werr)
+					return
+				}
+			case rfc2217.EventSubneg:
+				if ev.Option == connection.ComPortOption && len(ev.Data) > 0 && ev.Data[0] > connection.ServerResponseOffset {
+					reply := connection.RFC2217Command{Command: ev.Data[0] - connection.ServerResponseOffset, Data: ev.Data[1:]}
+					log.Printf("[vcom] device confirmed %s", reply.String())
+				}
+			}
+		}
+		if err != nil {
+			errc <- fmt.Errorf("proxy read: %w", err)
+			return
+		}
+	}
+}
+
+func (s *Session) write(p []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.conn.Write(p)
+	return err
+}
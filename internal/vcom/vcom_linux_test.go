@@ -0,0 +1,111 @@
+package vcom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/connection"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/device"
+	"git2.jad.ru/MeterRS485/proxy-rfc2217/internal/serial"
+)
+
+func TestTermiosProfile(t *testing.T) {
+	defaults := device.SerialProfile{BaudRate: 9600, DataBits: 7, Parity: 3, StopBits: 1}
+	tests := []struct {
+		cflag uint32
+		want  string
+	}{
+		{syscall.B2400 | syscall.CS8, "2400 7E1"},
+		{syscall.B300 | syscall.CSTOPB, "300 7E2"},
+		{syscall.B19200 | syscall.PARODD, "19200 7O1"},
+		{syscall.B1200 | serial.CMSPAR | syscall.PARODD, "1200 7M1"},
+		{syscall.B1200 | serial.CMSPAR, "1200 7S1"},
+		{syscall.B0, "9600 7E1"},
+	}
+	for _, tt := range tests {
+		p := termiosProfile(&syscall.Termios{Cflag: tt.cflag}, defaults)
+		if got := fmt.Sprintf("%d %s", p.BaudRate, p.ModeString()); got != tt.want {
+			t.Errorf("cflag %o: got %s, want %s", tt.cflag, got, tt.want)
+		}
+	}
+}
+
+// readProxy reads from proxy side of the session until want is contained
+func readProxy(t *testing.T, conn net.Conn, want []byte) []byte {
+	t.Helper()
+	var got []byte
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for !bytes.Contains(got, want) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("proxy got %x, want %x: %v", got, want, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	return got
+}
+
+func TestSession(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "ttyMETER")
+	pty, err := OpenPTY(link, 9600)
+	if err != nil {
+		t.Skipf("PTY not available: %v", err)
+	}
+	defer pty.Close()
+
+	conn, proxy := net.Pipe()
+	defer conn.Close()
+	defer proxy.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defaults, _ := serial.ParseMode("8N1", 9600)
+	go NewSession(conn, pty, defaults).Run(ctx, 10*time.Millisecond)
+
+	// Initial settings are sent before the port is opened
+	readProxy(t, proxy, connection.BuildRFC2217Packet(connection.PortSettingsCommands(defaults)))
+
+	// Opening the port raises DTR and RTS
+	app, err := os.OpenFile(link, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("open %s: %v", link, err)
+	}
+	readProxy(t, proxy, connection.BuildRFC2217Packet([]connection.RFC2217Command{
+		controlCommand(controlDTROn), controlCommand(controlRTSOn)}))
+
+	// termios changes become RFC2217 commands
+	raw, _ := app.SyscallConn()
+	raw.Control(func(fd uintptr) {
+		var tio syscall.Termios
+		ioctl(fd, syscall.TCGETS, unsafe.Pointer(&tio))
+		tio.Cflag = tio.Cflag&^serial.CBAUD | syscall.B2400 | syscall.CSTOPB
+		ioctl(fd, syscall.TCSETS, unsafe.Pointer(&tio))
+	})
+	want := defaults
+	want.BaudRate, want.StopBits = 2400, 2
+	readProxy(t, proxy, connection.BuildRFC2217Packet(connection.PortSettingsCommands(want)))
+
+	// Data in both directions, IAC escaped towards the proxy, NOP dropped
+	app.Write([]byte{0xFF, 0x01})
+	readProxy(t, proxy, []byte{0xFF, 0xFF, 0x01})
+	go proxy.Write([]byte{0xFF, 0xF1, 0x02, 0xFF, 0xFF})
+	buf := make([]byte, 16)
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := app.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{0x02, 0xFF}) {
+		t.Errorf("application got %x (%v), want 02ff", buf[:n], err)
+	}
+
+	// Closing the port with HUPCL drops DTR and RTS
+	app.Close()
+	readProxy(t, proxy, connection.BuildRFC2217Packet([]connection.RFC2217Command{
+		controlCommand(controlDTROff), controlCommand(controlRTSOff)}))
+}
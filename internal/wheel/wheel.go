@@ -0,0 +1,128 @@
+// Package wheel implements a hashed timer wheel: one goroutine and one ticker serve
+// many periodic timers of coarse precision, such as keepalives of idle devices
+package wheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Wheel runs periodic timers rounded up to its tick
+// The wheel goroutine runs only while there are timers
+type Wheel struct {
+	tick time.Duration
+
+	mu      sync.Mutex
+	slots   [][]*Timer
+	pos     int
+	count   int // timers not stopped
+	running bool
+}
+
+// Timer is a periodic timer of the wheel
+type Timer struct {
+	w        *Wheel
+	interval func() time.Duration
+	rounds   int // full turns of the wheel left before the timer is due
+	fn       func()
+	stopped  bool
+}
+
+// New creates a wheel with tick resolution and number of slots
+// Intervals up to tick*slots are served without extra turns
+func New(tick time.Duration, slots int) *Wheel {
+	return &Wheel{tick: tick, slots: make([][]*Timer, slots)}
+}
+
+// Every calls fn in a new goroutine every interval until the timer is stopped
+func (w *Wheel) Every(interval time.Duration, fn func()) *Timer {
+	return w.EveryFunc(func() time.Duration { return interval }, fn)
+}
+
+// EveryFunc is like Every, but the interval is read each time the timer is scheduled,
+// so a changed interval applies from the next run. interval is called under the wheel lock
+// and must not block
+func (w *Wheel) EveryFunc(interval func() time.Duration, fn func()) *Timer {
+	t := &Timer{w: w, interval: interval, fn: fn}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.schedule(t)
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	return t
+}
+
+// Stop stops the timer, fn already started keeps running
+func (t *Timer) Stop() {
+	t.w.mu.Lock()
+	defer t.w.mu.Unlock()
+	if !t.stopped {
+		t.stopped = true
+		t.w.count--
+	}
+}
+
+// Len returns number of active timers
+func (w *Wheel) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// schedule puts the timer into the slot where it is due after its interval
+func (w *Wheel) schedule(t *Timer) {
+	ticks := int((t.interval() + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	n := len(w.slots)
+	t.rounds = (ticks - 1) / n
+	slot := (w.pos + ticks) % n
+	w.slots[slot] = append(w.slots[slot], t)
+}
+
+func (w *Wheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !w.advance() {
+			return
+		}
+	}
+}
+
+// advance moves the wheel by one tick and fires due timers
+// Returns false when no timers are left and the wheel goroutine must exit
+func (w *Wheel) advance() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.count == 0 {
+		// Stopped timers may still be in slots
+		clear(w.slots)
+		w.running = false
+		return false
+	}
+
+	w.pos = (w.pos + 1) % len(w.slots)
+	due := w.slots[w.pos]
+	w.slots[w.pos] = nil
+	var keep []*Timer
+	for _, t := range due {
+		switch {
+		case t.stopped:
+		case t.rounds > 0:
+			t.rounds--
+			keep = append(keep, t)
+		default:
+			go t.fn()
+			w.schedule(t)
+		}
+	}
+	// Timers with interval of whole turns are rescheduled into this slot
+	w.slots[w.pos] = append(w.slots[w.pos], keep...)
+	return true
+}
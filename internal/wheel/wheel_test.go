@@ -0,0 +1,105 @@
+package wheel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWheelEvery(t *testing.T) {
+	w := New(5*time.Millisecond, 8)
+	var fired atomic.Int32
+	timer := w.Every(20*time.Millisecond, func() { fired.Add(1) })
+
+	time.Sleep(110 * time.Millisecond)
+	if n := fired.Load(); n < 3 || n > 6 {
+		t.Errorf("fired %d times in 110ms with 20ms interval", n)
+	}
+
+	timer.Stop()
+	timer.Stop()
+	if w.Len() != 0 {
+		t.Errorf("Len = %d after Stop", w.Len())
+	}
+	time.Sleep(10 * time.Millisecond) // fn started before Stop
+	n := fired.Load()
+	time.Sleep(50 * time.Millisecond)
+	if fired.Load() != n {
+		t.Error("stopped timer fired")
+	}
+}
+
+func TestWheelLongInterval(t *testing.T) {
+	// Interval of several turns of the wheel
+	w := New(2*time.Millisecond, 4)
+	start := time.Now()
+	fired := make(chan time.Duration, 10)
+	timer := w.Every(30*time.Millisecond, func() { fired <- time.Since(start) })
+	defer timer.Stop()
+
+	select {
+	case d := <-fired:
+		if d < 30*time.Millisecond {
+			t.Errorf("fired after %v, interval 30ms", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
+
+func TestWheelEveryFunc(t *testing.T) {
+	w := New(2*time.Millisecond, 8)
+	var interval atomic.Int64
+	interval.Store(int64(4 * time.Millisecond))
+	var fired atomic.Int32
+	timer := w.EveryFunc(func() time.Duration { return time.Duration(interval.Load()) }, func() { fired.Add(1) })
+	defer timer.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if fired.Load() < 2 {
+		t.Fatalf("fired %d times in 50ms with 4ms interval", fired.Load())
+	}
+
+	// Longer interval applies once the already scheduled run fires
+	interval.Store(int64(time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	n := fired.Load()
+	time.Sleep(50 * time.Millisecond)
+	if fired.Load() != n {
+		t.Error("timer fired after interval grew to an hour")
+	}
+}
+
+func TestWheelRestart(t *testing.T) {
+	w := New(time.Millisecond, 4)
+	w.Every(time.Millisecond, func() {}).Stop()
+	time.Sleep(10 * time.Millisecond)
+	w.mu.Lock()
+	running := w.running
+	w.mu.Unlock()
+	if running {
+		t.Fatal("wheel goroutine runs without timers")
+	}
+
+	fired := make(chan struct{}, 1)
+	timer := w.Every(time.Millisecond, func() {
+		select {
+		case fired <- struct{}{}:
+		default:
+		}
+	})
+	defer timer.Stop()
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer added after wheel stop did not fire")
+	}
+}
+
+func BenchmarkWheelEvery(b *testing.B) {
+	w := New(time.Second, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Every(30*time.Second, func() {}).Stop()
+	}
+}
@@ -0,0 +1,174 @@
+// Package wsconn presents a WebSocket connection as a net.Conn byte stream
+package wsconn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeTimeout limits writing of the close frame
+const closeTimeout = time.Second
+
+// Conn is a byte stream over WebSocket frames
+// Every Write is sent as one binary frame, Read returns payload of received
+// binary and text frames. Unlike the WebSocket connection itself, read deadline
+// timeouts are not fatal and a new deadline applies to the blocked Read, so Conn
+// can be used where TCP connection is expected (interrupted idle read of device,
+// exec and Modbus transactions)
+type Conn struct {
+	ws     *websocket.Conn
+	frames chan []byte   // received frames, closed when reading stops
+	closed chan struct{} // closed by Close
+	once   sync.Once
+
+	readErr error // reason reading stopped, valid after frames is closed
+
+	mu           sync.Mutex
+	pending      []byte // rest of partially read frame
+	readDeadline time.Time
+	deadlineSet  chan struct{} // closed when read deadline changes
+
+	wmu sync.Mutex // serializes writes
+}
+
+// New wraps WebSocket connection and starts reading frames
+func New(ws *websocket.Conn) *Conn {
+	c := &Conn{
+		ws:          ws,
+		frames:      make(chan []byte, 16),
+		closed:      make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop reads frames in the background so that read timeouts do not break the connection
+// Control frames (ping, close) are handled by the WebSocket connection while reading
+func (c *Conn) readLoop() {
+	defer close(c.frames)
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				err = io.EOF
+			}
+			c.readErr = err
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		select {
+		case c.frames <- msg:
+		case <-c.closed:
+			c.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+// Read reads stream data, returning os.ErrDeadlineExceeded on read deadline
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		deadline, deadlineSet := c.readDeadline, c.deadlineSet
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case msg, ok := <-c.frames:
+			stopTimer(timer)
+			if !ok {
+				return 0, c.readErr
+			}
+			n := copy(p, msg)
+			if n < len(msg) {
+				c.mu.Lock()
+				c.pending = append(c.pending, msg[n:]...)
+				c.mu.Unlock()
+			}
+			return n, nil
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			stopTimer(timer) // wait again with the new deadline
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// Write sends p as one binary frame
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends close frame and closes the connection
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+		err = c.ws.Close()
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets read deadline, also for Read in progress
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,113 @@
+package wsconn
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pair returns two Conns connected through a WebSocket server
+func pair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+	accepted := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- New(ws)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client := New(ws)
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestReadDeadlineIsNotFatal(t *testing.T) {
+	client, server := pair(t)
+	buf := make([]byte, 16)
+
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error = %v, want deadline exceeded", err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("hello"))
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read = %q, %v, want hello", buf[:n], err)
+	}
+}
+
+func TestReadDeadlineInterruptsRead(t *testing.T) {
+	client, server := pair(t)
+	buf := make([]byte, 16)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := server.Read(buf)
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	server.SetReadDeadline(time.Now())
+	select {
+	case err := <-result:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deadline did not interrupt blocked Read")
+	}
+
+	server.SetReadDeadline(time.Time{})
+	client.Write([]byte("hello"))
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read = %q, %v, want hello", buf[:n], err)
+	}
+}
+
+func TestPartialRead(t *testing.T) {
+	client, server := pair(t)
+	client.Write([]byte("abcdef"))
+
+	buf := make([]byte, 4)
+	var got []byte
+	for len(got) < 6 {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("got %q, want abcdef", got)
+	}
+}
+
+func TestCloseIsEOF(t *testing.T) {
+	client, server := pair(t)
+	client.Close()
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := server.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("read after close = %v, want EOF", err)
+	}
+}